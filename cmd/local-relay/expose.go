@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	connecttunnel "lds.li/netrelay/connect"
+)
+
+// runExpose exposes the service at localAddr through the remote proxy as the
+// reverse tunnel listener name until interrupted, then drains the open
+// connections for up to -drain-timeout.
+func (h *proxyHandler) runExpose(name, localAddr string) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Printf("✓ Exposing %s as %q via %s", localAddr, name, *proxyURL)
+	if err := h.serveExpose(ctx, name, localAddr); err != nil {
+		log.Fatalf("Failed to expose %s: %v", localAddr, err)
+	}
+
+	log.Printf("Shutting down gracefully, draining open connections (timeout: %s)...", *drainTimeout)
+	drainCtx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+	defer cancel()
+	if err := h.Shutdown(drainCtx); err != nil {
+		log.Printf("Drain timeout reached, closed remaining connections")
+	}
+	log.Println("Stopped")
+}
+
+// serveExpose registers name on the remote proxy and connects each tunnel
+// opened to it to localAddr. A lost registration is retried with backoff. It
+// returns nil when ctx is done, or an error if the proxy refuses the
+// registration outright.
+func (h *proxyHandler) serveExpose(ctx context.Context, name, localAddr string) error {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		// Get current dialer
+		h.dialerMu.RLock()
+		dialer := h.dialer
+		h.dialerMu.RUnlock()
+
+		ln, err := connecttunnel.Listen(ctx, dialer, name)
+		if err != nil {
+			var pe *connecttunnel.ProxyError
+			if errors.As(err, &pe) && (pe.StatusCode == http.StatusNotFound || pe.StatusCode == http.StatusForbidden || pe.StatusCode == http.StatusProxyAuthRequired) {
+				return err
+			}
+			h.logger.Warn("reverse listener registration failed", "name", name, "error", err, "retry_in", backoff)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+			}
+			backoff = min(backoff*2, 30*time.Second)
+			continue
+		}
+		backoff = time.Second
+		h.logger.Info("reverse listener registered", "name", name, "target", localAddr)
+
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					h.logger.Warn("reverse listener lost", "name", name, "error", err)
+				}
+				break
+			}
+			go h.handleExposed(conn, localAddr)
+		}
+		_ = ln.Close()
+	}
+	return nil
+}
+
+// handleExposed connects a tunnel accepted by the reverse listener to the
+// local service.
+func (h *proxyHandler) handleExposed(conn net.Conn, localAddr string) {
+	defer func() { _ = conn.Close() }()
+	id := newTunnelID()
+	logger := h.logger.With("tunnel_id", id, "remote_addr", conn.RemoteAddr().String(), "target", localAddr, "proto", "expose")
+
+	local, err := net.DialTimeout("tcp", localAddr, 10*time.Second)
+	if err != nil {
+		logger.Warn("local dial failed", "error", err)
+		return
+	}
+	defer func() { _ = local.Close() }()
+	h.track(conn)
+	defer h.untrack(conn)
+
+	logger.Info("tunnel started")
+
+	start := time.Now()
+	capture := h.startCapture(logger, id, "expose", conn.RemoteAddr().String(), localAddr)
+	h.metrics.TunnelOpened("expose")
+	sent, received, reason := copyBidirectional(conn, local, copyOptions{
+		idleTimeout: *idleTimeout,
+		maxLifetime: *maxLifetime,
+		capture:     capture,
+		metrics:     h.metrics,
+	})
+	h.metrics.TunnelClosed("expose")
+	finishCapture(logger, capture)
+
+	logger.Info("tunnel closed",
+		slog.Group("bytes", "sent", sent, "received", received),
+		"duration", time.Since(start),
+		"reason", reason)
+}
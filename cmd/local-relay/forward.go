@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync/atomic"
+	"time"
+
+	connecttunnel "lds.li/netrelay/connect"
+)
+
+// handleForward handles an absolute-form plain HTTP request (-forward-http)
+// by carrying it to the origin over a CONNECT tunnel through the remote
+// proxy, so it is authenticated and policed there like any other tunnel.
+// Each request gets its own tunnel.
+func (h *proxyHandler) handleForward(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Scheme != "http" || req.URL.Hostname() == "" {
+		http.Error(w, "Bad Request: only http URLs can be forwarded, use CONNECT", http.StatusBadRequest)
+		return
+	}
+	if h.shuttingDown() {
+		http.Error(w, "Service Unavailable: shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+	target := net.JoinHostPort(req.URL.Hostname(), port)
+
+	id := newTunnelID()
+	logger := h.logger.With("tunnel_id", id, "remote_addr", req.RemoteAddr, "target", target, "proto", "http")
+	logger.Debug("tunnel requested", "method", req.Method, "url", req.URL.String())
+
+	// Get current dialer
+	h.dialerMu.RLock()
+	dialer := h.dialer
+	h.dialerMu.RUnlock()
+
+	// Dial through remote proxy
+	ctx, cancel := context.WithTimeout(req.Context(), 30*time.Second)
+	defer cancel()
+
+	dialStart := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", target)
+	dialLatency := time.Since(dialStart)
+	h.metrics.RecordDial(dialLatency)
+	if err != nil {
+		h.dialFailed(w, logger, err)
+		return
+	}
+	h.metrics.RecordTunnel(connecttunnel.ResultAccepted)
+	capture := h.startCapture(logger, id, "http", req.RemoteAddr, target)
+	defer finishCapture(logger, capture)
+	proxyConn := &countingConn{Conn: conn, capture: capture, metrics: h.metrics}
+	defer func() { _ = proxyConn.Close() }()
+	h.track(proxyConn)
+	defer h.untrack(proxyConn)
+
+	var dialed atomic.Bool
+	var status int
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			// Out is already stripped of hop-by-hop headers, including
+			// Proxy-Authorization, and keeps the absolute URL and Host
+			pr.Out.Header.Add("Via", "1.1 local-relay")
+		},
+		Transport: &http.Transport{
+			DialContext: func(context.Context, string, string) (net.Conn, error) {
+				if dialed.Swap(true) {
+					return nil, errors.New("tunnel already used")
+				}
+				return proxyConn, nil
+			},
+			DisableKeepAlives:  true,
+			DisableCompression: true,
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			status = resp.StatusCode
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, _ *http.Request, err error) {
+			logger.Warn("forwarded request failed", "error", err)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		},
+	}
+
+	logger.Info("tunnel started", "dial_latency", dialLatency)
+	start := time.Now()
+	h.metrics.TunnelOpened("http")
+	proxy.ServeHTTP(w, req)
+	sent, received := proxyConn.sent.Load(), proxyConn.received.Load()
+	h.metrics.TunnelClosed("http")
+
+	logger.Info("request forwarded",
+		"method", req.Method,
+		"status", status,
+		slog.Group("bytes", "sent", sent, "received", received),
+		"duration", time.Since(start))
+}
+
+// countingConn counts, and captures if set, the bytes written to and read
+// from a connection.
+type countingConn struct {
+	net.Conn
+	sent, received atomic.Int64
+	capture        *connecttunnel.TunnelCapture
+	metrics        *connecttunnel.Metrics
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.received.Add(int64(n))
+	c.capture.Received(p[:n])
+	c.metrics.RecordBytes(0, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.sent.Add(int64(n))
+	c.capture.Sent(p[:n])
+	c.metrics.RecordBytes(int64(n), 0)
+	return n, err
+}
@@ -3,7 +3,15 @@
 // This command starts a local HTTP proxy server that accepts CONNECT requests
 // and tunnels them through a remote CONNECT proxy. This allows any tool that
 // supports HTTP CONNECT proxies (curl, browsers, SSH via nc) to tunnel through
-// the remote proxy.
+// the remote proxy. With -forward-http it also forwards plain HTTP requests, as
+// sent by clients using http_proxy, each over its own CONNECT tunnel. With
+// -transparent it accepts TCP connections redirected by iptables or nftables
+// and tunnels them to their original destination, for tools that can't be
+// configured to use a proxy. The expose subcommand does the reverse: it
+// registers a name on the remote proxy and connects the tunnels other clients
+// open to that name to a local service. With -capture-dir, the tunnels to
+// targets matching -capture-targets are written to pcapng files for
+// debugging in Wireshark.
 //
 // Example:
 //
@@ -12,21 +20,29 @@
 //	# Then use with any tool:
 //	curl -x http://localhost:8080 https://example.com
 //	ssh -o ProxyCommand='nc -X connect -x localhost:8080 %h %p' user@server
+//
+//	# Expose a local web server as web.<reverse domain> on the proxy:
+//	local-proxy expose -proxy https://proxy.example.com:443 web localhost:3000
 package main
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -38,11 +54,24 @@ import (
 )
 
 var (
-	listen    = flag.String("listen", "localhost:8080", "Local proxy listen address")
-	proxyURL  = flag.String("proxy", "", "CONNECT proxy URL (required, e.g., https://proxy.example.com:443)")
-	proxyAuth = flag.String("auth", "", "Proxy authentication header value (e.g., 'Bearer token')")
-	insecure  = flag.Bool("insecure", false, "Skip TLS verification")
-	verbose   = flag.Bool("verbose", false, "Enable verbose logging")
+	listen        = flag.String("listen", "localhost:8080", "Local proxy listen address")
+	proxyURL      = flag.String("proxy", "", "CONNECT proxy URL (required, e.g., https://proxy.example.com:443)")
+	proxyAuth     = flag.String("auth", "", "Proxy authentication header value (e.g., 'Bearer token')")
+	insecure      = flag.Bool("insecure", false, "Skip TLS verification")
+	metricsListen = flag.String("metrics-listen", "", "Address to serve OpenMetrics on at /metrics (e.g. localhost:9091, optional)")
+	tcpTmpl       = flag.String("tcp-template", "", "Use template-driven TCP (connect-tcp) with this URI template, e.g. /.well-known/masque/tcp/{target_host}/{tcp_port}/")
+	idleTimeout   = flag.Duration("idle-timeout", 0, "Close tunnels with no traffic in either direction for this long (0 disables)")
+	maxLifetime   = flag.Duration("max-lifetime", 0, "Close tunnels after this long regardless of activity (0 disables)")
+	drainTimeout  = flag.Duration("drain-timeout", 30*time.Second, "How long to wait for open tunnels to close on shutdown before closing them")
+	transparent   = flag.String("transparent", "", "Address to accept TCP connections redirected by iptables/nftables REDIRECT or TPROXY on, tunneling each to its original destination (Linux only, optional)")
+	forwardHTTP   = flag.Bool("forward-http", false, "Also act as a forward proxy for plain HTTP requests (http_proxy), carrying each one to the origin over a CONNECT tunnel")
+	captureDir    = flag.String("capture-dir", "", "Write pcapng captures of the tunnels selected by -capture-targets to this directory, for debugging (optional)")
+	captureTgts   = flag.String("capture-targets", "", "Comma-separated glob patterns of target hosts or host:ports to capture (e.g. *.example.com,10.0.0.5:443)")
+	captureSize   = flag.Int64("capture-max-size", 16, "Stop capturing a tunnel once its capture file reaches this size in megabytes")
+	captureMaxDur = flag.Duration("capture-max-duration", 0, "Stop capturing a tunnel this long after it starts (0 captures the whole tunnel)")
+	captureFor    = flag.Duration("capture-for", time.Hour, "Stop capturing new tunnels this long after startup (0 never stops)")
+	logFormat     = flag.String("log-format", "text", "Log format: text or json")
+	verbose       = flag.Bool("verbose", false, "Enable verbose logging")
 
 	// OIDC authentication flags
 	oidcIssuer       = flag.String("oidc-issuer", "", "OIDC issuer URL for automatic token acquisition")
@@ -55,14 +84,25 @@ var (
 type proxyHandler struct {
 	dialer      connecttunnel.Dialer
 	tokenSource oauth2.TokenSource
-	verbose     bool
+	metrics     *connecttunnel.Metrics
+	logger      *slog.Logger
+	capture     *connecttunnel.Capture
 	dialerMu    sync.RWMutex
+
+	// tunnels tracks the client connections of open tunnels for shutdown.
+	tunnelsMu sync.Mutex
+	tunnels   map[net.Conn]struct{}
+	closing   bool
+	aborted   bool
+	drained   chan struct{} // closed when the last tunnel closes
 }
 
 func main() {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Start a local HTTP CONNECT proxy that tunnels through a remote CONNECT proxy.\n\n")
+		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s expose [options] <name> <local-addr>\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Start a local HTTP CONNECT proxy that tunnels through a remote CONNECT proxy,\n")
+		fmt.Fprintf(os.Stderr, "or expose a local service through the remote proxy's reverse tunnels.\n\n")
 		fmt.Fprintf(os.Stderr, "Examples:\n")
 		fmt.Fprintf(os.Stderr, "  # Start local proxy\n")
 		fmt.Fprintf(os.Stderr, "  %s -proxy https://proxy.example.com:443\n\n", os.Args[0])
@@ -70,14 +110,34 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  curl -x http://localhost:8080 https://example.com\n\n")
 		fmt.Fprintf(os.Stderr, "  # Use with SSH\n")
 		fmt.Fprintf(os.Stderr, "  ssh -o ProxyCommand='nc -X connect -x localhost:8080 %%h %%p' user@server\n\n")
-		fmt.Fprintf(os.Stderr, "  # Use with environment variables\n")
+		fmt.Fprintf(os.Stderr, "  # Use with environment variables (http_proxy needs -forward-http)\n")
 		fmt.Fprintf(os.Stderr, "  export http_proxy=http://localhost:8080\n")
 		fmt.Fprintf(os.Stderr, "  export https_proxy=http://localhost:8080\n\n")
+		fmt.Fprintf(os.Stderr, "  # Transparently tunnel a container network's outbound TCP (Linux)\n")
+		fmt.Fprintf(os.Stderr, "  %s -proxy https://proxy.example.com:443 -transparent :12345\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  iptables -t nat -A PREROUTING -s 172.17.0.0/16 -p tcp -j REDIRECT --to-ports 12345\n\n")
+		fmt.Fprintf(os.Stderr, "  # Expose a local web server as web.<reverse domain> on the proxy\n")
+		fmt.Fprintf(os.Stderr, "  %s expose -proxy https://proxy.example.com:443 web localhost:3000\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flag.PrintDefaults()
 	}
 
-	flag.Parse()
+	// The expose subcommand takes the same options
+	args := os.Args[1:]
+	expose := len(args) > 0 && args[0] == "expose"
+	if expose {
+		args = args[1:]
+	}
+	_ = flag.CommandLine.Parse(args)
+
+	logger, err := newLogger(*logFormat, *verbose)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+	// Route the log package through the structured logger too
+	slog.SetDefault(logger)
 
 	// Validate arguments
 	if *proxyURL == "" {
@@ -86,6 +146,12 @@ func main() {
 		os.Exit(1)
 	}
 
+	if expose && flag.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "Error: expose requires <name> and <local-addr> arguments\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
 	// Validate OIDC configuration
 	if *oidcIssuer != "" && *oidcClientID == "" {
 		fmt.Fprintf(os.Stderr, "Error: -oidc-client-id is required when -oidc-issuer is set\n\n")
@@ -106,12 +172,18 @@ func main() {
 		if err != nil {
 			log.Fatalf("Failed to create token source: %v", err)
 		}
-		if *verbose {
-			log.Println("✓ OIDC token source created")
-		}
+		logger.Debug("OIDC token source created")
 		tokenSource = ts
 	}
 
+	// Set up packet capture if configured
+	capture, err := captureConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+
 	// Create dialer
 	dialer, err := createDialer(tokenSource)
 	if err != nil {
@@ -123,39 +195,72 @@ func main() {
 	handler := &proxyHandler{
 		dialer:      dialer,
 		tokenSource: tokenSource,
-		verbose:     *verbose,
+		metrics:     connecttunnel.NewMetrics(),
+		logger:      logger,
+		capture:     capture,
+	}
+
+	// Serve metrics if configured
+	if *metricsListen != "" {
+		go serveMetrics(*metricsListen, handler.metrics)
+	}
+
+	if expose {
+		handler.runExpose(flag.Arg(0), flag.Arg(1))
+		return
 	}
 
 	// Create HTTP server
 	server := &http.Server{
 		Addr:    *listen,
 		Handler: handler,
-		// Disable HTTP/2 for the local server (we only handle CONNECT)
+		// Disable HTTP/2 for the local server (we only handle HTTP/1.1 proxying)
 		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+		ErrorLog:     slog.NewLogLogger(logger.Handler(), slog.LevelError),
+	}
+
+	// Accept redirected connections if configured
+	var transparentLn net.Listener
+	if *transparent != "" {
+		transparentLn, err = listenTransparent(*transparent)
+		if err != nil {
+			log.Fatalf("Failed to listen for transparent connections: %v", err)
+		}
+		go handler.serveTransparent(transparentLn)
 	}
 
 	log.Printf("✓ Local proxy listening on %s", *listen)
+	if transparentLn != nil {
+		log.Printf("✓ Transparent proxy listening on %s", transparentLn.Addr())
+	}
 	log.Printf("✓ Tunneling via %s", *proxyURL)
 	if tokenSource != nil {
 		log.Printf("✓ OIDC authentication enabled")
 	}
 
 	// Handle graceful shutdown
-	go handleShutdown(server)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		handleShutdown(server, handler, transparentLn)
+	}()
 
 	// Start server
 	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Server error: %v", err)
 	}
+	<-stopped
 }
 
 // ServeHTTP implements http.Handler for the CONNECT proxy.
 func (h *proxyHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if *forwardHTTP && req.Method != http.MethodConnect && req.URL.IsAbs() {
+		h.handleForward(w, req)
+		return
+	}
 	if req.Method != http.MethodConnect {
 		http.Error(w, "Method not allowed. This proxy only supports CONNECT.", http.StatusMethodNotAllowed)
-		if h.verbose {
-			log.Printf("Rejected %s request to %s", req.Method, req.URL)
-		}
+		h.logger.Debug("rejected non-CONNECT request", "method", req.Method, "url", req.URL.String(), "remote_addr", req.RemoteAddr)
 		return
 	}
 	h.handleConnect(w, req)
@@ -168,11 +273,15 @@ func (h *proxyHandler) handleConnect(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, "Bad Request: no target specified", http.StatusBadRequest)
 		return
 	}
-
-	if h.verbose {
-		log.Printf("CONNECT request to %s from %s", target, req.RemoteAddr)
+	if h.shuttingDown() {
+		http.Error(w, "Service Unavailable: shutting down", http.StatusServiceUnavailable)
+		return
 	}
 
+	id := newTunnelID()
+	logger := h.logger.With("tunnel_id", id, "remote_addr", req.RemoteAddr, "target", target, "proto", "connect")
+	logger.Debug("tunnel requested")
+
 	// Get current dialer
 	h.dialerMu.RLock()
 	dialer := h.dialer
@@ -182,12 +291,15 @@ func (h *proxyHandler) handleConnect(w http.ResponseWriter, req *http.Request) {
 	ctx, cancel := context.WithTimeout(req.Context(), 30*time.Second)
 	defer cancel()
 
+	dialStart := time.Now()
 	proxyConn, err := dialer.DialContext(ctx, "tcp", target)
+	dialLatency := time.Since(dialStart)
+	h.metrics.RecordDial(dialLatency)
 	if err != nil {
-		log.Printf("Failed to dial %s: %v", target, err)
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		h.dialFailed(w, logger, err)
 		return
 	}
+	h.metrics.RecordTunnel(connecttunnel.ResultAccepted)
 	defer func() { _ = proxyConn.Close() }()
 
 	// Hijack client connection
@@ -199,53 +311,269 @@ func (h *proxyHandler) handleConnect(w http.ResponseWriter, req *http.Request) {
 
 	clientConn, _, err := hijacker.Hijack()
 	if err != nil {
-		log.Printf("Hijack failed: %v", err)
+		logger.Error("hijack failed", "error", err)
 		return
 	}
 	defer func() { _ = clientConn.Close() }()
+	h.track(clientConn)
+	defer h.untrack(clientConn)
 
 	// Send success response
 	_, err = clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
 	if err != nil {
-		log.Printf("Failed to send response: %v", err)
+		logger.Error("failed to send response", "error", err)
 		return
 	}
 
-	if h.verbose {
-		log.Printf("Connected to %s", target)
-	}
+	logger.Info("tunnel started", "dial_latency", dialLatency)
 
 	// Bidirectional copy
-	copyBidirectional(clientConn, proxyConn)
+	start := time.Now()
+	capture := h.startCapture(logger, id, "connect", req.RemoteAddr, target)
+	h.metrics.TunnelOpened("connect")
+	sent, received, reason := copyBidirectional(clientConn, proxyConn, copyOptions{
+		idleTimeout: *idleTimeout,
+		maxLifetime: *maxLifetime,
+		capture:     capture,
+		metrics:     h.metrics,
+	})
+	h.metrics.TunnelClosed("connect")
+	finishCapture(logger, capture)
+
+	logger.Info("tunnel closed",
+		slog.Group("bytes", "sent", sent, "received", received),
+		"duration", time.Since(start),
+		"reason", reason)
+}
 
-	if h.verbose {
-		log.Printf("Connection to %s closed", target)
+// dialFailed records a failed dial through the remote proxy and responds to
+// the client, passing on the remote proxy's Proxy-Status.
+func (h *proxyHandler) dialFailed(w http.ResponseWriter, logger *slog.Logger, err error) {
+	pe := h.logDialFailure(logger, err)
+	if pe != nil && pe.ProxyStatus != nil {
+		w.Header().Set("Proxy-Status", pe.ProxyStatus.String())
+	}
+	if pe != nil && pe.StatusCode == http.StatusGatewayTimeout {
+		http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+	} else {
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
 	}
 }
 
-// copyBidirectional copies data bidirectionally between two connections.
-func copyBidirectional(client, server net.Conn) {
+// logDialFailure records and logs a failed dial through the remote proxy,
+// returning the remote proxy's error response if there was one.
+func (h *proxyHandler) logDialFailure(logger *slog.Logger, err error) *connecttunnel.ProxyError {
+	var pe *connecttunnel.ProxyError
+	errors.As(err, &pe)
+	if errors.Is(err, connecttunnel.ErrTunnelRejected) || errors.Is(err, connecttunnel.ErrDestinationDenied) {
+		h.metrics.RecordTunnel(connecttunnel.ResultRejected)
+	} else {
+		h.metrics.RecordTunnel(connecttunnel.ResultDialFailed)
+	}
+	attrs := []any{"error", err}
+	if pe != nil && pe.ProxyStatus != nil {
+		// Why the remote proxy failed, e.g. dns_error or connection_refused
+		attrs = append(attrs, slog.Group("proxy_status",
+			"proxy", pe.ProxyStatus.Proxy,
+			"error", pe.ProxyStatus.Error,
+			"details", pe.ProxyStatus.Details,
+			"rcode", pe.ProxyStatus.RCode))
+	}
+	logger.Warn("tunnel dial failed", attrs...)
+	return pe
+}
+
+// newTunnelID returns a random tunnel identifier for logs.
+func newTunnelID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// copyOptions limits how long copyBidirectional keeps a tunnel open.
+type copyOptions struct {
+	// idleTimeout stops copying when no bytes are copied in either
+	// direction for this long. Zero means no idle timeout.
+	idleTimeout time.Duration
+
+	// maxLifetime stops copying after this long. Zero means no limit.
+	maxLifetime time.Duration
+
+	// capture, if set, records the bytes copied in each direction.
+	capture *connecttunnel.TunnelCapture
+
+	// metrics, if set, counts the bytes as they are copied.
+	metrics *connecttunnel.Metrics
+}
+
+// copyBidirectional copies data bidirectionally between two connections. It
+// returns the bytes sent to and received from the server by the time the
+// first direction finishes or a timeout in opts fires, and why it returned:
+// "closed", "idle_timeout" or "max_lifetime". The caller closes the
+// connections.
+func copyBidirectional(client, server net.Conn, opts copyOptions) (sent, received int64, reason string) {
 	done := make(chan struct{}, 2)
+	var sentN, receivedN, lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
 
 	go func() {
-		_, _ = io.Copy(server, client)
+		tee := func(p []byte) {
+			opts.capture.Sent(p)
+			opts.metrics.RecordBytes(int64(len(p)), 0)
+		}
+		_, _ = io.Copy(&countingWriter{w: server, n: &sentN, last: &lastActive, tee: tee}, client)
 		done <- struct{}{}
 	}()
 
 	go func() {
-		_, _ = io.Copy(client, server)
+		tee := func(p []byte) {
+			opts.capture.Received(p)
+			opts.metrics.RecordBytes(0, int64(len(p)))
+		}
+		_, _ = io.Copy(&countingWriter{w: client, n: &receivedN, last: &lastActive, tee: tee}, server)
 		done <- struct{}{}
 	}()
 
-	// Wait for first direction to finish
-	<-done
+	var idleTimer *time.Timer
+	var idle, expired <-chan time.Time
+	if opts.idleTimeout > 0 {
+		idleTimer = time.NewTimer(opts.idleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+	if opts.maxLifetime > 0 {
+		lifeTimer := time.NewTimer(opts.maxLifetime)
+		defer lifeTimer.Stop()
+		expired = lifeTimer.C
+	}
+
+	// Wait for first direction to finish, or a timeout
+	reason = "closed"
+wait:
+	for {
+		select {
+		case <-done:
+			break wait
+		case <-expired:
+			reason = "max_lifetime"
+			break wait
+		case <-idle:
+			inactive := time.Since(time.Unix(0, lastActive.Load()))
+			if inactive >= opts.idleTimeout {
+				reason = "idle_timeout"
+				break wait
+			}
+			idleTimer.Reset(opts.idleTimeout - inactive)
+		}
+	}
+	return sentN.Load(), receivedN.Load(), reason
+}
+
+// countingWriter counts the bytes written to w, records when they were last
+// written and passes them to tee.
+type countingWriter struct {
+	w    io.Writer
+	n    *atomic.Int64
+	last *atomic.Int64 // unix nanoseconds
+	tee  func(p []byte)
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.tee(p[:n])
+	c.n.Add(int64(n))
+	c.last.Store(time.Now().UnixNano())
+	return n, err
+}
+
+// captureConfig returns the packet capture configured by the -capture flags,
+// creating the directory, or nil if -capture-dir isn't set.
+func captureConfig() (*connecttunnel.Capture, error) {
+	if *captureDir == "" {
+		return nil, nil
+	}
+	if *captureTgts == "" {
+		return nil, fmt.Errorf("-capture-dir requires -capture-targets")
+	}
+	capture := &connecttunnel.Capture{
+		Dir:         *captureDir,
+		MaxBytes:    *captureSize << 20,
+		MaxDuration: *captureMaxDur,
+	}
+	for _, pat := range strings.Split(*captureTgts, ",") {
+		capture.Targets = append(capture.Targets, strings.TrimSpace(pat))
+	}
+	if *captureFor > 0 {
+		capture.Until = time.Now().Add(*captureFor)
+	}
+	if err := capture.Validate(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(capture.Dir, 0o700); err != nil {
+		return nil, err
+	}
+	return capture, nil
+}
+
+// startCapture starts capturing a tunnel if -capture-targets selects it. A
+// capture that can't be started is logged and skipped.
+func (h *proxyHandler) startCapture(logger *slog.Logger, id, proto, remoteAddr, target string) *connecttunnel.TunnelCapture {
+	capture, err := h.capture.Start(connecttunnel.TunnelStats{
+		ID:         id,
+		Target:     target,
+		Protocol:   proto,
+		RemoteAddr: remoteAddr,
+		Start:      time.Now(),
+	}, nil)
+	if err != nil {
+		logger.Warn("capture failed", "error", err)
+		return nil
+	}
+	if capture != nil {
+		logger.Info("capture started", "file", capture.Name())
+	}
+	return capture
+}
+
+// finishCapture closes a tunnel's capture, if any.
+func finishCapture(logger *slog.Logger, capture *connecttunnel.TunnelCapture) {
+	if err := capture.Close(); err != nil {
+		logger.Warn("capture failed", "error", err)
+	}
+}
+
+// newLogger creates the structured logger for the given -log-format.
+func newLogger(format string, verbose bool) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: slog.LevelInfo}
+	if verbose {
+		opts.Level = slog.LevelDebug
+	}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid -log-format %q (must be text or json)", format)
+	}
+}
+
+// serveMetrics serves metrics at /metrics on addr.
+func serveMetrics(addr string, metrics *connecttunnel.Metrics) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	log.Printf("✓ Metrics listening on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("Metrics server error: %v", err)
+	}
 }
 
 // createDialer creates a CONNECT dialer from the flags.
 func createDialer(tsTokenSource oauth2.TokenSource) (connecttunnel.Dialer, error) {
 	// Build client config
 	clientCfg := &connecttunnel.ClientConfig{
-		ProxyURL: *proxyURL,
+		ProxyURL:    *proxyURL,
+		TCPTemplate: *tcpTmpl,
 		HeadersForRequest: func(req *http.Request) (http.Header, error) {
 			if tsTokenSource != nil {
 				token, err := tsTokenSource.Token()
@@ -324,20 +652,91 @@ func createTokenSource(ctx context.Context) (oauth2.TokenSource, error) {
 	return ccfg.TokenSource(ctx)
 }
 
-// handleShutdown handles graceful shutdown on SIGINT/SIGTERM.
-func handleShutdown(server *http.Server) {
+// shuttingDown reports whether Shutdown has been called.
+func (h *proxyHandler) shuttingDown() bool {
+	h.tunnelsMu.Lock()
+	defer h.tunnelsMu.Unlock()
+	return h.closing
+}
+
+// track registers the client connection of an open tunnel. A tunnel opened
+// after Shutdown gave up waiting is closed straight away.
+func (h *proxyHandler) track(conn net.Conn) {
+	h.tunnelsMu.Lock()
+	defer h.tunnelsMu.Unlock()
+	if h.aborted {
+		_ = conn.Close()
+	}
+	if h.tunnels == nil {
+		h.tunnels = make(map[net.Conn]struct{})
+	}
+	h.tunnels[conn] = struct{}{}
+}
+
+// untrack removes a closed tunnel.
+func (h *proxyHandler) untrack(conn net.Conn) {
+	h.tunnelsMu.Lock()
+	defer h.tunnelsMu.Unlock()
+	delete(h.tunnels, conn)
+	if len(h.tunnels) == 0 && h.drained != nil {
+		close(h.drained)
+		h.drained = nil
+	}
+}
+
+// Shutdown refuses new tunnels and waits for the open ones to close. If ctx
+// expires first, the remaining tunnels are closed and ctx's error returned.
+func (h *proxyHandler) Shutdown(ctx context.Context) error {
+	h.tunnelsMu.Lock()
+	h.closing = true
+	if len(h.tunnels) == 0 {
+		h.tunnelsMu.Unlock()
+		return nil
+	}
+	if h.drained == nil {
+		h.drained = make(chan struct{})
+	}
+	drained := h.drained
+	h.tunnelsMu.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	h.tunnelsMu.Lock()
+	h.aborted = true
+	for conn := range h.tunnels {
+		_ = conn.Close()
+	}
+	h.tunnelsMu.Unlock()
+	return ctx.Err()
+}
+
+// handleShutdown handles graceful shutdown on SIGINT/SIGTERM, draining open
+// tunnels for up to -drain-timeout. transparentLn is the -transparent
+// listener, if any.
+func handleShutdown(server *http.Server, handler *proxyHandler, transparentLn net.Listener) {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 	<-sigChan
 
-	log.Println("\nShutting down gracefully...")
+	log.Printf("Shutting down gracefully, draining open tunnels (timeout: %s)...", *drainTimeout)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
 	defer cancel()
 
+	// Hijacked tunnels aren't tracked by the server, so drain them separately
+	if transparentLn != nil {
+		_ = transparentLn.Close()
+	}
 	if err := server.Shutdown(ctx); err != nil {
 		log.Printf("Server shutdown error: %v", err)
 	}
+	if err := handler.Shutdown(ctx); err != nil {
+		log.Printf("Drain timeout reached, closed remaining tunnels")
+	}
 
 	log.Println("Server stopped")
 }
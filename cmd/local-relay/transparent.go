@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"time"
+
+	connecttunnel "lds.li/netrelay/connect"
+)
+
+// serveTransparent accepts TCP connections redirected to ln by iptables or
+// nftables (REDIRECT or TPROXY), and tunnels each one to its original
+// destination through the remote proxy. It returns when ln is closed.
+func (h *proxyHandler) serveTransparent(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			h.logger.Error("transparent accept failed", "error", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go h.handleTransparent(conn.(*net.TCPConn), ln.Addr())
+	}
+}
+
+// handleTransparent tunnels a redirected connection to its original
+// destination.
+func (h *proxyHandler) handleTransparent(conn *net.TCPConn, listenAddr net.Addr) {
+	defer func() { _ = conn.Close() }()
+
+	dst, err := originalDst(conn)
+	if err != nil {
+		h.logger.Warn("transparent connection rejected", "remote_addr", conn.RemoteAddr().String(), "error", err)
+		return
+	}
+	// A connection made straight to the listener has no other destination,
+	// and tunneling it back to ourselves would loop
+	if isListenAddr(dst, conn.LocalAddr().(*net.TCPAddr).AddrPort(), listenAddr) {
+		h.logger.Warn("transparent connection rejected", "remote_addr", conn.RemoteAddr().String(), "error", "connection was not redirected")
+		return
+	}
+	if h.shuttingDown() {
+		return
+	}
+	target := dst.String()
+
+	id := newTunnelID()
+	logger := h.logger.With("tunnel_id", id, "remote_addr", conn.RemoteAddr().String(), "target", target, "proto", "transparent")
+	logger.Debug("tunnel requested")
+
+	// Get current dialer
+	h.dialerMu.RLock()
+	dialer := h.dialer
+	h.dialerMu.RUnlock()
+
+	// Dial through remote proxy
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	dialStart := time.Now()
+	proxyConn, err := dialer.DialContext(ctx, "tcp", target)
+	dialLatency := time.Since(dialStart)
+	h.metrics.RecordDial(dialLatency)
+	if err != nil {
+		// There is no response to send, so the client just sees a reset
+		h.logDialFailure(logger, err)
+		_ = conn.SetLinger(0)
+		return
+	}
+	h.metrics.RecordTunnel(connecttunnel.ResultAccepted)
+	defer func() { _ = proxyConn.Close() }()
+	h.track(conn)
+	defer h.untrack(conn)
+
+	logger.Info("tunnel started", "dial_latency", dialLatency)
+
+	start := time.Now()
+	capture := h.startCapture(logger, id, "transparent", conn.RemoteAddr().String(), target)
+	h.metrics.TunnelOpened("transparent")
+	sent, received, reason := copyBidirectional(conn, proxyConn, copyOptions{
+		idleTimeout: *idleTimeout,
+		maxLifetime: *maxLifetime,
+		capture:     capture,
+		metrics:     h.metrics,
+	})
+	h.metrics.TunnelClosed("transparent")
+	finishCapture(logger, capture)
+
+	logger.Info("tunnel closed",
+		slog.Group("bytes", "sent", sent, "received", received),
+		"duration", time.Since(start),
+		"reason", reason)
+}
+
+// isListenAddr reports whether a connection accepted at local by a listener
+// bound to listenAddr, whose original destination was dst, was made straight
+// to the listener rather than redirected to it. REDIRECT rewrites the
+// destination, so dst differs from local; TPROXY keeps it, so the connection
+// only reached the listener directly if local is the listener's own address.
+func isListenAddr(dst, local netip.AddrPort, listenAddr net.Addr) bool {
+	dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	local = netip.AddrPortFrom(local.Addr().Unmap(), local.Port())
+	ln, ok := listenAddr.(*net.TCPAddr)
+	if !ok || dst != local || int(local.Port()) != ln.Port {
+		return false
+	}
+	lnIP, _ := netip.AddrFromSlice(ln.IP)
+	lnIP = lnIP.Unmap()
+	if !lnIP.IsUnspecified() {
+		return lnIP == local.Addr()
+	}
+	// TPROXY can deliver connections for any address to a wildcard
+	// listener, so only one of this host's addresses is the listener
+	return local.Addr().IsLoopback() || isHostAddr(local.Addr())
+}
+
+// isHostAddr reports whether addr is assigned to one of this host's
+// interfaces.
+func isHostAddr(addr netip.Addr) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok {
+			if ip, ok := netip.AddrFromSlice(ipNet.IP); ok && ip.Unmap() == addr {
+				return true
+			}
+		}
+	}
+	return false
+}
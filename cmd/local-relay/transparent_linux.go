@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST from linux/netfilter_ipv4.h, which is the
+// same value as IP6T_SO_ORIGINAL_DST for IPv6.
+const soOriginalDst = 80
+
+// ipv6Transparent is IPV6_TRANSPARENT from linux/in6.h.
+const ipv6Transparent = 75
+
+// listenTransparent listens on addr for redirected connections. IP_TRANSPARENT
+// is set where permitted (it needs CAP_NET_ADMIN) so TPROXY rules can deliver
+// connections; REDIRECT works without it.
+func listenTransparent(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return c.Control(func(fd uintptr) {
+				if network == "tcp6" {
+					_ = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+				} else {
+					_ = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+				}
+			})
+		},
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// originalDst returns the destination a redirected connection was originally
+// sent to. REDIRECT (NAT) connections report it with SO_ORIGINAL_DST; TPROXY
+// connections keep it as their local address.
+func originalDst(conn *net.TCPConn) (netip.AddrPort, error) {
+	local := conn.LocalAddr().(*net.TCPAddr).AddrPort()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	var dst netip.AddrPort
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if local.Addr().Unmap().Is4() {
+			// The sockaddr_in fits in the 16 bytes of an ipv6_mreq
+			var mreq *syscall.IPv6Mreq
+			if mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst); sockErr == nil {
+				dst = decodeSockaddrIn(mreq.Multiaddr)
+			}
+			return
+		}
+		// The sockaddr_in6 fits in an ip6_mtuinfo
+		var info *syscall.IPv6MTUInfo
+		if info, sockErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst); sockErr == nil {
+			dst = decodeSockaddrIn6(info.Addr)
+		}
+	})
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if sockErr != nil {
+		// Not NATed, which is how TPROXY connections arrive
+		if sockErr == syscall.ENOENT {
+			return local, nil
+		}
+		return netip.AddrPort{}, fmt.Errorf("getting original destination: %w", sockErr)
+	}
+	return netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port()), nil
+}
+
+// decodeSockaddrIn decodes the address and port of a sockaddr_in.
+func decodeSockaddrIn(b [16]byte) netip.AddrPort {
+	return netip.AddrPortFrom(netip.AddrFrom4([4]byte(b[4:8])), binary.BigEndian.Uint16(b[2:4]))
+}
+
+// decodeSockaddrIn6 decodes the address and port of a sockaddr_in6.
+func decodeSockaddrIn6(sa syscall.RawSockaddrInet6) netip.AddrPort {
+	// The port is in network byte order
+	port := binary.BigEndian.Uint16(binary.NativeEndian.AppendUint16(nil, sa.Port))
+	return netip.AddrPortFrom(netip.AddrFrom16(sa.Addr), port)
+}
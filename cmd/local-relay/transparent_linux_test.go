@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"syscall"
+	"testing"
+)
+
+func TestDecodeSockaddr(t *testing.T) {
+	// sockaddr_in: family, port and address, all but the family in network
+	// byte order
+	var in [16]byte
+	binary.NativeEndian.PutUint16(in[0:2], syscall.AF_INET)
+	copy(in[2:8], []byte{0x01, 0xbb, 93, 184, 215, 14})
+	if got, want := decodeSockaddrIn(in), netip.MustParseAddrPort("93.184.215.14:443"); got != want {
+		t.Errorf("decodeSockaddrIn = %s, want %s", got, want)
+	}
+
+	want := netip.MustParseAddrPort("[2001:db8::1]:8080")
+	in6 := syscall.RawSockaddrInet6{
+		Family: syscall.AF_INET6,
+		Port:   binary.NativeEndian.Uint16([]byte{0x1f, 0x90}),
+		Addr:   want.Addr().As16(),
+	}
+	if got := decodeSockaddrIn6(in6); got != want {
+		t.Errorf("decodeSockaddrIn6 = %s, want %s", got, want)
+	}
+}
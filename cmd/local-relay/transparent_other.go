@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+var errTransparentUnsupported = errors.New("transparent mode is only supported on Linux")
+
+func listenTransparent(addr string) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
+
+func originalDst(conn *net.TCPConn) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errTransparentUnsupported
+}
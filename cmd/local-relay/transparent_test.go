@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestIsListenAddr(t *testing.T) {
+	wildcard := &net.TCPAddr{IP: net.IPv6unspecified, Port: 12345}
+	loopback := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}
+	ap := netip.MustParseAddrPort
+	tests := []struct {
+		name       string
+		dst, local netip.AddrPort
+		listenAddr net.Addr
+		want       bool
+	}{
+		{"direct to wildcard", ap("127.0.0.1:12345"), ap("127.0.0.1:12345"), wildcard, true},
+		{"direct to mapped", ap("127.0.0.1:12345"), ap("[::ffff:127.0.0.1]:12345"), wildcard, true},
+		{"direct to bound address", ap("127.0.0.1:12345"), ap("127.0.0.1:12345"), loopback, true},
+		{"redirected on the listener port", ap("93.184.215.14:12345"), ap("127.0.0.1:12345"), wildcard, false},
+		{"redirected to loopback", ap("127.0.0.53:53"), ap("127.0.0.1:12345"), loopback, false},
+		{"redirected from loopback on the listener port", ap("127.0.0.2:12345"), ap("127.0.0.1:12345"), wildcard, false},
+		{"tproxy on the listener port", ap("192.0.2.1:12345"), ap("192.0.2.1:12345"), wildcard, false},
+		{"tproxy to a bound listener", ap("192.0.2.1:12345"), ap("192.0.2.1:12345"), loopback, false},
+		{"tproxy on another port", ap("192.0.2.1:443"), ap("192.0.2.1:443"), wildcard, false},
+	}
+	for _, tt := range tests {
+		if got := isListenAddr(tt.dst, tt.local, tt.listenAddr); got != tt.want {
+			t.Errorf("%s: isListenAddr(%s, %s, %s) = %v, want %v", tt.name, tt.dst, tt.local, tt.listenAddr, got, tt.want)
+		}
+	}
+}
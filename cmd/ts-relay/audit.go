@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	connecttunnel "lds.li/netrelay/connect"
+)
+
+// auditRecord is the audit log entry for one tunnel, written when the tunnel
+// ends or is refused.
+type auditRecord struct {
+	TunnelID string `json:"tunnel_id"`
+	// Auth is the authentication method: "oidc", "token" or "none".
+	Auth    string `json:"auth"`
+	Subject string `json:"subject,omitempty"`
+	Email   string `json:"email,omitempty"`
+
+	SourceAddr string `json:"source_addr"`
+	Target     string `json:"target"`
+	Protocol   string `json:"protocol"`
+	// UpstreamIP is the address the target was dialed at, and Route whether
+	// it was dialed over the tailnet or directly.
+	UpstreamIP string `json:"upstream_ip,omitempty"`
+	Route      string `json:"route,omitempty"`
+
+	Start         time.Time `json:"start"`
+	End           time.Time `json:"end"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+
+	// Outcome is "closed" for tunnels that were established, "rejected" for
+	// tunnels refused by authentication, policy or limits, and
+	// "dial_failed". Reason is why an established tunnel closed.
+	Outcome string `json:"outcome"`
+	Reason  string `json:"reason,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// auditSink receives audit records.
+type auditSink interface {
+	WriteRecord(rec *auditRecord) error
+	Close() error
+}
+
+// auditLog assembles an audit record for each tunnel from the proxy's
+// callbacks, and writes it to the sinks once the tunnel ends or is refused.
+// A nil *auditLog discards everything.
+type auditLog struct {
+	auth   string
+	sinks  []auditSink
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	tunnels map[string]*auditRecord // in progress, by tunnel ID
+}
+
+func newAuditLog(auth string, sinks []auditSink, logger *slog.Logger) *auditLog {
+	return &auditLog{auth: auth, sinks: sinks, logger: logger, tunnels: make(map[string]*auditRecord)}
+}
+
+// update applies f to the record of the tunnel ctx belongs to.
+func (a *auditLog) update(ctx context.Context, f func(rec *auditRecord)) {
+	if a == nil {
+		return
+	}
+	id := connecttunnel.TunnelID(ctx)
+	if id == "" {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rec, ok := a.tunnels[id]
+	if !ok {
+		rec = &auditRecord{TunnelID: id}
+		a.tunnels[id] = rec
+	}
+	f(rec)
+}
+
+// dialed records how a tunnel's upstream connection was made.
+func (a *auditLog) dialed(ctx context.Context, route string, conn net.Conn) {
+	a.update(ctx, func(rec *auditRecord) {
+		rec.Route = route
+		if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+			rec.UpstreamIP = host
+		}
+	})
+}
+
+// tunnelEnded writes the record of an established tunnel that closed. It is
+// the OnTunnelEnd hook.
+func (a *auditLog) tunnelEnded(ctx context.Context, stats connecttunnel.TunnelStats) {
+	a.finish(ctx, stats, "closed")
+}
+
+// tunnelRejected writes the record of a refused tunnel. It is the
+// OnTunnelReject hook.
+func (a *auditLog) tunnelRejected(ctx context.Context, stats connecttunnel.TunnelStats) {
+	outcome := "rejected"
+	if errors.Is(stats.Err, connecttunnel.ErrUpstreamDial) {
+		outcome = "dial_failed"
+	}
+	a.finish(ctx, stats, outcome)
+}
+
+// finish completes a tunnel's record from its final stats and the principal
+// OnTunnel verified, and writes it.
+func (a *auditLog) finish(ctx context.Context, stats connecttunnel.TunnelStats, outcome string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	rec, ok := a.tunnels[stats.ID]
+	delete(a.tunnels, stats.ID)
+	a.mu.Unlock()
+	if !ok {
+		rec = &auditRecord{TunnelID: stats.ID}
+	}
+
+	rec.Auth = a.auth
+	if info, ok := connecttunnel.TunnelInfoFromContext(ctx); ok {
+		rec.Subject, rec.Email = info.Subject, info.Email
+	}
+	rec.SourceAddr = stats.RemoteAddr
+	rec.Target = stats.Target
+	rec.Protocol = stats.Protocol
+	rec.Start = stats.Start
+	rec.End = stats.Start.Add(stats.Duration)
+	rec.BytesSent = stats.BytesSent
+	rec.BytesReceived = stats.BytesReceived
+	rec.Outcome = outcome
+	rec.Reason = string(stats.Reason)
+	if stats.Err != nil {
+		rec.Error = stats.Err.Error()
+	}
+	for _, sink := range a.sinks {
+		if err := sink.WriteRecord(rec); err != nil {
+			a.logger.Error("failed to write audit record", "tunnel_id", rec.TunnelID, "error", err)
+		}
+	}
+}
+
+// Close closes the sinks.
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	var errs []error
+	for _, sink := range a.sinks {
+		errs = append(errs, sink.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// jsonlSink writes records as JSON Lines to w, closing c, if set, on Close.
+type jsonlSink struct {
+	mu sync.Mutex
+	w  io.Writer
+	c  io.Closer
+}
+
+func (s *jsonlSink) WriteRecord(rec *auditRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(b, '\n'))
+	return err
+}
+
+func (s *jsonlSink) Close() error {
+	if s.c == nil {
+		return nil
+	}
+	return s.c.Close()
+}
+
+// rotatingFile is an append-only file that is rotated once it reaches
+// maxSize bytes, keeping maxBackups old files as path.1 (the newest) to
+// path.N. Each write is synced to disk.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu     sync.Mutex
+	f      *os.File // nil after a failed rotation, until reopened
+	size   int64
+	closed bool
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open opens the current file for appending.
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+	if r.f == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, fmt.Errorf("rotating %s: %w", r.path, err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	if err != nil {
+		return n, err
+	}
+	return n, r.f.Sync()
+}
+
+// rotate shifts the backups along, dropping the oldest, and starts a new
+// file.
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	r.f = nil
+	if r.maxBackups <= 0 {
+		if err := os.Remove(r.path); err != nil {
+			return err
+		}
+		return r.open()
+	}
+	backup := func(i int) string { return r.path + "." + strconv.Itoa(i) }
+	for i := r.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(backup(i), backup(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(r.path, backup(1)); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// parseAuditSinks opens the sinks of a comma-separated -audit-log value:
+// "stdout", or file paths to write rotating JSON Lines files to.
+func parseAuditSinks(spec string, maxSize int64, maxBackups int) ([]auditSink, error) {
+	var sinks []auditSink
+	for _, item := range splitList(spec) {
+		if item == "stdout" {
+			sinks = append(sinks, &jsonlSink{w: os.Stdout})
+			continue
+		}
+		f, err := openRotatingFile(item, maxSize, maxBackups)
+		if err != nil {
+			for _, s := range sinks {
+				_ = s.Close()
+			}
+			return nil, fmt.Errorf("opening audit log: %w", err)
+		}
+		sinks = append(sinks, &jsonlSink{w: f, c: f})
+	}
+	return sinks, nil
+}
+
+// authMethod names the authentication method configured by the flags, for
+// the audit log.
+func authMethod() string {
+	switch {
+	case *oidcIssuer != "":
+		return "oidc"
+	case *enableAuth:
+		return "token"
+	default:
+		return "none"
+	}
+}
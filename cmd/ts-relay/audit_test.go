@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	connecttunnel "lds.li/netrelay/connect"
+)
+
+// recordSink collects audit records.
+type recordSink struct {
+	records chan auditRecord
+}
+
+func (s *recordSink) WriteRecord(rec *auditRecord) error {
+	s.records <- *rec
+	return nil
+}
+
+func (s *recordSink) Close() error { return nil }
+
+func TestAuditLog(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer func() { _ = ln.Close() }()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	sink := &recordSink{records: make(chan auditRecord, 1)}
+	audit := newAuditLog("oidc", []auditSink{sink}, slog.Default())
+	var dialer net.Dialer
+	cfg := &connecttunnel.ServerConfig{
+		OnTunnel: func(ctx context.Context, req *http.Request) error {
+			if req.Header.Get("Proxy-Authorization") != "Bearer good" {
+				return connecttunnel.ErrProxyAuthRequired
+			}
+			connecttunnel.SetTunnelInfo(ctx, connecttunnel.TunnelInfo{Subject: "1234", Email: "alice@example.com"})
+			return nil
+		},
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, address)
+			if err == nil {
+				audit.dialed(ctx, "direct", conn)
+			}
+			return conn, err
+		},
+		OnTunnelEnd:    audit.tunnelEnded,
+		OnTunnelReject: audit.tunnelRejected,
+	}
+	proxyServer := httptest.NewServer(connecttunnel.NewHandler(cfg))
+	defer proxyServer.Close()
+
+	dial := func(token string) (net.Conn, error) {
+		d := connecttunnel.NewH1Dialer(&connecttunnel.ClientConfig{
+			ProxyURL: proxyServer.URL,
+			HeadersForRequest: func(*http.Request) (http.Header, error) {
+				return http.Header{"Proxy-Authorization": {"Bearer " + token}}, nil
+			},
+		})
+		return d.DialContext(context.Background(), "tcp", ln.Addr().String())
+	}
+	wait := func() auditRecord {
+		t.Helper()
+		select {
+		case rec := <-sink.records:
+			return rec
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for audit record")
+			return auditRecord{}
+		}
+	}
+
+	conn, err := dial("good")
+	if err != nil {
+		t.Fatalf("Failed to dial through proxy: %v", err)
+	}
+	msg := []byte("audited")
+	_, _ = conn.Write(msg)
+	_, _ = io.ReadFull(conn, make([]byte, len(msg)))
+	_ = conn.Close()
+
+	rec := wait()
+	if rec.TunnelID == "" || rec.Auth != "oidc" || rec.Subject != "1234" || rec.Email != "alice@example.com" {
+		t.Errorf("Unexpected identity in record: %+v", rec)
+	}
+	if rec.Target != ln.Addr().String() || rec.UpstreamIP != "127.0.0.1" || rec.Route != "direct" || rec.Protocol != "connect" {
+		t.Errorf("Unexpected destination in record: %+v", rec)
+	}
+	if rec.Outcome != "closed" || rec.BytesSent != int64(len(msg)) || rec.BytesReceived != int64(len(msg)) || rec.End.Before(rec.Start) {
+		t.Errorf("Unexpected outcome in record: %+v", rec)
+	}
+	if !strings.HasPrefix(rec.SourceAddr, "127.0.0.1:") {
+		t.Errorf("SourceAddr = %q, want loopback", rec.SourceAddr)
+	}
+
+	if _, err := dial("bad"); err == nil {
+		t.Fatal("Dial with a bad token succeeded")
+	}
+	rec = wait()
+	if rec.Outcome != "rejected" || rec.Subject != "" || rec.Error == "" {
+		t.Errorf("Unexpected rejection record: %+v", rec)
+	}
+	if len(audit.tunnels) != 0 {
+		t.Errorf("%d records left in progress", len(audit.tunnels))
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	f, err := openRotatingFile(path, 400, 2)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	sink := &jsonlSink{w: f, c: f}
+	for i := range 10 {
+		if err := sink.WriteRecord(&auditRecord{TunnelID: strings.Repeat("x", i), Outcome: "closed"}); err != nil {
+			t.Fatalf("WriteRecord failed: %v", err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// The newest records are in path, then path.1 and path.2
+	var ids []string
+	for _, name := range []string{path + ".2", path + ".1", path} {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", name, err)
+		}
+		if len(b) > 400 {
+			t.Errorf("%s is %d bytes, want at most 400", name, len(b))
+		}
+		sc := bufio.NewScanner(bytes.NewReader(b))
+		for sc.Scan() {
+			var rec auditRecord
+			if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+				t.Fatalf("Invalid JSON line %q: %v", sc.Text(), err)
+			}
+			ids = append(ids, rec.TunnelID)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Error("Kept more than 2 backups")
+	}
+	if len(ids) == 0 || ids[len(ids)-1] != strings.Repeat("x", 9) {
+		t.Errorf("Records = %q, want the last one last", ids)
+	}
+	for i := 1; i < len(ids); i++ {
+		if len(ids[i]) != len(ids[i-1])+1 {
+			t.Errorf("Records out of order: %q", ids)
+			break
+		}
+	}
+}
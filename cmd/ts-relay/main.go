@@ -9,9 +9,11 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/netip"
@@ -19,6 +21,7 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/tink-crypto/tink-go/v2/jwt"
 	"k8s.io/client-go/kubernetes"
@@ -47,13 +50,63 @@ var (
 	oidcIssuer   = flag.String("oidc-issuer", "", "OIDC issuer URL (e.g., https://accounts.google.com)")
 	oidcAudience = flag.String("oidc-audience", "", "OIDC audience/client ID (required if -oidc-issuer is set)")
 
-	verbose = flag.Bool("verbose", false, "Enable verbose logging")
+	// Access control options
+	policyFile   = flag.String("policy", "", "Path to a JSON destination access policy file (optional)")
+	allowPrivate = flag.Bool("allow-private", false, "Allow tunnels to loopback, private and metadata addresses on the direct (non-tailnet) path")
+	allowCIDRs   = flag.String("allow-cidrs", "", "Comma-separated CIDRs exempt from private address blocking (e.g. 10.20.0.0/16)")
+
+	// Upstream DNS flags
+	dnsServers   = flag.String("dns-servers", "", "Comma-separated nameservers to resolve upstream targets with (default: system resolver)")
+	ipPreference = flag.String("ip-preference", "ipv6", "Address family order for upstream dials: ipv6, ipv4, ipv4only or ipv6only")
+
+	// Egress routing flags
+	routesFile = flag.String("routes", "", "Path to a JSON egress routing table: which tunnels go over the tailnet, directly, from a source address, through an upstream proxy or are rejected (optional)")
+
+	// PROXY protocol flags
+	upstreamProxyProtocol = flag.Int("upstream-proxy-protocol", 0, "Send a PROXY protocol header of this version (1 or 2) to upstream TCP services, carrying the client address (0 disables)")
+	upstreamProxyIdentity = flag.Bool("upstream-proxy-identity", false, "Send the authenticated user in PROXY protocol v2 headers, as TLV type 0xE0")
+
+	// Reverse tunnel flags
+	reverseDomain    = flag.String("reverse-domain", "", "Route tunnels to <name>.<domain> to the client that registered name with local-relay expose; requires -oidc-issuer (empty disables)")
+	reverseOwnerList = flag.String("reverse-owners", "", "Comma-separated name=identity pairs of the reverse tunnel names each user may register, with glob patterns for identities (default: each name is bound to the first user that registers it)")
+
+	// Audit log flags
+	auditLogSinks   = flag.String("audit-log", "", "Comma-separated tunnel audit log sinks: stdout, or file paths to write rotating JSON Lines files to (optional)")
+	auditMaxSize    = flag.Int64("audit-max-size", 100, "Rotate audit log files when they reach this size in megabytes (0 disables)")
+	auditMaxBackups = flag.Int("audit-max-backups", 10, "Number of rotated audit log files to keep")
+
+	// Packet capture flags
+	captureDir         = flag.String("capture-dir", "", "Write pcapng captures of the tunnels selected by -capture-targets and -capture-users to this directory, for debugging (optional)")
+	captureTargets     = flag.String("capture-targets", "", "Comma-separated glob patterns of target hosts or host:ports to capture (e.g. *.example.com,10.0.0.5:443)")
+	captureUsers       = flag.String("capture-users", "", "Comma-separated glob patterns of authenticated users to capture")
+	captureMaxSize     = flag.Int64("capture-max-size", 16, "Stop capturing a tunnel once its capture file reaches this size in megabytes")
+	captureMaxDuration = flag.Duration("capture-max-duration", 0, "Stop capturing a tunnel this long after it starts (0 captures the whole tunnel)")
+	captureFor         = flag.Duration("capture-for", time.Hour, "Stop capturing new tunnels this long after startup (0 never stops)")
+
+	metricsListen = flag.String("metrics-listen", "", "Address to serve OpenMetrics on at /metrics (e.g. :9090, optional)")
+
+	// Bandwidth limits, in bytes per second
+	uploadLimit       = flag.Int64("upload-limit", 0, "Per-tunnel upload limit in bytes per second (0 disables)")
+	downloadLimit     = flag.Int64("download-limit", 0, "Per-tunnel download limit in bytes per second (0 disables)")
+	userUploadLimit   = flag.Int64("user-upload-limit", 0, "Combined upload limit for each authenticated user's tunnels in bytes per second (0 disables)")
+	userDownloadLimit = flag.Int64("user-download-limit", 0, "Combined download limit for each authenticated user's tunnels in bytes per second (0 disables)")
+
+	// Concurrent tunnel limits
+	maxTunnels          = flag.Int("max-tunnels", 0, "Maximum concurrent tunnels (0 disables)")
+	maxTunnelsPerClient = flag.Int("max-tunnels-per-client", 0, "Maximum concurrent tunnels per client IP address (0 disables)")
+	maxTunnelsPerUser   = flag.Int("max-tunnels-per-user", 0, "Maximum concurrent tunnels per authenticated user (0 disables)")
+
+	idleTimeout  = flag.Duration("idle-timeout", 0, "Close tunnels with no traffic in either direction for this long (0 disables)")
+	maxLifetime  = flag.Duration("max-lifetime", 0, "Close tunnels after this long regardless of activity (0 disables)")
+	drainTimeout = flag.Duration("drain-timeout", 30*time.Second, "How long to wait for open tunnels to close on shutdown before closing them")
+	logFormat    = flag.String("log-format", "text", "Log format: text or json")
+	verbose      = flag.Bool("verbose", false, "Enable verbose logging")
 )
 
 // useTailscaleDial reports whether the given host is on the tailnet and should
 // be dialed via Tailscale (srv.Dial). Otherwise the connection should go out
 // over the normal network.
-func useTailscaleDial(ctx context.Context, lc *local.Client, host string) bool {
+func useTailscaleDial(ctx context.Context, lc *local.Client, resolver connecttunnel.Resolver, host string) bool {
 	// If host is an IP, use Tailscale only for Tailscale-assigned IPs.
 	if ip, err := netip.ParseAddr(host); err == nil {
 		return tsaddr.IsTailscaleIP(ip)
@@ -90,7 +143,6 @@ func useTailscaleDial(ctx context.Context, lc *local.Client, host string) bool {
 		}
 	}
 	// Resolve host; if any resolved IP is a Tailscale IP or matches a peer, use Tailscale.
-	resolver := net.DefaultResolver
 	addrs, err := resolver.LookupNetIP(ctx, "ip", host)
 	if err != nil {
 		return false
@@ -118,7 +170,56 @@ func dnsShortName(dnsName string) string {
 }
 
 func main() {
-	flag.Parse()
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s route [options] <host:port> [<identity>]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Run a CONNECT proxy on the tailnet, or print which egress route a tunnel\n")
+		fmt.Fprintf(os.Stderr, "to host:port would take with the given -routes and address options.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		flag.PrintDefaults()
+	}
+
+	// The route subcommand takes the same options
+	args := os.Args[1:]
+	routeCheck := len(args) > 0 && args[0] == "route"
+	if routeCheck {
+		args = args[1:]
+	}
+	_ = flag.CommandLine.Parse(args)
+
+	logger, err := newLogger(*logFormat, *verbose)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	// Route the log package through the structured logger too
+	slog.SetDefault(logger)
+
+	// Load the egress routing table if configured
+	routes := newRouteTable()
+	if *routesFile != "" {
+		routes, err = loadRoutes(*routesFile)
+		if err != nil {
+			log.Fatalf("Failed to load routes: %v", err)
+		}
+	}
+	resolver, guard, err := egressResolver()
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if routeCheck {
+		if flag.NArg() < 1 || flag.NArg() > 2 {
+			fmt.Fprintf(os.Stderr, "Error: route requires a <host:port> argument and an optional <identity>\n\n")
+			flag.Usage()
+			os.Exit(2)
+		}
+		if err := explainRoute(os.Stdout, routes, resolver, guard, flag.Arg(0), flag.Arg(1)); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+	if *routesFile != "" {
+		log.Printf("✓ Routes loaded: %d routes (default: %s)", len(routes.Routes), routes.Default.Action)
+	}
 
 	// Validate authentication flags
 	if *enableAuth && *authToken == "" {
@@ -137,11 +238,25 @@ func main() {
 		log.Fatal("Error: -hostname is required")
 	}
 
+	if err := checkReverseAuth(*reverseDomain, *oidcIssuer); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	owners, err := parseReverseOwners(*reverseOwnerList)
+	if err != nil {
+		log.Fatalf("Invalid -reverse-owners: %v", err)
+	}
+
+	if *upstreamProxyProtocol < 0 || *upstreamProxyProtocol > 2 {
+		log.Fatal("Error: -upstream-proxy-protocol must be 0, 1 or 2")
+	}
+	if *upstreamProxyIdentity && *upstreamProxyProtocol != 2 {
+		log.Fatal("Error: -upstream-proxy-identity requires -upstream-proxy-protocol 2")
+	}
+
 	// Initialize OIDC provider if configured
 	var oidcProvider *provider.Provider
 	if *oidcIssuer != "" {
 		log.Printf("Initializing OIDC provider: %s", *oidcIssuer)
-		var err error
 		oidcProvider, err = provider.DiscoverOIDCProvider(context.Background(), *oidcIssuer)
 		if err != nil {
 			log.Fatalf("Failed to initialize OIDC provider: %v", err)
@@ -149,6 +264,39 @@ func main() {
 		log.Printf("✓ OIDC provider initialized (issuer: %s)", oidcProvider.Issuer())
 	}
 
+	// Load destination access policy if configured
+	var policy *connecttunnel.Policy
+	if *policyFile != "" {
+		policy, err = connecttunnel.LoadPolicyFile(*policyFile)
+		if err != nil {
+			log.Fatalf("Failed to load policy: %v", err)
+		}
+		// CIDR rules check the addresses the tunnels are dialed to
+		policy.Resolver = resolver
+		log.Printf("✓ Policy loaded: %d rules (default: %s)", len(policy.Rules), policyDefault(policy))
+	}
+
+	// Open the audit log if configured
+	var audit *auditLog
+	if *auditLogSinks != "" {
+		sinks, err := parseAuditSinks(*auditLogSinks, *auditMaxSize<<20, *auditMaxBackups)
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+		audit = newAuditLog(authMethod(), sinks, logger)
+		defer func() { _ = audit.Close() }()
+		log.Printf("✓ Audit log: %s", *auditLogSinks)
+	}
+
+	// Set up packet capture if configured
+	capture, err := captureConfig()
+	if err != nil {
+		log.Fatalf("Invalid capture configuration: %v", err)
+	}
+	if capture != nil {
+		log.Printf("✓ Capturing selected tunnels to %s", capture.Dir)
+	}
+
 	// Create Tailscale server
 	ss, err := stateStore()
 	if err != nil {
@@ -185,41 +333,87 @@ func main() {
 	log.Printf("Tailscale node: %s", status.Self.DNSName)
 	log.Printf("Tailscale addresses: %v", status.Self.TailscaleIPs)
 
-	// Create the CONNECT proxy handler with tailnet-aware dialing:
+	// Serve metrics if configured
+	metrics := connecttunnel.NewMetrics()
+	if *metricsListen != "" {
+		go serveMetrics(*metricsListen, metrics)
+	}
+
+	// Create the CONNECT proxy handler with routed dialing: by default,
 	// use Tailscale for hosts on the tailnet, normal network for internet hosts.
-	netDialer := &net.Dialer{}
-	proxyHandler := connecttunnel.NewHandler(&connecttunnel.ServerConfig{
+	// Upstream names are resolved once per TTL, shared by the tailnet
+	// routing decision and the private address check.
+	var netDialer connecttunnel.Dialer = resolver
+	if guard != nil {
+		netDialer = guard
+	}
+	routes.bindSources(resolver, guard)
+	tunnelCfg := &connecttunnel.ServerConfig{
+		Policy:      policy,
+		Capture:     capture,
+		Metrics:     metrics,
+		IdleTimeout: *idleTimeout,
+		MaxLifetime: *maxLifetime,
+		TunnelBandwidth: connecttunnel.Bandwidth{
+			Upload:   *uploadLimit,
+			Download: *downloadLimit,
+		},
+		IdentityBandwidth: connecttunnel.Bandwidth{
+			Upload:   *userUploadLimit,
+			Download: *userDownloadLimit,
+		},
+		MaxTunnels:            *maxTunnels,
+		MaxTunnelsPerClient:   *maxTunnelsPerClient,
+		MaxTunnelsPerIdentity: *maxTunnelsPerUser,
+		UpstreamProxyProtocol: *upstreamProxyProtocol,
+		ReverseDomain:         *reverseDomain,
 		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
 			host, _, err := net.SplitHostPort(address)
 			if err != nil {
 				host = address
 			}
-			if useTailscaleDial(ctx, lc, host) {
-				if *verbose {
-					log.Printf("Dialing via Tailscale: %s %s", network, address)
+			r := routes.match(connecttunnel.Identity(ctx), address)
+			action := r.Action
+			if action == actionAuto {
+				action = actionDirect
+				if useTailscaleDial(ctx, lc, resolver, host) {
+					action = actionTailnet
+				}
+			}
+			// Upstream proxies resolve and dial the target themselves, so
+			// the private address guard doesn't apply to them
+			var dial connecttunnel.DialFunc
+			switch action {
+			case actionTailnet:
+				dial = srv.Dial
+			case actionDirect:
+				dial = netDialer.DialContext
+			case actionSource:
+				dial = r.Dialer.DialContext
+			case actionUpstream:
+				dial = r.DialContext
+			case actionReject:
+				dial = func(context.Context, string, string) (net.Conn, error) {
+					return nil, r.rejected()
 				}
-				return srv.Dial(ctx, network, address)
 			}
-			if *verbose {
-				log.Printf("Dialing via network: %s %s", network, address)
+			route := r.label(action)
+			metrics.RecordRoute(route)
+			logger.DebugContext(ctx, "dialing upstream", "route", route, "network", network, "target", address, "user", connecttunnel.Identity(ctx))
+			conn, err := dial(ctx, network, address)
+			if err == nil {
+				audit.dialed(ctx, route, conn)
 			}
-			return netDialer.DialContext(ctx, network, address)
+			return conn, err
 		},
 		OnTunnel: func(ctx context.Context, req *http.Request) error {
-			// Extract target for logging
-			target := req.Host
-			if target == "" {
-				target = req.RequestURI
-			}
-
 			// OIDC authentication
 			if oidcProvider != nil {
 				token, err := extractBearerToken(req)
 				if err != nil {
-					if *verbose {
-						log.Printf("No valid bearer token from %s: %v", req.RemoteAddr, err)
-					}
-					return connecttunnel.ErrTunnelRejected
+					metrics.RecordAuthFailure("missing_token")
+					logger.DebugContext(ctx, "authentication failed", "remote_addr", req.RemoteAddr, "reason", "missing_token", "error", err)
+					return authRequired("", "missing bearer token")
 				}
 
 				// Create validator with audience
@@ -229,32 +423,23 @@ func main() {
 					ExpectedIssuer:   &issuer,
 				})
 				if err != nil {
-					log.Printf("Failed to create validator: %v", err)
+					metrics.RecordAuthFailure("internal_error")
+					logger.ErrorContext(ctx, "failed to create validator", "error", err)
 					return connecttunnel.ErrTunnelRejected
 				}
 
 				// Verify and decode the token
 				verifiedJWT, err := oidcProvider.VerifyAndDecodeContext(ctx, token, validator)
 				if err != nil {
-					if *verbose {
-						log.Printf("Token verification failed from %s: %v", req.RemoteAddr, err)
-					}
-					return connecttunnel.ErrTunnelRejected
+					metrics.RecordAuthFailure("invalid_token")
+					logger.DebugContext(ctx, "authentication failed", "remote_addr", req.RemoteAddr, "reason", "invalid_token", "error", err)
+					return authRequired("invalid_token", "invalid bearer token")
 				}
 
-				// Extract subject and email for logging
-				subject, _ := verifiedJWT.Subject()
-
-				// Try to get email from custom claims
-				email, _ := verifiedJWT.StringClaim("email")
-
-				// Log authenticated tunnel with user identity
-				user := email
-				if user == "" {
-					user = subject
-				}
-				log.Printf("Tunnel: %s (%s) -> %s (proto: %s)", req.RemoteAddr, user, target, req.Proto)
-				return nil
+				// Attach the verified principal, which Dial, the logs and the
+				// audit log share
+				connecttunnel.SetTunnelInfo(ctx, tunnelInfo(verifiedJWT))
+				return authorizeReverse(ctx, req, owners)
 			}
 
 			// Simple bearer token authentication
@@ -262,19 +447,24 @@ func main() {
 				token := req.Header.Get("Proxy-Authorization")
 				expectedToken := "Bearer " + *authToken
 				if token != expectedToken {
-					if *verbose {
-						log.Printf("Authentication failed from %s (got: %q)", req.RemoteAddr, token)
-					}
-					return connecttunnel.ErrTunnelRejected
+					metrics.RecordAuthFailure("invalid_token")
+					logger.DebugContext(ctx, "authentication failed", "remote_addr", req.RemoteAddr, "reason", "invalid_token")
+					return authRequired("invalid_token", "invalid bearer token")
 				}
 			}
 
-			// Log tunnel requests (unauthenticated or simple auth)
-			log.Printf("Tunnel: %s -> %s (proto: %s)", req.RemoteAddr, target, req.Proto)
-			return nil
+			return authorizeReverse(ctx, req, owners)
 		},
-		ErrorLog: log.Default(),
-	})
+		Logger: logger,
+	}
+	if *upstreamProxyIdentity {
+		tunnelCfg.ProxyIdentityTLV = connecttunnel.ProxyTLVIdentity
+	}
+	if audit != nil {
+		tunnelCfg.OnTunnelEnd = audit.tunnelEnded
+		tunnelCfg.OnTunnelReject = audit.tunnelRejected
+	}
+	proxyHandler := connecttunnel.NewHandler(tunnelCfg)
 
 	tlsConfig := &tls.Config{
 		GetCertificate: lc.GetCertificate,
@@ -284,7 +474,7 @@ func main() {
 	// Create HTTP server
 	httpServer := &http.Server{
 		Handler:   proxyHandler,
-		ErrorLog:  log.Default(),
+		ErrorLog:  slog.NewLogLogger(logger.Handler(), slog.LevelError),
 		TLSConfig: tlsConfig,
 	}
 
@@ -311,12 +501,22 @@ func main() {
 
 	log.Println("✓ Server ready - press Ctrl+C to stop")
 
-	// Handle graceful shutdown
+	// Handle graceful shutdown, draining open tunnels
+	stopped := make(chan struct{})
 	go func() {
+		defer close(stopped)
 		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 		<-sigChan
-		log.Println("\nShutting down gracefully...")
+		log.Printf("Shutting down gracefully, draining %d tunnels (timeout: %s)...", tunnelCfg.ActiveTunnels(), *drainTimeout)
+
+		ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+		defer cancel()
+		// Stop accepting connections while the tunnels drain
+		go func() { _ = httpServer.Shutdown(ctx) }()
+		if err := tunnelCfg.Shutdown(ctx); err != nil {
+			log.Printf("Drain timeout reached, closed remaining tunnels")
+		}
 		_ = httpServer.Close()
 	}()
 
@@ -324,10 +524,152 @@ func main() {
 	if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Server error: %v", err)
 	}
+	<-stopped
 
 	log.Println("Server stopped")
 }
 
+// newLogger creates the structured logger for the given -log-format.
+func newLogger(format string, verbose bool) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: slog.LevelInfo}
+	if verbose {
+		opts.Level = slog.LevelDebug
+	}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid -log-format %q (must be text or json)", format)
+	}
+}
+
+// serveMetrics serves metrics at /metrics on addr.
+func serveMetrics(addr string, metrics *connecttunnel.Metrics) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	log.Printf("✓ Metrics listening on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("Metrics server error: %v", err)
+	}
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// tunnelInfo returns the principal a verified ID token is for: its subject,
+// email, groups claim and all its claims. The identity is the email, or the
+// subject if there is none.
+func tunnelInfo(verified *jwt.VerifiedJWT) connecttunnel.TunnelInfo {
+	var info connecttunnel.TunnelInfo
+	info.Subject, _ = verified.Subject()
+	info.Email, _ = verified.StringClaim("email")
+	if groups, err := verified.ArrayClaim("groups"); err == nil {
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				info.Groups = append(info.Groups, s)
+			}
+		}
+	}
+	if payload, err := verified.JSONPayload(); err == nil {
+		_ = json.Unmarshal(payload, &info.Claims)
+	}
+	return info
+}
+
+// captureConfig returns the packet capture configured by the -capture flags,
+// creating the directory, or nil if -capture-dir isn't set.
+func captureConfig() (*connecttunnel.Capture, error) {
+	if *captureDir == "" {
+		return nil, nil
+	}
+	capture := &connecttunnel.Capture{
+		Dir:         *captureDir,
+		Targets:     splitList(*captureTargets),
+		Identities:  splitList(*captureUsers),
+		MaxBytes:    *captureMaxSize << 20,
+		MaxDuration: *captureMaxDuration,
+	}
+	if len(capture.Targets) == 0 && len(capture.Identities) == 0 {
+		return nil, fmt.Errorf("-capture-dir requires -capture-targets or -capture-users")
+	}
+	if *captureFor > 0 {
+		capture.Until = time.Now().Add(*captureFor)
+	}
+	if err := capture.Validate(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(capture.Dir, 0o700); err != nil {
+		return nil, err
+	}
+	return capture, nil
+}
+
+// parsePrefixes parses a comma-separated list of CIDR prefixes.
+func parsePrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(c)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+// authorizeReverse checks that the tunnel's user may use the reverse tunnel
+// listener name of a reverse listener request. Other requests are allowed.
+func authorizeReverse(ctx context.Context, req *http.Request, owners *reverseOwners) error {
+	name, ok := connecttunnel.ReverseListenName(req)
+	if !ok {
+		return nil
+	}
+	return owners.authorize(name, connecttunnel.Identity(ctx))
+}
+
+// egressResolver returns the resolver for upstream targets and the private
+// address check for direct tunnels, or nil if -allow-private disables it.
+func egressResolver() (*connecttunnel.CachingResolver, *connecttunnel.GuardedDialer, error) {
+	prefer, err := connecttunnel.ParseIPPreference(*ipPreference)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid -ip-preference: %w", err)
+	}
+	resolver := &connecttunnel.CachingResolver{
+		Nameservers: splitList(*dnsServers),
+		Prefer:      prefer,
+	}
+	if *allowPrivate {
+		return resolver, nil, nil
+	}
+	allow, err := parsePrefixes(*allowCIDRs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid -allow-cidrs: %w", err)
+	}
+	return resolver, &connecttunnel.GuardedDialer{Allow: allow, Resolver: resolver}, nil
+}
+
+// policyDefault returns the action a policy takes when no rule matches.
+func policyDefault(p *connecttunnel.Policy) connecttunnel.PolicyAction {
+	if p.Default == "" {
+		return connecttunnel.PolicyDeny
+	}
+	return p.Default
+}
+
 // extractBearerToken extracts a bearer token from Authorization or Proxy-Authorization headers.
 func extractBearerToken(req *http.Request) (string, error) {
 	// Try Proxy-Authorization first (standard for CONNECT)
@@ -350,6 +692,21 @@ func extractBearerToken(req *http.Request) (string, error) {
 	return strings.TrimPrefix(auth, prefix), nil
 }
 
+// authRequired rejects a tunnel with 407 Proxy Authentication Required,
+// challenging the client for a bearer token. bearerError is the RFC 6750
+// error code, if any.
+func authRequired(bearerError, reason string) error {
+	challenge := "Bearer"
+	if bearerError != "" {
+		challenge += fmt.Sprintf(" error=%q", bearerError)
+	}
+	return &connecttunnel.RejectionError{
+		StatusCode: http.StatusProxyAuthRequired,
+		Header:     http.Header{"Proxy-Authenticate": {challenge}},
+		Reason:     reason,
+	}
+}
+
 func stateStore() (ipn.StateStore, error) {
 	var kubeConfig *rest.Config
 	if *kubeconfig != "" {
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	connecttunnel "lds.li/netrelay/connect"
+)
+
+// reverseOwners decides which users may register which reverse tunnel
+// listener names. With an allowlist, a name may only be registered by the
+// identities listed for it, and unlisted names are refused. Without one, a
+// name is bound to the first identity that registers it for as long as the
+// relay runs, so nobody else can take it over when its owner disconnects.
+type reverseOwners struct {
+	allow map[string][]string // name to identity glob patterns
+
+	mu    sync.Mutex
+	bound map[string]string
+}
+
+// checkReverseAuth returns an error unless reverse tunnels, enabled by a
+// non-empty -reverse-domain, authenticate users with OIDC. Names are owned
+// by identities, and a static -auth token doesn't tell its holders apart.
+func checkReverseAuth(reverseDomain, oidcIssuer string) error {
+	if reverseDomain != "" && oidcIssuer == "" {
+		return errors.New("-reverse-domain requires -oidc-issuer, so names can be bound to the users that register them")
+	}
+	return nil
+}
+
+// parseReverseOwners parses a -reverse-owners allowlist of comma-separated
+// name=identity pairs. A name can be listed more than once.
+func parseReverseOwners(s string) (*reverseOwners, error) {
+	o := &reverseOwners{bound: make(map[string]string)}
+	for _, entry := range splitList(s) {
+		name, pattern, ok := strings.Cut(entry, "=")
+		name, pattern = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(pattern)
+		if !ok || name == "" || pattern == "" {
+			return nil, fmt.Errorf("invalid entry %q (want name=identity)", entry)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q", pattern)
+		}
+		if o.allow == nil {
+			o.allow = make(map[string][]string)
+		}
+		o.allow[name] = append(o.allow[name], pattern)
+	}
+	return o, nil
+}
+
+// authorize returns an error rejecting a reverse listener request for name
+// by identity, unless identity may use the name. Tunnels without an identity
+// can't own names.
+func (o *reverseOwners) authorize(name, identity string) error {
+	if identity == "" {
+		return o.reject(name)
+	}
+	if o.allow != nil {
+		for _, pattern := range o.allow[name] {
+			if ok, _ := path.Match(pattern, identity); ok {
+				return nil
+			}
+		}
+		return o.reject(name)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	owner, ok := o.bound[name]
+	if !ok {
+		o.bound[name] = identity
+		return nil
+	}
+	if owner != identity {
+		return o.reject(name)
+	}
+	return nil
+}
+
+func (o *reverseOwners) reject(name string) error {
+	return &connecttunnel.RejectionError{Reason: fmt.Sprintf("not allowed to use reverse listener name %q", name)}
+}
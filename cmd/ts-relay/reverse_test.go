@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	connecttunnel "lds.li/netrelay/connect"
+)
+
+func TestReverseOwners(t *testing.T) {
+	// Without an allowlist, the first user to register a name keeps it
+	owners, err := parseReverseOwners("")
+	if err != nil {
+		t.Fatalf("parseReverseOwners failed: %v", err)
+	}
+	if err := owners.authorize("web", "alice@example.com"); err != nil {
+		t.Fatalf("First registration rejected: %v", err)
+	}
+	if err := owners.authorize("web", "bob@example.com"); !errors.Is(err, connecttunnel.ErrTunnelRejected) {
+		t.Errorf("Second user claiming a taken name = %v, want a rejection", err)
+	}
+	if err := owners.authorize("web", "alice@example.com"); err != nil {
+		t.Errorf("Owner re-registering rejected: %v", err)
+	}
+	if err := owners.authorize("api", "bob@example.com"); err != nil {
+		t.Errorf("Registration of a free name rejected: %v", err)
+	}
+
+	// With one, only the listed identities can use a name, and unlisted
+	// names can't be claimed
+	owners, err = parseReverseOwners("web=alice@example.com, web=*@ops.example.com,api=bob@example.com")
+	if err != nil {
+		t.Fatalf("parseReverseOwners failed: %v", err)
+	}
+	tests := []struct {
+		name, identity string
+		want           bool
+	}{
+		{"web", "alice@example.com", true},
+		{"web", "carol@ops.example.com", true},
+		{"web", "bob@example.com", false},
+		{"api", "bob@example.com", true},
+		{"unowned", "alice@example.com", false},
+		{"web", "", false},
+	}
+	for _, tt := range tests {
+		if err := owners.authorize(tt.name, tt.identity); (err == nil) != tt.want {
+			t.Errorf("authorize(%q, %q) = %v, want allowed %v", tt.name, tt.identity, err, tt.want)
+		}
+	}
+
+	// Static -auth tunnels have no identity, so they can't take a name over
+	// from its owner, or claim one through a catch-all pattern
+	owners, _ = parseReverseOwners("")
+	if err := owners.authorize("web", ""); err == nil {
+		t.Error("Tunnel without an identity registered a name")
+	}
+	if err := owners.authorize("web", ""); err == nil {
+		t.Error("Second tunnel without an identity registered the same name")
+	}
+	owners, _ = parseReverseOwners("web=*")
+	if err := owners.authorize("web", ""); err == nil {
+		t.Error("Tunnel without an identity matched a catch-all pattern")
+	}
+
+	for _, invalid := range []string{"web", "=alice", "web=[", "web="} {
+		if _, err := parseReverseOwners(invalid); err == nil {
+			t.Errorf("parseReverseOwners(%q) succeeded", invalid)
+		}
+	}
+}
+
+func TestCheckReverseAuth(t *testing.T) {
+	tests := []struct {
+		reverseDomain, oidcIssuer string
+		wantErr                   bool
+	}{
+		{"", "", false},
+		{"reverse.internal", "https://accounts.example.com", false},
+		// -auth alone doesn't tell users apart
+		{"reverse.internal", "", true},
+	}
+	for _, tt := range tests {
+		if err := checkReverseAuth(tt.reverseDomain, tt.oidcIssuer); (err != nil) != tt.wantErr {
+			t.Errorf("checkReverseAuth(%q, %q) = %v, want error %v", tt.reverseDomain, tt.oidcIssuer, err, tt.wantErr)
+		}
+	}
+}
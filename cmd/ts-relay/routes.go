@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	connecttunnel "lds.li/netrelay/connect"
+	"tailscale.com/net/tsaddr"
+)
+
+// routeAction is what an egress route does with the tunnels it matches.
+type routeAction string
+
+const (
+	// actionAuto dials tailnet peers over Tailscale and everything else
+	// directly. It is the default for tunnels no route matches.
+	actionAuto routeAction = "auto"
+
+	// actionTailnet dials over Tailscale.
+	actionTailnet routeAction = "tailnet"
+
+	// actionDirect dials over the host network, subject to the private
+	// address check.
+	actionDirect routeAction = "direct"
+
+	// actionSource dials over the host network from a given local address.
+	actionSource routeAction = "source"
+
+	// actionUpstream dials through an upstream proxy.
+	actionUpstream routeAction = "upstream"
+
+	// actionReject refuses the tunnel with 403 Forbidden.
+	actionReject routeAction = "reject"
+)
+
+// routesConfig is the -routes file: the upstream proxies tunnels can be sent
+// through, and the ordered egress routing table.
+type routesConfig struct {
+	Upstreams map[string]upstreamConfig `json:"upstreams"`
+	Routes    []routeConfig             `json:"routes"`
+
+	// Default is the action for tunnels no route matches: auto (the
+	// default), tailnet, direct or reject.
+	Default routeAction `json:"default,omitempty"`
+}
+
+// routeConfig is an egress route. The conditions work like those of policy
+// rules.
+type routeConfig struct {
+	Name       string                    `json:"name"`
+	Hosts      []string                  `json:"hosts,omitempty"`
+	Domains    []string                  `json:"domains,omitempty"`
+	CIDRs      []netip.Prefix            `json:"cidrs,omitempty"`
+	Ports      []connecttunnel.PortRange `json:"ports,omitempty"`
+	Identities []string                  `json:"identities,omitempty"`
+
+	// Action defaults to upstream if Upstream is set.
+	Action routeAction `json:"action,omitempty"`
+
+	// Upstream names the upstream proxy of an upstream route.
+	Upstream string `json:"upstream,omitempty"`
+
+	// Source is the local address a source route dials from.
+	Source netip.Addr `json:"source,omitzero"`
+}
+
+// egressRoute is a loaded egress route. The embedded UpstreamRoute holds its
+// name and conditions, and its dialer for upstream and source routes.
+type egressRoute struct {
+	connecttunnel.UpstreamRoute
+	Action   routeAction
+	Upstream string
+	Source   netip.Addr
+}
+
+// routeTable is the egress routing table. Routes are evaluated in order, and
+// the first match decides how the tunnel is dialed.
+type routeTable struct {
+	Routes  []egressRoute
+	Default egressRoute
+}
+
+// newRouteTable returns a table with no routes, dialing tailnet peers over
+// Tailscale and everything else directly.
+func newRouteTable() *routeTable {
+	return &routeTable{Default: egressRoute{Action: actionAuto}}
+}
+
+// loadRoutes reads a -routes file. Credentials files are read once, at
+// startup.
+func loadRoutes(name string) (*routeTable, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var cfg routesConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", name, err)
+	}
+
+	dialers := make(map[string]connecttunnel.Dialer)
+	for upstreamName, u := range cfg.Upstreams {
+		d, err := u.dialer()
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %w", upstreamName, err)
+		}
+		dialers[upstreamName] = d
+	}
+
+	table := newRouteTable()
+	switch cfg.Default {
+	case "":
+	case actionAuto, actionTailnet, actionDirect, actionReject:
+		table.Default.Action = cfg.Default
+	default:
+		return nil, fmt.Errorf("invalid default action %q (must be auto, tailnet, direct or reject)", cfg.Default)
+	}
+	for i, r := range cfg.Routes {
+		route, err := r.load(i, dialers)
+		if err != nil {
+			return nil, fmt.Errorf("route %d (%s): %w", i, r.Name, err)
+		}
+		table.Routes = append(table.Routes, route)
+	}
+	return table, nil
+}
+
+// load validates the i'th route and resolves its upstream.
+func (r *routeConfig) load(i int, dialers map[string]connecttunnel.Dialer) (egressRoute, error) {
+	route := egressRoute{
+		UpstreamRoute: connecttunnel.UpstreamRoute{
+			Name:       r.Name,
+			Hosts:      r.Hosts,
+			Domains:    r.Domains,
+			CIDRs:      r.CIDRs,
+			Ports:      r.Ports,
+			Identities: r.Identities,
+		},
+		Action:   r.Action,
+		Upstream: r.Upstream,
+		Source:   r.Source,
+	}
+	for _, pat := range append(append([]string{}, r.Hosts...), r.Identities...) {
+		if _, err := path.Match(pat, ""); err != nil {
+			return route, fmt.Errorf("invalid pattern %q", pat)
+		}
+	}
+	if route.Action == "" && r.Upstream != "" {
+		route.Action = actionUpstream
+	}
+	if (route.Action == actionUpstream) != (r.Upstream != "") {
+		return route, fmt.Errorf("upstream is required for, and only allowed with, the upstream action")
+	}
+	if (route.Action == actionSource) != r.Source.IsValid() {
+		return route, fmt.Errorf("source is required for, and only allowed with, the source action")
+	}
+	switch route.Action {
+	case actionTailnet, actionDirect, actionSource, actionReject:
+	case actionUpstream:
+		d, ok := dialers[r.Upstream]
+		if !ok {
+			return route, fmt.Errorf("unknown upstream %q", r.Upstream)
+		}
+		route.Dialer = d
+	case "":
+		return route, fmt.Errorf("action is required")
+	default:
+		return route, fmt.Errorf("invalid action %q (must be tailnet, direct, source, upstream or reject)", route.Action)
+	}
+	if route.Name == "" {
+		route.Name = r.Upstream
+		if route.Name == "" {
+			route.Name = strconv.Itoa(i)
+		}
+	}
+	return route, nil
+}
+
+// match returns the route for a tunnel to target by identity: the first
+// matching route, or the default route.
+func (t *routeTable) match(identity, target string) *egressRoute {
+	for i := range t.Routes {
+		if t.Routes[i].Match(identity, target) {
+			return &t.Routes[i]
+		}
+	}
+	return &t.Default
+}
+
+// label returns the route name used in logs, metrics and the audit log for a
+// tunnel the route dialed with action: the action, followed by the route's
+// name unless it is the default route.
+func (r *egressRoute) label(action routeAction) string {
+	if r.Name == "" {
+		return string(action)
+	}
+	return string(action) + ":" + r.Name
+}
+
+// rejected returns the error for a tunnel refused by a reject route. The
+// route may have matched on a hostname, identity or port, so it is reported
+// as a denied request rather than a prohibited destination address.
+func (r *egressRoute) rejected() error {
+	return &connecttunnel.RejectionError{Reason: fmt.Sprintf("rejected by route %q", r.label(actionReject))}
+}
+
+// bindSources sets the dialers of source routes, given the private address
+// check of direct tunnels (nil if disabled).
+func (t *routeTable) bindSources(resolver connecttunnel.Resolver, guard *connecttunnel.GuardedDialer) {
+	for i := range t.Routes {
+		if r := &t.Routes[i]; r.Action == actionSource {
+			r.Dialer = newSourceDialer(r.Source, resolver, guard)
+		}
+	}
+}
+
+// sourceDialer dials from a local address, resolving and vetting targets like
+// direct tunnels. Only targets in the source address's family are dialed.
+type sourceDialer struct {
+	source netip.Addr
+	guard  *connecttunnel.GuardedDialer
+}
+
+func newSourceDialer(source netip.Addr, resolver connecttunnel.Resolver, guard *connecttunnel.GuardedDialer) *sourceDialer {
+	d := &sourceDialer{source: source, guard: &connecttunnel.GuardedDialer{Resolver: resolver}}
+	if guard != nil {
+		d.guard.Allow = guard.Allow
+		d.guard.Deny = guard.Deny
+	} else {
+		// The private address check is disabled
+		d.guard.Deny = []netip.Prefix{}
+	}
+	d.guard.Dial = d.dialLocal
+	return d
+}
+
+func (d *sourceDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "udp":
+		if d.source.Is4() {
+			network += "4"
+		} else {
+			network += "6"
+		}
+	}
+	return d.guard.DialContext(ctx, network, address)
+}
+
+// dialLocal dials a vetted address from the source address.
+func (d *sourceDialer) dialLocal(ctx context.Context, network, address string) (net.Conn, error) {
+	var nd net.Dialer
+	if strings.HasPrefix(network, "udp") {
+		nd.LocalAddr = &net.UDPAddr{IP: d.source.AsSlice(), Zone: d.source.Zone()}
+	} else {
+		nd.LocalAddr = &net.TCPAddr{IP: d.source.AsSlice(), Zone: d.source.Zone()}
+	}
+	return nd.DialContext(ctx, network, address)
+}
+
+// explainRoute writes which route a tunnel to target by identity would take,
+// for the route subcommand. Hostnames are resolved with resolver to apply the
+// private address check (guard, nil if disabled) and the tailnet address
+// check; tailnet peer names can't be checked without joining the tailnet.
+func explainRoute(w io.Writer, table *routeTable, resolver connecttunnel.Resolver, guard *connecttunnel.GuardedDialer, target, identity string) error {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return fmt.Errorf("invalid target %q: %w", target, err)
+	}
+	r := table.match(identity, target)
+	routeName := r.Name
+	if routeName == "" {
+		routeName = "(default)"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var addrs []netip.Addr
+	var lookupErr error
+	if ip, err := netip.ParseAddr(host); err == nil {
+		addrs = []netip.Addr{ip}
+	} else if r.Action != actionUpstream && r.Action != actionReject {
+		addrs, lookupErr = resolver.LookupNetIP(ctx, "ip", host)
+	}
+
+	action := r.Action
+	var detail string
+	if action == actionAuto {
+		action = actionDirect
+		for _, ip := range addrs {
+			if tsaddr.IsTailscaleIP(ip) {
+				action = actionTailnet
+				detail = fmt.Sprintf("%s is a tailnet address", ip)
+				break
+			}
+		}
+		if action == actionDirect && net.ParseIP(host) == nil {
+			detail = "not a tailnet address; tailnet if it names a tailnet peer"
+		}
+	}
+	switch action {
+	case actionDirect, actionSource:
+		if action == actionSource {
+			detail = "from " + r.Source.String()
+		}
+		switch {
+		case lookupErr != nil:
+			detail = joinDetail(detail, "lookup failed: "+lookupErr.Error())
+		case guard != nil:
+			for _, ip := range addrs {
+				if !guard.Permitted(ip) {
+					detail = joinDetail(detail, fmt.Sprintf("refused: %s is a private or reserved address", ip))
+					break
+				}
+			}
+		}
+	case actionUpstream:
+		detail = "via " + r.Upstream
+	case actionReject:
+		detail = "refused with 403 Forbidden"
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintf(tw, "TARGET\tIDENTITY\tROUTE\tACTION\tDETAIL\n")
+	if identity == "" {
+		identity = "-"
+	}
+	_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", target, identity, routeName, action, detail)
+	return tw.Flush()
+}
+
+// joinDetail joins two explanations.
+func joinDetail(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "; " + b
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	connecttunnel "lds.li/netrelay/connect"
+)
+
+// staticResolver resolves every name to the same addresses.
+type staticResolver []netip.Addr
+
+func (r staticResolver) LookupNetIP(context.Context, string, string) ([]netip.Addr, error) {
+	return r, nil
+}
+
+func TestLoadRoutes(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		t.Helper()
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(data), 0o600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		return p
+	}
+	write("token", "hop-token\n")
+
+	table, err := loadRoutes(write("routes.json", `{
+		"upstreams": {
+			"corp": {"url": "http://proxy.example.com:3128", "username": "relay", "password": "pw"},
+			"hop": {"url": "https://relay.example.com", "protocol": "h2", "token_file": "`+filepath.Join(dir, "token")+`"},
+			"socks": {"url": "socks5://10.0.0.9:1080"}
+		},
+		"default": "direct",
+		"routes": [
+			{"name": "metadata", "cidrs": ["169.254.0.0/16"], "action": "reject"},
+			{"name": "dc2", "cidrs": ["10.40.0.0/16"], "upstream": "hop"},
+			{"domains": ["corp.example.com"], "ports": ["443"], "upstream": "corp"},
+			{"name": "contractors", "identities": ["*@contractor.example.com"], "upstream": "socks"},
+			{"name": "peers", "domains": ["ts.net"], "action": "tailnet"},
+			{"name": "smtp", "ports": ["25"], "action": "source", "source": "192.0.2.10"}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("loadRoutes failed: %v", err)
+	}
+	tests := []struct {
+		identity, target string
+		want             string
+	}{
+		{"", "169.254.169.254:80", "reject:metadata"},
+		{"", "10.40.1.2:22", "upstream:dc2"},
+		{"", "www.corp.example.com:443", "upstream:corp"},
+		{"", "www.corp.example.com:80", "direct"},
+		{"eve@contractor.example.com", "example.com:443", "upstream:contractors"},
+		{"", "db.tail1234.ts.net:5432", "tailnet:peers"},
+		{"", "mail.example.com:25", "source:smtp"},
+		{"", "example.com:443", "direct"},
+	}
+	for _, tt := range tests {
+		r := table.match(tt.identity, tt.target)
+		if got := r.label(r.Action); got != tt.want {
+			t.Errorf("match(%q, %q) = %q, want %q", tt.identity, tt.target, got, tt.want)
+		}
+	}
+	r := table.match("", "169.254.169.254:80")
+	if err := r.rejected(); !errors.Is(err, connecttunnel.ErrTunnelRejected) || errors.Is(err, connecttunnel.ErrDestinationDenied) {
+		t.Errorf("Reject error = %v, want a rejection", err)
+	}
+
+	// Without a file, tailnet peers are told apart from everything else
+	if r := newRouteTable().match("", "example.com:443"); r.label(r.Action) != "auto" {
+		t.Errorf("Default route = %q, want auto", r.label(r.Action))
+	}
+
+	invalid := map[string]string{
+		"unknown upstream":   `{"routes": [{"upstream": "missing"}]}`,
+		"bad scheme":         `{"upstreams": {"x": {"url": "ftp://example.com"}}}`,
+		"h2 over http":       `{"upstreams": {"x": {"url": "http://example.com", "protocol": "h2"}}}`,
+		"token and user":     `{"upstreams": {"x": {"url": "http://example.com", "token": "t", "username": "u"}}}`,
+		"bad pattern":        `{"routes": [{"hosts": ["["], "action": "direct"}]}`,
+		"bad port":           `{"routes": [{"ports": ["http"], "action": "direct"}]}`,
+		"missing action":     `{"routes": [{"ports": ["22"]}]}`,
+		"unknown action":     `{"routes": [{"action": "drop"}]}`,
+		"source without IP":  `{"routes": [{"action": "source"}]}`,
+		"stray upstream":     `{"upstreams": {"x": {"url": "http://example.com"}}, "routes": [{"action": "direct", "upstream": "x"}]}`,
+		"bad default":        `{"default": "source"}`,
+		"source in a string": `{"routes": [{"action": "source", "source": "not-an-ip"}]}`,
+	}
+	for name, data := range invalid {
+		if _, err := loadRoutes(write(strings.ReplaceAll(name, " ", "-")+".json", data)); err == nil {
+			t.Errorf("loadRoutes accepted a config with a %s", name)
+		}
+	}
+}
+
+func TestExplainRoute(t *testing.T) {
+	table := &routeTable{
+		Routes: []egressRoute{
+			{UpstreamRoute: connecttunnel.UpstreamRoute{Name: "corp", Domains: []string{"corp.example.com"}}, Action: actionUpstream, Upstream: "corp-proxy"},
+			{UpstreamRoute: connecttunnel.UpstreamRoute{Name: "ops", Identities: []string{"*@ops.example.com"}}, Action: actionSource, Source: netip.MustParseAddr("192.0.2.10")},
+		},
+		Default: egressRoute{Action: actionAuto},
+	}
+	guard := &connecttunnel.GuardedDialer{}
+	tests := []struct {
+		resolved         staticResolver
+		target, identity string
+		want             []string
+	}{
+		{nil, "git.corp.example.com:443", "", []string{"corp", "upstream", "via corp-proxy"}},
+		{staticResolver{netip.MustParseAddr("10.1.2.3")}, "db.example.com:5432", "alice@ops.example.com", []string{"ops", "source", "from 192.0.2.10", "refused: 10.1.2.3"}},
+		{staticResolver{netip.MustParseAddr("100.101.102.103")}, "db.example.com:5432", "", []string{"(default)", "tailnet"}},
+		{staticResolver{netip.MustParseAddr("93.184.215.14")}, "example.com:443", "", []string{"(default)", "direct", "tailnet if it names a tailnet peer"}},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := explainRoute(&buf, table, tt.resolved, guard, tt.target, tt.identity); err != nil {
+			t.Fatalf("explainRoute(%q) failed: %v", tt.target, err)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(buf.String(), want) {
+				t.Errorf("explainRoute(%q) = %q, want it to mention %q", tt.target, buf.String(), want)
+			}
+		}
+	}
+
+	if err := explainRoute(&bytes.Buffer{}, table, staticResolver{}, nil, "no-port", ""); err == nil {
+		t.Error("explainRoute accepted a target without a port")
+	}
+}
+
+// TestSourceDialer checks that source routes dial from the source address and
+// keep the private address check.
+func TestSourceDialer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer func() { _ = ln.Close() }()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	source := netip.MustParseAddr("127.0.0.1")
+	d := newSourceDialer(source, staticResolver{}, nil)
+	conn, err := d.DialContext(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	local := conn.LocalAddr().(*net.TCPAddr).AddrPort().Addr()
+	_ = conn.Close()
+	if local != source {
+		t.Errorf("Local address = %s, want %s", local, source)
+	}
+
+	d = newSourceDialer(source, staticResolver{}, &connecttunnel.GuardedDialer{})
+	if _, err := d.DialContext(context.Background(), "tcp", ln.Addr().String()); !errors.Is(err, connecttunnel.ErrDestinationDenied) {
+		t.Errorf("Dial to loopback = %v, want ErrDestinationDenied", err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	connecttunnel "lds.li/netrelay/connect"
+)
+
+// upstreamConfig is an upstream proxy and the credentials for it.
+type upstreamConfig struct {
+	// URL is an http or https URL for an HTTP CONNECT proxy or another
+	// netrelay, or a socks5 URL.
+	URL string `json:"url"`
+
+	// Protocol is the HTTP version used with an http or https upstream:
+	// "h1" (the default), "h2" (https only) or "h2c" (http only).
+	Protocol string `json:"protocol,omitempty"`
+
+	// Username and Password authenticate with HTTP Basic proxy
+	// authentication, or SOCKS5 username/password authentication.
+	// PasswordFile reads the password from a file instead.
+	Username     string `json:"username,omitempty"`
+	Password     string `json:"password,omitempty"`
+	PasswordFile string `json:"password_file,omitempty"`
+
+	// Token is sent as a bearer token to an HTTP upstream, e.g. the OIDC ID
+	// token another ts-relay expects. TokenFile reads it from a file instead.
+	Token     string `json:"token,omitempty"`
+	TokenFile string `json:"token_file,omitempty"`
+}
+
+// dialer returns the dialer that connects through the upstream.
+func (u *upstreamConfig) dialer() (connecttunnel.Dialer, error) {
+	proxyURL, err := url.Parse(u.URL)
+	if err != nil {
+		return nil, err
+	}
+	password, err := secret(u.Password, u.PasswordFile)
+	if err != nil {
+		return nil, err
+	}
+	token, err := secret(u.Token, u.TokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if proxyURL.Scheme == "socks5" {
+		if token != "" {
+			return nil, errors.New("SOCKS5 upstreams don't take a token")
+		}
+		return connecttunnel.NewSOCKS5Dialer(proxyURL.Host, u.Username, password, nil), nil
+	}
+	if proxyURL.Scheme != "http" && proxyURL.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported URL scheme %q (must be http, https or socks5)", proxyURL.Scheme)
+	}
+
+	header := make(http.Header)
+	switch {
+	case token != "" && u.Username != "":
+		return nil, errors.New("set either a token or a username, not both")
+	case token != "":
+		header.Set("Proxy-Authorization", "Bearer "+token)
+	case u.Username != "":
+		header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username+":"+password)))
+	}
+	cfg := &connecttunnel.ClientConfig{
+		ProxyURL: u.URL,
+		HeadersForRequest: func(*http.Request) (http.Header, error) {
+			return header, nil
+		},
+	}
+	switch u.Protocol {
+	case "", "h1":
+		return connecttunnel.NewH1Dialer(cfg), nil
+	case "h2":
+		if proxyURL.Scheme != "https" {
+			return nil, errors.New("h2 requires an https URL, use h2c for http")
+		}
+		return connecttunnel.NewH2Dialer(cfg), nil
+	case "h2c":
+		if proxyURL.Scheme != "http" {
+			return nil, errors.New("h2c requires an http URL, use h2 for https")
+		}
+		return connecttunnel.NewH2CDialer(cfg), nil
+	default:
+		return nil, fmt.Errorf("unsupported protocol %q (must be h1, h2 or h2c)", u.Protocol)
+	}
+}
+
+// secret returns value, or the trimmed contents of file if it is set.
+func secret(value, file string) (string, error) {
+	if file == "" {
+		return value, nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
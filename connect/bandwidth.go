@@ -0,0 +1,159 @@
+package connect
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+)
+
+// Bandwidth is a pair of token-bucket rate limits, in bytes per second. Zero
+// means unlimited. Up to a second's worth of bytes may be copied in a burst.
+type Bandwidth struct {
+	// Upload limits copying from the client to upstream.
+	Upload int64
+
+	// Download limits copying from upstream to the client.
+	Download int64
+}
+
+// newLimiter returns a limiter for bytesPerSec, or nil if it is unlimited.
+func newLimiter(bytesPerSec int64) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), int(bytesPerSec))
+}
+
+// sharedBandwidth is the limiters shared by the tunnels of an identity.
+type sharedBandwidth struct {
+	upload, download *rate.Limiter
+	refs             int
+}
+
+// identityBandwidth hands out the per-identity limiters, dropping them once
+// the identity's last tunnel has closed.
+type identityBandwidth struct {
+	mu         sync.Mutex
+	identities map[string]*sharedBandwidth
+}
+
+// acquire returns the limiters for identity, creating them with limit.
+func (b *identityBandwidth) acquire(identity string, limit Bandwidth) *sharedBandwidth {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.identities == nil {
+		b.identities = make(map[string]*sharedBandwidth)
+	}
+	s, ok := b.identities[identity]
+	if !ok {
+		s = &sharedBandwidth{upload: newLimiter(limit.Upload), download: newLimiter(limit.Download)}
+		b.identities[identity] = s
+	}
+	s.refs++
+	return s
+}
+
+// release drops a tunnel's reference to the limiters for identity.
+func (b *identityBandwidth) release(identity string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s, ok := b.identities[identity]; ok {
+		s.refs--
+		if s.refs == 0 {
+			delete(b.identities, identity)
+		}
+	}
+}
+
+// throttle waits until n bytes are allowed by every limiter. Waits larger
+// than a limiter's burst are split up.
+func throttle(ctx context.Context, limiters []*rate.Limiter, n int) error {
+	for _, l := range limiters {
+		for left := n; left > 0; {
+			chunk := min(left, l.Burst())
+			if err := l.WaitN(ctx, chunk); err != nil {
+				return err
+			}
+			left -= chunk
+		}
+	}
+	return nil
+}
+
+// throttledReader slows reads from r down to the limiters' rates.
+type throttledReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*rate.Limiter
+
+	// waiting counts the reads waiting on the limiters. The bytes were
+	// read, so the tunnel isn't idle while they wait.
+	waiting *atomic.Int32
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if n > 0 {
+		t.waiting.Add(1)
+		werr := throttle(t.ctx, t.limiters, n)
+		t.waiting.Add(-1)
+		if werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// limitBandwidth sets up the tunnel's limiters, sharing the identity limiters
+// with the identity's other tunnels.
+func (t *serverTunnel) limitBandwidth() {
+	t.limitCtx, t.stopLimits = context.WithCancel(context.Background())
+	if l := newLimiter(t.cfg.TunnelBandwidth.Upload); l != nil {
+		t.uploadLimits = append(t.uploadLimits, l)
+	}
+	if l := newLimiter(t.cfg.TunnelBandwidth.Download); l != nil {
+		t.downloadLimits = append(t.downloadLimits, l)
+	}
+
+	limit := t.cfg.IdentityBandwidth
+	if t.stats.Identity == "" || (limit.Upload <= 0 && limit.Download <= 0) {
+		return
+	}
+	s := t.cfg.bandwidth.acquire(t.stats.Identity, limit)
+	t.sharedLimits = true
+	if s.upload != nil {
+		t.uploadLimits = append(t.uploadLimits, s.upload)
+	}
+	if s.download != nil {
+		t.downloadLimits = append(t.downloadLimits, s.download)
+	}
+}
+
+// releaseBandwidth stops any waits on the tunnel's limiters and releases the
+// identity limiters.
+func (t *serverTunnel) releaseBandwidth() {
+	t.stopLimits()
+	if t.sharedLimits {
+		t.cfg.bandwidth.release(t.stats.Identity)
+	}
+}
+
+// upload returns r, reading from the client, throttled to the upload limits.
+func (t *serverTunnel) upload(r io.Reader) io.Reader {
+	if len(t.uploadLimits) == 0 {
+		return r
+	}
+	return &throttledReader{ctx: t.limitCtx, r: r, limiters: t.uploadLimits, waiting: &t.throttled}
+}
+
+// download returns r, reading from upstream, throttled to the download
+// limits.
+func (t *serverTunnel) download(r io.Reader) io.Reader {
+	if len(t.downloadLimits) == 0 {
+		return r
+	}
+	return &throttledReader{ctx: t.limitCtx, r: r, limiters: t.downloadLimits, waiting: &t.throttled}
+}
@@ -0,0 +1,147 @@
+package connect
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startTCPSource starts a server that writes n bytes to each connection and
+// closes it.
+func startTCPSource(t *testing.T, n int) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create source server: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer func() { _ = c.Close() }()
+				_, _ = c.Write(make([]byte, n))
+			}(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// timeDownloads downloads from addr through the dialer count times
+// concurrently, returning how long it took.
+func timeDownloads(t *testing.T, dialer Dialer, addr string, count, want int) time.Duration {
+	t.Helper()
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range count {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := dialer.DialContext(context.Background(), "tcp", addr)
+			if err != nil {
+				t.Errorf("Failed to dial through proxy: %v", err)
+				return
+			}
+			defer func() { _ = conn.Close() }()
+			if _, err := io.ReadFull(conn, make([]byte, want)); err != nil {
+				t.Errorf("Failed to read %d bytes: %v", want, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return time.Since(start)
+}
+
+func TestTunnelBandwidth(t *testing.T) {
+	const limit = 64 * 1024
+	for _, tc := range []struct {
+		name  string
+		setup func(t *testing.T, cfg *ServerConfig) Dialer
+	}{
+		{
+			name: "h1",
+			setup: func(t *testing.T, cfg *ServerConfig) Dialer {
+				proxyServer := httptest.NewServer(NewHandler(cfg))
+				t.Cleanup(proxyServer.Close)
+				return NewH1Dialer(&ClientConfig{ProxyURL: proxyServer.URL})
+			},
+		},
+		{
+			name: "h2",
+			setup: func(t *testing.T, cfg *ServerConfig) Dialer {
+				proxyServer := httptest.NewUnstartedServer(NewHandler(cfg))
+				proxyServer.EnableHTTP2 = true
+				proxyServer.StartTLS()
+				t.Cleanup(proxyServer.Close)
+				return NewH2Dialer(&ClientConfig{
+					ProxyURL:  proxyServer.URL,
+					TLSConfig: &tls.Config{InsecureSkipVerify: true},
+				})
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &ServerConfig{TunnelBandwidth: Bandwidth{Download: limit}}
+			dialer := tc.setup(t, cfg)
+
+			// A burst of one second's worth, then half a second throttled
+			size := limit + limit/2
+			if d := timeDownloads(t, dialer, startTCPSource(t, size), 1, size); d < 400*time.Millisecond {
+				t.Errorf("Expected download to be throttled, took %s", d)
+			}
+		})
+	}
+}
+
+func TestIdentityBandwidth(t *testing.T) {
+	const limit = 64 * 1024
+	cfg, _, _ := recordHooks()
+	cfg.OnTunnelStart, cfg.OnTunnelEnd = nil, nil
+	cfg.IdentityBandwidth = Bandwidth{Download: limit}
+	proxyServer := httptest.NewServer(NewHandler(cfg))
+	defer proxyServer.Close()
+	dialer := NewH1Dialer(&ClientConfig{ProxyURL: proxyServer.URL})
+
+	// Each tunnel alone is within the burst, but together they share it
+	addr := startTCPSource(t, limit*3/4)
+	if d := timeDownloads(t, dialer, addr, 2, limit*3/4); d < 400*time.Millisecond {
+		t.Errorf("Expected downloads to share the identity limit, took %s", d)
+	}
+}
+
+func TestTunnelBandwidthUnlimited(t *testing.T) {
+	proxyServer := httptest.NewServer(NewHandler(&ServerConfig{}))
+	defer proxyServer.Close()
+	dialer := NewH1Dialer(&ClientConfig{ProxyURL: proxyServer.URL})
+
+	const size = 1 << 20
+	if d := timeDownloads(t, dialer, startTCPSource(t, size), 1, size); d > 2*time.Second {
+		t.Errorf("Expected unthrottled download, took %s", d)
+	}
+}
+
+// TestTunnelBandwidthIdleTimeout checks that a tunnel held back by its
+// bandwidth limit isn't closed as idle while it waits.
+func TestTunnelBandwidthIdleTimeout(t *testing.T) {
+	const limit = 64 * 1024
+	proxyServer := httptest.NewServer(NewHandler(&ServerConfig{
+		TunnelBandwidth: Bandwidth{Download: limit},
+		IdleTimeout:     200 * time.Millisecond,
+	}))
+	defer proxyServer.Close()
+	dialer := NewH1Dialer(&ClientConfig{ProxyURL: proxyServer.URL})
+
+	// Each read past the burst waits longer than the idle timeout
+	size := 2 * limit
+	if d := timeDownloads(t, dialer, startTCPSource(t, size), 1, size); d < 400*time.Millisecond {
+		t.Errorf("Expected download to be throttled, took %s", d)
+	}
+}
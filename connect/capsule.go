@@ -0,0 +1,134 @@
+package connect
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Capsule types from RFC 9297.
+const (
+	// capsuleDatagram is the DATAGRAM capsule type.
+	capsuleDatagram = 0x00
+)
+
+// maxCapsuleLength bounds the size of a single capsule we are willing to read.
+// UDP payloads can't exceed 64KiB, so anything larger is a protocol error.
+const maxCapsuleLength = 1 << 16
+
+// capsuleProtocolHeader is sent on requests and responses that use the
+// capsule protocol (RFC 9297 Section 3.4).
+const capsuleProtocolHeader = "Capsule-Protocol"
+
+var errCapsuleTooLarge = errors.New("connecttunnel: capsule exceeds maximum length")
+
+// readVarint reads a QUIC variable-length integer (RFC 9000 Section 16).
+func readVarint(r io.ByteReader) (uint64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	length := 1 << (b >> 6)
+	v := uint64(b & 0x3f)
+	for i := 1; i < length; i++ {
+		b, err = r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+// appendVarint appends v to b as a QUIC variable-length integer.
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v <= 0x3f:
+		return append(b, byte(v))
+	case v <= 0x3fff:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case v <= 0x3fffffff:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32),
+			byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
+
+// readCapsule reads a single capsule from r. The returned payload is only
+// valid until the next call, as it aliases buf when it fits.
+func readCapsule(r *bufio.Reader, buf []byte) (typ uint64, payload []byte, err error) {
+	typ, err = readVarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	length, err := readVarint(r)
+	if err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	if length > maxCapsuleLength {
+		return 0, nil, errCapsuleTooLarge
+	}
+	if uint64(cap(buf)) < length {
+		buf = make([]byte, length)
+	}
+	payload = buf[:length]
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	return typ, payload, nil
+}
+
+// writeDatagramCapsule writes a DATAGRAM capsule carrying a UDP payload with
+// context ID 0 (RFC 9298 Section 5).
+func writeDatagramCapsule(w io.Writer, payload []byte) error {
+	// context ID 0 is a single byte varint
+	hdr := appendVarint(make([]byte, 0, 16), capsuleDatagram)
+	hdr = appendVarint(hdr, uint64(len(payload))+1)
+	hdr = append(hdr, 0)
+	// write as a single buffer so capsules from concurrent writers never
+	// interleave on the stream.
+	_, err := w.Write(append(hdr, payload...))
+	return err
+}
+
+// parseUDPDatagram extracts the UDP payload from a DATAGRAM capsule payload.
+// It reports false for datagrams using a context ID other than zero, which
+// must be silently dropped.
+func parseUDPDatagram(b []byte) ([]byte, bool, error) {
+	r := &byteSliceReader{b: b}
+	ctxID, err := readVarint(r)
+	if err != nil {
+		return nil, false, fmt.Errorf("connecttunnel: malformed datagram: %w", err)
+	}
+	if ctxID != 0 {
+		return nil, false, nil
+	}
+	return r.b[r.off:], true, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// byteSliceReader is a minimal io.ByteReader over a byte slice.
+type byteSliceReader struct {
+	b   []byte
+	off int
+}
+
+func (r *byteSliceReader) ReadByte() (byte, error) {
+	if r.off >= len(r.b) {
+		return 0, io.EOF
+	}
+	c := r.b[r.off]
+	r.off++
+	return c, nil
+}
@@ -0,0 +1,504 @@
+package connect
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCaptureMaxBytes is the size cap of capture files if
+// Capture.MaxBytes is zero.
+const DefaultCaptureMaxBytes = 16 << 20
+
+// Capture writes the bytes of selected tunnels to pcapng files for
+// debugging, one file per tunnel. The bytes are framed as a synthesized TCP
+// connection between the client and the upstream target, or as UDP datagrams
+// for CONNECT-UDP, so the files open in Wireshark and it decodes the tunneled
+// protocol, such as a failing TLS handshake.
+//
+// Endpoints that aren't IP addresses, such as hostname targets, are shown as
+// 192.0.2.1 for the client and 198.51.100.1 for the target, with the real
+// target recorded in the file's comment.
+type Capture struct {
+	// Dir is the directory the capture files are written to. Files are
+	// named after the time the tunnel started and its ID.
+	Dir string
+
+	// Targets are glob patterns matched against the target host, or the
+	// host:port if the pattern has a port, e.g. "*.example.com" or
+	// "10.0.0.5:443". Matching is case-insensitive.
+	Targets []string
+
+	// Identities are glob patterns matched against the identity attached to
+	// the tunnel with SetIdentity. A tunnel is captured if it matches any
+	// target or identity pattern.
+	Identities []string
+
+	// MaxBytes caps the size of each capture file. Capturing stops once it
+	// is reached. If zero, DefaultCaptureMaxBytes is used.
+	MaxBytes int64
+
+	// MaxDuration stops capturing a tunnel this long after it started. Zero
+	// captures for as long as the tunnel is open.
+	MaxDuration time.Duration
+
+	// Until stops capturing tunnels that start after it, so a capture left
+	// enabled turns itself off. Zero means no end.
+	Until time.Time
+}
+
+// Validate checks the capture's directory and patterns.
+func (c *Capture) Validate() error {
+	var errs []error
+	if c.Dir == "" {
+		errs = append(errs, errors.New("connecttunnel: capture directory is required"))
+	}
+	for _, pat := range append(append([]string{}, c.Targets...), c.Identities...) {
+		if _, err := path.Match(pat, ""); err != nil {
+			errs = append(errs, fmt.Errorf("connecttunnel: invalid capture pattern %q", pat))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Match reports whether a tunnel to target (host:port) for the given identity
+// is selected for capture.
+func (c *Capture) Match(identity, target string) bool {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if matchAny(c.Targets, func(pat string) bool {
+		pat = strings.ToLower(pat)
+		if h, p, err := net.SplitHostPort(pat); err == nil {
+			ok, _ := path.Match(p, port)
+			if !ok {
+				return false
+			}
+			pat = h
+		}
+		ok, _ := path.Match(pat, host)
+		return ok
+	}) {
+		return true
+	}
+	return identity != "" && matchAny(c.Identities, func(pat string) bool {
+		ok, _ := path.Match(pat, identity)
+		return ok
+	})
+}
+
+// Start starts capturing a tunnel, described by stats, if it is selected. It
+// returns nil if the tunnel isn't captured, including for a nil *Capture.
+// upstream is the address the target was dialed at, if known; it is only
+// used if the target isn't an IP address. Protocol "connect-udp" tunnels are
+// framed as UDP.
+func (c *Capture) Start(stats TunnelStats, upstream net.Addr) (*TunnelCapture, error) {
+	if c == nil || !c.Match(stats.Identity, stats.Target) {
+		return nil, nil
+	}
+	start := stats.Start
+	if start.IsZero() {
+		start = time.Now()
+	}
+	if !c.Until.IsZero() && start.After(c.Until) {
+		return nil, nil
+	}
+
+	name := filepath.Join(c.Dir, start.UTC().Format("20060102T150405")+"-"+stats.ID+".pcapng")
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("connecttunnel: creating capture file: %w", err)
+	}
+	tc := &TunnelCapture{
+		name:     name,
+		f:        f,
+		maxBytes: c.MaxBytes,
+		udp:      stats.Protocol == protocolConnectUDP,
+		// Arbitrary initial sequence numbers; Wireshark shows them relative
+		clientSeq:   1000,
+		upstreamSeq: 5000,
+	}
+	if tc.maxBytes <= 0 {
+		tc.maxBytes = DefaultCaptureMaxBytes
+	}
+	if c.MaxDuration > 0 {
+		tc.deadline = time.Now().Add(c.MaxDuration)
+	}
+	tc.client, tc.upstream = captureEndpoints(stats.RemoteAddr, stats.Target, upstream)
+
+	comment := fmt.Sprintf("netrelay tunnel %s from %s to %s (%s)", stats.ID, stats.RemoteAddr, stats.Target, stats.Protocol)
+	if stats.Identity != "" {
+		comment += " for " + stats.Identity
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.writeBlock(pcapngSectionHeader(comment))
+	tc.writeBlock(pcapngInterface())
+	if !tc.udp {
+		// Synthesize the handshake
+		tc.writeSegment(true, tcpSYN, nil)
+		tc.clientSeq++
+		tc.writeSegment(false, tcpSYN|tcpACK, nil)
+		tc.upstreamSeq++
+		tc.writeSegment(true, tcpACK, nil)
+	}
+	if tc.f == nil {
+		return nil, tc.err
+	}
+	return tc, nil
+}
+
+// TunnelCapture is the capture of one tunnel, started with Capture.Start.
+// Its methods do nothing on a nil *TunnelCapture, and are safe for
+// concurrent use.
+type TunnelCapture struct {
+	name     string
+	maxBytes int64
+	deadline time.Time
+	udp      bool
+
+	mu          sync.Mutex
+	f           *os.File // nil once capturing stopped
+	size        int64
+	err         error
+	client      netip.AddrPort
+	upstream    netip.AddrPort
+	clientSeq   uint32
+	upstreamSeq uint32
+	ipID        uint16
+}
+
+// Name returns the capture file's name.
+func (c *TunnelCapture) Name() string {
+	if c == nil {
+		return ""
+	}
+	return c.name
+}
+
+// Sent captures bytes sent from the client to upstream.
+func (c *TunnelCapture) Sent(p []byte) {
+	c.capture(true, p)
+}
+
+// Received captures bytes received from upstream by the client.
+func (c *TunnelCapture) Received(p []byte) {
+	c.capture(false, p)
+}
+
+func (c *TunnelCapture) capture(fromClient bool, p []byte) {
+	if c == nil || len(p) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return
+	}
+	if !c.deadline.IsZero() && time.Now().After(c.deadline) {
+		c.stop()
+		return
+	}
+	if c.udp {
+		c.writeDatagram(fromClient, p)
+		return
+	}
+	for len(p) > 0 {
+		n := min(len(p), maxCaptureSegment)
+		c.writeSegment(fromClient, tcpPSH|tcpACK, p[:n])
+		p = p[n:]
+	}
+}
+
+// Close finishes the capture, synthesizing the close of the TCP connection,
+// and returns the first error writing the file.
+func (c *TunnelCapture) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f != nil && !c.udp {
+		c.writeSegment(true, tcpFIN|tcpACK, nil)
+		c.clientSeq++
+		c.writeSegment(false, tcpFIN|tcpACK, nil)
+		c.upstreamSeq++
+		c.writeSegment(true, tcpACK, nil)
+	}
+	c.stop()
+	return c.err
+}
+
+// stop closes the file, ending the capture.
+func (c *TunnelCapture) stop() {
+	if c.f == nil {
+		return
+	}
+	if err := c.f.Close(); err != nil && c.err == nil {
+		c.err = err
+	}
+	c.f = nil
+}
+
+// writeBlock appends a pcapng block to the file, stopping the capture if it
+// would exceed the size cap or fails.
+func (c *TunnelCapture) writeBlock(b []byte) {
+	if c.f == nil {
+		return
+	}
+	if c.size+int64(len(b)) > c.maxBytes {
+		c.stop()
+		return
+	}
+	n, err := c.f.Write(b)
+	c.size += int64(n)
+	if err != nil {
+		c.err = fmt.Errorf("connecttunnel: writing capture: %w", err)
+		c.stop()
+	}
+}
+
+// writeSegment writes a TCP segment in one direction, advancing its sequence
+// number past the payload.
+func (c *TunnelCapture) writeSegment(fromClient bool, flags byte, payload []byte) {
+	src, dst := c.client, c.upstream
+	seq, ack := c.clientSeq, c.upstreamSeq
+	if !fromClient {
+		src, dst = dst, src
+		seq, ack = ack, seq
+	}
+	if flags&tcpACK == 0 {
+		ack = 0
+	}
+	seg := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(seg[0:], src.Port())
+	binary.BigEndian.PutUint16(seg[2:], dst.Port())
+	binary.BigEndian.PutUint32(seg[4:], seq)
+	binary.BigEndian.PutUint32(seg[8:], ack)
+	seg[12] = 5 << 4 // data offset, no options
+	seg[13] = flags
+	binary.BigEndian.PutUint16(seg[14:], 65535) // window
+	copy(seg[20:], payload)
+	binary.BigEndian.PutUint16(seg[16:], transportChecksum(src.Addr(), dst.Addr(), ipProtoTCP, seg))
+
+	if fromClient {
+		c.clientSeq += uint32(len(payload))
+	} else {
+		c.upstreamSeq += uint32(len(payload))
+	}
+	c.writePacket(src.Addr(), dst.Addr(), ipProtoTCP, seg)
+}
+
+// writeDatagram writes a UDP datagram in one direction.
+func (c *TunnelCapture) writeDatagram(fromClient bool, payload []byte) {
+	src, dst := c.client, c.upstream
+	if !fromClient {
+		src, dst = dst, src
+	}
+	payload = payload[:min(len(payload), maxCaptureSegment)]
+	dgram := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint16(dgram[0:], src.Port())
+	binary.BigEndian.PutUint16(dgram[2:], dst.Port())
+	binary.BigEndian.PutUint16(dgram[4:], uint16(len(dgram)))
+	copy(dgram[8:], payload)
+	sum := transportChecksum(src.Addr(), dst.Addr(), ipProtoUDP, dgram)
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(dgram[6:], sum)
+	c.writePacket(src.Addr(), dst.Addr(), ipProtoUDP, dgram)
+}
+
+// writePacket wraps a transport segment in an IP header and writes it as an
+// enhanced packet block.
+func (c *TunnelCapture) writePacket(src, dst netip.Addr, proto byte, segment []byte) {
+	var pkt []byte
+	if src.Is4() {
+		pkt = make([]byte, 20+len(segment))
+		pkt[0] = 4<<4 | 5 // version, header length
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		c.ipID++
+		binary.BigEndian.PutUint16(pkt[4:], c.ipID)
+		pkt[6] = 0x40 // don't fragment
+		pkt[8] = 64   // TTL
+		pkt[9] = proto
+		s, d := src.As4(), dst.As4()
+		copy(pkt[12:], s[:])
+		copy(pkt[16:], d[:])
+		binary.BigEndian.PutUint16(pkt[10:], ^onesComplementSum(0, pkt[:20]))
+		copy(pkt[20:], segment)
+	} else {
+		pkt = make([]byte, 40+len(segment))
+		pkt[0] = 6 << 4
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(segment)))
+		pkt[6] = proto
+		pkt[7] = 64 // hop limit
+		s, d := src.As16(), dst.As16()
+		copy(pkt[8:], s[:])
+		copy(pkt[24:], d[:])
+		copy(pkt[40:], segment)
+	}
+	c.writeBlock(pcapngPacket(time.Now(), pkt))
+}
+
+// captureEndpoints picks the synthesized addresses of a capture. Both are
+// IPv4 unless either is IPv6, in which case IPv4 addresses are mapped.
+func captureEndpoints(remoteAddr, target string, upstream net.Addr) (client, server netip.AddrPort) {
+	client, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		client = netip.AddrPortFrom(netip.AddrFrom4([4]byte{192, 0, 2, 1}), 49152)
+	}
+	server, err = netip.ParseAddrPort(target)
+	if err != nil && upstream != nil {
+		server, err = netip.ParseAddrPort(upstream.String())
+	}
+	if err != nil {
+		var port uint64
+		if _, p, err := net.SplitHostPort(target); err == nil {
+			port, _ = strconv.ParseUint(p, 10, 16)
+		}
+		server = netip.AddrPortFrom(netip.AddrFrom4([4]byte{198, 51, 100, 1}), uint16(port))
+	}
+	client = netip.AddrPortFrom(client.Addr().Unmap().WithZone(""), client.Port())
+	server = netip.AddrPortFrom(server.Addr().Unmap().WithZone(""), server.Port())
+	if client.Addr().Is4() != server.Addr().Is4() {
+		client = netip.AddrPortFrom(netip.AddrFrom16(client.Addr().As16()), client.Port())
+		server = netip.AddrPortFrom(netip.AddrFrom16(server.Addr().As16()), server.Port())
+	}
+	return client, server
+}
+
+const (
+	ipProtoTCP = 6
+	ipProtoUDP = 17
+
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+
+	// maxCaptureSegment is the largest payload of a synthesized packet, so
+	// that it fits the IP length fields.
+	maxCaptureSegment = 65535 - 60
+)
+
+// transportChecksum computes the TCP or UDP checksum of segment, including
+// the IP pseudo-header.
+func transportChecksum(src, dst netip.Addr, proto byte, segment []byte) uint16 {
+	var pseudo []byte
+	if src.Is4() {
+		s, d := src.As4(), dst.As4()
+		pseudo = append(append(pseudo, s[:]...), d[:]...)
+		pseudo = append(pseudo, 0, proto)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(segment)))
+	} else {
+		s, d := src.As16(), dst.As16()
+		pseudo = append(append(pseudo, s[:]...), d[:]...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(segment)))
+		pseudo = append(pseudo, 0, 0, 0, proto)
+	}
+	return ^onesComplementSum(onesComplementSum(0, pseudo), segment)
+}
+
+// onesComplementSum adds b to sum as big-endian 16-bit words, as used by the
+// Internet checksum.
+func onesComplementSum(sum uint16, b []byte) uint16 {
+	s := uint32(sum)
+	for len(b) >= 2 {
+		s += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		s += uint32(b[0]) << 8
+	}
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return uint16(s)
+}
+
+// pcapng block types, option codes and the raw IP link type.
+const (
+	pcapngSHB = 0x0A0D0D0A
+	pcapngIDB = 0x00000001
+	pcapngEPB = 0x00000006
+
+	pcapngOptComment  = 1
+	pcapngOptUserAppl = 4
+
+	linkTypeRaw = 101
+)
+
+// pcapngBlock frames a block body with its type and lengths, in little-endian
+// byte order.
+func pcapngBlock(blockType uint32, body []byte) []byte {
+	total := uint32(12 + len(body))
+	b := make([]byte, 0, total)
+	b = binary.LittleEndian.AppendUint32(b, blockType)
+	b = binary.LittleEndian.AppendUint32(b, total)
+	b = append(b, body...)
+	return binary.LittleEndian.AppendUint32(b, total)
+}
+
+// pcapngOption appends an option to b, padded to 32 bits.
+func pcapngOption(b []byte, code uint16, value string) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return pcapngPad(b)
+}
+
+// pcapngPad pads b to a multiple of 32 bits.
+func pcapngPad(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// pcapngSectionHeader returns the section header block that starts a file.
+func pcapngSectionHeader(comment string) []byte {
+	var body []byte
+	body = binary.LittleEndian.AppendUint32(body, 0x1A2B3C4D) // byte-order magic
+	body = binary.LittleEndian.AppendUint16(body, 1)          // major version
+	body = binary.LittleEndian.AppendUint16(body, 0)          // minor version
+	body = binary.LittleEndian.AppendUint64(body, ^uint64(0)) // section length unknown
+	body = pcapngOption(body, pcapngOptComment, comment)
+	body = pcapngOption(body, pcapngOptUserAppl, "netrelay")
+	body = binary.LittleEndian.AppendUint32(body, 0) // end of options
+	return pcapngBlock(pcapngSHB, body)
+}
+
+// pcapngInterface returns the block describing the single raw IP interface,
+// with microsecond timestamps.
+func pcapngInterface() []byte {
+	var body []byte
+	body = binary.LittleEndian.AppendUint16(body, linkTypeRaw)
+	body = binary.LittleEndian.AppendUint16(body, 0) // reserved
+	body = binary.LittleEndian.AppendUint32(body, 0) // no snap length
+	return pcapngBlock(pcapngIDB, body)
+}
+
+// pcapngPacket returns an enhanced packet block for pkt captured at ts.
+func pcapngPacket(ts time.Time, pkt []byte) []byte {
+	us := uint64(ts.UnixMicro())
+	body := make([]byte, 0, 20+len(pkt)+3)
+	body = binary.LittleEndian.AppendUint32(body, 0) // interface
+	body = binary.LittleEndian.AppendUint32(body, uint32(us>>32))
+	body = binary.LittleEndian.AppendUint32(body, uint32(us))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(pkt))) // captured
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(pkt))) // original
+	body = append(body, pkt...)
+	return pcapngBlock(pcapngEPB, pcapngPad(body))
+}
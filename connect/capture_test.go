@@ -0,0 +1,282 @@
+package connect
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// capturedPacket is a packet read back from a capture file.
+type capturedPacket struct {
+	src, dst         string // ip:port
+	proto            byte
+	flags            byte
+	payload          []byte
+	checksumsCorrect bool
+}
+
+// readCapture parses a pcapng file written by Capture, checking its framing.
+func readCapture(t *testing.T, name string) []capturedPacket {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("Failed to read capture: %v", err)
+	}
+	var pkts []capturedPacket
+	for first := true; len(data) > 0; first = false {
+		if len(data) < 12 {
+			t.Fatalf("Truncated block: %x", data)
+		}
+		typ := binary.LittleEndian.Uint32(data)
+		total := binary.LittleEndian.Uint32(data[4:])
+		if total%4 != 0 || int(total) > len(data) || binary.LittleEndian.Uint32(data[total-4:]) != total {
+			t.Fatalf("Invalid block length %d", total)
+		}
+		body := data[8 : total-4]
+		data = data[total:]
+		switch {
+		case first:
+			if typ != pcapngSHB || binary.LittleEndian.Uint32(body) != 0x1A2B3C4D {
+				t.Fatalf("File doesn't start with a section header")
+			}
+		case typ == pcapngIDB:
+			if binary.LittleEndian.Uint16(body) != linkTypeRaw {
+				t.Errorf("Link type = %d, want raw IP", binary.LittleEndian.Uint16(body))
+			}
+		case typ == pcapngEPB:
+			capLen := binary.LittleEndian.Uint32(body[12:])
+			pkts = append(pkts, parsePacket(t, body[20:20+capLen]))
+		default:
+			t.Errorf("Unexpected block type %#x", typ)
+		}
+	}
+	return pkts
+}
+
+// parsePacket parses a synthesized IP packet.
+func parsePacket(t *testing.T, pkt []byte) capturedPacket {
+	t.Helper()
+	var p capturedPacket
+	var src, dst netip.Addr
+	var segment []byte
+	switch pkt[0] >> 4 {
+	case 4:
+		p.proto = pkt[9]
+		src, dst = netip.AddrFrom4([4]byte(pkt[12:16])), netip.AddrFrom4([4]byte(pkt[16:20]))
+		segment = pkt[20:binary.BigEndian.Uint16(pkt[2:])]
+		p.checksumsCorrect = onesComplementSum(0, pkt[:20]) == 0xffff
+	case 6:
+		p.proto = pkt[6]
+		src, dst = netip.AddrFrom16([16]byte(pkt[8:24])), netip.AddrFrom16([16]byte(pkt[24:40]))
+		segment = pkt[40 : 40+binary.BigEndian.Uint16(pkt[4:])]
+		p.checksumsCorrect = true
+	default:
+		t.Fatalf("Invalid IP version in %x", pkt)
+	}
+	p.src = netip.AddrPortFrom(src, binary.BigEndian.Uint16(segment)).String()
+	p.dst = netip.AddrPortFrom(dst, binary.BigEndian.Uint16(segment[2:])).String()
+	if transportChecksum(src, dst, p.proto, segment) != 0 {
+		p.checksumsCorrect = false
+	}
+	switch p.proto {
+	case ipProtoTCP:
+		p.flags = segment[13]
+		p.payload = segment[(segment[12]>>4)*4:]
+	case ipProtoUDP:
+		p.payload = segment[8:]
+	}
+	return p
+}
+
+// captureFile returns the single capture file in dir.
+func captureFile(t *testing.T, dir string) string {
+	t.Helper()
+	names, _ := filepath.Glob(filepath.Join(dir, "*.pcapng"))
+	if len(names) != 1 {
+		t.Fatalf("Capture files = %q, want one", names)
+	}
+	return names[0]
+}
+
+func TestCapture(t *testing.T) {
+	dir := t.TempDir()
+	cfg, _, ends := recordHooks()
+	cfg.Capture = &Capture{Dir: dir, Targets: []string{"127.0.0.1"}}
+	proxyServer := httptest.NewServer(NewHandler(cfg))
+	defer proxyServer.Close()
+	echoAddr := startTCPEcho(t)
+
+	conn, err := NewH1Dialer(&ClientConfig{ProxyURL: proxyServer.URL}).DialContext(context.Background(), "tcp", echoAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial through proxy: %v", err)
+	}
+	msg := []byte("\x16\x03\x01 not quite a ClientHello")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, len(msg))); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	_ = conn.Close()
+	end := waitStats(t, ends)
+
+	pkts := readCapture(t, captureFile(t, dir))
+	if len(pkts) < 7 {
+		t.Fatalf("Got %d packets, want handshake, data and close", len(pkts))
+	}
+	wantFlags := []byte{tcpSYN, tcpSYN | tcpACK, tcpACK}
+	var sent, received []byte
+	for i, p := range pkts {
+		if !p.checksumsCorrect {
+			t.Errorf("Packet %d has a bad checksum", i)
+		}
+		if i < len(wantFlags) && p.flags != wantFlags[i] {
+			t.Errorf("Packet %d flags = %#x, want %#x", i, p.flags, wantFlags[i])
+		}
+		switch {
+		case p.src == end.RemoteAddr && p.dst == echoAddr:
+			sent = append(sent, p.payload...)
+		case p.src == echoAddr && p.dst == end.RemoteAddr:
+			received = append(received, p.payload...)
+		default:
+			t.Errorf("Packet %d is from %s to %s, want between %s and %s", i, p.src, p.dst, end.RemoteAddr, echoAddr)
+		}
+	}
+	if last := pkts[len(pkts)-2]; last.flags&tcpFIN == 0 {
+		t.Errorf("Capture doesn't end with FINs")
+	}
+	if !bytes.Equal(sent, msg) || !bytes.Equal(received, msg) {
+		t.Errorf("Captured sent=%q received=%q, want %q each way", sent, received, msg)
+	}
+}
+
+func TestCaptureUDP(t *testing.T) {
+	dir := t.TempDir()
+	cfg, _, ends := recordHooks()
+	cfg.Capture = &Capture{Dir: dir, Identities: []string{"al*"}}
+	proxyServer := httptest.NewServer(NewHandler(cfg))
+	defer proxyServer.Close()
+	echoAddr := startUDPEcho(t)
+
+	dialer := NewH1Dialer(&ClientConfig{ProxyURL: proxyServer.URL}).(PacketDialer)
+	pc, err := dialer.DialPacket(context.Background(), "udp", echoAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial through proxy: %v", err)
+	}
+	if _, err := pc.WriteTo([]byte("ping"), nil); err != nil {
+		t.Fatalf("Failed to write datagram: %v", err)
+	}
+	if _, _, err := pc.ReadFrom(make([]byte, 16)); err != nil {
+		t.Fatalf("Failed to read datagram: %v", err)
+	}
+	_ = pc.Close()
+	waitStats(t, ends)
+
+	pkts := readCapture(t, captureFile(t, dir))
+	if len(pkts) != 2 {
+		t.Fatalf("Got %d packets, want 2", len(pkts))
+	}
+	for i, p := range pkts {
+		if p.proto != ipProtoUDP || string(p.payload) != "ping" || !p.checksumsCorrect {
+			t.Errorf("Packet %d = %+v, want a UDP ping", i, p)
+		}
+	}
+	if pkts[0].dst != echoAddr || pkts[1].src != echoAddr {
+		t.Errorf("Packets are from %s and %s, want to and from %s", pkts[0].src, pkts[1].src, echoAddr)
+	}
+}
+
+func TestCaptureMatch(t *testing.T) {
+	c := &Capture{
+		Targets:    []string{"*.Example.com", "10.0.0.5:443", "[::1]:8*"},
+		Identities: []string{"bob@*"},
+	}
+	tests := []struct {
+		identity, target string
+		want             bool
+	}{
+		{"", "www.example.com:443", true},
+		{"", "example.com:443", false},
+		{"", "10.0.0.5:443", true},
+		{"", "10.0.0.5:80", false},
+		{"", "[::1]:8080", true},
+		{"", "[::1]:443", false},
+		{"bob@example.org", "other.org:22", true},
+		{"alice@example.org", "other.org:22", false},
+		{"", "invalid", false},
+	}
+	for _, tt := range tests {
+		if got := c.Match(tt.identity, tt.target); got != tt.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.identity, tt.target, got, tt.want)
+		}
+	}
+
+	if err := (&Capture{Dir: "x", Targets: []string{"["}}).Validate(); err == nil {
+		t.Error("Validate accepted an invalid pattern")
+	}
+	if err := (&Capture{}).Validate(); err == nil {
+		t.Error("Validate accepted a capture without a directory")
+	}
+}
+
+func TestCaptureLimits(t *testing.T) {
+	dir := t.TempDir()
+	stats := TunnelStats{ID: "limited", Target: "example.com:443", RemoteAddr: "[2001:db8::1]:50000", Protocol: "connect"}
+
+	c := &Capture{Dir: dir, Targets: []string{"*"}, MaxBytes: 1000}
+	tc, err := c.Start(stats, nil)
+	if err != nil || tc == nil {
+		t.Fatalf("Start = %v, %v", tc, err)
+	}
+	tc.Sent(make([]byte, 300))
+	tc.Received(make([]byte, 5000))
+	tc.Sent(make([]byte, 10))
+	if err := tc.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	fi, err := os.Stat(tc.Name())
+	if err != nil || fi.Size() > 1000 {
+		t.Fatalf("Capture file is %v bytes (%v), want at most 1000", fi.Size(), err)
+	}
+	pkts := readCapture(t, tc.Name())
+	if len(pkts) != 4 || len(pkts[3].payload) != 300 {
+		t.Fatalf("Got %d packets, want the handshake and the first segment", len(pkts))
+	}
+	// The hostname target is given a documentation address, and the IPv4
+	// one is mapped to go with the IPv6 client
+	if pkts[3].src != "[2001:db8::1]:50000" || pkts[3].dst != "[::ffff:198.51.100.1]:443" || !pkts[3].checksumsCorrect {
+		t.Errorf("Packet = %+v, want from the client to the placeholder target", pkts[3])
+	}
+
+	// Tunnels started after Until, or not selected, aren't captured
+	c = &Capture{Dir: dir, Targets: []string{"*"}, Until: time.Now().Add(-time.Second)}
+	stats.ID = "late"
+	if tc, err := c.Start(stats, nil); tc != nil || err != nil {
+		t.Errorf("Start after Until = %v, %v, want nil", tc, err)
+	}
+	c = &Capture{Dir: dir, Targets: []string{"other.com"}}
+	if tc, err := c.Start(stats, nil); tc != nil || err != nil {
+		t.Errorf("Start for an unselected target = %v, %v, want nil", tc, err)
+	}
+
+	// MaxDuration stops capturing
+	c = &Capture{Dir: dir, Targets: []string{"*"}, MaxDuration: time.Nanosecond}
+	stats.ID = "short"
+	tc, err = c.Start(stats, nil)
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+	tc.Sent([]byte("too late"))
+	_ = tc.Close()
+	if pkts := readCapture(t, tc.Name()); len(pkts) != 3 {
+		t.Errorf("Got %d packets, want only the handshake", len(pkts))
+	}
+}
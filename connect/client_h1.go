@@ -14,16 +14,20 @@ import (
 
 // h1Dialer implements Dialer for HTTP/1.1 CONNECT proxies.
 type h1Dialer struct {
+	proxyURL   *url.URL
 	proxyAddr  string
 	proxyHost  string
 	useTLS     bool
 	tlsConfig  *tls.Config
 	headerFunc func(req *http.Request) (http.Header, error)
 	dial       DialFunc
+	udpTmpl    *uriTemplate
+	tcpTmpl    *uriTemplate
 }
 
 // NewH1Dialer creates a Dialer that connects through an HTTP/1.1 proxy.
-// The proxy URL must use "http" or "https" scheme.
+// The proxy URL must use "http" or "https" scheme. The returned Dialer also
+// implements PacketDialer.
 func NewH1Dialer(cfg *ClientConfig) Dialer {
 	if cfg == nil {
 		cfg = &ClientConfig{}
@@ -51,15 +55,44 @@ func NewH1Dialer(cfg *ClientConfig) Dialer {
 	}
 
 	return &h1Dialer{
+		proxyURL:   proxyURL,
 		proxyAddr:  proxyHost,
 		proxyHost:  proxyURL.Hostname(),
 		useTLS:     useTLS,
 		tlsConfig:  cfg.TLSConfig,
 		headerFunc: cfg.HeadersForRequest,
 		dial:       dial,
+		udpTmpl:    mustClientUDPTemplate(proxyURL, cfg.UDPTemplate),
+		tcpTmpl:    mustClientTCPTemplate(proxyURL, cfg.TCPTemplate),
 	}
 }
 
+// mustClientUDPTemplate parses the client's CONNECT-UDP template, resolved
+// against the proxy URL.
+func mustClientUDPTemplate(proxyURL *url.URL, tmpl string) *uriTemplate {
+	if tmpl == "" {
+		tmpl = DefaultUDPTemplate
+	}
+	t, err := parseProxyTemplate(resolveTemplate(proxyURL, tmpl), "", "target_port")
+	if err != nil {
+		panic(err.Error())
+	}
+	return t
+}
+
+// mustClientTCPTemplate parses the client's connect-tcp template, resolved
+// against the proxy URL. It returns nil if template-driven TCP is not enabled.
+func mustClientTCPTemplate(proxyURL *url.URL, tmpl string) *uriTemplate {
+	if tmpl == "" {
+		return nil
+	}
+	t, err := parseProxyTemplate(resolveTemplate(proxyURL, tmpl), "", "tcp_port")
+	if err != nil {
+		panic(err.Error())
+	}
+	return t
+}
+
 // DialContext establishes a connection through the HTTP/1.1 proxy.
 func (d *h1Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
 	// Only support TCP networks
@@ -67,22 +100,23 @@ func (d *h1Dialer) DialContext(ctx context.Context, network, address string) (ne
 		return nil, fmt.Errorf("connecttunnel: unsupported network: %s", network)
 	}
 
-	// Connect to proxy
-	conn, err := d.dial(ctx, network, d.proxyAddr)
-	if err != nil {
-		return nil, fmt.Errorf("%w: %v", ErrProxyConnect, err)
+	// Template-driven TCP uses an upgraded GET instead of CONNECT
+	if d.tcpTmpl != nil {
+		target, err := expandTarget(d.tcpTmpl, "tcp_port", address)
+		if err != nil {
+			return nil, err
+		}
+		conn, br, err := d.upgrade(ctx, network, target, protocolConnectTCP, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &bufferedConn{Conn: conn, reader: br}, nil
 	}
 
-	// Upgrade to TLS if needed
-	if d.useTLS {
-		tlsConfig := d.tlsConfig
-		if tlsConfig == nil {
-			tlsConfig = &tls.Config{ServerName: d.proxyHost}
-		} else if tlsConfig.ServerName == "" {
-			tlsConfig = tlsConfig.Clone()
-			tlsConfig.ServerName = d.proxyHost
-		}
-		conn = tls.Client(conn, tlsConfig)
+	// Connect to proxy
+	conn, err := d.connectProxy(ctx, network)
+	if err != nil {
+		return nil, err
 	}
 
 	// Send CONNECT request
@@ -118,16 +152,15 @@ func (d *h1Dialer) DialContext(ctx context.Context, network, address string) (ne
 		_ = conn.Close()
 		return nil, fmt.Errorf("%w: failed to read response: %v", ErrProxyConnect, err)
 	}
-	_ = resp.Body.Close()
 
 	// Check status code
 	if resp.StatusCode != http.StatusOK {
+		pe := newProxyError(resp)
+		_ = resp.Body.Close()
 		_ = conn.Close()
-		return nil, &ProxyError{
-			StatusCode: resp.StatusCode,
-			Status:     resp.Status,
-		}
+		return nil, pe
 	}
+	_ = resp.Body.Close()
 
 	// Return wrapped connection that includes buffered reader
 	return &bufferedConn{
@@ -136,6 +169,107 @@ func (d *h1Dialer) DialContext(ctx context.Context, network, address string) (ne
 	}, nil
 }
 
+// DialPacket opens a CONNECT-UDP association through the HTTP/1.1 proxy,
+// using an upgraded GET request (RFC 9298 Section 3.2).
+func (d *h1Dialer) DialPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	if !strings.HasPrefix(network, "udp") {
+		return nil, fmt.Errorf("connecttunnel: unsupported network: %s", network)
+	}
+	target, err := expandTarget(d.udpTmpl, "target_port", address)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := http.Header{capsuleProtocolHeader: []string{"?1"}}
+	conn, br, err := d.upgrade(ctx, "tcp", target, protocolConnectUDP, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	return newPacketConn(conn, br, address), nil
+}
+
+// dialStream opens an upgraded connection for protocol to path on the proxy.
+func (d *h1Dialer) dialStream(ctx context.Context, path, protocol string) (net.Conn, error) {
+	conn, br, err := d.upgrade(ctx, "tcp", d.proxyURL.ResolveReference(&url.URL{Path: path}), protocol, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &bufferedConn{Conn: conn, reader: br}, nil
+}
+
+// upgrade connects to the proxy and sends an upgraded GET request for target,
+// as used by the MASQUE protocols over HTTP/1.1. It returns the upgraded
+// connection and a reader holding any data buffered after the response.
+func (d *h1Dialer) upgrade(ctx context.Context, network string, target *url.URL, protocol string, hdr http.Header) (net.Conn, *bufio.Reader, error) {
+	conn, err := d.connectProxy(ctx, network)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        target,
+		Host:       target.Host,
+		Header:     make(http.Header),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+	}
+	maps.Copy(req.Header, hdr)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", protocol)
+
+	if d.headerFunc != nil {
+		addlHeaders, err := d.headerFunc(req)
+		if err != nil {
+			_ = conn.Close()
+			return nil, nil, fmt.Errorf("%w: failed to get additional headers: %v", ErrProxyConnect, err)
+		}
+		maps.Copy(req.Header, addlHeaders)
+	}
+
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, nil, fmt.Errorf("%w: failed to write request: %v", ErrProxyConnect, err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, fmt.Errorf("%w: failed to read response: %v", ErrProxyConnect, err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		pe := newProxyError(resp)
+		_ = resp.Body.Close()
+		_ = conn.Close()
+		return nil, nil, pe
+	}
+	return conn, br, nil
+}
+
+// connectProxy establishes the transport connection to the proxy, upgrading
+// to TLS if needed.
+func (d *h1Dialer) connectProxy(ctx context.Context, network string) (net.Conn, error) {
+	conn, err := d.dial(ctx, network, d.proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrProxyConnect, err)
+	}
+
+	if d.useTLS {
+		tlsConfig := d.tlsConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{ServerName: d.proxyHost}
+		} else if tlsConfig.ServerName == "" {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName = d.proxyHost
+		}
+		conn = tls.Client(conn, tlsConfig)
+	}
+	return conn, nil
+}
+
 // bufferedConn wraps a net.Conn with a bufio.Reader to handle any buffered data.
 type bufferedConn struct {
 	net.Conn
@@ -147,3 +281,12 @@ func (c *bufferedConn) Read(b []byte) (int, error) {
 	// Always read from the buffered reader to maintain proper state
 	return c.reader.Read(b)
 }
+
+// CloseWrite shuts down the write side of the underlying connection, if it
+// supports it.
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -19,11 +19,14 @@ type h2Dialer struct {
 	proxyURL   *url.URL
 	transport  *http2.Transport
 	headerFunc func(req *http.Request) (http.Header, error)
+	udpTmpl    *uriTemplate
+	tcpTmpl    *uriTemplate
 }
 
 // NewH2Dialer creates a Dialer that connects through an HTTP/2 proxy.
 // The proxy URL must use "https" scheme (HTTP/2 over TLS).
-// For HTTP/2 cleartext (h2c), use NewH2CDialer instead.
+// For HTTP/2 cleartext (h2c), use NewH2CDialer instead. The returned Dialer
+// also implements PacketDialer.
 func NewH2Dialer(cfg *ClientConfig) Dialer {
 	if cfg == nil {
 		cfg = &ClientConfig{}
@@ -56,11 +59,14 @@ func NewH2Dialer(cfg *ClientConfig) Dialer {
 		proxyURL:   proxyURL,
 		transport:  transport,
 		headerFunc: cfg.HeadersForRequest,
+		udpTmpl:    mustClientUDPTemplate(proxyURL, cfg.UDPTemplate),
+		tcpTmpl:    mustClientTCPTemplate(proxyURL, cfg.TCPTemplate),
 	}
 }
 
 // NewH2CDialer creates a Dialer that connects through an HTTP/2 cleartext (h2c) proxy.
-// The proxy URL must use "http" scheme.
+// The proxy URL must use "http" scheme. The returned Dialer also implements
+// PacketDialer.
 func NewH2CDialer(cfg *ClientConfig) Dialer {
 	if cfg == nil {
 		cfg = &ClientConfig{}
@@ -93,6 +99,8 @@ func NewH2CDialer(cfg *ClientConfig) Dialer {
 		proxyURL:   proxyURL,
 		transport:  transport,
 		headerFunc: cfg.HeadersForRequest,
+		udpTmpl:    mustClientUDPTemplate(proxyURL, cfg.UDPTemplate),
+		tcpTmpl:    mustClientTCPTemplate(proxyURL, cfg.TCPTemplate),
 	}
 }
 
@@ -103,6 +111,15 @@ func (d *h2Dialer) DialContext(ctx context.Context, network, address string) (ne
 		return nil, fmt.Errorf("connecttunnel: unsupported network: %s", network)
 	}
 
+	// Template-driven TCP uses extended CONNECT to the expanded template
+	if d.tcpTmpl != nil {
+		target, err := expandTarget(d.tcpTmpl, "tcp_port", address)
+		if err != nil {
+			return nil, err
+		}
+		return d.extendedConnect(ctx, target, protocolConnectTCP, nil, address)
+	}
+
 	// Create a pipe for bidirectional communication
 	// pr/pw: client writes to pw, server reads from pr (client -> server)
 	pr, pw := io.Pipe()
@@ -142,13 +159,11 @@ func (d *h2Dialer) DialContext(ctx context.Context, network, address string) (ne
 
 	// Check status code
 	if resp.StatusCode != http.StatusOK {
+		pe := newProxyError(resp)
 		_ = resp.Body.Close()
 		_ = pr.Close()
 		_ = pw.Close()
-		return nil, &ProxyError{
-			StatusCode: resp.StatusCode,
-			Status:     resp.Status,
-		}
+		return nil, pe
 	}
 
 	// Parse remote address
@@ -176,6 +191,84 @@ func (d *h2Dialer) DialContext(ctx context.Context, network, address string) (ne
 	return newStreamConnRW(conn, &remoteAddr{addr: address}), nil
 }
 
+// DialPacket opens a CONNECT-UDP association through the HTTP/2 proxy, using
+// extended CONNECT (RFC 9298 Section 3.3).
+func (d *h2Dialer) DialPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	if !strings.HasPrefix(network, "udp") {
+		return nil, fmt.Errorf("connecttunnel: unsupported network: %s", network)
+	}
+	target, err := expandTarget(d.udpTmpl, "target_port", address)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := http.Header{capsuleProtocolHeader: []string{"?1"}}
+	conn, err := d.extendedConnect(ctx, target, protocolConnectUDP, hdr, address)
+	if err != nil {
+		return nil, err
+	}
+	return newPacketConn(conn, nil, address), nil
+}
+
+// dialStream opens an extended CONNECT stream for protocol to path on the
+// proxy.
+func (d *h2Dialer) dialStream(ctx context.Context, path, protocol string) (net.Conn, error) {
+	return d.extendedConnect(ctx, d.proxyURL.ResolveReference(&url.URL{Path: path}), protocol, nil, d.proxyURL.Host)
+}
+
+// extendedConnect sends an extended CONNECT (RFC 8441) request for target
+// with the given :protocol, and returns the resulting stream. The proxy must
+// advertise SETTINGS_ENABLE_CONNECT_PROTOCOL.
+func (d *h2Dialer) extendedConnect(ctx context.Context, target *url.URL, protocol string, hdr http.Header, address string) (net.Conn, error) {
+	pr, pw := io.Pipe()
+
+	req := &http.Request{
+		Method:        http.MethodConnect,
+		URL:           target,
+		Host:          target.Host,
+		Header:        make(http.Header),
+		Body:          pr,
+		ContentLength: -1,
+	}
+	maps.Copy(req.Header, hdr)
+	req.Header[":protocol"] = []string{protocol}
+
+	if d.headerFunc != nil {
+		addlHeaders, err := d.headerFunc(req)
+		if err != nil {
+			_ = pr.Close()
+			_ = pw.Close()
+			return nil, fmt.Errorf("%w: failed to get additional headers: %v", ErrProxyConnect, err)
+		}
+		maps.Copy(req.Header, addlHeaders)
+	}
+
+	req = req.WithContext(ctx)
+
+	resp, err := d.transport.RoundTrip(req)
+	if err != nil {
+		_ = pr.Close()
+		_ = pw.Close()
+		return nil, fmt.Errorf("%w: %v", ErrProxyConnect, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		pe := newProxyError(resp)
+		_ = resp.Body.Close()
+		_ = pr.Close()
+		_ = pw.Close()
+		return nil, pe
+	}
+
+	conn := &h2Conn{
+		reader: resp.Body,
+		writer: pw,
+		pr:     pr,
+		pw:     pw,
+	}
+	return newStreamConnRW(conn, &remoteAddr{addr: address}), nil
+}
+
 // h2Conn provides bidirectional I/O for HTTP/2 CONNECT.
 type h2Conn struct {
 	reader io.ReadCloser  // Response body (server -> client)
@@ -192,6 +285,11 @@ func (c *h2Conn) Write(p []byte) (n int, err error) {
 	return c.writer.Write(p)
 }
 
+// CloseWrite ends the request body, half-closing the stream.
+func (c *h2Conn) CloseWrite() error {
+	return c.writer.Close()
+}
+
 func (c *h2Conn) Close() error {
 	// Close both directions
 	err1 := c.reader.Close()
@@ -0,0 +1,181 @@
+package connect
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// h3Dialer implements Dialer for HTTP/3 CONNECT proxies.
+type h3Dialer struct {
+	proxyURL   *url.URL
+	transport  *http3.Transport
+	headerFunc func(req *http.Request) (http.Header, error)
+	udpTmpl    *uriTemplate
+	tcpTmpl    *uriTemplate
+}
+
+// NewH3Dialer creates a Dialer that connects through an HTTP/3 proxy over
+// QUIC. The proxy URL must use "https" scheme. Tunnels are multiplexed as
+// independent QUIC streams on a single connection, avoiding the TCP
+// head-of-line blocking of HTTP/2. The returned Dialer also implements
+// PacketDialer.
+//
+// ClientConfig.DialContext is not used, as QUIC runs over UDP.
+func NewH3Dialer(cfg *ClientConfig) Dialer {
+	if cfg == nil {
+		cfg = &ClientConfig{}
+	}
+
+	proxyURL, err := url.Parse(cfg.ProxyURL)
+	if err != nil {
+		panic(fmt.Sprintf("connecttunnel: invalid proxy URL: %v", err))
+	}
+
+	if proxyURL.Scheme != "https" {
+		panic("connecttunnel: NewH3Dialer requires https URL")
+	}
+
+	transport := &http3.Transport{
+		TLSClientConfig: cfg.TLSConfig,
+	}
+
+	return &h3Dialer{
+		proxyURL:   proxyURL,
+		transport:  transport,
+		headerFunc: cfg.HeadersForRequest,
+		udpTmpl:    mustClientUDPTemplate(proxyURL, cfg.UDPTemplate),
+		tcpTmpl:    mustClientTCPTemplate(proxyURL, cfg.TCPTemplate),
+	}
+}
+
+// DialContext establishes a connection through the HTTP/3 proxy.
+func (d *h3Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	// Only support TCP networks
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, fmt.Errorf("connecttunnel: unsupported network: %s", network)
+	}
+
+	// Template-driven TCP uses extended CONNECT to the expanded template
+	if d.tcpTmpl != nil {
+		target, err := expandTarget(d.tcpTmpl, "tcp_port", address)
+		if err != nil {
+			return nil, err
+		}
+		return d.roundTrip(ctx, &http.Request{
+			Method: http.MethodConnect,
+			// quic-go sends the request Proto as the :protocol pseudo-header
+			Proto:         protocolConnectTCP,
+			URL:           target,
+			Host:          target.Host,
+			Header:        make(http.Header),
+			ContentLength: -1,
+		}, address)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    d.proxyURL,
+		Host:   address,
+		Header: make(http.Header),
+		// ContentLength must be -1 for CONNECT to signal streaming body
+		ContentLength: -1,
+	}
+	return d.roundTrip(ctx, req, address)
+}
+
+// DialPacket opens a CONNECT-UDP association through the HTTP/3 proxy, using
+// extended CONNECT (RFC 9298 Section 3.4).
+func (d *h3Dialer) DialPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	if !strings.HasPrefix(network, "udp") {
+		return nil, fmt.Errorf("connecttunnel: unsupported network: %s", network)
+	}
+	target, err := expandTarget(d.udpTmpl, "target_port", address)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		// quic-go sends the request Proto as the :protocol pseudo-header
+		Proto:         protocolConnectUDP,
+		URL:           target,
+		Host:          target.Host,
+		Header:        make(http.Header),
+		ContentLength: -1,
+	}
+	req.Header.Set(capsuleProtocolHeader, "?1")
+
+	conn, err := d.roundTrip(ctx, req, address)
+	if err != nil {
+		return nil, err
+	}
+	return newPacketConn(conn, nil, address), nil
+}
+
+// dialStream opens an extended CONNECT stream for protocol to path on the
+// proxy.
+func (d *h3Dialer) dialStream(ctx context.Context, path, protocol string) (net.Conn, error) {
+	target := d.proxyURL.ResolveReference(&url.URL{Path: path})
+	return d.roundTrip(ctx, &http.Request{
+		Method: http.MethodConnect,
+		// quic-go sends the request Proto as the :protocol pseudo-header
+		Proto:         protocol,
+		URL:           target,
+		Host:          target.Host,
+		Header:        make(http.Header),
+		ContentLength: -1,
+	}, d.proxyURL.Host)
+}
+
+// roundTrip sends a CONNECT request with a streaming body, and returns the
+// resulting stream as a net.Conn.
+func (d *h3Dialer) roundTrip(ctx context.Context, req *http.Request, address string) (net.Conn, error) {
+	// pr/pw: client writes to pw, server reads from pr (client -> server)
+	pr, pw := io.Pipe()
+	req.Body = pr
+
+	// Copy custom headers
+	if d.headerFunc != nil {
+		addlHeaders, err := d.headerFunc(req)
+		if err != nil {
+			_ = pr.Close()
+			_ = pw.Close()
+			return nil, fmt.Errorf("%w: failed to get additional headers: %v", ErrProxyConnect, err)
+		}
+		maps.Copy(req.Header, addlHeaders)
+	}
+
+	req = req.WithContext(ctx)
+
+	// Send request - this returns after response headers are received
+	resp, err := d.transport.RoundTrip(req)
+	if err != nil {
+		_ = pr.Close()
+		_ = pw.Close()
+		return nil, fmt.Errorf("%w: %v", ErrProxyConnect, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		pe := newProxyError(resp)
+		_ = resp.Body.Close()
+		_ = pr.Close()
+		_ = pw.Close()
+		return nil, pe
+	}
+
+	conn := &h2Conn{
+		reader: resp.Body,
+		writer: pw,
+		pr:     pr,
+		pw:     pw,
+	}
+	return newStreamConnRW(conn, &remoteAddr{addr: address}), nil
+}
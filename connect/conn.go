@@ -36,6 +36,14 @@ func (c *streamConnRW) Close() error {
 	return c.rwc.Close()
 }
 
+// CloseWrite shuts down the write side of the stream, if it supports it.
+func (c *streamConnRW) CloseWrite() error {
+	if cw, ok := c.rwc.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
 // LocalAddr implements net.Conn.
 func (c *streamConnRW) LocalAddr() net.Addr {
 	return &net.TCPAddr{IP: net.IPv4zero, Port: 0}
@@ -64,6 +72,12 @@ func (c *streamConnRW) SetWriteDeadline(t time.Time) error {
 	return nil
 }
 
+// closeWriter is implemented by connections that can shut down their write
+// side, such as *net.TCPConn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
 var _ net.Addr = (*remoteAddr)(nil)
 
 type remoteAddr struct {
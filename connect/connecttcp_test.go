@@ -0,0 +1,185 @@
+package connect
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTCPEcho starts a TCP echo server and returns its address.
+func startTCPEcho(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create echo server: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer func() { _ = c.Close() }()
+				_, _ = io.Copy(c, c)
+			}(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// testTCPEcho dials echoAddr through the dialer and checks data is echoed.
+func testTCPEcho(t *testing.T, dialer Dialer, echoAddr string) {
+	t.Helper()
+	conn, err := dialer.DialContext(context.Background(), "tcp", echoAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial through proxy: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	message := []byte("Hello, connect-tcp!")
+	if _, err := conn.Write(message); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	buf := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if string(buf) != string(message) {
+		t.Errorf("Expected %q, got %q", message, buf)
+	}
+}
+
+// TestH1ConnectTCPTemplate tests template-driven TCP over an HTTP/1.1
+// upgrade, with the proxy mounted under a path on a shared server.
+func TestH1ConnectTCPTemplate(t *testing.T) {
+	echoAddr := startTCPEcho(t)
+
+	const tmpl = "/relay/tcp/{target_host}/{tcp_port}/"
+	var gotPath string
+	mux := http.NewServeMux()
+	mux.Handle("/relay/", NewHandler(&ServerConfig{
+		TCPTemplate: tmpl,
+		OnTunnel: func(ctx context.Context, req *http.Request) error {
+			gotPath = req.URL.Path
+			return nil
+		},
+	}))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "other service")
+	})
+	proxyServer := httptest.NewServer(mux)
+	defer proxyServer.Close()
+
+	dialer := NewH1Dialer(&ClientConfig{
+		ProxyURL:    proxyServer.URL,
+		TCPTemplate: tmpl,
+	})
+	testTCPEcho(t, dialer, echoAddr)
+
+	host, port, _ := net.SplitHostPort(echoAddr)
+	if want := "/relay/tcp/" + host + "/" + port + "/"; gotPath != want {
+		t.Errorf("Expected request path %q, got %q", want, gotPath)
+	}
+
+	// A template that doesn't match the server's is not found
+	dialer = NewH1Dialer(&ClientConfig{
+		ProxyURL:    proxyServer.URL,
+		TCPTemplate: "/relay/other/{target_host}/{tcp_port}/",
+	})
+	_, err := dialer.DialContext(context.Background(), "tcp", echoAddr)
+	if pe, ok := err.(*ProxyError); !ok || pe.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 ProxyError, got: %v", err)
+	}
+}
+
+// TestH2ConnectTCPTemplate tests template-driven TCP over HTTP/2 extended
+// CONNECT.
+func TestH2ConnectTCPTemplate(t *testing.T) {
+	// The net/http HTTP/2 server only advertises extended CONNECT when this
+	// is set in the environment at startup.
+	if !strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		t.Skip("requires GODEBUG=http2xconnect=1")
+	}
+	echoAddr := startTCPEcho(t)
+
+	proxyServer := httptest.NewUnstartedServer(NewHandler(&ServerConfig{}))
+	proxyServer.EnableHTTP2 = true
+	proxyServer.StartTLS()
+	defer proxyServer.Close()
+
+	dialer := NewH2Dialer(&ClientConfig{
+		ProxyURL:    proxyServer.URL,
+		TCPTemplate: DefaultTCPTemplate,
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	})
+	testTCPEcho(t, dialer, echoAddr)
+}
+
+// TestH3ConnectTCPTemplate tests template-driven TCP over HTTP/3 extended
+// CONNECT.
+func TestH3ConnectTCPTemplate(t *testing.T) {
+	echoAddr := startTCPEcho(t)
+	proxyURL := startH3Proxy(t, NewH3Handler(&ServerConfig{}))
+
+	dialer := NewH3Dialer(&ClientConfig{
+		ProxyURL:    proxyURL,
+		TCPTemplate: DefaultTCPTemplate,
+		TLSConfig:   &tls.Config{InsecureSkipVerify: true},
+	})
+	testTCPEcho(t, dialer, echoAddr)
+}
+
+// TestH1PipelinedData checks that data a client sends straight after its
+// CONNECT or connect-tcp request, without waiting for the response, reaches
+// the target.
+func TestH1PipelinedData(t *testing.T) {
+	echoAddr := startTCPEcho(t)
+	proxyServer := httptest.NewServer(NewHandler(&ServerConfig{}))
+	defer proxyServer.Close()
+
+	host, port, _ := net.SplitHostPort(echoAddr)
+	for name, request := range map[string]string{
+		"CONNECT": "CONNECT " + echoAddr + " HTTP/1.1\r\nHost: " + echoAddr + "\r\n\r\n",
+		"connect-tcp": "GET /.well-known/masque/tcp/" + host + "/" + port + "/ HTTP/1.1\r\n" +
+			"Host: " + proxyServer.Listener.Addr().String() + "\r\n" +
+			"Connection: Upgrade\r\nUpgrade: connect-tcp\r\n\r\n",
+	} {
+		conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to dial proxy: %v", err)
+		}
+		defer func() { _ = conn.Close() }()
+		message := "Hello, pipelined!"
+		if _, err := io.WriteString(conn, request+message); err != nil {
+			t.Fatalf("%s: failed to write: %v", name, err)
+		}
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("%s: failed to read response: %v", name, err)
+		}
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("%s: unexpected response %s", name, resp.Status)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, len(message))
+		if _, err := io.ReadFull(br, buf); err != nil {
+			t.Fatalf("%s: failed to read echo: %v", name, err)
+		}
+		if string(buf) != message {
+			t.Errorf("%s: expected %q, got %q", name, message, buf)
+		}
+	}
+}
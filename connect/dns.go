@@ -0,0 +1,236 @@
+package connect
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// maxDNSUDPSize is the EDNS(0) UDP payload size advertised to nameservers,
+// as recommended by DNS Flag Day 2020.
+const maxDNSUDPSize = 1232
+
+// dnsAnswer is the result of a query for one address family.
+type dnsAnswer struct {
+	addrs []netip.Addr
+	ttl   time.Duration
+	err   error
+}
+
+// resolveDNS looks up the A and AAAA records of host on the nameservers,
+// returning the addresses and how long to cache them.
+func (r *CachingResolver) resolveDNS(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: "invalid name", Name: host, IsNotFound: true}
+	}
+
+	answers := make(chan dnsAnswer, 2)
+	for _, typ := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		go func() {
+			addrs, ttl, err := r.query(ctx, host, dnsmessage.Question{Name: name, Type: typ, Class: dnsmessage.ClassINET})
+			answers <- dnsAnswer{addrs, ttl, err}
+		}()
+	}
+	a, b := <-answers, <-answers
+
+	addrs := append(a.addrs, b.addrs...)
+	ttl := min(a.ttl, b.ttl)
+	switch {
+	case len(addrs) > 0:
+		if a.err != nil && !isNotFound(a.err) || b.err != nil && !isNotFound(b.err) {
+			// Don't hide the family that failed for long
+			ttl = min(max(a.ttl, b.ttl), r.negativeTTL())
+		}
+		return addrs, ttl, nil
+	case a.err != nil && !isNotFound(a.err):
+		return nil, 0, a.err
+	case b.err != nil && !isNotFound(b.err):
+		return nil, 0, b.err
+	default:
+		return nil, ttl, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+}
+
+// query sends q to the nameservers in order until one answers. It returns
+// the addresses of the type asked for and their TTL, or the negative TTL if
+// there are none.
+func (r *CachingResolver) query(ctx context.Context, host string, q dnsmessage.Question) ([]netip.Addr, time.Duration, error) {
+	var lastErr error
+	for _, ns := range r.Nameservers {
+		server := nameserverAddr(ns)
+		qctx, cancel := context.WithTimeout(ctx, r.timeout())
+		msg, err := exchangeDNS(qctx, server, q)
+		cancel()
+		if err != nil {
+			lastErr = &net.DNSError{Err: err.Error(), Name: host, Server: server, IsTimeout: isTimeout(err) || errors.Is(err, context.DeadlineExceeded), IsTemporary: true}
+			continue
+		}
+		switch msg.RCode {
+		case dnsmessage.RCodeSuccess:
+			addrs, ttl := parseDNSAnswers(msg, q)
+			if len(addrs) == 0 {
+				return nil, r.soaTTL(msg), nil
+			}
+			return addrs, ttl, nil
+		case dnsmessage.RCodeNameError:
+			return nil, r.soaTTL(msg), &net.DNSError{Err: "no such host", Name: host, Server: server, IsNotFound: true}
+		default:
+			lastErr = &net.DNSError{Err: "server misbehaving: " + msg.RCode.String(), Name: host, Server: server, IsTemporary: true}
+		}
+	}
+	return nil, 0, lastErr
+}
+
+// soaTTL returns the negative caching TTL of a response: the minimum of the
+// SOA record's TTL and MINIMUM field (RFC 2308 Section 5).
+func (r *CachingResolver) soaTTL(msg *dnsmessage.Message) time.Duration {
+	for _, rr := range msg.Authorities {
+		if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+			return time.Duration(min(rr.Header.TTL, soa.MinTTL)) * time.Second
+		}
+	}
+	return r.negativeTTL()
+}
+
+// parseDNSAnswers returns the addresses answering q, following CNAME chains,
+// and the lowest TTL of the records used.
+func parseDNSAnswers(msg *dnsmessage.Message, q dnsmessage.Question) ([]netip.Addr, time.Duration) {
+	names := map[string]bool{strings.ToLower(q.Name.String()): true}
+	ttl := ^uint32(0)
+	for changed := true; changed; {
+		changed = false
+		for _, rr := range msg.Answers {
+			c, ok := rr.Body.(*dnsmessage.CNAMEResource)
+			if !ok || !names[strings.ToLower(rr.Header.Name.String())] {
+				continue
+			}
+			if target := strings.ToLower(c.CNAME.String()); !names[target] {
+				names[target] = true
+				ttl = min(ttl, rr.Header.TTL)
+				changed = true
+			}
+		}
+	}
+
+	var addrs []netip.Addr
+	for _, rr := range msg.Answers {
+		if !names[strings.ToLower(rr.Header.Name.String())] || rr.Header.Type != q.Type {
+			continue
+		}
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			addrs = append(addrs, netip.AddrFrom4(body.A))
+		case *dnsmessage.AAAAResource:
+			addrs = append(addrs, netip.AddrFrom16(body.AAAA))
+		default:
+			continue
+		}
+		ttl = min(ttl, rr.Header.TTL)
+	}
+	return addrs, time.Duration(ttl) * time.Second
+}
+
+// nameserverAddr adds the default port to a nameserver address.
+func nameserverAddr(ns string) string {
+	if _, _, err := net.SplitHostPort(ns); err == nil {
+		return ns
+	}
+	return net.JoinHostPort(strings.Trim(ns, "[]"), "53")
+}
+
+// exchangeDNS sends q to server over UDP, retrying over TCP if the response
+// is truncated.
+func exchangeDNS(ctx context.Context, server string, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	id := uint16(rand.Uint32())
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{q},
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(maxDNSUDPSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+	msg.Additionals = []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}}
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := exchangeDNSConn(ctx, "udp", server, query, id, q)
+	if err == nil && resp.Truncated {
+		resp, err = exchangeDNSConn(ctx, "tcp", server, query, id, q)
+	}
+	return resp, err
+}
+
+// exchangeDNSConn sends the packed query to server on network and reads the
+// response matching id and q.
+func exchangeDNSConn(ctx context.Context, network, server string, query []byte, id uint16, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if network == "tcp" {
+		// Messages over TCP are prefixed with their length (RFC 1035 Section 4.2.2)
+		framed := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+		if _, err := conn.Write(append(framed, query...)); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+		return parseDNSResponse(buf, id, q)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxDNSUDPSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore responses that don't match, e.g. spoofed ones
+		if resp, err := parseDNSResponse(buf[:n], id, q); err == nil {
+			return resp, nil
+		}
+	}
+}
+
+// parseDNSResponse parses a response and checks it answers query id for q.
+func parseDNSResponse(b []byte, id uint16, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	var resp dnsmessage.Message
+	if err := resp.Unpack(b); err != nil {
+		return nil, err
+	}
+	if !resp.Response || resp.ID != id || len(resp.Questions) != 1 ||
+		resp.Questions[0].Type != q.Type || resp.Questions[0].Class != q.Class ||
+		!strings.EqualFold(resp.Questions[0].Name.String(), q.Name.String()) {
+		return nil, fmt.Errorf("connecttunnel: mismatched DNS response")
+	}
+	return &resp, nil
+}
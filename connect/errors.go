@@ -1,8 +1,16 @@
 package connect
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
 )
 
 // Common errors returned by the package.
@@ -16,9 +24,18 @@ var (
 	// ErrTunnelRejected is returned when the OnTunnel callback rejects a connection.
 	ErrTunnelRejected = errors.New("connecttunnel: tunnel rejected by callback")
 
+	// ErrProxyAuthRequired can be returned (or wrapped) by the OnTunnel
+	// callback to reject a tunnel with 407 Proxy Authentication Required
+	// instead of 403 Forbidden.
+	ErrProxyAuthRequired = errors.New("connecttunnel: proxy authentication required")
+
 	// ErrUpstreamDial is returned when dialing the upstream target fails.
 	ErrUpstreamDial = errors.New("connecttunnel: failed to dial upstream")
 
+	// ErrDestinationDenied is returned when the upstream target resolves to a
+	// denied address.
+	ErrDestinationDenied = errors.New("connecttunnel: destination address denied")
+
 	// ErrHijackFailed is returned when HTTP/1.1 connection hijacking fails.
 	ErrHijackFailed = errors.New("connecttunnel: failed to hijack connection")
 
@@ -26,6 +43,11 @@ var (
 	ErrProxyConnect = errors.New("connecttunnel: proxy connection failed")
 )
 
+var (
+	errShuttingDown = errors.New("connecttunnel: server shutting down")
+	errTunnelStart  = errors.New("connecttunnel: tunnel failed to start")
+)
+
 // ProxyError represents an error response from a proxy server.
 type ProxyError struct {
 	// StatusCode is the HTTP status code returned by the proxy.
@@ -34,16 +56,72 @@ type ProxyError struct {
 	// Status is the HTTP status line (e.g., "403 Forbidden").
 	Status string
 
-	// Message is additional error information, if available.
+	// Message is additional error information, if available. It is the
+	// response body, or the "reason" field of a JSON body.
 	Message string
+
+	// Header is the response header, e.g. holding Proxy-Authenticate for
+	// 407 responses or Retry-After for 429 responses.
+	Header http.Header
+
+	// ProxyStatus is the Proxy-Status (RFC 9209) member reporting the
+	// error, if the proxy sent one. It tells apart e.g. DNS failures
+	// ("dns_error"), refused connections ("connection_refused") and denied
+	// destinations ("destination_ip_prohibited").
+	ProxyStatus *ProxyStatus
+}
+
+// maxErrorBody is how much of an error response body is kept as the
+// ProxyError message.
+const maxErrorBody = 1024
+
+// newProxyError returns the error for a failed tunnel response, reading the
+// start of the response body as the message. The caller closes the body.
+func newProxyError(resp *http.Response) *ProxyError {
+	pe := &ProxyError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Header:     resp.Header,
+	}
+	if resp.Body != nil {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		pe.Message = strings.TrimSpace(string(body))
+		var rb rejectionBody
+		if mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mt == "application/json" &&
+			json.Unmarshal(body, &rb) == nil && rb.Reason != "" {
+			pe.Message = rb.Reason
+		}
+	}
+	for _, v := range resp.Header.Values(proxyStatusHeader) {
+		statuses, err := ParseProxyStatus(v)
+		if err != nil {
+			continue
+		}
+		// The first error is from the intermediary closest to the target
+		for _, st := range statuses {
+			if st.Error != "" {
+				pe.ProxyStatus = &st
+				return pe
+			}
+		}
+	}
+	return pe
 }
 
 // Error implements the error interface.
 func (e *ProxyError) Error() string {
-	if e.Message != "" {
-		return fmt.Sprintf("connecttunnel: proxy returned %s: %s", e.Status, e.Message)
+	status := e.Status
+	if e.ProxyStatus != nil {
+		status += " (" + e.ProxyStatus.Error
+		if e.ProxyStatus.Details != "" {
+			status += ": " + e.ProxyStatus.Details
+		}
+		status += ")"
+	}
+	if e.Message != "" && e.Message != http.StatusText(e.StatusCode) {
+		return fmt.Sprintf("connecttunnel: proxy returned %s: %s", status, e.Message)
 	}
-	return fmt.Sprintf("connecttunnel: proxy returned %s", e.Status)
+	return fmt.Sprintf("connecttunnel: proxy returned %s", status)
 }
 
 // Is implements error matching for ProxyError.
@@ -51,3 +129,63 @@ func (e *ProxyError) Is(target error) bool {
 	_, ok := target.(*ProxyError)
 	return ok
 }
+
+// Unwrap returns the package errors matching the response, so errors.Is
+// reports the same cause on the client as on the server: ErrInvalidTarget for
+// 400, ErrTunnelRejected for 403, 407 and 451 (and ErrProxyAuthRequired for
+// 407), ErrDestinationDenied for a prohibited destination, and
+// ErrUpstreamDial for 502 and 504.
+func (e *ProxyError) Unwrap() []error {
+	switch e.StatusCode {
+	case http.StatusBadRequest:
+		return []error{ErrInvalidTarget}
+	case http.StatusForbidden:
+		if e.ProxyStatus != nil && e.ProxyStatus.Error == ProxyStatusDestinationProhibited {
+			return []error{ErrUpstreamDial, ErrDestinationDenied}
+		}
+		return []error{ErrTunnelRejected}
+	case http.StatusProxyAuthRequired:
+		return []error{ErrTunnelRejected, ErrProxyAuthRequired}
+	case http.StatusUnavailableForLegalReasons:
+		return []error{ErrTunnelRejected}
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return []error{ErrUpstreamDial}
+	}
+	return nil
+}
+
+// errorStatus returns the response status code for a tunnel that failed with
+// err.
+func errorStatus(err error) int {
+	var re *RejectionError
+	switch {
+	case errors.As(err, &re):
+		return re.status()
+	case errors.Is(err, ErrInvalidTarget):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrProxyAuthRequired):
+		return http.StatusProxyAuthRequired
+	case errors.Is(err, ErrTunnelRejected), errors.Is(err, ErrDestinationDenied):
+		return http.StatusForbidden
+	case errors.Is(err, ErrUpstreamDial):
+		if errors.Is(err, context.DeadlineExceeded) || isTimeout(err) {
+			return http.StatusGatewayTimeout
+		}
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// checkTarget returns an error wrapping ErrInvalidTarget unless target is a
+// host and numeric port.
+func checkTarget(target string) error {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidTarget, err)
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); host == "" || err != nil || n == 0 {
+		return fmt.Errorf("%w: %q", ErrInvalidTarget, target)
+	}
+	return nil
+}
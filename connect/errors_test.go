@@ -0,0 +1,153 @@
+package connect
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// errorRecorder is a slog.Handler keeping the error attributes logged.
+type errorRecorder struct {
+	mu   sync.Mutex
+	errs []error
+}
+
+func (r *errorRecorder) Enabled(context.Context, slog.Level) bool { return true }
+func (r *errorRecorder) WithAttrs([]slog.Attr) slog.Handler       { return r }
+func (r *errorRecorder) WithGroup(string) slog.Handler            { return r }
+
+func (r *errorRecorder) Handle(_ context.Context, rec slog.Record) error {
+	rec.Attrs(func(a slog.Attr) bool {
+		if err, ok := a.Value.Any().(error); ok && a.Key == "error" {
+			r.mu.Lock()
+			r.errs = append(r.errs, err)
+			r.mu.Unlock()
+		}
+		return true
+	})
+	return nil
+}
+
+func (r *errorRecorder) logged(target error) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, err := range r.errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTunnelErrors(t *testing.T) {
+	timeout := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: context.DeadlineExceeded}
+	}
+	reject := func(err error) TunnelFunc {
+		return func(ctx context.Context, req *http.Request) error { return err }
+	}
+	guarded := &GuardedDialer{}
+
+	for _, tc := range []struct {
+		name     string
+		onTunnel TunnelFunc
+		dial     DialFunc
+		target   string
+		status   int
+		want     []error
+		message  string
+	}{
+		{
+			name:    "missing port",
+			target:  "example.com",
+			status:  http.StatusBadRequest,
+			want:    []error{ErrInvalidTarget},
+			message: "Bad Request: invalid target",
+		},
+		{
+			name:   "invalid port",
+			target: "example.com:99999",
+			status: http.StatusBadRequest,
+			want:   []error{ErrInvalidTarget},
+		},
+		{
+			name:     "rejected",
+			onTunnel: reject(errors.New("access denied")),
+			target:   "example.com:443",
+			status:   http.StatusForbidden,
+			want:     []error{ErrTunnelRejected},
+		},
+		{
+			name:     "authentication required",
+			onTunnel: reject(fmt.Errorf("%w: missing token", ErrProxyAuthRequired)),
+			target:   "example.com:443",
+			status:   http.StatusProxyAuthRequired,
+			want:     []error{ErrTunnelRejected, ErrProxyAuthRequired},
+		},
+		{
+			name:   "refused",
+			target: closedTCPAddr(t),
+			status: http.StatusBadGateway,
+			want:   []error{ErrUpstreamDial},
+		},
+		{
+			name:    "timeout",
+			dial:    timeout,
+			target:  "example.com:443",
+			status:  http.StatusGatewayTimeout,
+			want:    []error{ErrUpstreamDial},
+			message: "Gateway Timeout",
+		},
+		{
+			name:    "destination denied",
+			dial:    guarded.DialContext,
+			target:  closedTCPAddr(t),
+			status:  http.StatusForbidden,
+			want:    []error{ErrUpstreamDial, ErrDestinationDenied},
+			message: "Forbidden: destination address denied",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			logged := &errorRecorder{}
+			cfg := &ServerConfig{OnTunnel: tc.onTunnel, Dial: tc.dial, Logger: slog.New(logged)}
+			h1Server := httptest.NewServer(NewHandler(cfg))
+			defer h1Server.Close()
+			h2Server := httptest.NewUnstartedServer(NewHandler(cfg))
+			h2Server.EnableHTTP2 = true
+			h2Server.StartTLS()
+			defer h2Server.Close()
+
+			for name, dialer := range map[string]Dialer{
+				"h1": NewH1Dialer(&ClientConfig{ProxyURL: h1Server.URL}),
+				"h2": NewH2Dialer(&ClientConfig{
+					ProxyURL:  h2Server.URL,
+					TLSConfig: &tls.Config{InsecureSkipVerify: true},
+				}),
+			} {
+				_, err := dialer.DialContext(context.Background(), "tcp", tc.target)
+				var pe *ProxyError
+				if !errors.As(err, &pe) || pe.StatusCode != tc.status {
+					t.Fatalf("%s: expected %d ProxyError, got %v", name, tc.status, err)
+				}
+				if tc.message != "" && pe.Message != tc.message {
+					t.Errorf("%s: expected message %q, got %q", name, tc.message, pe.Message)
+				}
+				for _, want := range tc.want {
+					if !errors.Is(err, want) {
+						t.Errorf("%s: expected client error %v to match %v", name, err, want)
+					}
+					if !logged.logged(want) {
+						t.Errorf("%s: expected a logged server error matching %v", name, want)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package connect
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Upgrade tokens and :protocol values for the MASQUE protocols.
+const (
+	// protocolConnectUDP is CONNECT-UDP (RFC 9298).
+	protocolConnectUDP = "connect-udp"
+	// protocolConnectTCP is template-driven TCP proxying
+	// (draft-ietf-httpbis-connect-tcp).
+	protocolConnectTCP = "connect-tcp"
+)
+
+// extendedProtocol returns the protocol requested via HTTP/2 or HTTP/3
+// extended CONNECT (the :protocol pseudo-header) or an HTTP/1.1 Upgrade, or ""
+// for a classic CONNECT request.
+func extendedProtocol(req *http.Request) string {
+	if req.ProtoMajor == 3 {
+		// quic-go's http3 server reports :protocol as the request Proto
+		if req.Method != http.MethodConnect || req.Proto == "HTTP/3.0" {
+			return ""
+		}
+		return req.Proto
+	}
+	if req.ProtoMajor == 2 {
+		if req.Method != http.MethodConnect {
+			return ""
+		}
+		return req.Header.Get(":protocol")
+	}
+	if req.Method != http.MethodGet {
+		return ""
+	}
+	if !headerHasToken(req.Header, "Connection", "upgrade") {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(req.Header.Get("Upgrade")))
+}
+
+// headerHasToken reports whether the comma-separated header contains token,
+// case-insensitively.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// templateTarget matches an extended CONNECT request against tmpl and returns
+// the host:port target it names. It writes an error response and returns
+// false if the request doesn't match.
+func templateTarget(w http.ResponseWriter, req *http.Request, tmpl *uriTemplate, portVar string) (string, bool) {
+	vars, ok := tmpl.match(req.URL)
+	if !ok {
+		http.NotFound(w, req)
+		return "", false
+	}
+	host, port := vars["target_host"], vars[portVar]
+	if host == "" || port == "" {
+		http.Error(w, "Bad request: missing target", http.StatusBadRequest)
+		return "", false
+	}
+	return net.JoinHostPort(host, port), true
+}
+
+// expandTarget expands a client template for the host:port address.
+func expandTarget(tmpl *uriTemplate, portVar, address string) (*url.URL, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTarget, err)
+	}
+	target, err := url.Parse(tmpl.expand(map[string]string{
+		"target_host": host,
+		portVar:       port,
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTarget, err)
+	}
+	return target, nil
+}
+
+// connectTCPTarget returns the target of a template-driven TCP request. It
+// writes an error response and returns false if there isn't a valid one.
+func connectTCPTarget(cfg *ServerConfig, w http.ResponseWriter, req *http.Request) (string, bool) {
+	tmpl, err := cfg.tcpTemplate()
+	if err != nil {
+		cfg.getSlogger().Error("invalid TCP template", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return "", false
+	}
+	return templateTarget(w, req, tmpl, "tcp_port")
+}
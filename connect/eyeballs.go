@@ -0,0 +1,162 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// defaultFallbackDelay is the Connection Attempt Delay recommended by RFC 8305
+// Section 5.
+const defaultFallbackDelay = 250 * time.Millisecond
+
+// IPPreference orders resolved addresses by family.
+type IPPreference int
+
+const (
+	// PreferIPv6 alternates address families starting with IPv6.
+	PreferIPv6 IPPreference = iota
+	// PreferIPv4 alternates address families starting with IPv4.
+	PreferIPv4
+	// IPv4Only uses only IPv4 addresses.
+	IPv4Only
+	// IPv6Only uses only IPv6 addresses.
+	IPv6Only
+)
+
+// ParseIPPreference parses "ipv6", "ipv4", "ipv4only" or "ipv6only".
+func ParseIPPreference(s string) (IPPreference, error) {
+	switch s {
+	case "ipv6", "":
+		return PreferIPv6, nil
+	case "ipv4":
+		return PreferIPv4, nil
+	case "ipv4only":
+		return IPv4Only, nil
+	case "ipv6only":
+		return IPv6Only, nil
+	}
+	return 0, fmt.Errorf("connecttunnel: invalid IP preference %q", s)
+}
+
+// order returns addrs in the order they should be tried: interleaving the
+// families starting with the preferred one (RFC 8305 Section 4), keeping the
+// order within each family.
+func (p IPPreference) order(addrs []netip.Addr) []netip.Addr {
+	var v4, v6 []netip.Addr
+	for _, ip := range addrs {
+		if ip.Unmap().Is4() {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	first, second := v6, v4
+	switch p {
+	case PreferIPv4:
+		first, second = v4, v6
+	case IPv4Only:
+		return v4
+	case IPv6Only:
+		return v6
+	}
+	out := make([]netip.Addr, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
+
+// dialHappyEyeballs dials addrs in order, starting the next attempt when the
+// previous one fails or delay passes (RFC 8305 Section 5), and returns the
+// first connection established. Attempts still running are canceled. A
+// negative delay dials the addresses one after the other. It fails if addrs
+// is empty.
+func dialHappyEyeballs(ctx context.Context, dial DialFunc, network string, addrs []netip.Addr, port string, delay time.Duration) (net.Conn, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("connecttunnel: no addresses to dial")
+	}
+	if dial == nil {
+		d := &net.Dialer{}
+		dial = d.DialContext
+	}
+	if delay == 0 {
+		delay = defaultFallbackDelay
+	}
+
+	if delay < 0 || len(addrs) == 1 {
+		var errs []error
+		for _, ip := range addrs {
+			conn, err := dial(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, errors.Join(errs...)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		addr := net.JoinHostPort(addrs[next].String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, network, addr)
+			results <- result{conn, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var errs []error
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				cancel()
+				// Close connections that lost the race
+				go func(n int) {
+					for range n {
+						if res := <-results; res.conn != nil {
+							_ = res.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			errs = append(errs, res.err)
+			if next < len(addrs) && ctx.Err() == nil {
+				start()
+				timer.Reset(delay)
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+				timer.Reset(delay)
+			}
+		}
+	}
+	return nil, errors.Join(errs...)
+}
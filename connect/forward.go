@@ -0,0 +1,119 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync/atomic"
+)
+
+// protocolForward is the protocol reported for requests forwarded in
+// forward-proxy mode.
+const protocolForward = "http"
+
+// forwards reports whether req is an absolute-form request to be forwarded
+// in forward-proxy mode.
+func (c *ServerConfig) forwards(req *http.Request) bool {
+	return c.ForwardProxy && req.ProtoMajor == 1 && req.Method != http.MethodConnect && req.URL.IsAbs()
+}
+
+// serveForward forwards an absolute-form request to its origin over a
+// connection opened like a tunnel, so it goes through the same admission
+// checks, limits and accounting. Each request gets its own upstream
+// connection.
+func serveForward(cfg *ServerConfig, w http.ResponseWriter, req *http.Request) {
+	if req.URL.Scheme != "http" || req.URL.Hostname() == "" {
+		http.Error(w, "Bad Request: only http URLs can be forwarded, use CONNECT", http.StatusBadRequest)
+		return
+	}
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+	target := net.JoinHostPort(req.URL.Hostname(), port)
+
+	t := cfg.openUpstream(w, req, "tcp", target)
+	if t == nil {
+		return
+	}
+	defer func() { _ = t.upstream.Close() }()
+	t.started()
+
+	// Cancel the request if the tunnel is aborted, e.g. by Shutdown
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-t.aborted:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var proxyErr error
+	var dialed atomic.Bool
+	conn := &forwardConn{Conn: t.upstream, t: t, r: t.download(t.upstream)}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			// Out is already stripped of hop-by-hop headers and keeps the
+			// absolute URL and Host of the request
+			pr.Out.Header.Add("Via", "1.1 "+cfg.proxyName())
+		},
+		Transport: &http.Transport{
+			DialContext: func(context.Context, string, string) (net.Conn, error) {
+				if dialed.Swap(true) {
+					return nil, errors.New("connecttunnel: upstream connection already used")
+				}
+				return conn, nil
+			},
+			DisableKeepAlives:  true,
+			DisableCompression: true,
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			proxyErr = err
+			if ctx.Err() != nil {
+				return
+			}
+			cfg.setProxyStatus(w, ProxyStatus{Error: ProxyStatusConnectionTerminated})
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, req.WithContext(ctx))
+
+	if ctx.Err() != nil {
+		t.canceled()
+		return
+	}
+	// The origin finished the response, unless the request failed
+	t.ended(copyResult{err: proxyErr}, copyResult{fromClient: true})
+}
+
+// forwardConn is the upstream connection of a forwarded request. It counts
+// the bytes in each direction and applies the bandwidth limits.
+type forwardConn struct {
+	net.Conn
+	t *serverTunnel
+	r io.Reader
+}
+
+func (c *forwardConn) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.t.addReceived(p[:n])
+	}
+	return n, err
+}
+
+func (c *forwardConn) Write(p []byte) (int, error) {
+	if err := throttle(c.t.limitCtx, c.t.uploadLimits, len(p)); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.t.addSent(p[:n])
+	}
+	return n, err
+}
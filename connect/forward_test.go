@@ -0,0 +1,89 @@
+package connect
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestForwardProxy(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, h := range []string{"Proxy-Authorization", "Keep-Alive", "X-Hop"} {
+			if v := req.Header.Get(h); v != "" {
+				t.Errorf("Origin got hop-by-hop header %s: %q", h, v)
+			}
+		}
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		w.Header().Set("X-Via", req.Header.Get("Via"))
+		body, _ := io.ReadAll(req.Body)
+		_, _ = io.WriteString(w, req.Method+" "+req.URL.RequestURI()+" "+string(body))
+	}))
+	defer origin.Close()
+
+	cfg, starts, ends := recordHooks()
+	cfg.ForwardProxy = true
+	cfg.ProxyName = "test-proxy"
+	proxyServer := httptest.NewServer(NewHandler(cfg))
+	defer proxyServer.Close()
+
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	req, _ := http.NewRequest(http.MethodPost, origin.URL+"/path?q=1", strings.NewReader("hello"))
+	req.Header.Set("Proxy-Authorization", "Bearer token")
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Request through proxy failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if got, want := string(body), "POST /path?q=1 hello"; got != want {
+		t.Errorf("Body = %q, want %q", got, want)
+	}
+	if got := resp.Header.Get("Proxy-Authenticate"); got != "" {
+		t.Errorf("Client got hop-by-hop header Proxy-Authenticate: %q", got)
+	}
+	if got, want := resp.Header.Get("X-Via"), "1.1 test-proxy"; got != want {
+		t.Errorf("Origin got Via %q, want %q", got, want)
+	}
+
+	start := waitStats(t, starts)
+	if start.Protocol != "http" || start.Identity != "alice" || start.Target != origin.Listener.Addr().String() {
+		t.Errorf("Start stats = %+v", start)
+	}
+	end := waitStats(t, ends)
+	if end.Reason != CloseUpstream || end.BytesSent == 0 || end.BytesReceived == 0 {
+		t.Errorf("End stats = %+v", end)
+	}
+}
+
+func TestForwardProxyRejects(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		forward bool
+		url     string
+		want    int
+	}{
+		{name: "disabled", url: "http://example.com/", want: http.StatusMethodNotAllowed},
+		{name: "https", forward: true, url: "https://example.com/", want: http.StatusBadRequest},
+		{name: "origin form", forward: true, url: "/", want: http.StatusMethodNotAllowed},
+		{name: "policy", forward: true, url: "http://example.com/", want: http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &ServerConfig{
+				ForwardProxy: tc.forward,
+				Policy:       &Policy{Rules: []PolicyRule{{Name: "no-example", Action: PolicyDeny, Hosts: []string{"example.com"}}}},
+			}
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+			NewHandler(cfg).ServeHTTP(rec, req)
+			if rec.Code != tc.want {
+				t.Errorf("Status = %d, want %d", rec.Code, tc.want)
+			}
+		})
+	}
+}
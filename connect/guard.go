@@ -0,0 +1,187 @@
+package connect
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+// DefaultDenyPrefixes are the destination ranges a GuardedDialer refuses by
+// default: unspecified, loopback, private, shared (CGNAT), link-local
+// (including cloud metadata at 169.254.169.254), benchmarking, multicast and
+// reserved addresses, including the IPv6 site-local, Teredo and
+// IPv4-compatible ranges. NAT64 and 6to4 addresses aren't listed: a
+// GuardedDialer checks the IPv4 address they embed instead.
+var DefaultDenyPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/96"),
+	netip.MustParsePrefix("2001::/32"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("fec0::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// Resolver looks up the IP addresses of a host. *net.Resolver satisfies
+// this interface.
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// GuardedDialer dials upstream targets only if every address they resolve to
+// is permitted, protecting against server-side request forgery to loopback,
+// private and metadata addresses. It resolves the name once and dials exactly
+// the vetted addresses, so a DNS rebinding between check and dial can't get
+// around it.
+//
+// Use its DialContext as ServerConfig.Dial.
+type GuardedDialer struct {
+	// Deny lists the denied destination ranges. If nil, DefaultDenyPrefixes
+	// is used.
+	Deny []netip.Prefix
+
+	// Allow lists exceptions to Deny, e.g. tailnet (100.64.0.0/10,
+	// fd7a:115c:a1e0::/48) or VPN ranges that should stay reachable.
+	Allow []netip.Prefix
+
+	// Resolver resolves hostnames. If nil, net.DefaultResolver is used.
+	Resolver Resolver
+
+	// Dial dials the vetted addresses. If nil, net.Dialer{}.DialContext is
+	// used.
+	Dial DialFunc
+
+	// FallbackDelay is how long to wait for a connection attempt before
+	// starting one to the next vetted address (RFC 8305). If zero, 250ms is
+	// used; if negative, addresses are tried one after the other.
+	FallbackDelay time.Duration
+}
+
+// DestinationDeniedError is returned by GuardedDialer when a target resolves
+// to a denied address. It wraps ErrDestinationDenied.
+type DestinationDeniedError struct {
+	// Host is the requested host.
+	Host string
+
+	// Addr is the denied address.
+	Addr netip.Addr
+}
+
+// Error implements the error interface.
+func (e *DestinationDeniedError) Error() string {
+	if e.Host == e.Addr.String() {
+		return fmt.Sprintf("connecttunnel: destination address %s denied", e.Addr)
+	}
+	return fmt.Sprintf("connecttunnel: destination %s resolves to denied address %s", e.Host, e.Addr)
+}
+
+// Unwrap returns ErrDestinationDenied.
+func (e *DestinationDeniedError) Unwrap() error {
+	return ErrDestinationDenied
+}
+
+// Permitted reports whether ip may be dialed. A NAT64 (64:ff9b::/96, or the
+// local-use 64:ff9b:1::/96) or 6to4 (2002::/16) address is only permitted if
+// the IPv4 address it embeds is. Other local-use NAT64 addresses, whose
+// layout depends on the translator, are refused.
+func (g *GuardedDialer) Permitted(ip netip.Addr) bool {
+	ip = ip.Unmap().WithZone("")
+	for _, p := range g.Allow {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	deny := g.Deny
+	if deny == nil {
+		deny = DefaultDenyPrefixes
+	}
+	for _, p := range deny {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	if v4, ok := embeddedIPv4(ip); ok {
+		return v4.IsValid() && g.Permitted(v4)
+	}
+	return true
+}
+
+var (
+	nat64Prefix        = netip.MustParsePrefix("64:ff9b::/96")
+	nat64LocalPrefix   = netip.MustParsePrefix("64:ff9b:1::/48")
+	nat64LocalPrefix96 = netip.MustParsePrefix("64:ff9b:1::/96")
+	sixToFourPrefix    = netip.MustParsePrefix("2002::/16")
+)
+
+// embeddedIPv4 returns the IPv4 address a NAT64 or 6to4 address translates
+// to, and whether ip is one. The address is invalid for local-use NAT64
+// addresses outside 64:ff9b:1::/96.
+func embeddedIPv4(ip netip.Addr) (netip.Addr, bool) {
+	b := ip.As16()
+	switch {
+	case nat64Prefix.Contains(ip), nat64LocalPrefix96.Contains(ip):
+		return netip.AddrFrom4([4]byte(b[12:16])), true
+	case nat64LocalPrefix.Contains(ip):
+		return netip.Addr{}, true
+	case sixToFourPrefix.Contains(ip):
+		return netip.AddrFrom4([4]byte(b[2:6])), true
+	}
+	return netip.Addr{}, false
+}
+
+// DialContext resolves address, checks every resolved IP and dials the
+// permitted addresses in the order resolved, racing them with happy eyeballs.
+func (g *GuardedDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTarget, err)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return nil, fmt.Errorf("%w: invalid port %q", ErrInvalidTarget, port)
+	}
+
+	ips, err := g.resolve(ctx, network, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if !g.Permitted(ip) {
+			return nil, &DestinationDeniedError{Host: host, Addr: ip}
+		}
+	}
+
+	return dialHappyEyeballs(ctx, g.Dial, network, ips, port, g.FallbackDelay)
+}
+
+// resolve returns the addresses for host, which may be an IP literal.
+func (g *GuardedDialer) resolve(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{ip}, nil
+	}
+
+	var r Resolver = net.DefaultResolver
+	if g.Resolver != nil {
+		r = g.Resolver
+	}
+	ips, err := r.LookupNetIP(ctx, lookupNetwork(network), host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
@@ -0,0 +1,121 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+// staticResolver resolves every host to the same addresses.
+type staticResolver []netip.Addr
+
+func (r staticResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	return r, nil
+}
+
+func TestGuardedDialerPermitted(t *testing.T) {
+	g := &GuardedDialer{Allow: mustPrefixes(t, "100.64.0.0/10")}
+	for _, tc := range []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.20.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1%eth0", false},
+		{"fd00:ec2::254", false},
+		{"fec0::1", false},
+		{"2001:0:4136:e378:8000:63bf:3fff:fdd2", false}, // Teredo
+		{"::a00:1", false},                              // IPv4-compatible 10.0.0.1
+		// NAT64 and 6to4 addresses are checked by their IPv4 address
+		{"64:ff9b::a00:1", false},
+		{"64:ff9b::a9fe:a9fe", false},
+		{"64:ff9b::5db8:d70e", true},
+		{"64:ff9b::6465:6667", true}, // allowed 100.101.102.103
+		{"64:ff9b:1::a00:1", false},
+		{"64:ff9b:1::5db8:d70e", true},
+		{"64:ff9b:1:5db8:d7:e00::", false}, // /48 layout, not checked
+		{"2002:a9fe:a9fe::1", false},
+		{"2002:7f00:1::1", false},
+		{"2002:5db8:d70e::1", true},
+		{"0.0.0.0", false},
+		{"100.101.102.103", true},
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+	} {
+		if got := g.Permitted(netip.MustParseAddr(tc.ip)); got != tc.want {
+			t.Errorf("Permitted(%s) = %v, want %v", tc.ip, got, tc.want)
+		}
+	}
+}
+
+func TestGuardedDialer(t *testing.T) {
+	echoAddr := startTCPEcho(t)
+	_, port, _ := net.SplitHostPort(echoAddr)
+	ctx := context.Background()
+
+	// Loopback is denied by default, both as a literal and after resolution
+	g := &GuardedDialer{Resolver: staticResolver{netip.MustParseAddr("127.0.0.1")}}
+	for _, addr := range []string{echoAddr, net.JoinHostPort("rebind.example", port)} {
+		_, err := g.DialContext(ctx, "tcp", addr)
+		var de *DestinationDeniedError
+		if !errors.As(err, &de) || !errors.Is(err, ErrDestinationDenied) {
+			t.Errorf("DialContext(%s): expected DestinationDeniedError, got %v", addr, err)
+		}
+	}
+
+	// A single denied address among the resolved set denies the target
+	g.Resolver = staticResolver{netip.MustParseAddr("93.184.216.34"), netip.MustParseAddr("10.0.0.1")}
+	if _, err := g.DialContext(ctx, "tcp", "mixed.example:80"); !errors.Is(err, ErrDestinationDenied) {
+		t.Errorf("Expected denial for mixed resolution, got %v", err)
+	}
+
+	// The vetted address is dialed, not the name
+	var dialed string
+	g = &GuardedDialer{
+		Allow:    mustPrefixes(t, "127.0.0.0/8"),
+		Resolver: staticResolver{netip.MustParseAddr("127.0.0.1")},
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed = address
+			return (&net.Dialer{}).DialContext(ctx, network, address)
+		},
+	}
+	testTCPEcho(t, &directDialer{g.DialContext}, net.JoinHostPort("allowed.example", port))
+	if dialed != echoAddr {
+		t.Errorf("Expected dial to %s, got %s", echoAddr, dialed)
+	}
+}
+
+// TestGuardedDialerHandler tests that a denied destination is rejected with
+// 403 rather than dialed.
+func TestGuardedDialerHandler(t *testing.T) {
+	echoAddr := startTCPEcho(t)
+
+	proxyServer := httptest.NewServer(NewHandler(&ServerConfig{
+		Dial: (&GuardedDialer{}).DialContext,
+	}))
+	defer proxyServer.Close()
+
+	dialer := NewH1Dialer(&ClientConfig{ProxyURL: proxyServer.URL})
+	_, err := dialer.DialContext(context.Background(), "tcp", echoAddr)
+	if pe, ok := err.(*ProxyError); !ok || pe.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 ProxyError, got: %v", err)
+	}
+}
+
+// directDialer adapts a DialFunc to the Dialer interface.
+type directDialer struct {
+	dial DialFunc
+}
+
+func (d *directDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.dial(ctx, network, address)
+}
@@ -0,0 +1,123 @@
+package connect
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// startH3Proxy starts an HTTP/3 server for handler on a local UDP port and
+// returns its URL.
+func startH3Proxy(t *testing.T, handler http.Handler) string {
+	t.Helper()
+
+	// Borrow the httptest certificate
+	certSrv := httptest.NewUnstartedServer(nil)
+	certSrv.StartTLS()
+	tlsConfig := certSrv.TLS.Clone()
+	certSrv.Close()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	srv := &http3.Server{
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(tlsConfig),
+	}
+	go func() { _ = srv.Serve(pc) }()
+	t.Cleanup(func() {
+		_ = srv.Close()
+		_ = pc.Close()
+	})
+	return "https://" + pc.LocalAddr().String()
+}
+
+// TestH3ServerClient tests HTTP/3 CONNECT tunnels over QUIC.
+func TestH3ServerClient(t *testing.T) {
+	echoAddr := startTCPEcho(t)
+
+	var gotProto string
+	proxyURL := startH3Proxy(t, NewHandler(&ServerConfig{
+		OnTunnel: func(ctx context.Context, req *http.Request) error {
+			gotProto = req.Proto
+			if req.Header.Get("Proxy-Authorization") != "Bearer test" {
+				return ErrTunnelRejected
+			}
+			return nil
+		},
+	}))
+
+	dialer := NewH3Dialer(&ClientConfig{
+		ProxyURL:  proxyURL,
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		HeadersForRequest: func(req *http.Request) (http.Header, error) {
+			return http.Header{"Proxy-Authorization": []string{"Bearer test"}}, nil
+		},
+	})
+
+	// Run several tunnels over the one QUIC connection
+	for i := 0; i < 3; i++ {
+		conn, err := dialer.DialContext(context.Background(), "tcp", echoAddr)
+		if err != nil {
+			t.Fatalf("Failed to dial through proxy: %v", err)
+		}
+
+		message := []byte("Hello, HTTP/3!")
+		if _, err := conn.Write(message); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+		buf := make([]byte, len(message))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if string(buf) != string(message) {
+			t.Errorf("Expected %q, got %q", message, buf)
+		}
+		_ = conn.Close()
+	}
+
+	if gotProto != "HTTP/3.0" {
+		t.Errorf("Expected HTTP/3.0 request, got %q", gotProto)
+	}
+}
+
+// TestH3ConnectUDP tests CONNECT-UDP over HTTP/3 extended CONNECT.
+func TestH3ConnectUDP(t *testing.T) {
+	echoAddr := startUDPEcho(t)
+	proxyURL := startH3Proxy(t, NewH3Handler(&ServerConfig{}))
+
+	dialer := NewH3Dialer(&ClientConfig{
+		ProxyURL:  proxyURL,
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+	})
+	testUDPEcho(t, dialer, echoAddr)
+}
+
+// TestH3Rejection tests that rejected HTTP/3 tunnels surface a ProxyError.
+func TestH3Rejection(t *testing.T) {
+	proxyURL := startH3Proxy(t, NewH3Handler(&ServerConfig{
+		OnTunnel: func(ctx context.Context, req *http.Request) error {
+			return ErrTunnelRejected
+		},
+	}))
+
+	dialer := NewH3Dialer(&ClientConfig{
+		ProxyURL:  proxyURL,
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := dialer.DialContext(ctx, "tcp", "example.com:80")
+	pe, ok := err.(*ProxyError)
+	if !ok || pe.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected 403 ProxyError, got: %v", err)
+	}
+}
@@ -0,0 +1,425 @@
+package connect
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// CloseReason describes why a tunnel ended.
+type CloseReason string
+
+const (
+	// CloseClient means the client finished sending first.
+	CloseClient CloseReason = "client_closed"
+	// CloseUpstream means the upstream target finished sending first.
+	CloseUpstream CloseReason = "upstream_closed"
+	// CloseError means copying in either direction failed.
+	CloseError CloseReason = "error"
+	// CloseCanceled means the request context was canceled.
+	CloseCanceled CloseReason = "canceled"
+	// CloseShutdown means the tunnel was closed by ServerConfig.Shutdown
+	// after the drain deadline passed.
+	CloseShutdown CloseReason = "shutdown"
+	// CloseIdle means no bytes were copied in either direction for the
+	// IdleTimeout.
+	CloseIdle CloseReason = "idle_timeout"
+	// CloseMaxLifetime means the tunnel reached its MaxLifetime.
+	CloseMaxLifetime CloseReason = "max_lifetime"
+)
+
+// TunnelStats describes a tunnel for the OnTunnelStart, OnTunnelEnd and
+// OnTunnelReject hooks. Bytes, Duration, Reason and Err are only set for
+// OnTunnelEnd, except that OnTunnelReject also sets Duration and Err.
+type TunnelStats struct {
+	// ID is a random identifier for the tunnel, also used in logs.
+	ID string
+
+	// Target is the upstream host:port.
+	Target string
+
+	// Identity is the identity attached with SetIdentity or SetTunnelInfo,
+	// if any.
+	Identity string
+
+	// Protocol is "connect" for classic CONNECT, the extended CONNECT
+	// protocol ("connect-tcp" or "connect-udp"), or "http" for a request
+	// forwarded in forward-proxy mode.
+	Protocol string
+
+	// HTTPVersion is the major HTTP version of the request (1, 2 or 3).
+	HTTPVersion int
+
+	// RemoteAddr is the client's address.
+	RemoteAddr string
+
+	// Start is when the tunnel was requested.
+	Start time.Time
+
+	// DialLatency is how long dialing the upstream target took.
+	DialLatency time.Duration
+
+	// BytesSent is the number of bytes copied from the client to upstream.
+	// For CONNECT-UDP this counts datagram payloads.
+	BytesSent int64
+
+	// BytesReceived is the number of bytes copied from upstream to the
+	// client.
+	BytesReceived int64
+
+	// Duration is how long the tunnel was open, from Start.
+	Duration time.Duration
+
+	// Reason is why the tunnel ended.
+	Reason CloseReason
+
+	// Err is the first error that ended the tunnel, if Reason is CloseError,
+	// or why it was refused.
+	Err error
+}
+
+// TunnelHook receives tunnel lifecycle events. The ctx carries the tunnel's
+// TunnelInfo, but is not canceled when the tunnel ends.
+type TunnelHook func(ctx context.Context, stats TunnelStats)
+
+// serverTunnel is an admitted tunnel with its dialed upstream connection.
+type serverTunnel struct {
+	cfg      *ServerConfig
+	ctx      context.Context
+	upstream net.Conn
+	stats    TunnelStats
+
+	sent       atomic.Int64
+	received   atomic.Int64
+	lastActive atomic.Int64 // unix nanoseconds of the last copy
+	throttled  atomic.Int32 // copies waiting on the bandwidth limits
+
+	// aborted is closed to tear the tunnel down, for abortReason.
+	aborted     chan struct{}
+	abortOnce   sync.Once
+	abortReason CloseReason
+
+	// done is closed once the tunnel has ended.
+	done chan struct{}
+
+	// admitted is set while the tunnel holds a slot under the concurrent
+	// tunnel limits, counted against client and admittedIdentity.
+	admitted         bool
+	client           string
+	admittedIdentity string
+
+	// uploadLimits and downloadLimits throttle the copy loops, and
+	// limitCtx bounds their waits.
+	uploadLimits   []*rate.Limiter
+	downloadLimits []*rate.Limiter
+	sharedLimits   bool
+	limitCtx       context.Context
+	stopLimits     context.CancelFunc
+
+	// capture records the tunnel's bytes if ServerConfig.Capture selects it.
+	capture *TunnelCapture
+}
+
+func newServerTunnel(cfg *ServerConfig, ctx context.Context, req *http.Request, target string) *serverTunnel {
+	protocol := extendedProtocol(req)
+	switch {
+	case req.Method != http.MethodConnect && protocol != protocolConnectTCP && protocol != protocolConnectUDP:
+		// An absolute-form request in forward-proxy mode, possibly upgrading
+		protocol = protocolForward
+	case protocol == "":
+		protocol = "connect"
+	}
+	return &serverTunnel{
+		cfg:     cfg,
+		ctx:     context.WithoutCancel(ctx),
+		aborted: make(chan struct{}),
+		done:    make(chan struct{}),
+		client:  clientKey(req.RemoteAddr),
+		stats: TunnelStats{
+			ID:          newTunnelID(),
+			Target:      target,
+			Protocol:    protocol,
+			HTTPVersion: req.ProtoMajor,
+			RemoteAddr:  req.RemoteAddr,
+			Start:       time.Now(),
+		},
+	}
+}
+
+// started is called once the tunnel is established with the client.
+func (t *serverTunnel) started() {
+	t.stats.Identity = Identity(t.ctx)
+	t.cfg.tracker.add(t)
+	t.lastActive.Store(time.Now().UnixNano())
+	t.limitBandwidth()
+	t.startCapture()
+	go t.watch()
+	t.cfg.Metrics.TunnelOpened(t.stats.Protocol)
+	t.log(slog.LevelInfo, "tunnel started", slog.Duration("dial_latency", t.stats.DialLatency))
+	if t.cfg.OnTunnelStart != nil {
+		t.cfg.OnTunnelStart(t.ctx, t.stats)
+	}
+}
+
+// copyResult is the outcome of copying one direction of a tunnel.
+type copyResult struct {
+	// fromClient is set for the client to upstream direction.
+	fromClient bool
+	err        error
+}
+
+// ended is called once both directions of an established tunnel are done,
+// with the results in the order they finished.
+func (t *serverTunnel) ended(first, second copyResult) {
+	stats := t.stats
+	stats.BytesSent = t.sent.Load()
+	stats.BytesReceived = t.received.Load()
+	stats.Duration = time.Since(stats.Start)
+	switch {
+	case isCopyError(first.err):
+		stats.Reason = CloseError
+		stats.Err = first.err
+	case isCopyError(second.err):
+		stats.Reason = CloseError
+		stats.Err = second.err
+	case first.fromClient:
+		stats.Reason = CloseClient
+	default:
+		stats.Reason = CloseUpstream
+	}
+	t.end(stats)
+}
+
+// wait waits for both copy directions of an established tunnel to report on
+// errCh, then records how the tunnel ended. It returns early if ctx is
+// canceled or the tunnel is aborted, even after one direction has finished,
+// so half-closed tunnels are still torn down by Shutdown, the IdleTimeout and
+// the MaxLifetime. The caller closes both connections when wait returns.
+func (t *serverTunnel) wait(ctx context.Context, errCh <-chan copyResult) {
+	var results []copyResult
+	for len(results) < 2 {
+		select {
+		case <-ctx.Done():
+			t.canceled()
+			return
+		case <-t.aborted:
+			t.canceled()
+			return
+		case res := <-errCh:
+			results = append(results, res)
+		}
+	}
+	t.ended(results[0], results[1])
+}
+
+// canceled is called when the tunnel is torn down by its context or aborted.
+func (t *serverTunnel) canceled() {
+	stats := t.stats
+	stats.BytesSent = t.sent.Load()
+	stats.BytesReceived = t.received.Load()
+	stats.Duration = time.Since(stats.Start)
+	stats.Reason = CloseCanceled
+	select {
+	case <-t.aborted:
+		stats.Reason = t.abortReason
+	default:
+	}
+	t.end(stats)
+}
+
+// abort tears down the tunnel for the given reason. Only the first reason is
+// kept.
+func (t *serverTunnel) abort(reason CloseReason) {
+	t.abortOnce.Do(func() {
+		t.abortReason = reason
+		close(t.aborted)
+	})
+}
+
+// release frees the tunnel's slot under the concurrent tunnel limits.
+func (t *serverTunnel) release() {
+	if t.admitted {
+		t.admitted = false
+		t.cfg.release(t.client, t.admittedIdentity)
+	}
+}
+
+// discard closes the upstream connection of a tunnel that failed to start.
+func (t *serverTunnel) discard() {
+	_ = t.upstream.Close()
+	t.release()
+	t.refuse(errTunnelStart)
+}
+
+// refuse reports a tunnel that was refused or failed to start to the
+// OnTunnelReject hook.
+func (t *serverTunnel) refuse(err error) {
+	if t.cfg.OnTunnelReject == nil {
+		return
+	}
+	stats := t.stats
+	stats.Identity = Identity(t.ctx)
+	stats.Duration = time.Since(stats.Start)
+	stats.Err = err
+	t.cfg.OnTunnelReject(t.ctx, stats)
+}
+
+// startCapture starts capturing the tunnel if ServerConfig.Capture selects
+// it. A capture that can't be started is logged and skipped.
+func (t *serverTunnel) startCapture() {
+	capture, err := t.cfg.Capture.Start(t.stats, t.upstream.RemoteAddr())
+	if err != nil {
+		t.log(slog.LevelWarn, "capture failed", slog.Any("error", err))
+		return
+	}
+	if capture != nil {
+		t.capture = capture
+		t.log(slog.LevelInfo, "capture started", slog.String("file", capture.Name()))
+	}
+}
+
+// addSent counts and captures bytes copied from the client to upstream.
+func (t *serverTunnel) addSent(p []byte) {
+	t.sent.Add(int64(len(p)))
+	t.cfg.Metrics.RecordBytes(int64(len(p)), 0)
+	t.capture.Sent(p)
+	t.lastActive.Store(time.Now().UnixNano())
+}
+
+// addReceived counts and captures bytes copied from upstream to the client.
+func (t *serverTunnel) addReceived(p []byte) {
+	t.received.Add(int64(len(p)))
+	t.cfg.Metrics.RecordBytes(0, int64(len(p)))
+	t.capture.Received(p)
+	t.lastActive.Store(time.Now().UnixNano())
+}
+
+// watch aborts the tunnel when it has been idle for the IdleTimeout or open
+// for the MaxLifetime, until it ends.
+func (t *serverTunnel) watch() {
+	idleTimeout, maxLifetime := t.cfg.IdleTimeout, t.cfg.MaxLifetime
+	if idleTimeout <= 0 && maxLifetime <= 0 {
+		return
+	}
+
+	var idleTimer *time.Timer
+	var idle, expired <-chan time.Time
+	if idleTimeout > 0 {
+		idleTimer = time.NewTimer(idleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+	if maxLifetime > 0 {
+		lifeTimer := time.NewTimer(maxLifetime - time.Since(t.stats.Start))
+		defer lifeTimer.Stop()
+		expired = lifeTimer.C
+	}
+
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-expired:
+			t.abort(CloseMaxLifetime)
+			return
+		case <-idle:
+			// Copies since the timer was set push the deadline out, and
+			// copies held back by the bandwidth limits count as active
+			inactive := time.Since(time.Unix(0, t.lastActive.Load()))
+			if t.throttled.Load() > 0 {
+				inactive = 0
+			}
+			if inactive >= idleTimeout {
+				t.abort(CloseIdle)
+				return
+			}
+			idleTimer.Reset(idleTimeout - inactive)
+		}
+	}
+}
+
+// end records, logs and reports the final stats of a tunnel.
+func (t *serverTunnel) end(stats TunnelStats) {
+	close(t.done)
+	t.release()
+	t.releaseBandwidth()
+	t.cfg.tracker.remove(t)
+	if err := t.capture.Close(); err != nil {
+		t.log(slog.LevelWarn, "capture failed", slog.Any("error", err))
+	}
+	t.cfg.Metrics.TunnelClosed(stats.Protocol)
+	level := slog.LevelInfo
+	attrs := []slog.Attr{
+		slog.Group("bytes", slog.Int64("sent", stats.BytesSent), slog.Int64("received", stats.BytesReceived)),
+		slog.Duration("duration", stats.Duration),
+		slog.String("reason", string(stats.Reason)),
+	}
+	if stats.Err != nil {
+		level = slog.LevelWarn
+		attrs = append(attrs, slog.Any("error", stats.Err))
+	}
+	t.log(level, "tunnel closed", attrs...)
+	if t.cfg.OnTunnelEnd != nil {
+		t.cfg.OnTunnelEnd(t.ctx, stats)
+	}
+}
+
+// log emits a tunnel event with the tunnel's identifying attributes.
+func (t *serverTunnel) log(level slog.Level, msg string, attrs ...slog.Attr) {
+	base := []slog.Attr{
+		slog.String("tunnel_id", t.stats.ID),
+		slog.String("remote_addr", t.stats.RemoteAddr),
+		slog.String("target", t.stats.Target),
+		slog.String("proto", t.stats.Protocol),
+		slog.Int("http", t.stats.HTTPVersion),
+	}
+	info, _ := TunnelInfoFromContext(t.ctx)
+	if info.Identity != "" {
+		base = append(base, slog.String("user", info.Identity))
+	}
+	if info.Subject != "" && info.Subject != info.Identity {
+		base = append(base, slog.String("subject", info.Subject))
+	}
+	if len(info.Groups) > 0 {
+		base = append(base, slog.Any("groups", info.Groups))
+	}
+	t.cfg.getSlogger().LogAttrs(t.ctx, level, msg, append(base, attrs...)...)
+}
+
+// newTunnelID returns a random tunnel identifier.
+func newTunnelID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// isCopyError reports whether err from a copy loop is a real failure rather
+// than one side closing.
+func isCopyError(err error) bool {
+	return err != nil && err != io.EOF && !errors.Is(err, net.ErrClosed)
+}
+
+// countingWriter passes the bytes written to w to add as they are written,
+// so the totals are current even if the tunnel is torn down mid-copy.
+type countingWriter struct {
+	w   io.Writer
+	add func(p []byte)
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if n > 0 {
+		c.add(p[:n])
+	}
+	return n, err
+}
@@ -0,0 +1,322 @@
+package connect
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordHooks returns a config recording tunnel lifecycle events.
+func recordHooks() (*ServerConfig, chan TunnelStats, chan TunnelStats) {
+	starts := make(chan TunnelStats, 1)
+	ends := make(chan TunnelStats, 1)
+	cfg := &ServerConfig{
+		OnTunnel: func(ctx context.Context, req *http.Request) error {
+			SetIdentity(ctx, "alice")
+			return nil
+		},
+		OnTunnelStart: func(ctx context.Context, stats TunnelStats) { starts <- stats },
+		OnTunnelEnd:   func(ctx context.Context, stats TunnelStats) { ends <- stats },
+	}
+	return cfg, starts, ends
+}
+
+// checkLifecycle dials through the dialer, exchanges data and checks the
+// reported tunnel stats.
+func checkLifecycle(t *testing.T, dialer Dialer, starts, ends chan TunnelStats, wantHTTP int) {
+	t.Helper()
+	echoAddr := startTCPEcho(t)
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", echoAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial through proxy: %v", err)
+	}
+	msg := []byte("lifecycle")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, len(msg))); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+
+	start := waitStats(t, starts)
+	if start.Target != echoAddr || start.Identity != "alice" || start.Protocol != "connect" || start.HTTPVersion != wantHTTP {
+		t.Errorf("Unexpected start stats: %+v", start)
+	}
+	if start.DialLatency <= 0 {
+		t.Errorf("Expected dial latency, got %v", start.DialLatency)
+	}
+
+	_ = conn.Close()
+	end := waitStats(t, ends)
+	if end.BytesSent != int64(len(msg)) || end.BytesReceived != int64(len(msg)) {
+		t.Errorf("Expected %d bytes each way, got sent=%d received=%d", len(msg), end.BytesSent, end.BytesReceived)
+	}
+	if end.Reason != CloseClient && end.Reason != CloseCanceled {
+		t.Errorf("Expected client close, got %s (%v)", end.Reason, end.Err)
+	}
+	if end.Duration <= 0 {
+		t.Errorf("Expected duration, got %v", end.Duration)
+	}
+}
+
+func waitStats(t *testing.T, ch chan TunnelStats) TunnelStats {
+	t.Helper()
+	select {
+	case s := <-ch:
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for tunnel hook")
+		return TunnelStats{}
+	}
+}
+
+func TestH1TunnelHooks(t *testing.T) {
+	cfg, starts, ends := recordHooks()
+	proxyServer := httptest.NewServer(NewHandler(cfg))
+	defer proxyServer.Close()
+
+	checkLifecycle(t, NewH1Dialer(&ClientConfig{ProxyURL: proxyServer.URL}), starts, ends, 1)
+}
+
+func TestH2TunnelHooks(t *testing.T) {
+	cfg, starts, ends := recordHooks()
+	proxyServer := httptest.NewUnstartedServer(NewHandler(cfg))
+	proxyServer.EnableHTTP2 = true
+	proxyServer.StartTLS()
+	defer proxyServer.Close()
+
+	dialer := NewH2Dialer(&ClientConfig{
+		ProxyURL:  proxyServer.URL,
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+	})
+	checkLifecycle(t, dialer, starts, ends, 2)
+}
+
+func TestUDPTunnelHooks(t *testing.T) {
+	cfg, starts, ends := recordHooks()
+	proxyServer := httptest.NewServer(NewHandler(cfg))
+	defer proxyServer.Close()
+	echoAddr := startUDPEcho(t)
+
+	dialer := NewH1Dialer(&ClientConfig{ProxyURL: proxyServer.URL}).(PacketDialer)
+	pc, err := dialer.DialPacket(context.Background(), "udp", echoAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial through proxy: %v", err)
+	}
+	if _, err := pc.WriteTo([]byte("ping"), nil); err != nil {
+		t.Fatalf("Failed to write datagram: %v", err)
+	}
+	if _, _, err := pc.ReadFrom(make([]byte, 16)); err != nil {
+		t.Fatalf("Failed to read datagram: %v", err)
+	}
+	if start := waitStats(t, starts); start.Protocol != protocolConnectUDP {
+		t.Errorf("Expected %s protocol, got %+v", protocolConnectUDP, start)
+	}
+	_ = pc.Close()
+	end := waitStats(t, ends)
+	if end.BytesSent != 4 || end.BytesReceived != 4 || end.Reason != CloseClient {
+		t.Errorf("Unexpected end stats: %+v", end)
+	}
+}
+
+func TestTunnelRejectHook(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		configure func(cfg *ServerConfig)
+		check     func(err error) bool
+	}{
+		{
+			name:      "policy",
+			configure: func(cfg *ServerConfig) { cfg.Policy = &Policy{Default: PolicyDeny} },
+			check: func(err error) bool {
+				var pe *PolicyError
+				return errors.As(err, &pe)
+			},
+		},
+		{
+			name: "dial",
+			configure: func(cfg *ServerConfig) {
+				cfg.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+					return nil, errors.New("no route")
+				}
+			},
+			check: func(err error) bool { return errors.Is(err, ErrUpstreamDial) },
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _, _ := recordHooks()
+			ids := make(chan string, 1)
+			cfg.OnTunnel = func(ctx context.Context, req *http.Request) error {
+				SetIdentity(ctx, "alice")
+				ids <- TunnelID(ctx)
+				return nil
+			}
+			rejects := make(chan TunnelStats, 1)
+			cfg.OnTunnelReject = func(ctx context.Context, stats TunnelStats) { rejects <- stats }
+			tc.configure(cfg)
+			proxyServer := httptest.NewServer(NewHandler(cfg))
+			defer proxyServer.Close()
+
+			dialer := NewH1Dialer(&ClientConfig{ProxyURL: proxyServer.URL})
+			if _, err := dialer.DialContext(context.Background(), "tcp", "example.com:443"); err == nil {
+				t.Fatal("Dial succeeded, want error")
+			}
+			stats := waitStats(t, rejects)
+			if id := <-ids; id == "" || stats.ID != id {
+				t.Errorf("Reject stats ID = %q, OnTunnel saw %q", stats.ID, id)
+			}
+			if stats.Identity != "alice" || stats.Target != "example.com:443" || !tc.check(stats.Err) {
+				t.Errorf("Unexpected reject stats: %+v", stats)
+			}
+		})
+	}
+}
+
+func TestTunnelInfo(t *testing.T) {
+	var buf syncBuffer
+	cfg, _, ends := recordHooks()
+	cfg.Logger = slog.New(slog.NewJSONHandler(&buf, nil))
+	cfg.OnTunnel = func(ctx context.Context, req *http.Request) error {
+		SetTunnelInfo(ctx, TunnelInfo{
+			Subject: "1234",
+			Email:   "alice@example.com",
+			Groups:  []string{"eng"},
+			Claims:  map[string]any{"hd": "example.com"},
+		})
+		return nil
+	}
+	cfg.Policy = &Policy{Rules: []PolicyRule{{Name: "alice", Action: PolicyAllow, Identities: []string{"alice@*"}}}}
+	dialed := make(chan TunnelInfo, 1)
+	var d net.Dialer
+	cfg.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		info, _ := TunnelInfoFromContext(ctx)
+		dialed <- info
+		return d.DialContext(ctx, network, address)
+	}
+	hooked := make(chan TunnelInfo, 1)
+	cfg.OnTunnelEnd = func(ctx context.Context, stats TunnelStats) {
+		info, _ := TunnelInfoFromContext(ctx)
+		hooked <- info
+		ends <- stats
+	}
+	proxyServer := httptest.NewServer(NewHandler(cfg))
+	defer proxyServer.Close()
+
+	testTCPEcho(t, NewH1Dialer(&ClientConfig{ProxyURL: proxyServer.URL}), startTCPEcho(t))
+	end := waitStats(t, ends)
+	if end.Identity != "alice@example.com" {
+		t.Errorf("Identity = %q, want the email", end.Identity)
+	}
+	for _, info := range []TunnelInfo{<-dialed, <-hooked} {
+		if info.TunnelID != end.ID || info.Identity != "alice@example.com" || info.Subject != "1234" ||
+			len(info.Groups) != 1 || info.Claims["hd"] != "example.com" {
+			t.Errorf("TunnelInfo = %+v, want the one OnTunnel attached", info)
+		}
+	}
+	if log := buf.String(); !strings.Contains(log, `"subject":"1234"`) || !strings.Contains(log, `"groups":["eng"]`) {
+		t.Errorf("Tunnel logs are missing the subject and groups: %s", log)
+	}
+
+	if _, ok := TunnelInfoFromContext(context.Background()); ok {
+		t.Error("TunnelInfoFromContext reported a TunnelInfo outside a tunnel")
+	}
+}
+
+func TestTunnelTimeouts(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		idle, life time.Duration
+		want       CloseReason
+	}{
+		{name: "idle", idle: 150 * time.Millisecond, want: CloseIdle},
+		{name: "max lifetime", idle: 150 * time.Millisecond, life: 400 * time.Millisecond, want: CloseMaxLifetime},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, starts, ends := recordHooks()
+			cfg.IdleTimeout = tc.idle
+			cfg.MaxLifetime = tc.life
+			proxyServer := httptest.NewServer(NewHandler(cfg))
+			defer proxyServer.Close()
+
+			dialer := NewH1Dialer(&ClientConfig{ProxyURL: proxyServer.URL})
+			conn, err := dialer.DialContext(context.Background(), "tcp", startTCPEcho(t))
+			if err != nil {
+				t.Fatalf("Failed to dial through proxy: %v", err)
+			}
+			defer func() { _ = conn.Close() }()
+			waitStats(t, starts)
+
+			// Traffic more often than the idle timeout keeps the tunnel open
+			// until the max lifetime, if any
+			deadline := time.Now().Add(300 * time.Millisecond)
+			if tc.life == 0 {
+				deadline = time.Now()
+			}
+			for time.Now().Before(deadline) {
+				if _, err := conn.Write([]byte("x")); err != nil {
+					t.Fatalf("Failed to write: %v", err)
+				}
+				if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+					t.Fatalf("Failed to read: %v", err)
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+
+			end := waitStats(t, ends)
+			if end.Reason != tc.want {
+				t.Errorf("Expected %s, got %s", tc.want, end.Reason)
+			}
+			if tc.life > 0 && end.Duration < tc.life {
+				t.Errorf("Expected duration of at least %s, got %s", tc.life, end.Duration)
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Read(make([]byte, 1)); err == nil {
+				t.Error("Expected read to fail after the tunnel closed")
+			}
+		})
+	}
+}
+
+// TestHalfClosedTunnelTimeouts checks that the idle timeout and max lifetime
+// close tunnels whose client has finished sending while the upstream stays
+// silent.
+func TestHalfClosedTunnelTimeouts(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		idle, life time.Duration
+		want       CloseReason
+	}{
+		{name: "idle", idle: 100 * time.Millisecond, want: CloseIdle},
+		{name: "max lifetime", life: 200 * time.Millisecond, want: CloseMaxLifetime},
+	} {
+		for _, server := range proxyServers {
+			t.Run(tc.name+"/"+server.name, func(t *testing.T) {
+				cfg, starts, ends := recordHooks()
+				cfg.IdleTimeout = tc.idle
+				cfg.MaxLifetime = tc.life
+				dialer := server.setup(t, cfg)
+				addr, eof := startSilentUpstream(t)
+
+				conn := dialHalfClosed(t, dialer, addr, eof)
+				waitStats(t, starts)
+
+				if end := waitStats(t, ends); end.Reason != tc.want {
+					t.Errorf("Expected %s, got %s", tc.want, end.Reason)
+				}
+				_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if _, err := conn.Read(make([]byte, 1)); isTimeout(err) {
+					t.Error("Expected the tunnel to close")
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package connect
+
+import (
+	"net"
+	"sync"
+)
+
+// limitRetryAfter is the Retry-After value, in seconds, sent with 429
+// responses when a concurrent tunnel limit is reached.
+const limitRetryAfter = "1"
+
+// tunnelLimits counts the admitted tunnels for the concurrent tunnel limits.
+type tunnelLimits struct {
+	mu         sync.Mutex
+	total      int
+	clients    map[string]int
+	identities map[string]int
+}
+
+// admit reserves a slot for a tunnel from client with identity. If a limit is
+// reached it returns false and which limit: "global", "client" or "identity".
+func (c *ServerConfig) admit(client, identity string) (bool, string) {
+	l := &c.limits
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c.MaxTunnels > 0 && l.total >= c.MaxTunnels {
+		return false, "global"
+	}
+	if c.MaxTunnelsPerClient > 0 && l.clients[client] >= c.MaxTunnelsPerClient {
+		return false, "client"
+	}
+	if identity != "" && c.MaxTunnelsPerIdentity > 0 && l.identities[identity] >= c.MaxTunnelsPerIdentity {
+		return false, "identity"
+	}
+
+	if l.clients == nil {
+		l.clients = make(map[string]int)
+		l.identities = make(map[string]int)
+	}
+	l.total++
+	l.clients[client]++
+	if identity != "" {
+		l.identities[identity]++
+	}
+	return true, ""
+}
+
+// release frees a slot reserved with admit.
+func (c *ServerConfig) release(client, identity string) {
+	l := &c.limits
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.clients[client]--; l.clients[client] <= 0 {
+		delete(l.clients, client)
+	}
+	if identity != "" {
+		if l.identities[identity]--; l.identities[identity] <= 0 {
+			delete(l.identities, identity)
+		}
+	}
+}
+
+// clientKey returns the client address remoteAddr is limited by, without the
+// port.
+func clientKey(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
@@ -0,0 +1,142 @@
+package connect
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// rawConnect sends an HTTP/1.1 CONNECT to target through the proxy with the
+// given identity header, returning the response and the connection.
+func rawConnect(t *testing.T, proxyAddr, target, user string) (*http.Response, net.Conn) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nX-User: %s\r\n\r\n", target, target, user)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	return resp, conn
+}
+
+func TestConcurrentTunnelLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		cfg   func() *ServerConfig
+		users []string // identities of the tunnels that are opened
+		next  string   // identity of the next tunnel
+		want  int
+	}{
+		{
+			name:  "global",
+			cfg:   func() *ServerConfig { return &ServerConfig{MaxTunnels: 2} },
+			users: []string{"alice", "bob"},
+			next:  "carol",
+			want:  http.StatusTooManyRequests,
+		},
+		{
+			name:  "per client",
+			cfg:   func() *ServerConfig { return &ServerConfig{MaxTunnelsPerClient: 1} },
+			users: []string{"alice"},
+			next:  "bob",
+			want:  http.StatusTooManyRequests,
+		},
+		{
+			name:  "per identity",
+			cfg:   func() *ServerConfig { return &ServerConfig{MaxTunnelsPerIdentity: 1} },
+			users: []string{"alice"},
+			next:  "alice",
+			want:  http.StatusTooManyRequests,
+		},
+		{
+			name:  "other identity",
+			cfg:   func() *ServerConfig { return &ServerConfig{MaxTunnelsPerIdentity: 1} },
+			users: []string{"alice"},
+			next:  "bob",
+			want:  http.StatusOK,
+		},
+		{
+			name:  "unauthenticated",
+			cfg:   func() *ServerConfig { return &ServerConfig{MaxTunnelsPerIdentity: 1} },
+			users: []string{""},
+			next:  "",
+			want:  http.StatusOK,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := tc.cfg()
+			ends := make(chan TunnelStats, len(tc.users)+1)
+			cfg.OnTunnel = func(ctx context.Context, req *http.Request) error {
+				SetIdentity(ctx, req.Header.Get("X-User"))
+				return nil
+			}
+			cfg.OnTunnelEnd = func(ctx context.Context, stats TunnelStats) { ends <- stats }
+			proxyServer := httptest.NewServer(NewHandler(cfg))
+			defer proxyServer.Close()
+			proxyAddr := proxyServer.Listener.Addr().String()
+			echoAddr := startTCPEcho(t)
+
+			var conns []net.Conn
+			for _, user := range tc.users {
+				resp, conn := rawConnect(t, proxyAddr, echoAddr, user)
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("Expected tunnel for %q, got %s", user, resp.Status)
+				}
+				conns = append(conns, conn)
+			}
+
+			resp, _ := rawConnect(t, proxyAddr, echoAddr, tc.next)
+			if resp.StatusCode != tc.want {
+				t.Fatalf("Expected %d, got %s", tc.want, resp.Status)
+			}
+			if tc.want != http.StatusTooManyRequests {
+				return
+			}
+			if ra := resp.Header.Get("Retry-After"); ra == "" {
+				t.Error("Expected Retry-After header")
+			}
+
+			// Closing a tunnel frees its slot
+			_ = conns[0].Close()
+			waitStats(t, ends)
+			if resp, _ := rawConnect(t, proxyAddr, echoAddr, tc.next); resp.StatusCode != http.StatusOK {
+				t.Errorf("Expected tunnel after a slot was freed, got %s", resp.Status)
+			}
+		})
+	}
+}
+
+func TestConcurrentTunnelLimitDialFailure(t *testing.T) {
+	cfg := &ServerConfig{MaxTunnels: 1}
+	proxyServer := httptest.NewServer(NewHandler(cfg))
+	defer proxyServer.Close()
+	proxyAddr := proxyServer.Listener.Addr().String()
+
+	// Failed dials don't hold on to their slot
+	closed := closedTCPAddr(t)
+	for range 2 {
+		if resp, _ := rawConnect(t, proxyAddr, closed, ""); resp.StatusCode != http.StatusBadGateway {
+			t.Fatalf("Expected 502, got %s", resp.Status)
+		}
+	}
+}
+
+// closedTCPAddr returns an address nothing is listening on.
+func closedTCPAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+	return addr
+}
@@ -0,0 +1,109 @@
+package connect
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestStructuredLogging(t *testing.T) {
+	var buf syncBuffer
+	cfg, _, ends := recordHooks()
+	cfg.Logger = slog.New(slog.NewJSONHandler(&buf, nil))
+	proxyServer := httptest.NewServer(NewHandler(cfg))
+	defer proxyServer.Close()
+
+	echoAddr := startTCPEcho(t)
+	testTCPEcho(t, NewH1Dialer(&ClientConfig{ProxyURL: proxyServer.URL}), echoAddr)
+	end := waitStats(t, ends)
+
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var rec map[string]any
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("Invalid JSON log line %q: %v", line, err)
+		}
+		records = append(records, rec)
+	}
+	if len(records) != 2 || records[0]["msg"] != "tunnel started" || records[1]["msg"] != "tunnel closed" {
+		t.Fatalf("Unexpected log records: %v", records)
+	}
+	for _, rec := range records {
+		if rec["tunnel_id"] != end.ID || rec["target"] != echoAddr || rec["user"] != "alice" || rec["proto"] != "connect" {
+			t.Errorf("Missing tunnel attributes in %v", rec)
+		}
+		if _, ok := rec["remote_addr"]; !ok {
+			t.Errorf("Missing remote_addr in %v", rec)
+		}
+	}
+	closed := records[1]
+	if b, ok := closed["bytes"].(map[string]any); !ok || b["sent"] != float64(end.BytesSent) || b["received"] != float64(end.BytesReceived) {
+		t.Errorf("Unexpected bytes in %v", closed)
+	}
+	if _, ok := closed["duration"]; !ok {
+		t.Errorf("Missing duration in %v", closed)
+	}
+}
+
+// printfLogger records Printf calls.
+type printfLogger struct {
+	syncBuffer
+}
+
+func (l *printfLogger) Printf(format string, v ...interface{}) {
+	_, _ = fmt.Fprintf(&l.syncBuffer, format+"\n", v...)
+}
+
+func TestErrorLogCompatibility(t *testing.T) {
+	var logger printfLogger
+	cfg, _, ends := recordHooks()
+	cfg.ErrorLog = &logger
+	cfg.OnTunnel = func(ctx context.Context, req *http.Request) error {
+		if strings.HasSuffix(req.Host, ":1") {
+			return errors.New("no port 1")
+		}
+		return nil
+	}
+	proxyServer := httptest.NewServer(NewHandler(cfg))
+	defer proxyServer.Close()
+
+	dialer := NewH1Dialer(&ClientConfig{ProxyURL: proxyServer.URL})
+	testTCPEcho(t, dialer, startTCPEcho(t))
+	waitStats(t, ends)
+	_, _ = dialer.DialContext(context.Background(), "tcp", "127.0.0.1:1")
+
+	// Only warnings and errors reach the Printf logger
+	out := logger.String()
+	if strings.Contains(out, "tunnel started") || strings.Contains(out, "tunnel closed") {
+		t.Errorf("Unexpected info events in ErrorLog: %q", out)
+	}
+	if !strings.Contains(out, `msg="tunnel rejected"`) || !strings.Contains(out, `error="connecttunnel: tunnel rejected by callback: no port 1"`) || !strings.Contains(out, "target=127.0.0.1:1") {
+		t.Errorf("Expected rejection in ErrorLog, got %q", out)
+	}
+}
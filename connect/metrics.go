@@ -0,0 +1,202 @@
+package connect
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tunnel results recorded by Metrics.
+const (
+	// ResultAccepted is a tunnel that was admitted and dialed.
+	ResultAccepted = "accepted"
+	// ResultRejected is a tunnel refused by OnTunnel, the Policy or a
+	// GuardedDialer.
+	ResultRejected = "rejected"
+	// ResultDialFailed is a tunnel whose upstream target couldn't be dialed.
+	ResultDialFailed = "dial_failed"
+)
+
+// dialBuckets are the upper bounds of the upstream dial latency histogram, in
+// seconds.
+var dialBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics collects tunnel metrics and serves them in the OpenMetrics text
+// format. Set it as ServerConfig.Metrics to have the handlers record into it,
+// and serve it on a metrics endpoint. The Record methods can also be called
+// directly, e.g. by clients or from OnTunnel and Dial.
+//
+// The zero Metrics is ready to use, and a nil *Metrics records nothing.
+type Metrics struct {
+	// sent and received are updated as tunnels copy, without the lock.
+	sent, received atomic.Uint64
+
+	mu           sync.Mutex
+	active       map[string]int64
+	tunnels      map[string]uint64
+	authFailures map[string]uint64
+	routes       map[string]uint64
+	dialCounts   []uint64 // per bucket, not cumulative
+	dialCount    uint64
+	dialSum      float64
+}
+
+// NewMetrics returns an empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+// initLocked allocates the maps of a zero Metrics. m.mu must be held.
+func (m *Metrics) initLocked() {
+	if m.active == nil {
+		m.active = make(map[string]int64)
+		m.tunnels = make(map[string]uint64)
+		m.authFailures = make(map[string]uint64)
+		m.routes = make(map[string]uint64)
+		m.dialCounts = make([]uint64, len(dialBuckets)+1)
+	}
+}
+
+// RecordTunnel counts a tunnel request by result (ResultAccepted,
+// ResultRejected or ResultDialFailed).
+func (m *Metrics) RecordTunnel(result string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.initLocked()
+	m.tunnels[result]++
+	m.mu.Unlock()
+}
+
+// RecordDial observes the latency of an upstream dial.
+func (m *Metrics) RecordDial(d time.Duration) {
+	if m == nil {
+		return
+	}
+	secs := d.Seconds()
+	i, _ := slices.BinarySearch(dialBuckets, secs)
+	m.mu.Lock()
+	m.initLocked()
+	m.dialCounts[i]++
+	m.dialCount++
+	m.dialSum += secs
+	m.mu.Unlock()
+}
+
+// TunnelOpened counts an established tunnel of the given protocol as active.
+func (m *Metrics) TunnelOpened(protocol string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.initLocked()
+	m.active[protocol]++
+	m.mu.Unlock()
+}
+
+// TunnelClosed removes a tunnel of the given protocol from the active count.
+func (m *Metrics) TunnelClosed(protocol string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.initLocked()
+	m.active[protocol]--
+	m.mu.Unlock()
+}
+
+// RecordBytes adds bytes copied through a tunnel, sent from the client to
+// upstream and received from upstream. Call it as the tunnel copies, so
+// long-lived tunnels are counted before they close.
+func (m *Metrics) RecordBytes(sent, received int64) {
+	if m == nil {
+		return
+	}
+	m.sent.Add(uint64(sent))
+	m.received.Add(uint64(received))
+}
+
+// RecordAuthFailure counts a failed authentication by reason, e.g.
+// "missing_token" or "invalid_token".
+func (m *Metrics) RecordAuthFailure(reason string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.initLocked()
+	m.authFailures[reason]++
+	m.mu.Unlock()
+}
+
+// RecordRoute counts an upstream routing decision, e.g. "tailnet" or
+// "direct".
+func (m *Metrics) RecordRoute(route string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.initLocked()
+	m.routes[route]++
+	m.mu.Unlock()
+}
+
+// ServeHTTP serves the metrics in the OpenMetrics text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	_ = m.WriteOpenMetrics(w)
+}
+
+// WriteOpenMetrics writes the metrics to w in the OpenMetrics text format.
+func (m *Metrics) WriteOpenMetrics(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.initLocked()
+	bytes := map[string]uint64{"sent": m.sent.Load(), "received": m.received.Load()}
+
+	var sb strings.Builder
+	writeFamily(&sb, "netrelay_tunnels_active", "gauge", "Currently established tunnels.",
+		"", "protocol", m.active)
+	writeFamily(&sb, "netrelay_tunnels", "counter", "Tunnel requests by result.",
+		"_total", "result", m.tunnels)
+	writeFamily(&sb, "netrelay_tunnel_bytes", "counter", "Bytes copied through tunnels, sent from client to upstream and received from upstream.",
+		"_total", "direction", bytes)
+	writeFamily(&sb, "netrelay_auth_failures", "counter", "Failed tunnel authentications by reason.",
+		"_total", "reason", m.authFailures)
+	writeFamily(&sb, "netrelay_route_decisions", "counter", "Upstream routing decisions by route.",
+		"_total", "route", m.routes)
+
+	const dial = "netrelay_upstream_dial_duration_seconds"
+	fmt.Fprintf(&sb, "# TYPE %s histogram\n# UNIT %s seconds\n# HELP %s Upstream dial latency.\n", dial, dial, dial)
+	var cum uint64
+	for i, le := range dialBuckets {
+		cum += m.dialCounts[i]
+		fmt.Fprintf(&sb, "%s_bucket{le=\"%s\"} %d\n", dial, strconv.FormatFloat(le, 'g', -1, 64), cum)
+	}
+	fmt.Fprintf(&sb, "%s_bucket{le=\"+Inf\"} %d\n", dial, m.dialCount)
+	fmt.Fprintf(&sb, "%s_sum %s\n", dial, strconv.FormatFloat(m.dialSum, 'g', -1, 64))
+	fmt.Fprintf(&sb, "%s_count %d\n", dial, m.dialCount)
+	sb.WriteString("# EOF\n")
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// writeFamily writes a single-label metric family.
+func writeFamily[V int64 | uint64](sb *strings.Builder, name, typ, help, suffix, label string, values map[string]V) {
+	fmt.Fprintf(sb, "# TYPE %s %s\n# HELP %s %s\n", name, typ, name, help)
+	for _, k := range slices.Sorted(maps.Keys(values)) {
+		fmt.Fprintf(sb, "%s%s{%s=\"%s\"} %d\n", name, suffix, label, labelEscaper.Replace(k), values[k])
+	}
+}
+
+// labelEscaper escapes label values as OpenMetrics requires: backslash,
+// double quote and line feed are the only escaped characters.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,171 @@
+package connect
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	cfg, _, ends := recordHooks()
+	cfg.Metrics = metrics
+	cfg.OnTunnelStart = nil
+	cfg.Policy = &Policy{Default: PolicyAllow, Rules: []PolicyRule{
+		{Name: "no-ssh", Action: PolicyDeny, Ports: []PortRange{{22, 22}}},
+	}}
+	proxyServer := httptest.NewServer(NewHandler(cfg))
+	defer proxyServer.Close()
+
+	dialer := NewH1Dialer(&ClientConfig{ProxyURL: proxyServer.URL})
+	testTCPEcho(t, dialer, startTCPEcho(t))
+	waitStats(t, ends)
+
+	ctx := context.Background()
+	if _, err := dialer.DialContext(ctx, "tcp", "127.0.0.1:22"); err == nil {
+		t.Fatal("Expected policy rejection")
+	}
+	if _, err := dialer.DialContext(ctx, "tcp", "127.0.0.1:1"); err == nil {
+		t.Fatal("Expected dial failure")
+	}
+	metrics.RecordAuthFailure("invalid_token")
+	metrics.RecordRoute("direct")
+
+	metricsServer := httptest.NewServer(metrics)
+	defer metricsServer.Close()
+	resp, err := http.Get(metricsServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text") {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	out := string(body)
+
+	for _, want := range []string{
+		`netrelay_tunnels_active{protocol="connect"} 0`,
+		`netrelay_tunnels_total{result="accepted"} 1`,
+		`netrelay_tunnels_total{result="rejected"} 1`,
+		`netrelay_tunnels_total{result="dial_failed"} 1`,
+		`netrelay_tunnel_bytes_total{direction="sent"} 19`,
+		`netrelay_tunnel_bytes_total{direction="received"} 19`,
+		`netrelay_auth_failures_total{reason="invalid_token"} 1`,
+		`netrelay_route_decisions_total{route="direct"} 1`,
+		`netrelay_upstream_dial_duration_seconds_bucket{le="+Inf"} 2`,
+		`netrelay_upstream_dial_duration_seconds_count 2`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Metrics output missing %q:\n%s", want, out)
+		}
+	}
+	if !strings.HasSuffix(out, "# EOF\n") {
+		t.Errorf("Metrics output not terminated with # EOF")
+	}
+}
+
+func TestMetricsDialBuckets(t *testing.T) {
+	m := NewMetrics()
+	m.RecordDial(5 * time.Millisecond)
+	m.RecordDial(200 * time.Millisecond)
+	m.RecordDial(time.Minute)
+
+	var sb strings.Builder
+	if err := m.WriteOpenMetrics(&sb); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`_bucket{le="0.005"} 1`,
+		`_bucket{le="0.1"} 1`,
+		`_bucket{le="0.25"} 2`,
+		`_bucket{le="10"} 2`,
+		`_bucket{le="+Inf"} 3`,
+	} {
+		if !strings.Contains(sb.String(), want) {
+			t.Errorf("Metrics output missing %q:\n%s", want, sb.String())
+		}
+	}
+
+	// A nil Metrics records nothing
+	var nilMetrics *Metrics
+	nilMetrics.RecordTunnel(ResultAccepted)
+	nilMetrics.TunnelOpened("connect")
+}
+
+func TestMetricsZeroValue(t *testing.T) {
+	// The zero Metrics is usable, and labels are escaped for OpenMetrics
+	var m Metrics
+	m.RecordTunnel(ResultAccepted)
+	m.RecordRoute("a\"b\\c\nd")
+	m.RecordBytes(3, 4)
+
+	var sb strings.Builder
+	if err := m.WriteOpenMetrics(&sb); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`netrelay_tunnels_total{result="accepted"} 1`,
+		`netrelay_route_decisions_total{route="a\"b\\c\nd"} 1`,
+		`netrelay_tunnel_bytes_total{direction="sent"} 3`,
+		`netrelay_tunnel_bytes_total{direction="received"} 4`,
+	} {
+		if !strings.Contains(sb.String(), want) {
+			t.Errorf("Metrics output missing %q:\n%s", want, sb.String())
+		}
+	}
+}
+
+// TestMetricsOpenTunnelBytes checks that bytes are counted while a tunnel is
+// still open, not only once it closes.
+func TestMetricsOpenTunnelBytes(t *testing.T) {
+	metrics := NewMetrics()
+	proxyServer := httptest.NewServer(NewHandler(&ServerConfig{Metrics: metrics}))
+	defer proxyServer.Close()
+
+	dialer := NewH1Dialer(&ClientConfig{ProxyURL: proxyServer.URL})
+	conn, err := dialer.DialContext(context.Background(), "tcp", startTCPEcho(t))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+
+	// The received bytes are counted just after they're written to the client
+	want := []string{
+		`netrelay_tunnels_active{protocol="connect"} 1`,
+		`netrelay_tunnel_bytes_total{direction="sent"} 5`,
+		`netrelay_tunnel_bytes_total{direction="received"} 5`,
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var sb strings.Builder
+		if err := metrics.WriteOpenMetrics(&sb); err != nil {
+			t.Fatal(err)
+		}
+		missing := ""
+		for _, w := range want {
+			if !strings.Contains(sb.String(), w) {
+				missing = w
+				break
+			}
+		}
+		if missing == "" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Metrics output missing %q:\n%s", missing, sb.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
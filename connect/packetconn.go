@@ -0,0 +1,131 @@
+package connect
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// packetConn carries UDP datagrams over a CONNECT-UDP stream as DATAGRAM
+// capsules. It implements both net.PacketConn and net.Conn, and only ever
+// exchanges datagrams with the single target it was opened for.
+type packetConn struct {
+	stream net.Conn
+	r      *bufio.Reader
+	raddr  net.Addr
+
+	rmu  sync.Mutex
+	rbuf []byte
+
+	wmu sync.Mutex
+}
+
+// newPacketConn creates a packetConn over an established CONNECT-UDP stream.
+func newPacketConn(stream net.Conn, r *bufio.Reader, target string) *packetConn {
+	if r == nil {
+		r = bufio.NewReader(stream)
+	}
+	return &packetConn{
+		stream: stream,
+		r:      r,
+		raddr:  udpTargetAddr(target),
+		rbuf:   make([]byte, maxCapsuleLength),
+	}
+}
+
+// udpTargetAddr returns a *net.UDPAddr for IP literal targets, which is what
+// most UDP consumers expect, or an opaque address for hostnames.
+func udpTargetAddr(target string) net.Addr {
+	if ap, err := netip.ParseAddrPort(target); err == nil {
+		return net.UDPAddrFromAddrPort(ap)
+	}
+	return &remoteAddr{addr: target}
+}
+
+// ReadFrom implements net.PacketConn.
+func (c *packetConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for {
+		typ, payload, err := readCapsule(c.r, c.rbuf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if typ != capsuleDatagram {
+			continue
+		}
+		data, ok, err := parseUDPDatagram(payload)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !ok {
+			continue
+		}
+		// Like a UDP socket, excess bytes of a datagram are discarded
+		n := copy(p, data)
+		return n, c.raddr, nil
+	}
+}
+
+// WriteTo implements net.PacketConn. The address is ignored, as the
+// association is bound to a single target.
+func (c *packetConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	if len(p) >= maxCapsuleLength {
+		return 0, errCapsuleTooLarge
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := writeDatagramCapsule(c.stream, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Read implements net.Conn.
+func (c *packetConn) Read(p []byte) (int, error) {
+	n, _, err := c.ReadFrom(p)
+	return n, err
+}
+
+// Write implements net.Conn.
+func (c *packetConn) Write(p []byte) (int, error) {
+	return c.WriteTo(p, c.raddr)
+}
+
+// Close implements net.PacketConn.
+func (c *packetConn) Close() error {
+	err := c.stream.Close()
+	if errors.Is(err, io.ErrClosedPipe) {
+		err = nil
+	}
+	return err
+}
+
+// LocalAddr implements net.PacketConn.
+func (c *packetConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4zero, Port: 0}
+}
+
+// RemoteAddr implements net.Conn.
+func (c *packetConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// SetDeadline implements net.PacketConn.
+func (c *packetConn) SetDeadline(t time.Time) error {
+	return c.stream.SetDeadline(t)
+}
+
+// SetReadDeadline implements net.PacketConn.
+func (c *packetConn) SetReadDeadline(t time.Time) error {
+	return c.stream.SetReadDeadline(t)
+}
+
+// SetWriteDeadline implements net.PacketConn.
+func (c *packetConn) SetWriteDeadline(t time.Time) error {
+	return c.stream.SetWriteDeadline(t)
+}
@@ -0,0 +1,289 @@
+package connect
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// PolicyAction is the action a policy rule takes when it matches.
+type PolicyAction string
+
+const (
+	// PolicyAllow accepts the tunnel.
+	PolicyAllow PolicyAction = "allow"
+	// PolicyDeny rejects the tunnel with 403 Forbidden.
+	PolicyDeny PolicyAction = "deny"
+)
+
+// Policy is a declarative destination access policy, evaluated by the
+// handlers after OnTunnel and before dialing the upstream target.
+//
+// Rules are evaluated in order and the first matching rule decides. If no rule
+// matches, Default applies; an empty Default denies.
+type Policy struct {
+	// Rules are the ordered policy rules.
+	Rules []PolicyRule `json:"rules"`
+
+	// Default is the action taken when no rule matches.
+	Default PolicyAction `json:"default,omitempty"`
+
+	// Resolver resolves hostname targets for CIDR conditions. Set it to
+	// the CachingResolver that dials the tunnels so the policy checks the
+	// addresses that are dialed. If nil, net.DefaultResolver is used.
+	Resolver Resolver `json:"-"`
+}
+
+// PolicyRule matches tunnels by destination and identity. Each non-empty
+// condition must match for the rule to apply, and a condition matches if any
+// of its entries does. A rule with no conditions matches every tunnel.
+type PolicyRule struct {
+	// Name identifies the rule in rejections and logs.
+	Name string `json:"name"`
+
+	// Action is taken when the rule matches.
+	Action PolicyAction `json:"action"`
+
+	// Hosts are glob patterns matched against the target host, e.g.
+	// "*.example.com" or "db-?.internal". Matching is case-insensitive.
+	Hosts []string `json:"hosts,omitempty"`
+
+	// Domains match the target host and all its subdomains, so
+	// "example.com" matches both "example.com" and "www.example.com".
+	Domains []string `json:"domains,omitempty"`
+
+	// CIDRs match the target's addresses. Hostname targets are resolved
+	// with Policy.Resolver, and every address must pass: a deny rule
+	// matches if any address is in a prefix, any other rule only if all
+	// are. A hostname that can't be resolved matches deny rules only.
+	CIDRs []netip.Prefix `json:"cidrs,omitempty"`
+
+	// Ports match the target port.
+	Ports []PortRange `json:"ports,omitempty"`
+
+	// Identities are glob patterns matched against the identity attached to
+	// the tunnel with SetIdentity. Unauthenticated tunnels never match.
+	Identities []string `json:"identities,omitempty"`
+}
+
+// PortRange is an inclusive range of ports. In JSON it is written as a single
+// port ("443") or a range ("8000-8999").
+type PortRange struct {
+	Low, High uint16
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (r *PortRange) UnmarshalText(text []byte) error {
+	lo, hi, isRange := strings.Cut(string(text), "-")
+	low, err := strconv.ParseUint(strings.TrimSpace(lo), 10, 16)
+	if err != nil {
+		return fmt.Errorf("connecttunnel: invalid port range %q", text)
+	}
+	high := low
+	if isRange {
+		high, err = strconv.ParseUint(strings.TrimSpace(hi), 10, 16)
+		if err != nil || high < low {
+			return fmt.Errorf("connecttunnel: invalid port range %q", text)
+		}
+	}
+	r.Low, r.High = uint16(low), uint16(high)
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (r PortRange) MarshalText() ([]byte, error) {
+	if r.Low == r.High {
+		return []byte(strconv.Itoa(int(r.Low))), nil
+	}
+	return []byte(fmt.Sprintf("%d-%d", r.Low, r.High)), nil
+}
+
+// Contains reports whether port is within the range.
+func (r PortRange) Contains(port uint16) bool {
+	return r.Low <= port && port <= r.High
+}
+
+// PolicyError is returned when a tunnel is denied by a Policy. It wraps
+// ErrTunnelRejected.
+type PolicyError struct {
+	// Rule is the name of the rule that denied the tunnel, or "default" if
+	// no rule matched.
+	Rule string
+
+	// Target is the host:port the tunnel was requested for.
+	Target string
+}
+
+// Error implements the error interface.
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("connecttunnel: tunnel to %s denied by policy rule %q", e.Target, e.Rule)
+}
+
+// Unwrap returns ErrTunnelRejected.
+func (e *PolicyError) Unwrap() error {
+	return ErrTunnelRejected
+}
+
+// ParsePolicy parses a JSON encoded policy and validates it.
+func ParsePolicy(data []byte) (*Policy, error) {
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("connecttunnel: parsing policy: %w", err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// LoadPolicyFile reads and parses a JSON policy file. See ParsePolicy.
+func LoadPolicyFile(name string) (*Policy, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("connecttunnel: reading policy: %w", err)
+	}
+	return ParsePolicy(data)
+}
+
+// Validate checks the policy's actions and patterns.
+func (p *Policy) Validate() error {
+	var errs []error
+	if p.Default != "" && p.Default != PolicyAllow && p.Default != PolicyDeny {
+		errs = append(errs, fmt.Errorf("connecttunnel: invalid default policy action %q", p.Default))
+	}
+	for i, r := range p.Rules {
+		if r.Action != PolicyAllow && r.Action != PolicyDeny {
+			errs = append(errs, fmt.Errorf("connecttunnel: policy rule %d (%s): invalid action %q", i, r.Name, r.Action))
+		}
+		for _, pat := range append(append([]string{}, r.Hosts...), r.Identities...) {
+			if _, err := path.Match(pat, ""); err != nil {
+				errs = append(errs, fmt.Errorf("connecttunnel: policy rule %d (%s): invalid pattern %q", i, r.Name, pat))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Match returns the first rule matching a tunnel to target (host:port) for the
+// given identity, or nil if none match. A hostname target is resolved, once,
+// if a rule with CIDRs is reached.
+func (p *Policy) Match(ctx context.Context, identity, target string) *PolicyRule {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	var addrs []netip.Addr
+	var lookupErr error
+	var resolved bool
+	lookup := func() ([]netip.Addr, error) {
+		if !resolved {
+			resolved = true
+			resolver := p.Resolver
+			if resolver == nil {
+				resolver = net.DefaultResolver
+			}
+			addrs, lookupErr = resolver.LookupNetIP(ctx, "ip", host)
+			if lookupErr == nil && len(addrs) == 0 {
+				lookupErr = fmt.Errorf("connecttunnel: no addresses for %s", host)
+			}
+		}
+		return addrs, lookupErr
+	}
+	for i := range p.Rules {
+		if p.Rules[i].matches(identity, host, uint16(port), lookup) {
+			return &p.Rules[i]
+		}
+	}
+	return nil
+}
+
+// Check evaluates the policy for a tunnel to target (host:port), returning a
+// *PolicyError if it is denied.
+func (p *Policy) Check(ctx context.Context, identity, target string) error {
+	rule := p.Match(ctx, identity, target)
+	if rule == nil {
+		if p.Default == PolicyAllow {
+			return nil
+		}
+		return &PolicyError{Rule: "default", Target: target}
+	}
+	if rule.Action == PolicyAllow {
+		return nil
+	}
+	return &PolicyError{Rule: rule.Name, Target: target}
+}
+
+// matches reports whether the rule applies to a tunnel to host and port for
+// identity. lookup resolves a hostname host for CIDR conditions; if nil,
+// hostnames never match them.
+func (r *PolicyRule) matches(identity, host string, port uint16, lookup func() ([]netip.Addr, error)) bool {
+	if len(r.Hosts) > 0 && !matchAny(r.Hosts, func(pat string) bool {
+		ok, _ := path.Match(strings.ToLower(pat), host)
+		return ok
+	}) {
+		return false
+	}
+	if len(r.Domains) > 0 && !matchAny(r.Domains, func(d string) bool {
+		d = strings.ToLower(strings.Trim(d, "."))
+		return host == d || strings.HasSuffix(host, "."+d)
+	}) {
+		return false
+	}
+	if len(r.Ports) > 0 && !matchAny(r.Ports, func(pr PortRange) bool { return pr.Contains(port) }) {
+		return false
+	}
+	if len(r.Identities) > 0 && (identity == "" || !matchAny(r.Identities, func(pat string) bool {
+		ok, _ := path.Match(pat, identity)
+		return ok
+	})) {
+		return false
+	}
+	// Checked last, so a hostname is only resolved if everything else matches
+	if len(r.CIDRs) > 0 && !r.matchesAddrs(host, lookup) {
+		return false
+	}
+	return true
+}
+
+// matchesAddrs reports whether the addresses of host satisfy the rule's CIDR
+// condition.
+func (r *PolicyRule) matchesAddrs(host string, lookup func() ([]netip.Addr, error)) bool {
+	var addrs []netip.Addr
+	if ip, err := netip.ParseAddr(host); err == nil {
+		addrs = []netip.Addr{ip}
+	} else if lookup == nil {
+		return false
+	} else if addrs, err = lookup(); err != nil {
+		// Fail closed: an address that can't be checked can't be allowed
+		return r.Action == PolicyDeny
+	}
+	inCIDRs := func(ip netip.Addr) bool {
+		return matchAny(r.CIDRs, func(p netip.Prefix) bool { return p.Contains(ip.Unmap()) })
+	}
+	if r.Action == PolicyDeny {
+		return matchAny(addrs, inCIDRs)
+	}
+	return !matchAny(addrs, func(ip netip.Addr) bool { return !inCIDRs(ip) })
+}
+
+func matchAny[T any](items []T, match func(T) bool) bool {
+	for _, it := range items {
+		if match(it) {
+			return true
+		}
+	}
+	return false
+}
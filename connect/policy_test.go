@@ -0,0 +1,216 @@
+package connect
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testPolicy = `{
+	"default": "deny",
+	"rules": [
+		{"name": "no-metadata", "action": "deny", "cidrs": ["169.254.0.0/16"]},
+		{"name": "admins", "action": "allow", "identities": ["*@admin.example.com"]},
+		{"name": "web", "action": "allow", "domains": ["example.com"], "ports": ["80", "443"]},
+		{"name": "dev", "action": "allow", "hosts": ["dev-*.internal"], "ports": ["8000-8999"]},
+		{"name": "loopback", "action": "allow", "cidrs": ["127.0.0.0/8"], "identities": ["alice"]}
+	]
+}`
+
+// hostsResolver resolves the hosts in the map, and no others.
+type hostsResolver map[string][]netip.Addr
+
+func (r hostsResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	if addrs, ok := r[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	p, err := ParsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("Failed to parse policy: %v", err)
+	}
+	public := netip.MustParseAddr("93.184.215.14")
+	p.Resolver = hostsResolver{
+		"www.example.com":      {public},
+		"example.com":          {public},
+		"notexample.com":       {public},
+		"db.internal":          {netip.MustParseAddr("10.1.2.4")},
+		"dev-db.internal":      {netip.MustParseAddr("10.1.2.3")},
+		"anything.test":        {public},
+		"localhost":            {netip.MustParseAddr("127.0.0.1")},
+		"metadata.example.com": {public, netip.MustParseAddr("169.254.169.254")},
+		"lo.example.com":       {netip.MustParseAddr("127.0.0.2")},
+		"mixed.example.com":    {netip.MustParseAddr("127.0.0.2"), public},
+	}
+
+	for _, tc := range []struct {
+		identity, target string
+		wantRule         string // empty if allowed
+	}{
+		{"", "www.example.com:443", ""},
+		{"", "example.com:80", ""},
+		{"", "EXAMPLE.COM.:443", ""},
+		{"", "notexample.com:443", "default"},
+		{"", "www.example.com:22", "default"},
+		{"", "dev-db.internal:8080", ""},
+		{"", "dev-db.internal:9000", "default"},
+		{"", "db.internal:8080", "default"},
+		{"", "169.254.169.254:80", "no-metadata"},
+		{"bob@admin.example.com", "169.254.169.254:80", "no-metadata"},
+		{"bob@admin.example.com", "anything.test:22", ""},
+		{"alice", "127.0.0.1:22", ""},
+		{"", "127.0.0.1:22", "default"},
+		{"bob", "127.0.0.1:22", "default"},
+		{"", "localhost:22", "default"},
+		{"alice", "localhost:22", ""},
+		// Hostnames are denied if any address is, and allowed by a CIDR
+		// only if every address is in it
+		{"", "metadata.example.com:443", "no-metadata"},
+		{"bob@admin.example.com", "metadata.example.com:22", "no-metadata"},
+		{"alice", "lo.example.com:22", ""},
+		{"alice", "mixed.example.com:22", "default"},
+		// A name that can't be resolved can't be checked
+		{"bob@admin.example.com", "unknown.test:22", "no-metadata"},
+	} {
+		err := p.Check(context.Background(), tc.identity, tc.target)
+		if tc.wantRule == "" {
+			if err != nil {
+				t.Errorf("Check(%q, %q): expected allow, got %v", tc.identity, tc.target, err)
+			}
+			continue
+		}
+		pe, ok := err.(*PolicyError)
+		if !ok || pe.Rule != tc.wantRule {
+			t.Errorf("Check(%q, %q): expected denial by %q, got %v", tc.identity, tc.target, tc.wantRule, err)
+		}
+	}
+}
+
+func TestParsePolicyInvalid(t *testing.T) {
+	for _, data := range []string{
+		`{"rules": [{"name": "a", "action": "maybe"}]}`,
+		`{"rules": [{"name": "a", "action": "allow", "ports": ["99999"]}]}`,
+		`{"rules": [{"name": "a", "action": "allow", "ports": ["10-1"]}]}`,
+		`{"rules": [{"name": "a", "action": "allow", "cidrs": ["10.0.0.0"]}]}`,
+		`{"rules": [{"name": "a", "action": "allow", "hosts": ["[a-"]}]}`,
+		`{"default": "permit"}`,
+	} {
+		if _, err := ParsePolicy([]byte(data)); err == nil {
+			t.Errorf("Expected error parsing %s", data)
+		}
+	}
+}
+
+func TestLoadPolicyFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(name, []byte(testPolicy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := LoadPolicyFile(name)
+	if err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+	if len(p.Rules) != 5 {
+		t.Errorf("Expected 5 rules, got %d", len(p.Rules))
+	}
+}
+
+// TestHandlerPolicy tests that the handler enforces the policy with the
+// identity attached by OnTunnel, and names the denying rule.
+func TestHandlerPolicy(t *testing.T) {
+	echoAddr := startTCPEcho(t)
+	_, echoPort, _ := net.SplitHostPort(echoAddr)
+
+	policy := &Policy{Rules: []PolicyRule{
+		{Name: "alice-loopback", Action: PolicyAllow, CIDRs: mustPrefixes(t, "127.0.0.0/8"), Identities: []string{"alice"}},
+	}}
+	proxyServer := httptest.NewServer(NewHandler(&ServerConfig{
+		Policy: policy,
+		OnTunnel: func(ctx context.Context, req *http.Request) error {
+			SetIdentity(ctx, req.Header.Get("X-User"))
+			return nil
+		},
+	}))
+	defer proxyServer.Close()
+
+	userDialer := func(user string) Dialer {
+		return NewH1Dialer(&ClientConfig{
+			ProxyURL: proxyServer.URL,
+			HeadersForRequest: func(req *http.Request) (http.Header, error) {
+				return http.Header{"X-User": []string{user}}, nil
+			},
+		})
+	}
+
+	testTCPEcho(t, userDialer("alice"), echoAddr)
+
+	_, err := userDialer("bob").DialContext(context.Background(), "tcp", echoAddr)
+	if pe, ok := err.(*ProxyError); !ok || pe.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected 403 ProxyError, got: %v", err)
+	}
+
+	// The rejection body names the rule
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxyServer.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	_, _ = io.WriteString(conn, "CONNECT 127.0.0.1:"+echoPort+" HTTP/1.1\r\nHost: 127.0.0.1:"+echoPort+"\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), `policy rule "default"`) {
+		t.Errorf("Expected rejection naming the default rule, got %q", body)
+	}
+}
+
+// TestHandlerPolicyResolvesHostnames tests that a CIDR deny rule can't be
+// bypassed by a hostname that resolves into the denied range.
+func TestHandlerPolicyResolvesHostnames(t *testing.T) {
+	echoAddr := startTCPEcho(t)
+	_, echoPort, _ := net.SplitHostPort(echoAddr)
+
+	proxyServer := httptest.NewServer(NewHandler(&ServerConfig{
+		Policy: &Policy{
+			Default:  PolicyAllow,
+			Rules:    []PolicyRule{{Name: "no-loopback", Action: PolicyDeny, CIDRs: mustPrefixes(t, "127.0.0.0/8")}},
+			Resolver: hostsResolver{"internal.example.com": {netip.MustParseAddr("127.0.0.1")}},
+		},
+	}))
+	defer proxyServer.Close()
+
+	resp, _ := rawConnect(t, proxyServer.Listener.Addr().String(), "internal.example.com:"+echoPort, "")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 for a hostname resolving to a denied address, got %s", resp.Status)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), `policy rule "no-loopback"`) {
+		t.Errorf("Expected rejection naming the no-loopback rule, got %q", body)
+	}
+}
+
+func mustPrefixes(t *testing.T, cidrs ...string) []netip.Prefix {
+	t.Helper()
+	var ps []netip.Prefix
+	for _, c := range cidrs {
+		p, err := netip.ParsePrefix(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ps = append(ps, p)
+	}
+	return ps
+}
@@ -0,0 +1,411 @@
+package connect
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol v2 TLV types.
+const (
+	// ProxyTLVUniqueID (PP2_TYPE_UNIQUE_ID) carries the tunnel ID in headers
+	// sent upstream.
+	ProxyTLVUniqueID byte = 0x05
+	// ProxyTLVIdentity is the first of the types reserved for custom use
+	// (PP2_TYPE_MIN_CUSTOM), suggested for ServerConfig.ProxyIdentityTLV.
+	ProxyTLVIdentity byte = 0xE0
+)
+
+const (
+	// maxProxyV1Header is the longest v1 header, including the CRLF.
+	maxProxyV1Header = 107
+
+	// defaultProxyHeaderTimeout limits how long ProxyProtocolListener
+	// waits for a header.
+	defaultProxyHeaderTimeout = 10 * time.Second
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ErrNoProxyHeader is returned by ReadProxyHeader if the data doesn't start
+// with a PROXY protocol header.
+var ErrNoProxyHeader = errors.New("connecttunnel: no PROXY protocol header")
+
+// ProxyHeader is a PROXY protocol header, which a proxy or load balancer sends
+// at the start of a TCP connection to pass on the addresses of the connection
+// it accepted.
+type ProxyHeader struct {
+	// Version is 1 (text) or 2 (binary).
+	Version int
+
+	// Source and Destination are the client's address and the address it
+	// connected to. They are the zero value if the sender doesn't know them
+	// ("UNKNOWN" in v1, LOCAL or AF_UNSPEC in v2), in which case the
+	// receiver uses the connection's own addresses.
+	Source, Destination netip.AddrPort
+
+	// TLVs are the v2 type-length-value extensions. They are not sent in v1
+	// headers.
+	TLVs []ProxyTLV
+}
+
+// ProxyTLV is a PROXY protocol v2 type-length-value extension.
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// TLV returns the value of the first TLV of type typ, if any.
+func (h *ProxyHeader) TLV(typ byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Marshal encodes the header. The addresses must be of the same family, or
+// both unset.
+func (h *ProxyHeader) Marshal() ([]byte, error) {
+	src, dst := h.Source, h.Destination
+	known := src.IsValid() && dst.IsValid()
+	if known && src.Addr().Is4() != dst.Addr().Is4() {
+		return nil, fmt.Errorf("connecttunnel: PROXY header addresses %s and %s are of different families", src, dst)
+	}
+
+	switch h.Version {
+	case 1:
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		family := "TCP6"
+		if src.Addr().Is4() {
+			family = "TCP4"
+		}
+		return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family, src.Addr(), dst.Addr(), src.Port(), dst.Port()), nil
+	case 2:
+		b := append([]byte(nil), proxyV2Signature...)
+		b = append(b, 0x21) // version 2, PROXY command
+		switch {
+		case !known:
+			b = append(b, 0x00, 0, 0) // AF_UNSPEC
+		case src.Addr().Is4():
+			b = append(b, 0x11, 0, 0) // TCP over IPv4
+			b = append(b, src.Addr().AsSlice()...)
+			b = append(b, dst.Addr().AsSlice()...)
+			b = binary.BigEndian.AppendUint16(b, src.Port())
+			b = binary.BigEndian.AppendUint16(b, dst.Port())
+		default:
+			b = append(b, 0x21, 0, 0) // TCP over IPv6
+			b = append(b, src.Addr().AsSlice()...)
+			b = append(b, dst.Addr().AsSlice()...)
+			b = binary.BigEndian.AppendUint16(b, src.Port())
+			b = binary.BigEndian.AppendUint16(b, dst.Port())
+		}
+		for _, tlv := range h.TLVs {
+			if len(tlv.Value) > 0xffff {
+				return nil, fmt.Errorf("connecttunnel: PROXY header TLV 0x%02x too long", tlv.Type)
+			}
+			b = append(b, tlv.Type)
+			b = binary.BigEndian.AppendUint16(b, uint16(len(tlv.Value)))
+			b = append(b, tlv.Value...)
+		}
+		length := len(b) - 16
+		if length > 0xffff {
+			return nil, errors.New("connecttunnel: PROXY header too long")
+		}
+		binary.BigEndian.PutUint16(b[14:16], uint16(length))
+		return b, nil
+	default:
+		return nil, fmt.Errorf("connecttunnel: invalid PROXY protocol version %d", h.Version)
+	}
+}
+
+// ReadProxyHeader reads a v1 or v2 PROXY protocol header from r. If r doesn't
+// start with one, it returns ErrNoProxyHeader and nothing is consumed.
+func ReadProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case 'P':
+		if b, err := r.Peek(6); err != nil || string(b) != "PROXY " {
+			return nil, ErrNoProxyHeader
+		}
+		return readProxyV1(r)
+	case '\r':
+		if b, err := r.Peek(len(proxyV2Signature)); err != nil || !bytes.Equal(b, proxyV2Signature) {
+			return nil, ErrNoProxyHeader
+		}
+		return readProxyV2(r)
+	}
+	return nil, ErrNoProxyHeader
+}
+
+func readProxyV1(r *bufio.Reader) (*ProxyHeader, error) {
+	var line []byte
+	for len(line) < maxProxyV1Header {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("connecttunnel: reading PROXY header: %w", err)
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, errors.New("connecttunnel: invalid PROXY v1 header: missing CRLF")
+	}
+
+	h := &ProxyHeader{Version: 1}
+	fields := strings.Split(s, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("connecttunnel: invalid PROXY v1 header %q", s)
+	}
+	var err error
+	if h.Source, err = parseProxyV1Addr(fields[2], fields[4], fields[1] == "TCP4"); err != nil {
+		return nil, err
+	}
+	if h.Destination, err = parseProxyV1Addr(fields[3], fields[5], fields[1] == "TCP4"); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func parseProxyV1Addr(ip, port string, is4 bool) (netip.AddrPort, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Is4() != is4 || addr.Zone() != "" {
+		return netip.AddrPort{}, fmt.Errorf("connecttunnel: invalid PROXY v1 address %q", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return netip.AddrPort{}, fmt.Errorf("connecttunnel: invalid PROXY v1 port %q", port)
+	}
+	return netip.AddrPortFrom(addr, uint16(p)), nil
+}
+
+func readProxyV2(r *bufio.Reader) (*ProxyHeader, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, fmt.Errorf("connecttunnel: reading PROXY header: %w", err)
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("connecttunnel: unsupported PROXY protocol version %d", fixed[12]>>4)
+	}
+	command, family := fixed[12]&0x0f, fixed[13]
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("connecttunnel: reading PROXY header: %w", err)
+	}
+
+	h := &ProxyHeader{Version: 2}
+	var addrLen int
+	switch family >> 4 {
+	case 0x0: // AF_UNSPEC
+	case 0x1: // AF_INET
+		addrLen = 12
+	case 0x2: // AF_INET6
+		addrLen = 36
+	case 0x3: // AF_UNIX
+		addrLen = 216
+	default:
+		return nil, fmt.Errorf("connecttunnel: invalid PROXY v2 address family 0x%02x", family)
+	}
+	if len(body) < addrLen {
+		return nil, errors.New("connecttunnel: invalid PROXY v2 header: truncated addresses")
+	}
+	switch command {
+	case 0x0: // LOCAL: the connection was made by the proxy itself
+	case 0x1: // PROXY
+		switch addrLen {
+		case 12:
+			h.Source = netip.AddrPortFrom(netip.AddrFrom4([4]byte(body[0:4])), binary.BigEndian.Uint16(body[8:10]))
+			h.Destination = netip.AddrPortFrom(netip.AddrFrom4([4]byte(body[4:8])), binary.BigEndian.Uint16(body[10:12]))
+		case 36:
+			h.Source = netip.AddrPortFrom(netip.AddrFrom16([16]byte(body[0:16])), binary.BigEndian.Uint16(body[32:34]))
+			h.Destination = netip.AddrPortFrom(netip.AddrFrom16([16]byte(body[16:32])), binary.BigEndian.Uint16(body[34:36]))
+		}
+	default:
+		return nil, fmt.Errorf("connecttunnel: invalid PROXY v2 command 0x%x", command)
+	}
+
+	for tlvs := body[addrLen:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 {
+			return nil, errors.New("connecttunnel: invalid PROXY v2 header: truncated TLV")
+		}
+		n := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+n {
+			return nil, errors.New("connecttunnel: invalid PROXY v2 header: truncated TLV")
+		}
+		h.TLVs = append(h.TLVs, ProxyTLV{Type: tlvs[0], Value: tlvs[3 : 3+n]})
+		tlvs = tlvs[3+n:]
+	}
+	return h, nil
+}
+
+// ProxyProtocolListener wraps a listener to accept PROXY protocol v1 and v2
+// headers, as sent by HAProxy and TCP load balancers, so the connections it
+// accepts report the original client and destination addresses. Serving
+// NewHandler from it makes req.RemoteAddr, the per-client limits and the logs
+// use the real client address.
+//
+// The header is read on the connection's first Read, RemoteAddr or
+// LocalAddr call rather than in Accept, so a slow peer doesn't hold up other
+// connections.
+type ProxyProtocolListener struct {
+	net.Listener
+
+	// Trusted are the peers, typically the load balancers, whose headers
+	// are accepted. Connections from other peers are passed through
+	// unchanged, so a header they send is not trusted. If empty, no peer
+	// is trusted: list the load balancers' prefixes, as any client that
+	// can connect directly could otherwise claim any address.
+	Trusted []netip.Prefix
+
+	// Required closes connections from trusted peers that don't start with
+	// a header. Otherwise they are used with their own addresses.
+	Required bool
+
+	// HeaderTimeout limits how long to wait for the header. If zero, 10s is
+	// used.
+	HeaderTimeout time.Duration
+}
+
+// Accept waits for and returns the next connection.
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusts(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	timeout := l.HeaderTimeout
+	if timeout <= 0 {
+		timeout = defaultProxyHeaderTimeout
+	}
+	return &proxyProtocolConn{Conn: conn, timeout: timeout, required: l.Required}, nil
+}
+
+// trusts reports whether a header from addr is accepted.
+func (l *ProxyProtocolListener) trusts(addr net.Addr) bool {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	for _, p := range l.Trusted {
+		if p.Contains(ap.Addr().Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtocolConn is a connection that may start with a PROXY header.
+type proxyProtocolConn struct {
+	net.Conn
+	timeout  time.Duration
+	required bool
+
+	once   sync.Once
+	r      *bufio.Reader
+	header *ProxyHeader
+	err    error
+}
+
+// readHeader reads the header, once.
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.r = bufio.NewReader(c.Conn)
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.header, c.err = ReadProxyHeader(c.r)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+		if errors.Is(c.err, ErrNoProxyHeader) && !c.required {
+			c.err = nil
+		}
+		if c.err != nil {
+			_ = c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.header != nil && c.header.Source.IsValid() {
+		return net.TCPAddrFromAddrPort(c.header.Source)
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.header != nil && c.header.Destination.IsValid() {
+		return net.TCPAddrFromAddrPort(c.header.Destination)
+	}
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite shuts down the write side of the connection, if it supports it,
+// so tunnels served through the listener can be half-closed.
+func (c *proxyProtocolConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// sendProxyHeader writes the UpstreamProxyProtocol header for a tunnel from
+// the client of req to upstream.
+func (c *ServerConfig) sendProxyHeader(upstream net.Conn, req *http.Request, t *serverTunnel) error {
+	h := &ProxyHeader{Version: c.UpstreamProxyProtocol}
+	src, err1 := netip.ParseAddrPort(req.RemoteAddr)
+	dst, err2 := netip.ParseAddrPort(upstream.RemoteAddr().String())
+	if err1 == nil && err2 == nil {
+		src = netip.AddrPortFrom(src.Addr().Unmap().WithZone(""), src.Port())
+		dst = netip.AddrPortFrom(dst.Addr().Unmap().WithZone(""), dst.Port())
+		if src.Addr().Is4() != dst.Addr().Is4() {
+			// Send both as IPv6, with the IPv4 one mapped
+			src = netip.AddrPortFrom(netip.AddrFrom16(src.Addr().As16()), src.Port())
+			dst = netip.AddrPortFrom(netip.AddrFrom16(dst.Addr().As16()), dst.Port())
+		}
+		h.Source, h.Destination = src, dst
+	}
+	if h.Version == 2 {
+		h.TLVs = append(h.TLVs, ProxyTLV{Type: ProxyTLVUniqueID, Value: []byte(t.stats.ID)})
+		if identity := Identity(t.ctx); identity != "" && c.ProxyIdentityTLV != 0 {
+			h.TLVs = append(h.TLVs, ProxyTLV{Type: c.ProxyIdentityTLV, Value: []byte(identity)})
+		}
+	}
+	b, err := h.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = upstream.Write(b)
+	return err
+}
@@ -0,0 +1,291 @@
+package connect
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		header ProxyHeader
+		want   string // v1 encoding, if checked
+	}{
+		{
+			name:   "v1 IPv4",
+			header: ProxyHeader{Version: 1, Source: netip.MustParseAddrPort("192.0.2.1:56324"), Destination: netip.MustParseAddrPort("198.51.100.2:443")},
+			want:   "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n",
+		},
+		{
+			name:   "v1 IPv6",
+			header: ProxyHeader{Version: 1, Source: netip.MustParseAddrPort("[2001:db8::1]:56324"), Destination: netip.MustParseAddrPort("[2001:db8::2]:443")},
+			want:   "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n",
+		},
+		{
+			name:   "v1 unknown",
+			header: ProxyHeader{Version: 1},
+			want:   "PROXY UNKNOWN\r\n",
+		},
+		{
+			name:   "v2 IPv4",
+			header: ProxyHeader{Version: 2, Source: netip.MustParseAddrPort("192.0.2.1:56324"), Destination: netip.MustParseAddrPort("198.51.100.2:443")},
+		},
+		{
+			name: "v2 IPv6 with TLVs",
+			header: ProxyHeader{
+				Version:     2,
+				Source:      netip.MustParseAddrPort("[2001:db8::1]:56324"),
+				Destination: netip.MustParseAddrPort("[2001:db8::2]:443"),
+				TLVs:        []ProxyTLV{{Type: ProxyTLVUniqueID, Value: []byte("tunnel")}, {Type: ProxyTLVIdentity, Value: []byte("alice")}},
+			},
+		},
+		{
+			name:   "v2 unknown",
+			header: ProxyHeader{Version: 2, TLVs: []ProxyTLV{{Type: ProxyTLVIdentity, Value: []byte("alice")}}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := tc.header.Marshal()
+			if err != nil {
+				t.Fatalf("Marshal failed: %v", err)
+			}
+			if tc.want != "" && string(b) != tc.want {
+				t.Errorf("Marshal = %q, want %q", b, tc.want)
+			}
+			r := bufio.NewReader(io.MultiReader(bytes.NewReader(b), strings.NewReader("GET / HTTP/1.1\r\n")))
+			got, err := ReadProxyHeader(r)
+			if err != nil {
+				t.Fatalf("ReadProxyHeader failed: %v", err)
+			}
+			if got.Version != tc.header.Version || got.Source != tc.header.Source || got.Destination != tc.header.Destination {
+				t.Errorf("ReadProxyHeader = %+v, want %+v", got, tc.header)
+			}
+			if fmt.Sprint(got.TLVs) != fmt.Sprint(tc.header.TLVs) {
+				t.Errorf("TLVs = %v, want %v", got.TLVs, tc.header.TLVs)
+			}
+			if rest, _ := r.ReadString('\n'); rest != "GET / HTTP/1.1\r\n" {
+				t.Errorf("Data after header = %q", rest)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input string
+		want  error // ErrNoProxyHeader, or nil for any other error
+	}{
+		{name: "HTTP request", input: "GET / HTTP/1.1\r\n\r\n", want: ErrNoProxyHeader},
+		{name: "POST request", input: "POST / HTTP/1.1\r\n\r\n", want: ErrNoProxyHeader},
+		{name: "v1 bad family", input: "PROXY UDP4 192.0.2.1 198.51.100.2 1 2\r\n"},
+		{name: "v1 mismatched family", input: "PROXY TCP4 2001:db8::1 198.51.100.2 1 2\r\n"},
+		{name: "v1 bad port", input: "PROXY TCP4 192.0.2.1 198.51.100.2 65536 2\r\n"},
+		{name: "v1 missing CRLF", input: "PROXY TCP4 192.0.2.1 198.51.100.2 1 2\n"},
+		{name: "v1 too long", input: "PROXY UNKNOWN " + strings.Repeat("x", 120) + "\r\n"},
+		{name: "v2 truncated", input: string(proxyV2Signature) + "\x21\x11\x00\x0c\x01\x02"},
+		{name: "v2 bad version", input: string(proxyV2Signature) + "\x31\x11\x00\x00"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ReadProxyHeader(bufio.NewReader(strings.NewReader(tc.input)))
+			if err == nil {
+				t.Fatal("ReadProxyHeader succeeded, want error")
+			}
+			if got := errors.Is(err, ErrNoProxyHeader); got != (tc.want == ErrNoProxyHeader) {
+				t.Errorf("ReadProxyHeader error = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	loopback := mustPrefixes(t, "127.0.0.0/8")
+	for _, tc := range []struct {
+		name     string
+		trusted  []netip.Prefix
+		required bool
+		header   string
+		want     string // remote address seen by the handler, "" if the request fails
+	}{
+		{name: "v1", trusted: loopback, header: "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n", want: "192.0.2.1:56324"},
+		{name: "no header", trusted: loopback, want: "127.0.0.1"},
+		{name: "required", trusted: loopback, required: true},
+		{name: "untrusted", trusted: mustPrefixes(t, "192.0.2.0/24"), header: "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n"},
+		{name: "untrusted without header", trusted: mustPrefixes(t, "192.0.2.0/24"), required: true, want: "127.0.0.1"},
+		{name: "nobody trusted", header: "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n"},
+		{name: "nobody trusted without header", want: "127.0.0.1"},
+		{name: "unknown", trusted: loopback, header: "PROXY UNKNOWN\r\n", want: "127.0.0.1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Failed to listen: %v", err)
+			}
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				_, _ = io.WriteString(w, req.RemoteAddr)
+			}))
+			server.Listener = &ProxyProtocolListener{Listener: ln, Trusted: tc.trusted, Required: tc.required}
+			server.Start()
+			defer server.Close()
+
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatalf("Failed to dial: %v", err)
+			}
+			defer func() { _ = conn.Close() }()
+			fmt.Fprintf(conn, "%sGET / HTTP/1.1\r\nHost: test\r\n\r\n", tc.header)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if tc.want == "" {
+				// An untrusted header is left for the HTTP server, which
+				// rejects it rather than taking its address
+				if err == nil && resp.StatusCode == http.StatusOK {
+					body, _ := io.ReadAll(resp.Body)
+					t.Errorf("Request succeeded with RemoteAddr %q, want failure", body)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if !strings.HasPrefix(string(body), tc.want) {
+				t.Errorf("RemoteAddr = %q, want %q", body, tc.want)
+			}
+		})
+	}
+}
+
+// TestProxyProtocolListenerHalfClose checks that a tunnel served through a
+// ProxyProtocolListener passes on the upstream closing its write side, while
+// the client can still send.
+func TestProxyProtocolListenerHalfClose(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer func() { _ = upstream.Close() }()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		_, _ = io.WriteString(conn, "hello")
+		_ = conn.(*net.TCPConn).CloseWrite()
+		b, _ := io.ReadAll(conn)
+		received <- string(b)
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := httptest.NewUnstartedServer(NewHandler(&ServerConfig{}))
+	server.Listener = &ProxyProtocolListener{Listener: ln, Trusted: mustPrefixes(t, "127.0.0.0/8")}
+	server.Start()
+	defer server.Close()
+
+	conn, err := NewH1Dialer(&ClientConfig{ProxyURL: server.URL}).DialContext(context.Background(), "tcp", upstream.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial through proxy: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	// The upstream's EOF reaches the client
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(conn)
+	if err != nil || string(b) != "hello" {
+		t.Fatalf("Read %q, %v, want hello and EOF", b, err)
+	}
+
+	// and the other direction stays open
+	if _, err := io.WriteString(conn, "more"); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	_ = conn.(closeWriter).CloseWrite()
+	select {
+	case got := <-received:
+		if got != "more" {
+			t.Errorf("Upstream received %q, want more", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the upstream")
+	}
+}
+
+func TestUpstreamProxyProtocol(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Failed to listen: %v", err)
+			}
+			defer func() { _ = ln.Close() }()
+			headers := make(chan *ProxyHeader, 1)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer func() { _ = conn.Close() }()
+				r := bufio.NewReader(conn)
+				h, err := ReadProxyHeader(r)
+				if err != nil {
+					t.Errorf("ReadProxyHeader failed: %v", err)
+				}
+				headers <- h
+				_, _ = io.Copy(conn, r)
+			}()
+
+			cfg, _, ends := recordHooks()
+			cfg.UpstreamProxyProtocol = version
+			cfg.ProxyIdentityTLV = ProxyTLVIdentity
+			proxyServer := httptest.NewServer(NewHandler(cfg))
+			defer proxyServer.Close()
+
+			dialer := NewH1Dialer(&ClientConfig{ProxyURL: proxyServer.URL})
+			conn, err := dialer.DialContext(context.Background(), "tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatalf("Failed to dial through proxy: %v", err)
+			}
+			msg := []byte("after header")
+			if _, err := conn.Write(msg); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			buf := make([]byte, len(msg))
+			if _, err := io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, msg) {
+				t.Fatalf("Echo = %q, %v", buf, err)
+			}
+			_ = conn.Close()
+
+			h := <-headers
+			if h == nil {
+				t.Fatal("No header received")
+			}
+			if !h.Source.Addr().IsLoopback() || h.Destination.String() != ln.Addr().String() {
+				t.Errorf("Header addresses = %s -> %s, want loopback -> %s", h.Source, h.Destination, ln.Addr())
+			}
+			stats := waitStats(t, ends)
+			if version == 2 {
+				if id, _ := h.TLV(ProxyTLVUniqueID); string(id) != stats.ID {
+					t.Errorf("Unique ID TLV = %q, want %q", id, stats.ID)
+				}
+				if identity, _ := h.TLV(ProxyTLVIdentity); string(identity) != "alice" {
+					t.Errorf("Identity TLV = %q, want alice", identity)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Proxy-Status (RFC 9209) error types reported by the handlers.
+const (
+	ProxyStatusDNSTimeout             = "dns_timeout"
+	ProxyStatusDNSError               = "dns_error"
+	ProxyStatusDestinationProhibited  = "destination_ip_prohibited"
+	ProxyStatusDestinationUnroutable  = "destination_ip_unroutable"
+	ProxyStatusDestinationUnavailable = "destination_unavailable"
+	ProxyStatusConnectionRefused      = "connection_refused"
+	ProxyStatusConnectionTimeout      = "connection_timeout"
+	ProxyStatusConnectionTerminated   = "connection_terminated"
+	ProxyStatusRequestDenied          = "http_request_denied"
+	ProxyStatusInternalError          = "proxy_internal_error"
+)
+
+// DefaultProxyName identifies the proxy in Proxy-Status headers if
+// ServerConfig.ProxyName is empty.
+const DefaultProxyName = "netrelay"
+
+const proxyStatusHeader = "Proxy-Status"
+
+// ProxyStatus is a member of a Proxy-Status header (RFC 9209), describing how
+// an intermediary handled a request.
+type ProxyStatus struct {
+	// Proxy identifies the intermediary.
+	Proxy string
+
+	// Error is the proxy error type, e.g. "dns_error", "connection_refused"
+	// or "destination_ip_prohibited". It is empty if the intermediary didn't
+	// report an error.
+	Error string
+
+	// Details is a human readable description of the error.
+	Details string
+
+	// RCode is the DNS response code for dns_error, e.g. "NXDOMAIN".
+	RCode string
+}
+
+// String returns the member in Structured Fields (RFC 8941) syntax.
+func (s ProxyStatus) String() string {
+	var b strings.Builder
+	b.WriteString(sfItem(s.Proxy))
+	if s.Error != "" {
+		b.WriteString("; error=" + sfItem(s.Error))
+	}
+	if s.RCode != "" {
+		b.WriteString("; rcode=" + sfString(s.RCode))
+	}
+	if s.Details != "" {
+		b.WriteString("; details=" + sfString(s.Details))
+	}
+	return b.String()
+}
+
+// ParseProxyStatus parses the value of a Proxy-Status header. The first
+// member is the intermediary closest to the origin server. Unknown parameters
+// are ignored.
+func ParseProxyStatus(value string) ([]ProxyStatus, error) {
+	p := &sfParser{s: value}
+	var statuses []ProxyStatus
+	for {
+		p.skipSpace()
+		if p.done() {
+			return statuses, nil
+		}
+		var st ProxyStatus
+		var err error
+		if st.Proxy, err = p.bareItem(); err != nil {
+			return nil, err
+		}
+		for p.skipSpace(); p.peek() == ';'; p.skipSpace() {
+			p.i++
+			p.skipSpace()
+			key := p.key()
+			val := "?1" // boolean true
+			if p.peek() == '=' {
+				p.i++
+				if val, err = p.bareItem(); err != nil {
+					return nil, err
+				}
+			}
+			switch key {
+			case "error":
+				st.Error = val
+			case "details":
+				st.Details = val
+			case "rcode":
+				st.RCode = val
+			}
+		}
+		statuses = append(statuses, st)
+		if p.done() {
+			return statuses, nil
+		}
+		if p.peek() != ',' {
+			return nil, fmt.Errorf("connecttunnel: invalid Proxy-Status %q", value)
+		}
+		p.i++
+	}
+}
+
+// proxyStatusError classifies an upstream dial error as a Proxy-Status
+// member.
+func proxyStatusError(err error) ProxyStatus {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, ErrDestinationDenied):
+		return ProxyStatus{Error: ProxyStatusDestinationProhibited}
+	case errors.As(err, &dnsErr):
+		if dnsErr.IsTimeout {
+			return ProxyStatus{Error: ProxyStatusDNSTimeout}
+		}
+		if dnsErr.IsNotFound {
+			return ProxyStatus{Error: ProxyStatusDNSError, RCode: "NXDOMAIN"}
+		}
+		return ProxyStatus{Error: ProxyStatusDNSError}
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ProxyStatus{Error: ProxyStatusConnectionRefused}
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return ProxyStatus{Error: ProxyStatusDestinationUnroutable}
+	case errors.Is(err, context.DeadlineExceeded), isTimeout(err):
+		return ProxyStatus{Error: ProxyStatusConnectionTimeout}
+	default:
+		return ProxyStatus{Error: ProxyStatusDestinationUnavailable}
+	}
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// sfItem formats s as a token if it is one, otherwise as a string.
+func sfItem(s string) string {
+	if isSFToken(s) {
+		return s
+	}
+	return sfString(s)
+}
+
+// sfString formats s as a Structured Fields string. Characters outside
+// printable ASCII are replaced.
+func sfString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r > 0x7e:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func isSFToken(s string) bool {
+	if s == "" || !(isAlpha(s[0]) || s[0] == '*') {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isTChar(s[i]) && s[i] != ':' && s[i] != '/' {
+			return false
+		}
+	}
+	return true
+}
+
+func isAlpha(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isTChar(c byte) bool {
+	return isAlpha(c) || '0' <= c && c <= '9' || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// sfParser parses the subset of Structured Fields (RFC 8941) lists used by
+// Proxy-Status: bare items are returned as strings.
+type sfParser struct {
+	s string
+	i int
+}
+
+func (p *sfParser) done() bool { return p.i >= len(p.s) }
+
+func (p *sfParser) peek() byte {
+	if p.done() {
+		return 0
+	}
+	return p.s[p.i]
+}
+
+func (p *sfParser) skipSpace() {
+	for !p.done() && (p.s[p.i] == ' ' || p.s[p.i] == '\t') {
+		p.i++
+	}
+}
+
+func (p *sfParser) key() string {
+	start := p.i
+	for !p.done() {
+		c := p.s[p.i]
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '_' || c == '-' || c == '.' || c == '*') {
+			break
+		}
+		p.i++
+	}
+	return p.s[start:p.i]
+}
+
+func (p *sfParser) bareItem() (string, error) {
+	switch c := p.peek(); {
+	case c == '"':
+		var b strings.Builder
+		for p.i++; !p.done(); p.i++ {
+			switch c := p.s[p.i]; c {
+			case '\\':
+				p.i++
+				if p.done() {
+					return "", fmt.Errorf("connecttunnel: invalid Proxy-Status string in %q", p.s)
+				}
+				b.WriteByte(p.s[p.i])
+			case '"':
+				p.i++
+				return b.String(), nil
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return "", fmt.Errorf("connecttunnel: unterminated Proxy-Status string in %q", p.s)
+	case c == '-' || '0' <= c && c <= '9':
+		start := p.i
+		for p.i++; !p.done() && strings.IndexByte("0123456789.", p.s[p.i]) >= 0; p.i++ {
+		}
+		if _, err := strconv.ParseFloat(p.s[start:p.i], 64); err != nil {
+			return "", fmt.Errorf("connecttunnel: invalid Proxy-Status number in %q", p.s)
+		}
+		return p.s[start:p.i], nil
+	case c == '?' || isAlpha(c) || c == '*':
+		start := p.i
+		for p.i++; !p.done() && (isTChar(p.s[p.i]) || p.s[p.i] == ':' || p.s[p.i] == '/'); p.i++ {
+		}
+		return p.s[start:p.i], nil
+	default:
+		return "", fmt.Errorf("connecttunnel: invalid Proxy-Status item in %q", p.s)
+	}
+}
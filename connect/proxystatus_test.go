@@ -0,0 +1,103 @@
+package connect
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseProxyStatus(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  []ProxyStatus
+	}{
+		{
+			value: `netrelay; error=connection_refused`,
+			want:  []ProxyStatus{{Proxy: "netrelay", Error: "connection_refused"}},
+		},
+		{
+			value: `"edge proxy"; error=dns_error; rcode="NXDOMAIN"; info-code=3, cdn; received-status=502`,
+			want: []ProxyStatus{
+				{Proxy: "edge proxy", Error: "dns_error", RCode: "NXDOMAIN"},
+				{Proxy: "cdn"},
+			},
+		},
+		{
+			value: `netrelay;error=http_request_denied;details="denied by \"ops\" \\ rule";next-hop=?1`,
+			want:  []ProxyStatus{{Proxy: "netrelay", Error: "http_request_denied", Details: `denied by "ops" \ rule`}},
+		},
+	} {
+		got, err := ParseProxyStatus(tc.value)
+		if err != nil {
+			t.Errorf("ParseProxyStatus(%s): %v", tc.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ParseProxyStatus(%s) = %+v, want %+v", tc.value, got, tc.want)
+		}
+	}
+
+	for _, value := range []string{`netrelay; details="unterminated`, `netrelay error`, `(x)`} {
+		if _, err := ParseProxyStatus(value); err == nil {
+			t.Errorf("ParseProxyStatus(%s): expected error", value)
+		}
+	}
+}
+
+func TestProxyStatusRoundTrip(t *testing.T) {
+	st := ProxyStatus{Proxy: "my proxy", Error: "dns_error", RCode: "SERVFAIL", Details: `say "hi"`}
+	got, err := ParseProxyStatus(st.String())
+	if err != nil || len(got) != 1 || got[0] != st {
+		t.Errorf("Round trip of %s = %+v (%v)", st, got, err)
+	}
+}
+
+func TestProxyStatusErrors(t *testing.T) {
+	refused := closedTCPAddr(t)
+	guarded := &GuardedDialer{}
+	nxdomain := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: &net.DNSError{Err: "no such host", Name: "nx.example", IsNotFound: true}}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		dial   DialFunc
+		target string
+		want   ProxyStatus
+	}{
+		{"refused", nil, refused, ProxyStatus{Proxy: "test-proxy", Error: ProxyStatusConnectionRefused}},
+		{"prohibited", guarded.DialContext, refused, ProxyStatus{Proxy: "test-proxy", Error: ProxyStatusDestinationProhibited}},
+		{"nxdomain", nxdomain, "nx.example:443", ProxyStatus{Proxy: "test-proxy", Error: ProxyStatusDNSError, RCode: "NXDOMAIN"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &ServerConfig{Dial: tc.dial, ProxyName: "test-proxy"}
+			h1Server := httptest.NewServer(NewHandler(cfg))
+			defer h1Server.Close()
+			h2Server := httptest.NewUnstartedServer(NewHandler(cfg))
+			h2Server.EnableHTTP2 = true
+			h2Server.StartTLS()
+			defer h2Server.Close()
+
+			for name, dialer := range map[string]Dialer{
+				"h1": NewH1Dialer(&ClientConfig{ProxyURL: h1Server.URL}),
+				"h2": NewH2Dialer(&ClientConfig{
+					ProxyURL:  h2Server.URL,
+					TLSConfig: &tls.Config{InsecureSkipVerify: true},
+				}),
+			} {
+				_, err := dialer.DialContext(context.Background(), "tcp", tc.target)
+				var pe *ProxyError
+				if !errors.As(err, &pe) {
+					t.Fatalf("%s: expected ProxyError, got %v", name, err)
+				}
+				if pe.ProxyStatus == nil || *pe.ProxyStatus != tc.want {
+					t.Errorf("%s: expected Proxy-Status %+v, got %+v", name, tc.want, pe.ProxyStatus)
+				}
+			}
+		})
+	}
+}
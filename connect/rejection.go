@@ -0,0 +1,106 @@
+package connect
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// RejectionError is returned by a TunnelFunc to reject a tunnel with a
+// specific response, instead of the default 403 Forbidden. For example, to
+// ask the client to authenticate:
+//
+//	return &connect.RejectionError{
+//		StatusCode: http.StatusProxyAuthRequired,
+//		Header:     http.Header{"Proxy-Authenticate": {"Bearer"}},
+//		Reason:     "missing bearer token",
+//	}
+//
+// or to throttle it with 429 Too Many Requests and a Retry-After header, or
+// block it with 451 Unavailable For Legal Reasons. The response has a JSON
+// body explaining the rejection. It wraps ErrTunnelRejected, and
+// ErrProxyAuthRequired if the status is 407.
+type RejectionError struct {
+	// StatusCode is the response status, a 4xx or 5xx code. If zero or
+	// anything else, 403 Forbidden is used, so a rejection can't be taken
+	// for an established tunnel.
+	StatusCode int
+
+	// Header holds additional response headers, e.g. Proxy-Authenticate or
+	// Retry-After.
+	Header http.Header
+
+	// Reason explains the rejection to the client. It is sent as the
+	// "reason" field of the JSON body.
+	Reason string
+
+	// Body, if set, is encoded as the JSON response body instead of the
+	// default {"error": ..., "reason": ...} object.
+	Body any
+
+	// Err is the underlying cause. It is logged, but not sent to the client.
+	Err error
+}
+
+// status returns the response status code.
+func (e *RejectionError) status() int {
+	if e.StatusCode < 400 || e.StatusCode > 599 {
+		return http.StatusForbidden
+	}
+	return e.StatusCode
+}
+
+// Error implements the error interface.
+func (e *RejectionError) Error() string {
+	status := e.status()
+	msg := fmt.Sprintf("connecttunnel: tunnel rejected with %d %s", status, http.StatusText(status))
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns ErrTunnelRejected, ErrProxyAuthRequired for 407 responses,
+// and the underlying cause.
+func (e *RejectionError) Unwrap() []error {
+	errs := []error{ErrTunnelRejected}
+	if e.status() == http.StatusProxyAuthRequired {
+		errs = append(errs, ErrProxyAuthRequired)
+	}
+	if e.Err != nil {
+		errs = append(errs, e.Err)
+	}
+	return errs
+}
+
+// rejectionBody is the default JSON body of a rejection response.
+type rejectionBody struct {
+	Error  string `json:"error"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// writeRejection writes the response a RejectionError describes.
+func (c *ServerConfig) writeRejection(w http.ResponseWriter, e *RejectionError) {
+	status := e.status()
+	body := e.Body
+	if body == nil {
+		body = rejectionBody{Error: http.StatusText(status), Reason: e.Reason}
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		c.getSlogger().Error("failed to encode rejection body", "error", err)
+		data, _ = json.Marshal(rejectionBody{Error: http.StatusText(status), Reason: e.Reason})
+	}
+
+	for k, v := range e.Header {
+		w.Header()[http.CanonicalHeaderKey(k)] = v
+	}
+	c.setProxyStatus(w, ProxyStatus{Error: ProxyStatusRequestDenied, Details: e.Reason})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_, _ = w.Write(append(data, '\n'))
+}
@@ -0,0 +1,187 @@
+package connect
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRejectionError(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		err     *RejectionError
+		header  [2]string // response header and value that must be set
+		body    map[string]any
+		message string
+		want    []error
+	}{
+		{
+			name: "authentication required",
+			err: &RejectionError{
+				StatusCode: http.StatusProxyAuthRequired,
+				Header:     http.Header{"Proxy-Authenticate": {`Bearer realm="relay"`}},
+				Reason:     "missing bearer token",
+			},
+			header:  [2]string{"Proxy-Authenticate", `Bearer realm="relay"`},
+			body:    map[string]any{"error": "Proxy Authentication Required", "reason": "missing bearer token"},
+			message: "missing bearer token",
+			want:    []error{ErrTunnelRejected, ErrProxyAuthRequired},
+		},
+		{
+			name: "throttled",
+			err: &RejectionError{
+				StatusCode: http.StatusTooManyRequests,
+				Header:     http.Header{"retry-after": {"30"}},
+				Reason:     "too many tunnels per minute",
+			},
+			header:  [2]string{"Retry-After", "30"},
+			body:    map[string]any{"error": "Too Many Requests", "reason": "too many tunnels per minute"},
+			message: "too many tunnels per minute",
+		},
+		{
+			name: "blocked",
+			err: &RejectionError{
+				StatusCode: http.StatusUnavailableForLegalReasons,
+				Body:       map[string]any{"blocked_by": "sanctions"},
+			},
+			body:    map[string]any{"blocked_by": "sanctions"},
+			message: `{"blocked_by":"sanctions"}`,
+			want:    []error{ErrTunnelRejected},
+		},
+		{
+			name:    "default status",
+			err:     &RejectionError{Reason: "not today", Err: errors.New("internal detail")},
+			body:    map[string]any{"error": "Forbidden", "reason": "not today"},
+			message: "not today",
+			want:    []error{ErrTunnelRejected},
+		},
+		{
+			name:    "success status",
+			err:     &RejectionError{StatusCode: http.StatusOK, Reason: "not a tunnel"},
+			body:    map[string]any{"error": "Forbidden", "reason": "not a tunnel"},
+			message: "not a tunnel",
+			want:    []error{ErrTunnelRejected},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &ServerConfig{OnTunnel: func(ctx context.Context, req *http.Request) error {
+				return tc.err
+			}}
+			h1Server := httptest.NewServer(NewHandler(cfg))
+			defer h1Server.Close()
+			h2Server := httptest.NewUnstartedServer(NewHandler(cfg))
+			h2Server.EnableHTTP2 = true
+			h2Server.StartTLS()
+			defer h2Server.Close()
+
+			// The response is exactly what the error describes
+			resp, _ := rawConnect(t, h1Server.Listener.Addr().String(), "example.com:443", "")
+			if resp.StatusCode != tc.err.status() {
+				t.Errorf("Expected %d, got %s", tc.err.status(), resp.Status)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Expected JSON body, got Content-Type %q", ct)
+			}
+			var body map[string]any
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("Failed to decode body: %v", err)
+			}
+			if len(body) != len(tc.body) {
+				t.Errorf("Expected body %v, got %v", tc.body, body)
+			}
+			for k, v := range tc.body {
+				if body[k] != v {
+					t.Errorf("Expected body %v, got %v", tc.body, body)
+				}
+			}
+
+			for name, dialer := range map[string]Dialer{
+				"h1": NewH1Dialer(&ClientConfig{ProxyURL: h1Server.URL}),
+				"h2": NewH2Dialer(&ClientConfig{
+					ProxyURL:  h2Server.URL,
+					TLSConfig: &tls.Config{InsecureSkipVerify: true},
+				}),
+			} {
+				_, err := dialer.DialContext(context.Background(), "tcp", "example.com:443")
+				var pe *ProxyError
+				if !errors.As(err, &pe) || pe.StatusCode != tc.err.status() {
+					t.Fatalf("%s: expected %d ProxyError, got %v", name, tc.err.status(), err)
+				}
+				if k, v := tc.header[0], tc.header[1]; k != "" && pe.Header.Get(k) != v {
+					t.Errorf("%s: expected %s header %q, got %q", name, k, v, pe.Header.Get(k))
+				}
+				if pe.Message != tc.message {
+					t.Errorf("%s: expected message %q, got %q", name, tc.message, pe.Message)
+				}
+				for _, want := range tc.want {
+					if !errors.Is(err, want) {
+						t.Errorf("%s: expected %v to match %v", name, err, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRejectionErrorStatus(t *testing.T) {
+	for code, want := range map[int]int{
+		0:                             http.StatusForbidden,
+		http.StatusContinue:           http.StatusForbidden,
+		http.StatusOK:                 http.StatusForbidden,
+		http.StatusFound:              http.StatusForbidden,
+		http.StatusTooManyRequests:    http.StatusTooManyRequests,
+		http.StatusServiceUnavailable: http.StatusServiceUnavailable,
+		600:                           http.StatusForbidden,
+	} {
+		if got := (&RejectionError{StatusCode: code}).status(); got != want {
+			t.Errorf("status() for StatusCode %d = %d, want %d", code, got, want)
+		}
+	}
+}
+
+// TestDialRejection checks that a Dial returning a *RejectionError refuses the
+// tunnel as a rejection rather than a dial failure.
+func TestDialRejection(t *testing.T) {
+	metrics := NewMetrics()
+	cfg := &ServerConfig{Metrics: metrics}
+	cfg.Dial = func(context.Context, string, string) (net.Conn, error) {
+		return nil, &RejectionError{Reason: "rejected by route"}
+	}
+	rejects := make(chan TunnelStats, 1)
+	cfg.OnTunnelReject = func(_ context.Context, stats TunnelStats) { rejects <- stats }
+	proxyServer := httptest.NewServer(NewHandler(cfg))
+	defer proxyServer.Close()
+
+	dialer := NewH1Dialer(&ClientConfig{ProxyURL: proxyServer.URL})
+	_, err := dialer.DialContext(context.Background(), "tcp", "example.com:443")
+	var pe *ProxyError
+	if !errors.As(err, &pe) || pe.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected 403 ProxyError, got %v", err)
+	}
+	if pe.ProxyStatus == nil || pe.ProxyStatus.Error != ProxyStatusRequestDenied {
+		t.Errorf("Expected request_denied Proxy-Status, got %+v", pe.ProxyStatus)
+	}
+	if !errors.Is(err, ErrTunnelRejected) || errors.Is(err, ErrDestinationDenied) {
+		t.Errorf("Expected %v to match only ErrTunnelRejected", err)
+	}
+	if pe.Message != "rejected by route" {
+		t.Errorf("Expected message %q, got %q", "rejected by route", pe.Message)
+	}
+	if stats := waitStats(t, rejects); errors.Is(stats.Err, ErrUpstreamDial) {
+		t.Errorf("Rejection reported as a dial failure: %v", stats.Err)
+	}
+
+	var sb strings.Builder
+	if err := metrics.WriteOpenMetrics(&sb); err != nil {
+		t.Fatal(err)
+	}
+	if want := `netrelay_tunnels_total{result="rejected"} 1`; !strings.Contains(sb.String(), want) {
+		t.Errorf("Metrics output missing %q:\n%s", want, sb.String())
+	}
+}
@@ -0,0 +1,283 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for CachingResolver.
+const (
+	defaultResolverTimeout = 5 * time.Second
+	defaultSystemTTL       = 30 * time.Second
+	defaultNegativeTTL     = 10 * time.Second
+	defaultMinTTL          = time.Second
+
+	// maxResolverEntries bounds the cache. Expired entries are swept when it
+	// is full.
+	maxResolverEntries = 10000
+)
+
+// CachingResolver resolves upstream hostnames, caching answers for their DNS
+// TTL and failed lookups (NXDOMAIN or no addresses) for the negative TTL. It
+// implements Resolver, so it can be shared by a GuardedDialer and routing
+// decisions that resolve the same target, and its DialContext dials targets
+// racing their addresses with happy eyeballs (RFC 8305).
+//
+// Use its DialContext as ServerConfig.Dial, or set it as the Resolver of a
+// GuardedDialer.
+type CachingResolver struct {
+	// Nameservers are the DNS servers queried directly, as "ip" or
+	// "ip:port", in order of preference. Names are treated as fully
+	// qualified; /etc/hosts and search domains are not consulted. If empty,
+	// Resolver is used.
+	Nameservers []string
+
+	// Resolver is used if Nameservers is empty. If nil, net.DefaultResolver
+	// is used. It doesn't report TTLs, so its answers are cached for
+	// DefaultTTL.
+	Resolver Resolver
+
+	// Prefer orders the resolved addresses by family. The zero value
+	// alternates families starting with IPv6, as RFC 8305 recommends.
+	Prefer IPPreference
+
+	// Dial dials the resolved addresses. If nil, net.Dialer{}.DialContext
+	// is used.
+	Dial DialFunc
+
+	// FallbackDelay is how long DialContext waits for a connection attempt
+	// before starting one to the next address. If zero, 250ms is used; if
+	// negative, addresses are tried one after the other.
+	FallbackDelay time.Duration
+
+	// Timeout limits each query to a nameserver. If zero, 5s is used.
+	Timeout time.Duration
+
+	// DefaultTTL is how long answers without a TTL, from Resolver, are
+	// cached. If zero, 30s is used.
+	DefaultTTL time.Duration
+
+	// NegativeTTL is how long failed lookups are cached if the nameserver
+	// doesn't say (RFC 2308). If zero, 10s is used.
+	NegativeTTL time.Duration
+
+	// MinTTL is the shortest time answers are cached, so the lookups made
+	// for one tunnel share a result. If zero, 1s is used.
+	MinTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*resolverEntry
+
+	// now returns the current time, for tests.
+	now func() time.Time
+}
+
+// resolverEntry is a cached or in-flight lookup.
+type resolverEntry struct {
+	ready   chan struct{} // closed once the lookup finished
+	addrs   []netip.Addr
+	err     error
+	expires time.Time
+}
+
+// LookupNetIP returns the addresses of host ordered by Prefer. The network
+// is "ip", "ip4" or "ip6".
+func (r *CachingResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{ip}, nil
+	}
+	addrs, err := r.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs = r.Prefer.order(filterFamily(addrs, network))
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no suitable address", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+// DialContext resolves address and dials its addresses, starting a new
+// attempt every FallbackDelay until one connects.
+func (r *CachingResolver) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTarget, err)
+	}
+	addrs, err := r.LookupNetIP(ctx, lookupNetwork(network), host)
+	if err != nil {
+		return nil, err
+	}
+	return dialHappyEyeballs(ctx, r.Dial, network, addrs, port, r.FallbackDelay)
+}
+
+// lookup returns the cached addresses of host, resolving it if needed.
+// Concurrent lookups of the same host share one resolution.
+func (r *CachingResolver) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	key := strings.ToLower(strings.TrimSuffix(host, "."))
+	r.mu.Lock()
+	if r.cache == nil {
+		r.cache = make(map[string]*resolverEntry)
+	}
+	e, ok := r.cache[key]
+	if ok {
+		select {
+		case <-e.ready:
+			if r.clock().Before(e.expires) {
+				r.mu.Unlock()
+				return e.addrs, e.err
+			}
+			ok = false
+		default:
+			// In flight
+		}
+	}
+	if !ok {
+		if len(r.cache) >= maxResolverEntries {
+			r.sweep()
+		}
+		e = &resolverEntry{ready: make(chan struct{})}
+		r.cache[key] = e
+		// The resolution outlives a canceled caller, as others may wait on it
+		go r.fill(context.WithoutCancel(ctx), key, e)
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-e.ready:
+		return e.addrs, e.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// fill resolves host into e. Only answers and negative answers are cached.
+func (r *CachingResolver) fill(ctx context.Context, key string, e *resolverEntry) {
+	addrs, ttl, err := r.resolve(ctx, key)
+	if ttl < r.minTTL() && (err == nil || isNotFound(err)) {
+		ttl = r.minTTL()
+	}
+
+	r.mu.Lock()
+	e.addrs, e.err = addrs, err
+	e.expires = r.clock().Add(ttl)
+	if err != nil && !isNotFound(err) && r.cache[key] == e {
+		delete(r.cache, key)
+	}
+	r.mu.Unlock()
+	close(e.ready)
+}
+
+// resolve looks up the addresses of host and how long to cache them.
+func (r *CachingResolver) resolve(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	if len(r.Nameservers) > 0 {
+		return r.resolveDNS(ctx, host)
+	}
+
+	var res Resolver = net.DefaultResolver
+	if r.Resolver != nil {
+		res = r.Resolver
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.timeout())
+	defer cancel()
+	addrs, err := res.LookupNetIP(ctx, "ip", host)
+	if err == nil && len(addrs) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if err != nil {
+		return nil, r.negativeTTL(), err
+	}
+	ttl := r.DefaultTTL
+	if ttl <= 0 {
+		ttl = defaultSystemTTL
+	}
+	return addrs, ttl, nil
+}
+
+// sweep removes the expired entries, or an arbitrary one if none expired.
+// The caller holds r.mu.
+func (r *CachingResolver) sweep() {
+	now := r.clock()
+	for k, e := range r.cache {
+		select {
+		case <-e.ready:
+			if !now.Before(e.expires) {
+				delete(r.cache, k)
+			}
+		default:
+		}
+	}
+	if len(r.cache) < maxResolverEntries {
+		return
+	}
+	for k := range r.cache {
+		delete(r.cache, k)
+		return
+	}
+}
+
+func (r *CachingResolver) clock() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
+
+func (r *CachingResolver) timeout() time.Duration {
+	if r.Timeout > 0 {
+		return r.Timeout
+	}
+	return defaultResolverTimeout
+}
+
+func (r *CachingResolver) negativeTTL() time.Duration {
+	if r.NegativeTTL > 0 {
+		return r.NegativeTTL
+	}
+	return defaultNegativeTTL
+}
+
+func (r *CachingResolver) minTTL() time.Duration {
+	if r.MinTTL > 0 {
+		return r.MinTTL
+	}
+	return defaultMinTTL
+}
+
+// isNotFound reports whether err is a lookup that found no addresses, as
+// opposed to one that failed.
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// lookupNetwork returns the address family to look up for a dial network.
+func lookupNetwork(network string) string {
+	switch network {
+	case "tcp4", "udp4":
+		return "ip4"
+	case "tcp6", "udp6":
+		return "ip6"
+	}
+	return "ip"
+}
+
+// filterFamily returns the addresses of addrs in the family of network.
+func filterFamily(addrs []netip.Addr, network string) []netip.Addr {
+	if network != "ip4" && network != "ip6" {
+		return addrs
+	}
+	var out []netip.Addr
+	for _, ip := range addrs {
+		if ip.Unmap().Is4() == (network == "ip4") {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
@@ -0,0 +1,386 @@
+package connect
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeClock is a settable time source.
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.t = c.t.Add(d)
+	c.mu.Unlock()
+}
+
+// countingResolver counts lookups and answers them from a map, failing with
+// NXDOMAIN for unknown hosts.
+type countingResolver struct {
+	addrs map[string][]netip.Addr
+	err   error
+	count atomic.Int32
+}
+
+func (r *countingResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	r.count.Add(1)
+	if r.err != nil {
+		return nil, r.err
+	}
+	addrs, ok := r.addrs[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+// startDNSServer starts a nameserver on UDP and TCP answering from a fixed
+// zone, and returns its address and the number of queries per name.
+func startDNSServer(t *testing.T) (string, *sync.Map) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to listen on TCP: %v", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	var queries sync.Map
+	answer := func(req []byte, tcp bool) []byte {
+		var msg dnsmessage.Message
+		if err := msg.Unpack(req); err != nil || len(msg.Questions) != 1 {
+			return nil
+		}
+		q := msg.Questions[0]
+		name := strings.ToLower(q.Name.String())
+		n, _ := queries.LoadOrStore(name, new(atomic.Int32))
+		n.(*atomic.Int32).Add(1)
+
+		msg.Response, msg.RecursionAvailable = true, true
+		msg.Additionals = nil
+		rr := func(name string, ttl uint32, body dnsmessage.ResourceBody) dnsmessage.Resource {
+			return dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Class: dnsmessage.ClassINET, TTL: ttl},
+				Body:   body,
+			}
+		}
+		soa := rr("example.", 300, &dnsmessage.SOAResource{
+			NS: dnsmessage.MustNewName("ns.example."), MBox: dnsmessage.MustNewName("admin.example."), MinTTL: 7,
+		})
+		switch {
+		case name == "big.example." && !tcp:
+			msg.Truncated = true
+		case (name == "host.example." || name == "big.example.") && q.Type == dnsmessage.TypeA:
+			msg.Answers = []dnsmessage.Resource{rr(name, 60, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}})}
+		case (name == "host.example." || name == "big.example.") && q.Type == dnsmessage.TypeAAAA:
+			aaaa := netip.MustParseAddr("2001:db8::1").As16()
+			msg.Answers = []dnsmessage.Resource{rr(name, 30, &dnsmessage.AAAAResource{AAAA: aaaa})}
+		case name == "alias.example." && q.Type == dnsmessage.TypeA:
+			msg.Answers = []dnsmessage.Resource{
+				rr("alias.example.", 20, &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("host.example.")}),
+				rr("host.example.", 60, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}),
+			}
+		case name == "host.example." || name == "alias.example.":
+			// No data
+			msg.Authorities = []dnsmessage.Resource{soa}
+		default:
+			msg.RCode = dnsmessage.RCodeNameError
+			msg.Authorities = []dnsmessage.Resource{soa}
+		}
+		b, err := msg.Pack()
+		if err != nil {
+			t.Errorf("Failed to pack response: %v", err)
+		}
+		return b
+	}
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := answer(buf[:n], false); resp != nil {
+				_, _ = pc.WriteTo(resp, addr)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				req := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, req); err != nil {
+					return
+				}
+				resp := answer(req, true)
+				_, _ = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+			}()
+		}
+	}()
+	return pc.LocalAddr().String(), &queries
+}
+
+func queryCount(queries *sync.Map, name string) int32 {
+	n, ok := queries.Load(name)
+	if !ok {
+		return 0
+	}
+	return n.(*atomic.Int32).Load()
+}
+
+func TestCachingResolverNameservers(t *testing.T) {
+	ns, queries := startDNSServer(t)
+	clock := &fakeClock{t: time.Now()}
+	r := &CachingResolver{Nameservers: []string{closedUDPAddr(t), ns}, Timeout: 200 * time.Millisecond, now: clock.now}
+	ctx := context.Background()
+	both := []netip.Addr{netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("192.0.2.1")}
+
+	// Unreachable nameservers are skipped
+	addrs, err := r.LookupNetIP(ctx, "ip", "host.example")
+	if err != nil || !reflect.DeepEqual(addrs, both) {
+		t.Fatalf("LookupNetIP(host.example) = %v, %v; want %v", addrs, err, both)
+	}
+	if _, err := r.LookupNetIP(ctx, "ip", "HOST.example."); err != nil {
+		t.Fatalf("Cached lookup failed: %v", err)
+	}
+	if n := queryCount(queries, "host.example."); n != 2 {
+		t.Errorf("Expected one query per family, got %d", n)
+	}
+
+	// Answers expire with the lowest TTL (30s for AAAA)
+	clock.advance(31 * time.Second)
+	if _, err := r.LookupNetIP(ctx, "ip4", "host.example"); err != nil {
+		t.Fatalf("Lookup after expiry failed: %v", err)
+	}
+	if n := queryCount(queries, "host.example."); n != 4 {
+		t.Errorf("Expected the expired answer to be resolved again, got %d queries", n)
+	}
+
+	// NXDOMAIN is cached for the SOA minimum (7s)
+	for range 2 {
+		_, err = r.LookupNetIP(ctx, "ip", "nx.example")
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Fatalf("Expected NXDOMAIN, got %v", err)
+		}
+	}
+	if n := queryCount(queries, "nx.example."); n != 2 {
+		t.Errorf("Expected negative answer to be cached, got %d queries", n)
+	}
+	clock.advance(8 * time.Second)
+	_, _ = r.LookupNetIP(ctx, "ip", "nx.example")
+	if n := queryCount(queries, "nx.example."); n != 4 {
+		t.Errorf("Expected negative answer to expire, got %d queries", n)
+	}
+
+	// CNAMEs are followed, and truncated answers retried over TCP
+	if addrs, err := r.LookupNetIP(ctx, "ip", "alias.example"); err != nil || len(addrs) != 1 || addrs[0] != both[1] {
+		t.Errorf("LookupNetIP(alias.example) = %v, %v", addrs, err)
+	}
+	if addrs, err := r.LookupNetIP(ctx, "ip", "big.example"); err != nil || !reflect.DeepEqual(addrs, both) {
+		t.Errorf("LookupNetIP(big.example) = %v, %v", addrs, err)
+	}
+
+	// A family without addresses is not found
+	if _, err := r.LookupNetIP(ctx, "ip6", "alias.example"); !isNotFound(err) {
+		t.Errorf("Expected no IPv6 addresses, got %v", err)
+	}
+}
+
+// closedUDPAddr returns a UDP address nothing is listening on.
+func closedUDPAddr(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := pc.LocalAddr().String()
+	_ = pc.Close()
+	return addr
+}
+
+func TestCachingResolverSystem(t *testing.T) {
+	res := &countingResolver{addrs: map[string][]netip.Addr{
+		"example.com": {netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2"), netip.MustParseAddr("2001:db8::1")},
+	}}
+	clock := &fakeClock{t: time.Now()}
+	r := &CachingResolver{Resolver: res, Prefer: PreferIPv4, now: clock.now}
+	ctx := context.Background()
+
+	// Concurrent lookups share one resolution
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addrs, err := r.LookupNetIP(ctx, "ip", "example.com")
+			want := []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("192.0.2.2")}
+			if err != nil || !reflect.DeepEqual(addrs, want) {
+				t.Errorf("LookupNetIP = %v, %v; want %v", addrs, err, want)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := res.count.Load(); n != 1 {
+		t.Errorf("Expected 1 lookup, got %d", n)
+	}
+
+	// Answers are cached for DefaultTTL
+	clock.advance(29 * time.Second)
+	_, _ = r.LookupNetIP(ctx, "ip", "example.com")
+	clock.advance(2 * time.Second)
+	_, _ = r.LookupNetIP(ctx, "ip", "example.com")
+	if n := res.count.Load(); n != 2 {
+		t.Errorf("Expected 2 lookups, got %d", n)
+	}
+
+	// Failures are only cached if nothing was found
+	for range 2 {
+		_, _ = r.LookupNetIP(ctx, "ip", "nx.example")
+	}
+	if n := res.count.Load(); n != 3 {
+		t.Errorf("Expected negative answer to be cached, got %d lookups", n)
+	}
+	res.err = &net.DNSError{Err: "server misbehaving", Name: "fail.example", IsTemporary: true}
+	for range 2 {
+		_, _ = r.LookupNetIP(ctx, "ip", "fail.example")
+	}
+	if n := res.count.Load(); n != 5 {
+		t.Errorf("Expected failures not to be cached, got %d lookups", n)
+	}
+}
+
+func TestIPPreferenceOrder(t *testing.T) {
+	addrs := []netip.Addr{
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("192.0.2.2"),
+		netip.MustParseAddr("192.0.2.3"),
+		netip.MustParseAddr("2001:db8::1"),
+		netip.MustParseAddr("2001:db8::2"),
+	}
+	for _, tc := range []struct {
+		prefer IPPreference
+		want   string
+	}{
+		{PreferIPv6, "2001:db8::1 192.0.2.1 2001:db8::2 192.0.2.2 192.0.2.3"},
+		{PreferIPv4, "192.0.2.1 2001:db8::1 192.0.2.2 2001:db8::2 192.0.2.3"},
+		{IPv4Only, "192.0.2.1 192.0.2.2 192.0.2.3"},
+		{IPv6Only, "2001:db8::1 2001:db8::2"},
+	} {
+		var got []string
+		for _, ip := range tc.prefer.order(addrs) {
+			got = append(got, ip.String())
+		}
+		if strings.Join(got, " ") != tc.want {
+			t.Errorf("order(%d) = %v, want %s", tc.prefer, got, tc.want)
+		}
+	}
+}
+
+func TestHappyEyeballs(t *testing.T) {
+	echoAddr := startTCPEcho(t)
+	_, port, _ := net.SplitHostPort(echoAddr)
+
+	// The first address blackholes; the second attempt starts after the
+	// fallback delay and wins
+	var canceled atomic.Bool
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		if strings.HasPrefix(address, "[2001:db8::1]") {
+			<-ctx.Done()
+			canceled.Store(true)
+			return nil, ctx.Err()
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, net.JoinHostPort("127.0.0.1", port))
+	}
+	r := &CachingResolver{
+		Resolver:      staticResolver{netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("192.0.2.1")},
+		Dial:          dial,
+		FallbackDelay: 50 * time.Millisecond,
+	}
+
+	start := time.Now()
+	conn, err := r.DialContext(context.Background(), "tcp", "dual.example:"+port)
+	if err != nil {
+		t.Fatalf("DialContext failed: %v", err)
+	}
+	_ = conn.Close()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Expected fallback after 50ms, took %s", d)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !canceled.Load() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !canceled.Load() {
+		t.Error("Expected the losing attempt to be canceled")
+	}
+
+	// All attempts failing reports every error
+	r.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, errors.New("refused " + address)
+	}
+	_, err = r.DialContext(context.Background(), "tcp", "dual.example:"+port)
+	if err == nil || !strings.Contains(err.Error(), "2001:db8::1") || !strings.Contains(err.Error(), "192.0.2.1") {
+		t.Errorf("Expected both errors, got %v", err)
+	}
+
+	// No addresses is an error, whether attempts race or not
+	for _, delay := range []time.Duration{0, -1} {
+		if _, err := dialHappyEyeballs(context.Background(), r.Dial, "tcp", nil, port, delay); err == nil {
+			t.Errorf("Dial with no addresses and delay %s succeeded", delay)
+		}
+	}
+}
+
+// TestGuardedDialerSharedResolver tests that a routing decision and the
+// GuardedDialer's check share one resolution.
+func TestGuardedDialerSharedResolver(t *testing.T) {
+	echoAddr := startTCPEcho(t)
+	_, port, _ := net.SplitHostPort(echoAddr)
+	res := &countingResolver{addrs: map[string][]netip.Addr{"echo.example": {netip.MustParseAddr("127.0.0.1")}}}
+	r := &CachingResolver{Resolver: res}
+	g := &GuardedDialer{Allow: mustPrefixes(t, "127.0.0.0/8"), Resolver: r}
+
+	if _, err := r.LookupNetIP(context.Background(), "ip", "echo.example"); err != nil {
+		t.Fatalf("LookupNetIP failed: %v", err)
+	}
+	testTCPEcho(t, &directDialer{g.DialContext}, net.JoinHostPort("echo.example", port))
+	if n := res.count.Load(); n != 1 {
+		t.Errorf("Expected 1 lookup, got %d", n)
+	}
+}
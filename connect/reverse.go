@@ -0,0 +1,608 @@
+package connect
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upgrade tokens and :protocol values for reverse tunnels.
+const (
+	// protocolReverseListen registers a reverse tunnel listener. The stream
+	// carries connection notices from the proxy to the client.
+	protocolReverseListen = "netrelay-reverse-listen"
+	// protocolReverseAccept accepts a connection announced on a listener's
+	// notice stream, and carries its data.
+	protocolReverseAccept = "netrelay-reverse-accept"
+)
+
+// reversePathPrefix is the path reverse tunnel requests are made to, followed
+// by the listener name, and for accept requests "/" and the connection ID.
+const reversePathPrefix = "/.well-known/netrelay/reverse/"
+
+const (
+	// reverseAcceptTimeout bounds how long a tunnel to a reverse listener
+	// waits for the listening client to accept it.
+	reverseAcceptTimeout = 10 * time.Second
+	// reversePingInterval is how often an empty line is sent on an idle
+	// notice stream, so intermediaries don't time it out.
+	reversePingInterval = 30 * time.Second
+)
+
+var (
+	errReverseNameInUse = errors.New("connecttunnel: reverse listener name in use")
+	errReverseClosed    = errors.New("connecttunnel: reverse listener closed")
+	errReverseAccept    = errors.New("connecttunnel: reverse listener failed to accept")
+)
+
+// ReverseListenName returns the name of the reverse tunnel listener that a
+// registration or accept request is for, so OnTunnel can decide which
+// identities may register which names. ok is false for other requests.
+func ReverseListenName(req *http.Request) (name string, ok bool) {
+	switch extendedProtocol(req) {
+	case protocolReverseListen, protocolReverseAccept:
+		name, _, ok = parseReversePath(req.URL.Path)
+		return name, ok
+	}
+	return "", false
+}
+
+// parseReversePath splits a reverse tunnel request path into the listener
+// name and connection ID, which is empty for registrations.
+func parseReversePath(path string) (name, id string, ok bool) {
+	rest, ok := strings.CutPrefix(path, reversePathPrefix)
+	if !ok {
+		return "", "", false
+	}
+	name, id, _ = strings.Cut(rest, "/")
+	return name, id, validReverseName(name)
+}
+
+// validReverseName reports whether name is a lowercase DNS label.
+func validReverseName(name string) bool {
+	if name == "" || len(name) > 63 || name[0] == '-' || name[len(name)-1] == '-' {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// reverseName returns the listener name a tunnel target under ReverseDomain
+// is routed to.
+func (c *ServerConfig) reverseName(target string) (string, bool) {
+	if c.ReverseDomain == "" {
+		return "", false
+	}
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	domain := strings.ToLower(strings.Trim(c.ReverseDomain, "."))
+	return strings.CutSuffix(host, "."+domain)
+}
+
+// reverseRegistry holds the registered reverse tunnel listeners of a
+// ServerConfig.
+type reverseRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*reverseSession
+	closed   bool
+}
+
+// reverseSession is a registered reverse tunnel listener.
+type reverseSession struct {
+	identity string
+	notices  chan string
+	done     chan struct{} // closed when the listener is unregistered
+
+	mu      sync.Mutex
+	pending map[string]chan net.Conn // connections awaiting an accept request
+}
+
+// register registers a listener for name, owned by identity.
+func (r *reverseRegistry) register(name, identity string) (*reverseSession, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, errReverseClosed
+	}
+	if _, ok := r.sessions[name]; ok {
+		return nil, errReverseNameInUse
+	}
+	if r.sessions == nil {
+		r.sessions = make(map[string]*reverseSession)
+	}
+	s := &reverseSession{
+		identity: identity,
+		notices:  make(chan string),
+		done:     make(chan struct{}),
+		pending:  make(map[string]chan net.Conn),
+	}
+	r.sessions[name] = s
+	return s, nil
+}
+
+// unregister removes the listener s registered for name.
+func (r *reverseRegistry) unregister(name string, s *reverseSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sessions[name] == s {
+		delete(r.sessions, name)
+		close(s.done)
+	}
+}
+
+// lookup returns the listener registered for name, or nil.
+func (r *reverseRegistry) lookup(name string) *reverseSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[name]
+}
+
+// close unregisters all listeners and refuses new registrations.
+func (r *reverseRegistry) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	for name, s := range r.sessions {
+		delete(r.sessions, name)
+		close(s.done)
+	}
+}
+
+// dial announces a connection from client to the listener registered for
+// name, and waits for the listening client to accept it.
+func (r *reverseRegistry) dial(ctx context.Context, network, name, client string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("connecttunnel: unsupported network for reverse tunnel: %s", network)
+	}
+	s := r.lookup(name)
+	if s == nil {
+		return nil, &net.DNSError{Err: "no reverse listener registered", Name: name, IsNotFound: true}
+	}
+
+	id := rand.Text()
+	ch := make(chan net.Conn, 1)
+	s.mu.Lock()
+	s.pending[id] = ch
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, reverseAcceptTimeout)
+	defer cancel()
+	select {
+	case s.notices <- id + " " + client:
+		select {
+		case conn := <-ch:
+			if conn == nil {
+				return nil, errReverseAccept
+			}
+			return conn, nil
+		case <-ctx.Done():
+		case <-s.done:
+		}
+	case <-ctx.Done():
+	case <-s.done:
+	}
+
+	// Give up, unless an accept request already claimed the connection
+	if conn, claimed := s.cancel(id, ch); claimed {
+		if conn == nil {
+			return nil, errReverseAccept
+		}
+		return conn, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errReverseClosed
+}
+
+// claim takes the pending connection id for an accept request. The accepted
+// stream, or nil if accepting failed, must be sent on the returned channel.
+func (s *reverseSession) claim(id string) chan net.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := s.pending[id]
+	delete(s.pending, id)
+	return ch
+}
+
+// cancel withdraws the pending connection id. If an accept request claimed
+// it first, cancel waits for and returns its stream.
+func (s *reverseSession) cancel(id string, ch chan net.Conn) (net.Conn, bool) {
+	s.mu.Lock()
+	_, pending := s.pending[id]
+	delete(s.pending, id)
+	s.mu.Unlock()
+	if pending {
+		return nil, false
+	}
+	return <-ch, true
+}
+
+// serveReverse handles reverse tunnel registration and accept requests over
+// HTTP/1.1, HTTP/2 or HTTP/3.
+func serveReverse(cfg *ServerConfig, w http.ResponseWriter, req *http.Request, protocol string) {
+	name, id, ok := parseReversePath(req.URL.Path)
+	if cfg.ReverseDomain == "" || !ok || (protocol == protocolReverseAccept) == (id == "") {
+		http.NotFound(w, req)
+		return
+	}
+	log := cfg.getSlogger().With(slog.String("reverse_name", name), slog.String("remote_addr", req.RemoteAddr))
+
+	if cfg.tracker.shuttingDown() {
+		cfg.setProxyStatus(w, ProxyStatus{Error: ProxyStatusInternalError, Details: "shutting down"})
+		http.Error(w, "Service Unavailable: server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Authenticate like a tunnel request; OnTunnel can use ReverseListenName
+	ctx := withTunnelState(req.Context())
+	req = req.WithContext(ctx)
+	if err := cfg.checkTunnel(ctx, req); err != nil {
+		log.Warn("reverse listener rejected", slog.Any("error", err))
+		cfg.rejectTunnel(w, err)
+		return
+	}
+	identity := Identity(ctx)
+	if identity != "" {
+		log = log.With(slog.String("user", identity))
+	}
+
+	if protocol == protocolReverseListen {
+		cfg.serveReverseListen(w, req, log, name, identity)
+	} else {
+		cfg.serveReverseAccept(w, req, log, name, id, identity)
+	}
+}
+
+// serveReverseListen registers a listener for name and sends it a notice
+// for each connection routed to it, until the client closes the stream.
+func (c *ServerConfig) serveReverseListen(w http.ResponseWriter, req *http.Request, log *slog.Logger, name, identity string) {
+	s, err := c.reverse.register(name, identity)
+	switch {
+	case errors.Is(err, errReverseNameInUse):
+		log.Warn("reverse listener rejected", slog.Any("error", err))
+		http.Error(w, "Conflict: reverse listener name in use", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "Service Unavailable: server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer c.reverse.unregister(name, s)
+
+	stream, wait, err := acceptStream(w, req, protocolReverseListen)
+	if err != nil {
+		log.Error("failed to accept reverse listener", slog.Any("error", err))
+		return
+	}
+	defer wait(req.Context())
+	defer func() { _ = stream.Close() }()
+	log.Info("reverse listener registered")
+	defer log.Info("reverse listener closed")
+
+	// The client doesn't send anything; EOF means it closed the listener
+	closed := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, stream)
+		close(closed)
+	}()
+
+	ping := time.NewTicker(reversePingInterval)
+	defer ping.Stop()
+	for {
+		var line string
+		select {
+		case line = <-s.notices:
+		case <-ping.C:
+		case <-closed:
+			return
+		case <-s.done:
+			return
+		case <-req.Context().Done():
+			return
+		}
+		if _, err := io.WriteString(stream, line+"\n"); err != nil {
+			return
+		}
+	}
+}
+
+// serveReverseAccept hands the stream of an accept request to the tunnel
+// waiting for connection id.
+func (c *ServerConfig) serveReverseAccept(w http.ResponseWriter, req *http.Request, log *slog.Logger, name, id, identity string) {
+	s := c.reverse.lookup(name)
+	if s == nil {
+		http.NotFound(w, req)
+		return
+	}
+	if s.identity != identity {
+		log.Warn("reverse accept rejected", slog.String("reason", "identity mismatch"))
+		c.setProxyStatus(w, ProxyStatus{Error: ProxyStatusRequestDenied})
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	ch := s.claim(id)
+	if ch == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	stream, wait, err := acceptStream(w, req, protocolReverseAccept)
+	if err != nil {
+		log.Error("failed to accept reverse connection", slog.Any("error", err))
+		ch <- nil
+		return
+	}
+	ch <- stream
+	wait(req.Context())
+}
+
+// acceptStream sends the success response for an upgrade or extended
+// CONNECT request and returns the resulting stream. HTTP/1.1 connections are
+// hijacked; for HTTP/2 and HTTP/3 the handler must call wait before
+// returning, which blocks until the stream is closed. It writes an error
+// response if the stream can't be accepted.
+func acceptStream(w http.ResponseWriter, req *http.Request, protocol string) (net.Conn, func(context.Context), error) {
+	if req.ProtoMajor == 1 {
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return nil, nil, fmt.Errorf("%w: connection does not support hijacking", ErrHijackFailed)
+		}
+		conn, bufrw, err := hijacker.Hijack()
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return nil, nil, fmt.Errorf("%w: %w", ErrHijackFailed, err)
+		}
+		_, err = bufrw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + protocol + "\r\n\r\n")
+		if err == nil {
+			err = bufrw.Flush()
+		}
+		if err != nil {
+			_ = conn.Close()
+			return nil, nil, err
+		}
+		// Hijacked connections are independent of the request lifecycle.
+		return &bufferedConn{Conn: conn, reader: bufrw.Reader}, func(context.Context) {}, nil
+	}
+
+	rc := http.NewResponseController(w)
+	if req.ProtoMajor == 2 {
+		// HTTP/3 streams are always full duplex
+		if err := rc.EnableFullDuplex(); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return nil, nil, err
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return nil, nil, err
+	}
+	s := &serverStream{body: req.Body, w: &flushWriter{w: w, rc: rc}, rc: rc, done: make(chan struct{})}
+	return newStreamConnRW(s, &remoteAddr{addr: req.RemoteAddr}), s.wait, nil
+}
+
+// serverStream is the server side of an HTTP/2 or HTTP/3 stream accepted
+// with a 200 response. The ResponseWriter must not be used once the handler
+// returns, so writes after Close fail instead.
+type serverStream struct {
+	body io.ReadCloser
+	w    io.Writer
+	rc   *http.ResponseController
+	done chan struct{} // closed by Close
+
+	once   sync.Once
+	mu     sync.Mutex
+	closed bool
+}
+
+func (s *serverStream) Read(p []byte) (int, error) {
+	return s.body.Read(p)
+}
+
+func (s *serverStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, net.ErrClosed
+	}
+	return s.w.Write(p)
+}
+
+// Close ends the stream. It returns once no write is in progress.
+func (s *serverStream) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+		// Unblock a pending write while the handler is still running
+		_ = s.rc.SetWriteDeadline(time.Now())
+		_ = s.body.Close()
+		s.mu.Lock()
+		s.closed = true
+		s.mu.Unlock()
+	})
+	return nil
+}
+
+// CloseWrite closes the stream, as the response can't end before the handler
+// returns.
+func (s *serverStream) CloseWrite() error {
+	return s.Close()
+}
+
+// wait blocks until the stream is closed or ctx is done.
+func (s *serverStream) wait(ctx context.Context) {
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+	}
+	_ = s.Close()
+}
+
+// streamDialer is implemented by the Dialers of this package, which can open
+// a stream for a reverse tunnel protocol on the proxy.
+type streamDialer interface {
+	// dialStream sends an upgrade (HTTP/1.1) or extended CONNECT (HTTP/2
+	// and HTTP/3) request for protocol to path on the proxy.
+	dialStream(ctx context.Context, path, protocol string) (net.Conn, error)
+}
+
+// Listen registers a reverse tunnel listener named name on the proxy d
+// connects through, and returns a net.Listener for the tunnels clients open
+// to "<name>.<ReverseDomain>" on the proxy. The proxy must set
+// ServerConfig.ReverseDomain. d must be a Dialer created by this package.
+//
+// The name must be a DNS label, and is only registered by one listener at a
+// time; the proxy rejects a second registration with 409 Conflict. ctx
+// bounds the lifetime of the listener as well as the registration: when it's
+// done the listener is closed. Closing the listener unregisters the name but
+// leaves accepted connections open. If the registration is lost, e.g. because
+// the proxy restarted, Accept returns an error and Listen must be called
+// again.
+//
+// Over HTTP/2 and HTTP/3 the proxy can't half-close accepted connections:
+// they are closed once the dialing client finishes sending.
+func Listen(ctx context.Context, d Dialer, name string) (net.Listener, error) {
+	sd, ok := d.(streamDialer)
+	if !ok {
+		return nil, fmt.Errorf("connecttunnel: Listen requires a Dialer created by this package, got %T", d)
+	}
+	name = strings.ToLower(name)
+	if !validReverseName(name) {
+		return nil, fmt.Errorf("connecttunnel: invalid reverse listener name %q", name)
+	}
+
+	ctl, err := sd.dialStream(ctx, reversePathPrefix+name, protocolReverseListen)
+	if err != nil {
+		return nil, err
+	}
+	l := &reverseListener{
+		d:     sd,
+		name:  name,
+		ctl:   ctl,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+		ended: make(chan struct{}),
+	}
+	stop := context.AfterFunc(ctx, func() { _ = l.Close() })
+	go func() {
+		defer stop()
+		l.readNotices()
+	}()
+	return l, nil
+}
+
+// reverseListener is the client side of a registered reverse tunnel
+// listener.
+type reverseListener struct {
+	d     streamDialer
+	name  string
+	ctl   net.Conn // notice stream
+	conns chan net.Conn
+
+	done      chan struct{} // closed by Close
+	closeOnce sync.Once
+	ended     chan struct{} // closed when the notice stream ends
+	err       error         // why the notice stream ended, set before ended is closed
+}
+
+// readNotices accepts the connection announced by each notice line, of the
+// form "<id> <client address>". Empty lines are pings.
+func (l *reverseListener) readNotices() {
+	sc := bufio.NewScanner(l.ctl)
+	for sc.Scan() {
+		id, client, ok := strings.Cut(sc.Text(), " ")
+		if !ok {
+			continue
+		}
+		go l.accept(id, client)
+	}
+	err := sc.Err()
+	if err == nil {
+		err = io.EOF
+	}
+	l.err = fmt.Errorf("connecttunnel: reverse listener %q lost its registration: %w", l.name, err)
+	close(l.ended)
+}
+
+// accept opens the stream for connection id and queues it for Accept. If the
+// stream can't be opened the proxy gives up on the connection after
+// reverseAcceptTimeout, so the error is dropped.
+func (l *reverseListener) accept(id, client string) {
+	// The stream outlives the listener, so it isn't bound to a context
+	conn, err := l.d.dialStream(context.Background(), reversePathPrefix+l.name+"/"+id, protocolReverseAccept)
+	if err != nil {
+		return
+	}
+	conn = &reverseConn{Conn: conn, remote: &remoteAddr{addr: client}}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		_ = conn.Close()
+	}
+}
+
+// Accept waits for and returns the next tunnel opened to the listener. Its
+// RemoteAddr is the address of the client that opened it, as seen by the
+// proxy.
+func (l *reverseListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	case <-l.ended:
+		select {
+		case <-l.done:
+			return nil, net.ErrClosed
+		default:
+		}
+		return nil, l.err
+	}
+}
+
+// Close unregisters the listener.
+func (l *reverseListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		_ = l.ctl.Close()
+	})
+	return nil
+}
+
+// Addr returns the listener name.
+func (l *reverseListener) Addr() net.Addr {
+	return &remoteAddr{addr: l.name}
+}
+
+// reverseConn is a connection accepted by a reverse listener.
+type reverseConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *reverseConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// CloseWrite shuts down the write side of the stream, if it supports it.
+func (c *reverseConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package connect
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveReverseEcho echoes the connections accepted from ln, sending each
+// one's remote address first.
+func serveReverseEcho(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer func() { _ = conn.Close() }()
+			_, _ = io.WriteString(conn, conn.RemoteAddr().String()+"\n")
+			_, _ = io.Copy(conn, conn)
+		}()
+	}
+}
+
+// testReverseTunnel exposes an echo service through the proxy and dials it
+// from another client.
+func testReverseTunnel(t *testing.T, dialer Dialer, ends chan TunnelStats) {
+	t.Helper()
+	ln, err := Listen(context.Background(), dialer, "echo")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer func() { _ = ln.Close() }()
+	go serveReverseEcho(ln)
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", "echo.reverse.internal:80")
+	if err != nil {
+		t.Fatalf("Failed to dial reverse tunnel: %v", err)
+	}
+	msg := []byte("hello reverse")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	want := "127.0.0.1"
+	buf := make([]byte, 256)
+	var got []byte
+	for !bytes.HasSuffix(got, msg) {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("Read failed after %q: %v", got, err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if !strings.HasPrefix(string(got), want) {
+		t.Errorf("Accepted RemoteAddr = %q, want %s", got, want)
+	}
+	_ = conn.Close()
+
+	stats := waitStats(t, ends)
+	if stats.Target != "echo.reverse.internal:80" || stats.Identity != "alice" {
+		t.Errorf("Stats = %+v, want reverse target for alice", stats)
+	}
+}
+
+func TestReverseTunnel(t *testing.T) {
+	t.Run("HTTP/1.1", func(t *testing.T) {
+		cfg, _, ends := recordHooks()
+		cfg.ReverseDomain = "reverse.internal"
+		proxyServer := httptest.NewServer(NewHandler(cfg))
+		defer proxyServer.Close()
+		testReverseTunnel(t, NewH1Dialer(&ClientConfig{ProxyURL: proxyServer.URL}), ends)
+	})
+
+	t.Run("HTTP/2", func(t *testing.T) {
+		if !strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+			t.Skip("requires GODEBUG=http2xconnect=1")
+		}
+		cfg, _, ends := recordHooks()
+		cfg.ReverseDomain = "reverse.internal"
+		proxyServer := httptest.NewUnstartedServer(NewHandler(cfg))
+		proxyServer.EnableHTTP2 = true
+		proxyServer.StartTLS()
+		defer proxyServer.Close()
+		testReverseTunnel(t, NewH2Dialer(&ClientConfig{
+			ProxyURL:  proxyServer.URL,
+			TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		}), ends)
+	})
+
+	t.Run("HTTP/3", func(t *testing.T) {
+		cfg, _, ends := recordHooks()
+		cfg.ReverseDomain = "reverse.internal"
+		proxyURL := startH3Proxy(t, NewHandler(cfg))
+		testReverseTunnel(t, NewH3Dialer(&ClientConfig{
+			ProxyURL:  proxyURL,
+			TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		}), ends)
+	})
+}
+
+func TestReverseTunnelErrors(t *testing.T) {
+	var rejected bool
+	cfg := &ServerConfig{
+		ReverseDomain: "reverse.internal",
+		OnTunnel: func(ctx context.Context, req *http.Request) error {
+			if name, ok := ReverseListenName(req); ok && name == "secret" {
+				rejected = true
+				return errors.New("name not allowed")
+			}
+			return nil
+		},
+	}
+	proxyServer := httptest.NewServer(NewHandler(cfg))
+	defer proxyServer.Close()
+	dialer := NewH1Dialer(&ClientConfig{ProxyURL: proxyServer.URL})
+	ctx := context.Background()
+
+	wantStatus := func(t *testing.T, err error, status int) {
+		t.Helper()
+		var pe *ProxyError
+		if !errors.As(err, &pe) || pe.StatusCode != status {
+			t.Errorf("Error = %v, want status %d", err, status)
+		}
+	}
+
+	t.Run("unknown name", func(t *testing.T) {
+		_, err := dialer.DialContext(ctx, "tcp", "missing.reverse.internal:80")
+		wantStatus(t, err, http.StatusBadGateway)
+	})
+
+	t.Run("invalid name", func(t *testing.T) {
+		if _, err := Listen(ctx, dialer, "not.a.label"); err == nil {
+			t.Error("Listen succeeded, want error")
+		}
+	})
+
+	t.Run("rejected by OnTunnel", func(t *testing.T) {
+		_, err := Listen(ctx, dialer, "secret")
+		wantStatus(t, err, http.StatusForbidden)
+		if !rejected {
+			t.Error("OnTunnel didn't see the listener name")
+		}
+	})
+
+	t.Run("name in use", func(t *testing.T) {
+		ln, err := Listen(ctx, dialer, "dup")
+		if err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+		_, err = Listen(ctx, dialer, "dup")
+		wantStatus(t, err, http.StatusConflict)
+
+		// Closing the listener frees the name
+		_ = ln.Close()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			ln, err = Listen(ctx, dialer, "dup")
+			if err == nil {
+				_ = ln.Close()
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Listen after Close failed: %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		ln, err := Listen(ctx, dialer, "down")
+		if err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+		defer func() { _ = ln.Close() }()
+		if err := cfg.Shutdown(ctx); err != nil {
+			t.Fatalf("Shutdown failed: %v", err)
+		}
+		if _, err := ln.Accept(); err == nil || errors.Is(err, net.ErrClosed) {
+			t.Errorf("Accept error = %v, want lost registration", err)
+		}
+	})
+}
+
+func TestReverseTunnelDisabled(t *testing.T) {
+	proxyServer := httptest.NewServer(NewHandler(&ServerConfig{}))
+	defer proxyServer.Close()
+	dialer := NewH1Dialer(&ClientConfig{ProxyURL: proxyServer.URL})
+
+	_, err := Listen(context.Background(), dialer, "echo")
+	var pe *ProxyError
+	if !errors.As(err, &pe) || pe.StatusCode != http.StatusNotFound {
+		t.Errorf("Listen error = %v, want 404", err)
+	}
+}
@@ -5,7 +5,7 @@ import (
 )
 
 // NewHandler creates a unified handler that automatically detects and handles
-// both HTTP/1.1 and HTTP/2 CONNECT requests.
+// HTTP/1.1, HTTP/2 and HTTP/3 CONNECT requests, including CONNECT-UDP.
 //
 // This is the recommended handler for most use cases. It inspects the request
 // protocol and delegates to the appropriate protocol-specific handler.
@@ -17,6 +17,7 @@ func NewHandler(cfg *ServerConfig) http.Handler {
 		cfg: cfg,
 		h1:  NewH1Handler(cfg).(*h1Handler),
 		h2:  NewH2Handler(cfg).(*h2Handler),
+		h3:  NewH3Handler(cfg).(*h3Handler),
 	}
 }
 
@@ -24,19 +25,23 @@ type unifiedHandler struct {
 	cfg *ServerConfig
 	h1  *h1Handler
 	h2  *h2Handler
+	h3  *h3Handler
 }
 
 func (h *unifiedHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	// Check method first
-	if req.Method != http.MethodConnect {
+	// Check method first. HTTP/1.1 CONNECT-UDP uses a GET upgrade.
+	if req.Method != http.MethodConnect && extendedProtocol(req) == "" && !h.cfg.forwards(req) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	// Detect protocol and delegate
-	if req.ProtoMajor == 2 {
+	switch req.ProtoMajor {
+	case 3:
+		h.h3.ServeHTTP(w, req)
+	case 2:
 		h.h2.ServeHTTP(w, req)
-	} else {
+	default:
 		h.h1.ServeHTTP(w, req)
 	}
 }
@@ -2,7 +2,9 @@ package connect
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
 )
@@ -22,114 +24,122 @@ type h1Handler struct {
 }
 
 func (h *h1Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	// Verify method is CONNECT
-	if req.Method != http.MethodConnect {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	// The MASQUE protocols use an upgraded GET request
+	var target string
+	upgrade := extendedProtocol(req)
+	switch upgrade {
+	case protocolConnectUDP:
+		serveConnectUDP(h.cfg, w, req)
 		return
-	}
-
-	// Extract target from RequestURI (e.g., "example.com:443")
-	target := req.RequestURI
-	if target == "" || target == "/" {
-		http.Error(w, "Bad request: missing target", http.StatusBadRequest)
+	case protocolReverseListen, protocolReverseAccept:
+		serveReverse(h.cfg, w, req, upgrade)
 		return
-	}
+	case protocolConnectTCP:
+		var ok bool
+		if target, ok = connectTCPTarget(h.cfg, w, req); !ok {
+			return
+		}
+	default:
+		if h.cfg.forwards(req) {
+			serveForward(h.cfg, w, req)
+			return
+		}
 
-	// Call OnTunnel callback if configured
-	if err := h.cfg.checkTunnel(req.Context(), req); err != nil {
-		h.cfg.getLogger().Printf("tunnel rejected: %v", err)
-		http.Error(w, "Forbidden", http.StatusForbidden)
-		return
+		// Verify method is CONNECT
+		if req.Method != http.MethodConnect {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Extract target from RequestURI (e.g., "example.com:443")
+		target = req.RequestURI
+		if target == "" || target == "/" {
+			http.Error(w, "Bad request: missing target", http.StatusBadRequest)
+			return
+		}
 	}
 
-	// Dial upstream target
-	dial := h.cfg.getDialFunc()
-	upstream, err := dial(req.Context(), "tcp", target)
-	if err != nil {
-		h.cfg.getLogger().Printf("failed to dial %s: %v", target, err)
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+	// Run admission checks and dial upstream target
+	t := h.cfg.openUpstream(w, req, "tcp", target)
+	if t == nil {
 		return
 	}
 
 	// Hijack the client connection
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
-		_ = upstream.Close()
+		t.discard()
+		t.log(slog.LevelError, "hijack failed", slog.Any("error", fmt.Errorf("%w: connection does not support hijacking", ErrHijackFailed)))
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
 	client, bufrw, err := hijacker.Hijack()
 	if err != nil {
-		_ = upstream.Close()
-		h.cfg.getLogger().Printf("hijack failed: %v", err)
+		t.discard()
+		t.log(slog.LevelError, "hijack failed", slog.Any("error", fmt.Errorf("%w: %w", ErrHijackFailed, err)))
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
 	// Send success response
-	_, err = bufrw.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n")
+	status := "HTTP/1.1 200 Connection Established\r\n\r\n"
+	if upgrade != "" {
+		status = "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + upgrade + "\r\n\r\n"
+	}
+	_, err = bufrw.WriteString(status)
 	if err != nil {
 		_ = client.Close()
-		_ = upstream.Close()
-		h.cfg.getLogger().Printf("failed to write response: %v", err)
+		t.discard()
+		t.log(slog.LevelError, "failed to write response", slog.Any("error", err))
 		return
 	}
 	if err = bufrw.Flush(); err != nil {
 		_ = client.Close()
-		_ = upstream.Close()
-		h.cfg.getLogger().Printf("failed to flush response: %v", err)
+		t.discard()
+		t.log(slog.LevelError, "failed to flush response", slog.Any("error", err))
 		return
 	}
 
-	// Start bidirectional copy in a goroutine
+	t.started()
+
+	// Start bidirectional copy in a goroutine, reading from bufrw so bytes
+	// the client sent right after the request aren't lost
 	// Note: We use context.Background() instead of req.Context() because hijacked
-	// connections are independent of the HTTP request lifecycle
-	go h.tunnel(context.Background(), client, upstream)
+	// connections are independent of the HTTP request lifecycle. Shutdown
+	// still tears the tunnel down.
+	go h.tunnel(context.Background(), t, &bufferedConn{Conn: client, reader: bufrw.Reader})
 }
 
 // tunnel performs bidirectional copying between client and upstream connections.
-func (h *h1Handler) tunnel(ctx context.Context, client, upstream net.Conn) {
+func (h *h1Handler) tunnel(ctx context.Context, t *serverTunnel, client net.Conn) {
+	upstream := t.upstream
 	defer func() { _ = client.Close() }()
 	defer func() { _ = upstream.Close() }()
 
-	errCh := make(chan error, 2)
+	errCh := make(chan copyResult, 2)
 
 	// Copy from client to upstream
 	go func() {
-		_, err := io.Copy(upstream, client)
+		_, err := io.Copy(&countingWriter{w: upstream, add: t.addSent}, t.upload(client))
 		// Close write side of upstream when client sends EOF
-		if conn, ok := upstream.(*net.TCPConn); ok {
+		if conn, ok := upstream.(closeWriter); ok {
 			_ = conn.CloseWrite()
 		}
-		errCh <- err
+		errCh <- copyResult{fromClient: true, err: err}
 	}()
 
 	// Copy from upstream to client
 	go func() {
-		_, err := io.Copy(client, upstream)
+		_, err := io.Copy(&countingWriter{w: client, add: t.addReceived}, t.download(upstream))
 		// Close write side of client when upstream sends EOF
-		if conn, ok := client.(*net.TCPConn); ok {
+		if conn, ok := client.(closeWriter); ok {
 			_ = conn.CloseWrite()
 		}
-		errCh <- err
+		errCh <- copyResult{err: err}
 	}()
 
-	// Wait for both copies to complete or context cancellation
-	select {
-	case <-ctx.Done():
-		// Context cancelled, close connections
-		return
-	case err := <-errCh:
-		// One direction finished (possibly with error)
-		if err != nil && err != io.EOF {
-			h.cfg.getLogger().Printf("tunnel error: %v", err)
-		}
-		// Wait for the other direction to finish
-		err2 := <-errCh
-		if err2 != nil && err2 != io.EOF {
-			h.cfg.getLogger().Printf("tunnel error: %v", err2)
-		}
-		return
-	}
+	// Wait for both copies to complete, or for the tunnel to be torn down;
+	// the deferred closes unblock the copies
+	t.wait(ctx, errCh)
 }
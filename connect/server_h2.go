@@ -4,7 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"net"
+	"log/slog"
 	"net/http"
 )
 
@@ -35,34 +35,43 @@ func (h *h2Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// Extract target from Host header (HTTP/2 CONNECT uses :authority pseudo-header)
-	target := req.Host
-	if target == "" {
-		http.Error(w, "Bad request: missing target", http.StatusBadRequest)
+	// Extended CONNECT (RFC 8441) carries the protocol in :protocol
+	var target string
+	switch protocol := extendedProtocol(req); protocol {
+	case "":
+		// Extract target from Host header (HTTP/2 CONNECT uses :authority pseudo-header)
+		target = req.Host
+		if target == "" {
+			http.Error(w, "Bad request: missing target", http.StatusBadRequest)
+			return
+		}
+	case protocolConnectTCP:
+		var ok bool
+		if target, ok = connectTCPTarget(h.cfg, w, req); !ok {
+			return
+		}
+	case protocolConnectUDP:
+		serveConnectUDP(h.cfg, w, req)
 		return
-	}
-
-	// Call OnTunnel callback if configured
-	if err := h.cfg.checkTunnel(req.Context(), req); err != nil {
-		h.cfg.getLogger().Printf("tunnel rejected: %v", err)
-		http.Error(w, "Forbidden", http.StatusForbidden)
+	case protocolReverseListen, protocolReverseAccept:
+		serveReverse(h.cfg, w, req, protocol)
+		return
+	default:
+		http.Error(w, "Bad request: unsupported protocol", http.StatusBadRequest)
 		return
 	}
 
-	// Dial upstream target
-	dial := h.cfg.getDialFunc()
-	upstream, err := dial(req.Context(), "tcp", target)
-	if err != nil {
-		h.cfg.getLogger().Printf("failed to dial %s: %v", target, err)
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+	// Run admission checks and dial upstream target
+	t := h.cfg.openUpstream(w, req, "tcp", target)
+	if t == nil {
 		return
 	}
 
 	// Enable full duplex mode for HTTP/2 streams
 	rc := http.NewResponseController(w)
 	if err := rc.EnableFullDuplex(); err != nil {
-		_ = upstream.Close()
-		h.cfg.getLogger().Printf("failed to enable full duplex: %v", err)
+		t.discard()
+		t.log(slog.LevelError, "failed to enable full duplex", slog.Any("error", err))
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
@@ -72,18 +81,23 @@ func (h *h2Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	// Flush headers to establish the tunnel
 	if err := rc.Flush(); err != nil {
-		_ = upstream.Close()
-		h.cfg.getLogger().Printf("failed to flush response: %v", err)
+		t.discard()
+		t.log(slog.LevelError, "failed to flush response", slog.Any("error", err))
 		return
 	}
 
 	// Start bidirectional copy between request body and upstream
 	// For HTTP/2, we must stay in the handler to keep the response stream open
-	h.tunnel(req.Context(), req.Body, w, upstream)
+	t.started()
+	tunnelStream(req.Context(), t, req.Body, w)
 }
 
-// tunnel performs bidirectional copying between the HTTP/2 stream and upstream connection.
-func (h *h2Handler) tunnel(ctx context.Context, reqBody io.ReadCloser, w http.ResponseWriter, upstream net.Conn) {
+// tunnelStream performs bidirectional copying between a request stream and
+// the upstream connection. It is shared by the HTTP/2 and HTTP/3 handlers,
+// where the request body and response writer form the two halves of the
+// stream.
+func tunnelStream(ctx context.Context, t *serverTunnel, reqBody io.ReadCloser, w http.ResponseWriter) {
+	upstream := t.upstream
 	defer func() { _ = reqBody.Close() }()
 	defer func() { _ = upstream.Close() }()
 
@@ -91,25 +105,29 @@ func (h *h2Handler) tunnel(ctx context.Context, reqBody io.ReadCloser, w http.Re
 	// HTTP/2 requires explicit flushing to send data frames immediately
 	flusher, _ := w.(http.Flusher)
 
-	errCh := make(chan error, 2)
+	errCh := make(chan copyResult, 2)
 
 	// Copy from request body (client) to upstream
 	go func() {
-		_, err := io.Copy(upstream, reqBody)
+		_, err := io.Copy(&countingWriter{w: upstream, add: t.addSent}, t.upload(reqBody))
 		// Close write side of upstream when client sends EOF
-		if conn, ok := upstream.(*net.TCPConn); ok {
+		if conn, ok := upstream.(closeWriter); ok {
 			_ = conn.CloseWrite()
 		}
-		errCh <- err
+		errCh <- copyResult{fromClient: true, err: err}
 	}()
 
 	// Copy from upstream to response body (client), with explicit flushing
 	go func() {
 		buf := make([]byte, 32*1024)
+		src := t.download(upstream)
 		for {
-			nr, er := upstream.Read(buf)
+			nr, er := src.Read(buf)
 			if nr > 0 {
 				nw, ew := w.Write(buf[0:nr])
+				if nw > 0 {
+					t.addReceived(buf[:nw])
+				}
 				// Flush after each write to ensure data is sent immediately
 				if flusher != nil {
 					flusher.Flush()
@@ -121,36 +139,22 @@ func (h *h2Handler) tunnel(ctx context.Context, reqBody io.ReadCloser, w http.Re
 					}
 				}
 				if ew != nil {
-					errCh <- ew
+					errCh <- copyResult{err: ew}
 					return
 				}
 				if nr != nw {
-					errCh <- io.ErrShortWrite
+					errCh <- copyResult{err: io.ErrShortWrite}
 					return
 				}
 			}
 			if er != nil {
-				errCh <- er
+				errCh <- copyResult{err: er}
 				return
 			}
 		}
 	}()
 
-	// Wait for both copies to complete or context cancellation
-	select {
-	case <-ctx.Done():
-		// Context cancelled, close connections
-		return
-	case err := <-errCh:
-		// One direction finished (possibly with error)
-		if err != nil && err != io.EOF {
-			h.cfg.getLogger().Printf("tunnel error: %v", err)
-		}
-		// Wait for the other direction to finish
-		err2 := <-errCh
-		if err2 != nil && err2 != io.EOF {
-			h.cfg.getLogger().Printf("tunnel error: %v", err2)
-		}
-		return
-	}
+	// Wait for both copies to complete, or for the tunnel to be torn down;
+	// the deferred closes unblock the copies
+	t.wait(ctx, errCh)
 }
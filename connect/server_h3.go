@@ -0,0 +1,81 @@
+package connect
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// NewH3Handler creates an HTTP/3 CONNECT handler.
+// It handles CONNECT requests carried on QUIC streams, and is intended to be
+// served by a quic-go http3.Server. Each tunnel is an independent QUIC stream,
+// so packet loss on one tunnel does not stall the others.
+func NewH3Handler(cfg *ServerConfig) http.Handler {
+	if cfg == nil {
+		cfg = &ServerConfig{}
+	}
+	return &h3Handler{cfg: cfg}
+}
+
+type h3Handler struct {
+	cfg *ServerConfig
+}
+
+func (h *h3Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// Verify protocol is HTTP/3
+	if req.ProtoMajor != 3 {
+		http.Error(w, "HTTP/3 required", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	// Verify method is CONNECT
+	if req.Method != http.MethodConnect {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Extended CONNECT carries the protocol in :protocol
+	var target string
+	switch protocol := extendedProtocol(req); protocol {
+	case "":
+		// Extract target from Host header (HTTP/3 CONNECT uses :authority pseudo-header)
+		target = req.Host
+		if target == "" {
+			http.Error(w, "Bad request: missing target", http.StatusBadRequest)
+			return
+		}
+	case protocolConnectTCP:
+		var ok bool
+		if target, ok = connectTCPTarget(h.cfg, w, req); !ok {
+			return
+		}
+	case protocolConnectUDP:
+		serveConnectUDP(h.cfg, w, req)
+		return
+	case protocolReverseListen, protocolReverseAccept:
+		serveReverse(h.cfg, w, req, protocol)
+		return
+	default:
+		http.Error(w, "Bad request: unsupported protocol", http.StatusBadRequest)
+		return
+	}
+
+	// Run admission checks and dial upstream target
+	t := h.cfg.openUpstream(w, req, "tcp", target)
+	if t == nil {
+		return
+	}
+
+	// Send 200 OK response. HTTP/3 streams are always full duplex.
+	w.WriteHeader(http.StatusOK)
+
+	// Flush headers to establish the tunnel
+	if err := http.NewResponseController(w).Flush(); err != nil {
+		t.discard()
+		t.log(slog.LevelError, "failed to flush response", slog.Any("error", err))
+		return
+	}
+
+	// Stay in the handler to keep the stream open
+	t.started()
+	tunnelStream(req.Context(), t, req.Body, w)
+}
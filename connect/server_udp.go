@@ -0,0 +1,195 @@
+package connect
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"syscall"
+)
+
+// serveConnectUDP handles a CONNECT-UDP request (RFC 9298) over HTTP/1.1,
+// HTTP/2 or HTTP/3. UDP payloads are carried in DATAGRAM capsules on the
+// request stream.
+func serveConnectUDP(cfg *ServerConfig, w http.ResponseWriter, req *http.Request) {
+	tmpl, err := cfg.udpTemplate()
+	if err != nil {
+		cfg.getSlogger().Error("invalid UDP template", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	target, ok := templateTarget(w, req, tmpl, "target_port")
+	if !ok {
+		return
+	}
+
+	// Run admission checks and dial upstream target
+	t := cfg.openUpstream(w, req, "udp", target)
+	if t == nil {
+		return
+	}
+
+	if req.ProtoMajor == 1 {
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			t.discard()
+			t.log(slog.LevelError, "hijack failed", slog.Any("error", fmt.Errorf("%w: connection does not support hijacking", ErrHijackFailed)))
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		client, bufrw, err := hijacker.Hijack()
+		if err != nil {
+			t.discard()
+			t.log(slog.LevelError, "hijack failed", slog.Any("error", fmt.Errorf("%w: %w", ErrHijackFailed, err)))
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		_, err = bufrw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Upgrade: " + protocolConnectUDP + "\r\n" +
+			capsuleProtocolHeader + ": ?1\r\n\r\n")
+		if err == nil {
+			err = bufrw.Flush()
+		}
+		if err != nil {
+			_ = client.Close()
+			t.discard()
+			t.log(slog.LevelError, "failed to write response", slog.Any("error", err))
+			return
+		}
+		// Hijacked connections are independent of the request lifecycle.
+		t.started()
+		go proxyUDP(t, bufrw.Reader, client, client)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	if req.ProtoMajor == 2 {
+		// HTTP/3 streams are always full duplex
+		if err := rc.EnableFullDuplex(); err != nil {
+			t.discard()
+			t.log(slog.LevelError, "failed to enable full duplex", slog.Any("error", err))
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set(capsuleProtocolHeader, "?1")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		t.discard()
+		t.log(slog.LevelError, "failed to flush response", slog.Any("error", err))
+		return
+	}
+
+	// For HTTP/2 and HTTP/3, we must stay in the handler to keep the response stream open
+	t.started()
+	proxyUDP(t, bufio.NewReader(req.Body), &flushWriter{w: w, rc: rc}, req.Body)
+}
+
+// proxyUDP relays DATAGRAM capsules read from r to upstream, and datagrams
+// received from upstream as capsules written to w. stream is closed when
+// either side finishes.
+func proxyUDP(t *serverTunnel, r *bufio.Reader, w io.Writer, stream io.Closer) {
+	upstream := t.upstream
+	defer func() { _ = stream.Close() }()
+	defer func() { _ = upstream.Close() }()
+
+	errCh := make(chan copyResult, 2)
+
+	// Client capsules to upstream datagrams
+	go func() {
+		buf := make([]byte, maxCapsuleLength)
+		for {
+			typ, payload, err := readCapsule(r, buf)
+			if err != nil {
+				errCh <- copyResult{fromClient: true, err: err}
+				return
+			}
+			if typ != capsuleDatagram {
+				// Unknown capsule types are ignored (RFC 9297 Section 3.2)
+				continue
+			}
+			data, ok, err := parseUDPDatagram(payload)
+			if err != nil {
+				errCh <- copyResult{fromClient: true, err: err}
+				return
+			}
+			if !ok {
+				continue
+			}
+			if err := throttle(t.limitCtx, t.uploadLimits, len(data)); err != nil {
+				errCh <- copyResult{fromClient: true, err: err}
+				return
+			}
+			if _, err := upstream.Write(data); err != nil && !isTransientUDPError(err) {
+				errCh <- copyResult{fromClient: true, err: err}
+				return
+			}
+			t.addSent(data)
+		}
+	}()
+
+	// Upstream datagrams to client capsules
+	go func() {
+		buf := make([]byte, maxCapsuleLength)
+		src := t.download(upstream)
+		for {
+			n, err := src.Read(buf)
+			if err != nil {
+				if isTransientUDPError(err) {
+					continue
+				}
+				errCh <- copyResult{err: err}
+				return
+			}
+			if err := writeDatagramCapsule(w, buf[:n]); err != nil {
+				errCh <- copyResult{err: err}
+				return
+			}
+			t.addReceived(buf[:n])
+		}
+	}()
+
+	// Either side finishing or shutdown tears down the association; closing
+	// both ends unblocks the goroutines.
+	var res copyResult
+	select {
+	case res = <-errCh:
+	case <-t.aborted:
+		_ = stream.Close()
+		_ = upstream.Close()
+		<-errCh
+		<-errCh
+		t.canceled()
+		return
+	}
+	_ = stream.Close()
+	_ = upstream.Close()
+	<-errCh
+	// The other side's error is only a result of the teardown.
+	t.ended(res, copyResult{})
+}
+
+// isTransientUDPError reports whether err is an ICMP-induced error on a
+// connected UDP socket, which should not tear down the association.
+func isTransientUDPError(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// flushWriter flushes after every write, so HTTP/2 DATA frames are sent
+// immediately.
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, f.rc.Flush()
+}
@@ -0,0 +1,96 @@
+package connect
+
+import (
+	"context"
+	"sync"
+)
+
+// tunnelTracker tracks the established tunnels of a ServerConfig so they can
+// be drained on shutdown.
+type tunnelTracker struct {
+	mu       sync.Mutex
+	tunnels  map[*serverTunnel]struct{}
+	shutdown bool
+	aborted  bool
+	idle     chan struct{} // closed when the last tunnel is removed
+}
+
+// Shutdown gracefully shuts down the tunnels served with this config. New
+// tunnels are refused with 503 Service Unavailable, and Shutdown waits for the
+// established tunnels to close. If ctx expires first, the remaining tunnels
+// are closed with reason CloseShutdown and ctx's error is returned. Reverse
+// tunnel listeners are unregistered straight away.
+//
+// Shutdown doesn't close listeners, so call it alongside http.Server.Shutdown,
+// which doesn't wait for hijacked HTTP/1.1 tunnels.
+func (c *ServerConfig) Shutdown(ctx context.Context) error {
+	c.reverse.close()
+
+	tr := &c.tracker
+	tr.mu.Lock()
+	tr.shutdown = true
+	if len(tr.tunnels) == 0 {
+		tr.mu.Unlock()
+		return nil
+	}
+	if tr.idle == nil {
+		tr.idle = make(chan struct{})
+	}
+	idle := tr.idle
+	tr.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+	}
+
+	// Deadline passed, close the remaining tunnels
+	tr.mu.Lock()
+	tr.aborted = true
+	for t := range tr.tunnels {
+		t.abort(CloseShutdown)
+	}
+	tr.mu.Unlock()
+	return ctx.Err()
+}
+
+// ActiveTunnels returns the number of established tunnels.
+func (c *ServerConfig) ActiveTunnels() int {
+	c.tracker.mu.Lock()
+	defer c.tracker.mu.Unlock()
+	return len(c.tracker.tunnels)
+}
+
+// shuttingDown reports whether Shutdown has been called.
+func (tr *tunnelTracker) shuttingDown() bool {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.shutdown
+}
+
+// add tracks an established tunnel. A tunnel admitted before Shutdown but
+// established once nothing is waiting for it to close, because Shutdown gave
+// up waiting or already returned, is closed straight away.
+func (tr *tunnelTracker) add(t *serverTunnel) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.tunnels == nil {
+		tr.tunnels = make(map[*serverTunnel]struct{})
+	}
+	tr.tunnels[t] = struct{}{}
+	if tr.aborted || (tr.shutdown && tr.idle == nil) {
+		t.abort(CloseShutdown)
+	}
+}
+
+// remove stops tracking a closed tunnel.
+func (tr *tunnelTracker) remove(t *serverTunnel) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	delete(tr.tunnels, t)
+	if len(tr.tunnels) == 0 && tr.idle != nil {
+		close(tr.idle)
+		tr.idle = nil
+	}
+}
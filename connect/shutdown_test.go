@@ -0,0 +1,255 @@
+package connect
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrainsTunnels(t *testing.T) {
+	cfg, starts, ends := recordHooks()
+	proxyServer := httptest.NewServer(NewHandler(cfg))
+	defer proxyServer.Close()
+	echoAddr := startTCPEcho(t)
+
+	dialer := NewH1Dialer(&ClientConfig{ProxyURL: proxyServer.URL})
+	conn, err := dialer.DialContext(context.Background(), "tcp", echoAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial through proxy: %v", err)
+	}
+	waitStats(t, starts)
+
+	done := make(chan error, 1)
+	go func() { done <- cfg.Shutdown(context.Background()) }()
+
+	// New tunnels are refused while draining
+	waitShuttingDown(t, cfg)
+	_, err = dialer.DialContext(context.Background(), "tcp", echoAddr)
+	var pe *ProxyError
+	if !errors.As(err, &pe) || pe.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 during shutdown, got %v", err)
+	}
+
+	// The established tunnel still works
+	msg := []byte("draining")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, len(msg))); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned with an open tunnel: %v", err)
+	default:
+	}
+
+	_ = conn.Close()
+	waitStats(t, ends)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Shutdown failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for Shutdown")
+	}
+}
+
+// proxyServers start an HTTP/1.1 and an HTTP/2 proxy serving cfg, and return
+// dialers for them.
+var proxyServers = []struct {
+	name  string
+	setup func(t *testing.T, cfg *ServerConfig) Dialer
+}{
+	{
+		name: "h1",
+		setup: func(t *testing.T, cfg *ServerConfig) Dialer {
+			proxyServer := httptest.NewServer(NewHandler(cfg))
+			t.Cleanup(proxyServer.Close)
+			return NewH1Dialer(&ClientConfig{ProxyURL: proxyServer.URL})
+		},
+	},
+	{
+		name: "h2",
+		setup: func(t *testing.T, cfg *ServerConfig) Dialer {
+			proxyServer := httptest.NewUnstartedServer(NewHandler(cfg))
+			proxyServer.EnableHTTP2 = true
+			proxyServer.StartTLS()
+			t.Cleanup(proxyServer.Close)
+			return NewH2Dialer(&ClientConfig{
+				ProxyURL:  proxyServer.URL,
+				TLSConfig: &tls.Config{InsecureSkipVerify: true},
+			})
+		},
+	},
+}
+
+// startSilentUpstream starts a TCP server that reads each connection to EOF
+// and then holds it open without writing, so tunnels to it stay half-closed.
+// Each client EOF is reported on the returned channel.
+func startSilentUpstream(t *testing.T) (string, chan struct{}) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	eof := make(chan struct{}, 1)
+	var conns []net.Conn
+	var mu sync.Mutex
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			_ = c.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			go func() {
+				_, _ = io.Copy(io.Discard, conn)
+				eof <- struct{}{}
+			}()
+		}
+	}()
+	return listener.Addr().String(), eof
+}
+
+// dialHalfClosed dials a tunnel to addr, sends a byte and closes the write
+// side, and waits for the upstream to see the EOF.
+func dialHalfClosed(t *testing.T, dialer Dialer, addr string, eof chan struct{}) net.Conn {
+	t.Helper()
+	conn, err := dialer.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial through proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	if _, err := conn.Write([]byte("x")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if err := conn.(closeWriter).CloseWrite(); err != nil {
+		t.Fatalf("Failed to close write side: %v", err)
+	}
+	select {
+	case <-eof:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the upstream to see EOF")
+	}
+	return conn
+}
+
+func TestShutdownDeadlineClosesTunnels(t *testing.T) {
+	for _, tc := range proxyServers {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, starts, ends := recordHooks()
+			dialer := tc.setup(t, cfg)
+
+			conn, err := dialer.DialContext(context.Background(), "tcp", startTCPEcho(t))
+			if err != nil {
+				t.Fatalf("Failed to dial through proxy: %v", err)
+			}
+			defer func() { _ = conn.Close() }()
+			waitStats(t, starts)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			if err := cfg.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("Expected deadline exceeded, got %v", err)
+			}
+
+			if end := waitStats(t, ends); end.Reason != CloseShutdown {
+				t.Errorf("Expected shutdown close, got %s", end.Reason)
+			}
+			if n := cfg.ActiveTunnels(); n != 0 {
+				t.Errorf("Expected no active tunnels, got %d", n)
+			}
+
+			// The client sees the tunnel close
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Read(make([]byte, 1)); err == nil {
+				t.Error("Expected read to fail after shutdown")
+			}
+		})
+	}
+}
+
+// TestShutdownDeadlineClosesHalfClosedTunnels checks that tunnels with one
+// direction finished are still closed when Shutdown gives up waiting.
+func TestShutdownDeadlineClosesHalfClosedTunnels(t *testing.T) {
+	for _, tc := range proxyServers {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, starts, ends := recordHooks()
+			dialer := tc.setup(t, cfg)
+			addr, eof := startSilentUpstream(t)
+
+			conn := dialHalfClosed(t, dialer, addr, eof)
+			waitStats(t, starts)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			if err := cfg.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("Expected deadline exceeded, got %v", err)
+			}
+			if end := waitStats(t, ends); end.Reason != CloseShutdown {
+				t.Errorf("Expected shutdown close, got %s", end.Reason)
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Read(make([]byte, 1)); isTimeout(err) {
+				t.Error("Expected the tunnel to close after shutdown")
+			}
+		})
+	}
+}
+
+// TestShutdownLateTunnel checks that a tunnel admitted before Shutdown but
+// established after it returned is closed.
+func TestShutdownLateTunnel(t *testing.T) {
+	cfg := &ServerConfig{}
+	if err := cfg.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	late := &serverTunnel{aborted: make(chan struct{})}
+	cfg.tracker.add(late)
+	defer cfg.tracker.remove(late)
+	select {
+	case <-late.aborted:
+		if late.abortReason != CloseShutdown {
+			t.Errorf("Expected shutdown close, got %s", late.abortReason)
+		}
+	default:
+		t.Error("Tunnel established after Shutdown returned wasn't closed")
+	}
+}
+
+func TestShutdownIdle(t *testing.T) {
+	cfg := &ServerConfig{}
+	if err := cfg.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+}
+
+func waitShuttingDown(t *testing.T, cfg *ServerConfig) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cfg.tracker.shuttingDown() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for shutdown")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
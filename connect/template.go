@@ -0,0 +1,251 @@
+package connect
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// DefaultUDPTemplate is the default URI template path for CONNECT-UDP
+// requests, as suggested by RFC 9298.
+const DefaultUDPTemplate = "/.well-known/masque/udp/{target_host}/{target_port}/"
+
+// DefaultTCPTemplate is the default URI template path for template-driven TCP
+// (connect-tcp) requests, as suggested by draft-ietf-httpbis-connect-tcp.
+const DefaultTCPTemplate = "/.well-known/masque/tcp/{target_host}/{tcp_port}/"
+
+// uriTemplate is a minimal RFC 6570 URI template supporting the subset used by
+// MASQUE: simple string expansion ({var}) and form-style query expansion
+// ({?var1,var2}).
+type uriTemplate struct {
+	raw   string
+	parts []templatePart
+}
+
+type templatePart struct {
+	literal string
+	// vars is set for expressions. query is true for {?...} expressions.
+	vars  []string
+	query bool
+}
+
+// parseURITemplate parses a URI template.
+func parseURITemplate(s string) (*uriTemplate, error) {
+	t := &uriTemplate{raw: s}
+	for len(s) > 0 {
+		open := strings.IndexByte(s, '{')
+		if open < 0 {
+			t.parts = append(t.parts, templatePart{literal: s})
+			break
+		}
+		if open > 0 {
+			t.parts = append(t.parts, templatePart{literal: s[:open]})
+		}
+		end := strings.IndexByte(s[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("connecttunnel: unterminated expression in URI template %q", t.raw)
+		}
+		expr := s[open+1 : open+end]
+		p := templatePart{}
+		if strings.HasPrefix(expr, "?") {
+			p.query = true
+			expr = expr[1:]
+		}
+		for _, v := range strings.Split(expr, ",") {
+			if v == "" || strings.ContainsAny(v, "+#./;?&=,!@|*:") {
+				return nil, fmt.Errorf("connecttunnel: unsupported expression {%s} in URI template %q", expr, t.raw)
+			}
+			p.vars = append(p.vars, v)
+		}
+		if !p.query && len(p.vars) != 1 {
+			return nil, fmt.Errorf("connecttunnel: unsupported expression {%s} in URI template %q", expr, t.raw)
+		}
+		t.parts = append(t.parts, p)
+		s = s[open+end+1:]
+	}
+	return t, nil
+}
+
+// hasVars reports whether the template references all of the given variables.
+func (t *uriTemplate) hasVars(names ...string) bool {
+	for _, n := range names {
+		found := false
+		for _, p := range t.parts {
+			for _, v := range p.vars {
+				if v == n {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// expand expands the template with the given variables.
+func (t *uriTemplate) expand(vars map[string]string) string {
+	var sb strings.Builder
+	for _, p := range t.parts {
+		switch {
+		case p.vars == nil:
+			sb.WriteString(p.literal)
+		case p.query:
+			sep := "?"
+			for _, v := range p.vars {
+				val, ok := vars[v]
+				if !ok {
+					continue
+				}
+				sb.WriteString(sep)
+				sb.WriteString(v)
+				sb.WriteByte('=')
+				sb.WriteString(pctEncode(val))
+				sep = "&"
+			}
+		default:
+			sb.WriteString(pctEncode(vars[p.vars[0]]))
+		}
+	}
+	return sb.String()
+}
+
+// match matches a request URL's path and query against the template,
+// returning the decoded variables. Only the path and query of the template
+// are considered, so absolute templates match requests for any authority.
+func (t *uriTemplate) match(u *url.URL) (map[string]string, bool) {
+	parts := t.parts
+	// Strip any scheme and authority from the template.
+	if len(parts) > 0 && parts[0].vars == nil {
+		lit := parts[0].literal
+		if i := strings.Index(lit, "://"); i >= 0 {
+			rest := lit[i+3:]
+			slash := strings.IndexByte(rest, '/')
+			if slash < 0 {
+				return nil, false
+			}
+			parts = append([]templatePart{{literal: rest[slash:]}}, parts[1:]...)
+		}
+	}
+
+	vars := make(map[string]string)
+	path := u.EscapedPath()
+	for i, p := range parts {
+		switch {
+		case p.vars == nil:
+			lit, query, hasQuery := strings.Cut(p.literal, "?")
+			if !strings.HasPrefix(path, lit) {
+				return nil, false
+			}
+			path = path[len(lit):]
+			if hasQuery {
+				// Literal query parameters must be present as written.
+				for k, vs := range parseQueryLiteral(query) {
+					if u.Query().Get(k) != vs {
+						return nil, false
+					}
+				}
+			}
+		case p.query:
+			q := u.Query()
+			for _, v := range p.vars {
+				if q.Has(v) {
+					vars[v] = q.Get(v)
+				}
+			}
+		default:
+			// A path variable extends to the next literal, or the end of
+			// the path if it is the last path element.
+			end := len(path)
+			if i+1 < len(parts) && parts[i+1].vars == nil {
+				next, _, _ := strings.Cut(parts[i+1].literal, "?")
+				if next != "" {
+					idx := strings.Index(path, next)
+					if idx < 0 {
+						return nil, false
+					}
+					end = idx
+				}
+			} else if idx := strings.IndexByte(path, '/'); idx >= 0 {
+				end = idx
+			}
+			val, err := url.PathUnescape(path[:end])
+			if err != nil || val == "" {
+				return nil, false
+			}
+			vars[p.vars[0]] = val
+			path = path[end:]
+		}
+	}
+	if path != "" {
+		return nil, false
+	}
+	return vars, true
+}
+
+// String returns the raw template.
+func (t *uriTemplate) String() string {
+	return t.raw
+}
+
+func parseQueryLiteral(s string) map[string]string {
+	m := make(map[string]string)
+	for _, kv := range strings.Split(s, "&") {
+		if kv == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(kv, "=")
+		m[k] = v
+	}
+	return m
+}
+
+// pctEncode percent-encodes everything outside the RFC 3986 unreserved set,
+// which is what RFC 6570 simple expansion requires. Notably this encodes the
+// colons in IPv6 literals.
+func pctEncode(s string) string {
+	const hex = "0123456789ABCDEF"
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' {
+			sb.WriteByte(c)
+			continue
+		}
+		sb.WriteByte('%')
+		sb.WriteByte(hex[c>>4])
+		sb.WriteByte(hex[c&0xf])
+	}
+	return sb.String()
+}
+
+// parseProxyTemplate parses a proxy URI template, falling back to def if raw
+// is empty, and checks it contains {target_host} and the port variable.
+func parseProxyTemplate(raw, def, portVar string) (*uriTemplate, error) {
+	if raw == "" {
+		raw = def
+	}
+	t, err := parseURITemplate(raw)
+	if err != nil {
+		return nil, err
+	}
+	if !t.hasVars("target_host", portVar) {
+		return nil, fmt.Errorf("connecttunnel: URI template %q must contain {target_host} and {%s}", raw, portVar)
+	}
+	return t, nil
+}
+
+// resolveTemplate resolves a possibly relative URI template against the proxy
+// URL, returning an absolute template.
+func resolveTemplate(proxyURL *url.URL, tmpl string) string {
+	if strings.Contains(tmpl, "://") {
+		return tmpl
+	}
+	base := proxyURL.Scheme + "://" + proxyURL.Host
+	if !strings.HasPrefix(tmpl, "/") {
+		tmpl = "/" + tmpl
+	}
+	return base + tmpl
+}
@@ -1,11 +1,17 @@
 package connect
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"sync"
+	"time"
 )
 
 // Dialer establishes network connections through a tunnel.
@@ -16,12 +22,28 @@ type Dialer interface {
 	DialContext(ctx context.Context, network, address string) (net.Conn, error)
 }
 
+// PacketDialer establishes UDP associations through a tunnel using
+// CONNECT-UDP (RFC 9298). The H1, H2, H2C and H3 dialers satisfy this
+// interface.
+type PacketDialer interface {
+	// DialPacket opens a UDP association to the address on the named network.
+	// The network must be "udp", "udp4", or "udp6". The returned connection
+	// only exchanges datagrams with address; it also implements net.Conn.
+	DialPacket(ctx context.Context, network, address string) (net.PacketConn, error)
+}
+
 // TunnelFunc is called when a tunnel is established on the server side.
 // It receives the incoming request and can inspect headers, perform authentication,
 // or reject the connection by returning an error.
 //
 // If TunnelFunc returns an error, the tunnel is rejected and a 403 Forbidden
-// response is sent to the client.
+// response is sent to the client, or 407 Proxy Authentication Required if the
+// error wraps ErrProxyAuthRequired. A *RejectionError controls the exact
+// status, headers and body of the response.
+//
+// The ctx is specific to the tunnel, and TunnelFunc can attach the
+// authenticated principal to it with SetTunnelInfo, or just an identity with
+// SetIdentity.
 type TunnelFunc func(ctx context.Context, req *http.Request) error
 
 // DialFunc is a function that establishes a network connection.
@@ -37,16 +59,148 @@ type Logger interface {
 type ServerConfig struct {
 	// OnTunnel is called when a tunnel is established.
 	// If nil, all tunnels are accepted.
-	// If it returns an error, the tunnel is rejected with 403 Forbidden.
+	// If it returns an error, the tunnel is rejected with 403 Forbidden, or
+	// 407 Proxy Authentication Required if the error wraps
+	// ErrProxyAuthRequired, or the response a *RejectionError describes.
 	OnTunnel TunnelFunc
 
-	// Dial is used to establish connections to upstream targets.
-	// If nil, net.Dialer{}.DialContext is used.
+	// Dial is used to establish connections to upstream targets. The network
+	// is "tcp" for CONNECT tunnels and "udp" for CONNECT-UDP associations.
+	// The ctx carries the tunnel's TunnelInfo, so Dial can route by who the
+	// tunnel is for. If nil, net.Dialer{}.DialContext is used. Use a
+	// GuardedDialer to block loopback, private and metadata destinations.
+	// Dial failures are reported with 502 Bad Gateway, or 504 Gateway
+	// Timeout if the dial timed out. Dial can return a *RejectionError to
+	// refuse the tunnel with the response it describes instead.
 	Dial DialFunc
 
+	// OnTunnelStart is called once a tunnel is established, with its target,
+	// identity, protocol and dial latency.
+	OnTunnelStart TunnelHook
+
+	// OnTunnelEnd is called when an established tunnel closes, additionally
+	// reporting the bytes copied in each direction, the duration and why it
+	// closed.
+	OnTunnelEnd TunnelHook
+
+	// OnTunnelReject is called when a tunnel is refused before it is
+	// established: while shutting down, for an invalid target, by OnTunnel,
+	// Policy or the limits, or because it failed to dial or start. The
+	// stats' Err says why, and wraps ErrUpstreamDial for dial failures.
+	OnTunnelReject TunnelHook
+
+	// Metrics, if set, records tunnel counts, upstream dial latency and
+	// bytes transferred.
+	Metrics *Metrics
+
 	// ErrorLog specifies an optional logger for errors.
 	// If nil, logging goes to os.Stderr via the log package's standard logger.
+	// It only receives warnings and errors, and is ignored if Logger is set.
 	ErrorLog Logger
+
+	// Logger receives structured tunnel events: rejections, dial failures,
+	// and tunnels starting and closing. Tunnel events carry the tunnel_id,
+	// remote_addr, target, proto and user attributes, the subject and
+	// groups attached with SetTunnelInfo, and closing events also bytes,
+	// duration and any error. If nil, warnings and errors are
+	// formatted as text to ErrorLog.
+	Logger *slog.Logger
+
+	// UDPTemplate is the URI template path that CONNECT-UDP requests are
+	// served on. It must contain the {target_host} and {target_port}
+	// variables. If empty, DefaultUDPTemplate is used.
+	UDPTemplate string
+
+	// Policy is an optional destination access policy, evaluated after
+	// OnTunnel and before dialing. Denied tunnels are rejected with 403
+	// Forbidden naming the rule that denied them.
+	Policy *Policy
+
+	// TCPTemplate is the URI template path that template-driven TCP
+	// (connect-tcp) requests are served on. It must contain the
+	// {target_host} and {tcp_port} variables. If empty, DefaultTCPTemplate
+	// is used. Classic CONNECT requests are always accepted as well.
+	TCPTemplate string
+
+	// IdleTimeout closes tunnels that copy no bytes in either direction for
+	// this long. Zero means no idle timeout.
+	IdleTimeout time.Duration
+
+	// MaxLifetime closes tunnels this long after they were requested,
+	// regardless of activity. Zero means no limit.
+	MaxLifetime time.Duration
+
+	// TunnelBandwidth limits the throughput of each tunnel. Tunnels over the
+	// limit are slowed down rather than closed.
+	TunnelBandwidth Bandwidth
+
+	// IdentityBandwidth limits the combined throughput of all tunnels with
+	// the same identity, as attached with SetIdentity. Tunnels without an
+	// identity are only limited by TunnelBandwidth.
+	IdentityBandwidth Bandwidth
+
+	// ProxyName identifies the proxy in the Proxy-Status (RFC 9209) header
+	// sent with error responses. If empty, DefaultProxyName is used.
+	ProxyName string
+
+	// MaxTunnels limits the number of concurrent tunnels. Tunnels over a
+	// limit are rejected with 429 Too Many Requests and a Retry-After
+	// header, before dialing. Zero means no limit.
+	MaxTunnels int
+
+	// MaxTunnelsPerClient limits the concurrent tunnels from each client IP
+	// address. Zero means no limit.
+	MaxTunnelsPerClient int
+
+	// MaxTunnelsPerIdentity limits the concurrent tunnels of each identity
+	// attached with SetIdentity. Tunnels without an identity are not
+	// limited by it. Zero means no limit.
+	MaxTunnelsPerIdentity int
+
+	// ForwardProxy enables forward-proxy mode: HTTP/1.1 requests in
+	// absolute form (e.g. "GET http://example.com/ HTTP/1.1") are forwarded
+	// to the origin, with hop-by-hop headers removed. Each request is
+	// admitted and dialed like a tunnel to the origin, so OnTunnel, Policy,
+	// the limits and Dial apply, and is reported with the "http" protocol.
+	// Only http URLs are forwarded; clients use CONNECT for https.
+	ForwardProxy bool
+
+	// UpstreamProxyProtocol sends a PROXY protocol header of this version (1
+	// or 2) at the start of upstream TCP connections, carrying the client's
+	// address so upstream services see it rather than the relay's. v2
+	// headers also carry the tunnel ID as PP2_TYPE_UNIQUE_ID. Zero sends no
+	// header. Wrap the listener in a ProxyProtocolListener to receive the
+	// client's address from a load balancer.
+	UpstreamProxyProtocol int
+
+	// ProxyIdentityTLV sends the identity attached with SetIdentity in a
+	// TLV of this type in v2 upstream PROXY headers, e.g. ProxyTLVIdentity.
+	// Zero doesn't send it.
+	ProxyIdentityTLV byte
+
+	// ReverseDomain enables reverse tunnels under this domain. Clients
+	// register a named listener with Listen, and tunnels to
+	// "<name>.<ReverseDomain>" on any port are routed to the registered
+	// client instead of being dialed. OnTunnel authenticates registrations
+	// too, and can use ReverseListenName to authorize names; Policy and the
+	// limits apply to the tunnels. Empty disables reverse tunnels.
+	ReverseDomain string
+
+	// Capture, if set, writes the bytes of the tunnels it selects to pcapng
+	// files for debugging.
+	Capture *Capture
+
+	// tracker tracks the established tunnels for Shutdown.
+	tracker tunnelTracker
+
+	// bandwidth holds the limiters shared per identity.
+	bandwidth identityBandwidth
+
+	// limits counts tunnels for the concurrent tunnel limits.
+	limits tunnelLimits
+
+	// reverse holds the registered reverse tunnel listeners.
+	reverse reverseRegistry
 }
 
 // ClientConfig configures client-side tunnel dialers.
@@ -68,6 +222,19 @@ type ClientConfig struct {
 	// If nil, net.Dialer{}.DialContext is used.
 	// This can be used to chain proxies or customize the transport layer.
 	DialContext DialFunc
+
+	// UDPTemplate is the URI template used for CONNECT-UDP requests. It may
+	// be absolute, or a path that is resolved against ProxyURL. If empty,
+	// DefaultUDPTemplate is used.
+	UDPTemplate string
+
+	// TCPTemplate enables template-driven TCP (connect-tcp) for DialContext.
+	// When set, tunnels are requested with an upgraded GET (HTTP/1.1) or
+	// extended CONNECT (HTTP/2 and HTTP/3) to the expanded template instead
+	// of a classic CONNECT, so the proxy can be hosted under a path on a
+	// shared hostname. It must contain the {target_host} and {tcp_port}
+	// variables, and may be absolute or a path resolved against ProxyURL.
+	TCPTemplate string
 }
 
 // getDialFunc returns a DialFunc from the config, or a default dialer.
@@ -79,6 +246,16 @@ func (c *ServerConfig) getDialFunc() DialFunc {
 	return d.DialContext
 }
 
+// udpTemplate returns the parsed CONNECT-UDP template.
+func (c *ServerConfig) udpTemplate() (*uriTemplate, error) {
+	return parseProxyTemplate(c.UDPTemplate, DefaultUDPTemplate, "target_port")
+}
+
+// tcpTemplate returns the parsed connect-tcp template.
+func (c *ServerConfig) tcpTemplate() (*uriTemplate, error) {
+	return parseProxyTemplate(c.TCPTemplate, DefaultTCPTemplate, "tcp_port")
+}
+
 // getLogger returns the configured logger or a default logger.
 func (c *ServerConfig) getLogger() Logger {
 	if c.ErrorLog != nil {
@@ -87,11 +264,304 @@ func (c *ServerConfig) getLogger() Logger {
 	return log.Default()
 }
 
+// getSlogger returns the structured logger, falling back to a text logger
+// writing warnings and errors to the Printf logger.
+func (c *ServerConfig) getSlogger() *slog.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return slog.New(slog.NewTextHandler(&printfWriter{c.getLogger()}, &slog.HandlerOptions{
+		Level: slog.LevelWarn,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			// The Printf logger adds its own timestamp
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+}
+
+// printfWriter writes each log line to a Printf logger.
+type printfWriter struct {
+	l Logger
+}
+
+func (w *printfWriter) Write(p []byte) (int, error) {
+	w.l.Printf("%s", bytes.TrimSuffix(p, []byte("\n")))
+	return len(p), nil
+}
+
 // checkTunnel calls the OnTunnel callback if configured.
-// Returns nil if the tunnel should be accepted.
+// Returns nil if the tunnel should be accepted, or an error wrapping
+// ErrTunnelRejected.
 func (c *ServerConfig) checkTunnel(ctx context.Context, req *http.Request) error {
-	if c.OnTunnel != nil {
-		return c.OnTunnel(ctx, req)
+	if c.OnTunnel == nil {
+		return nil
+	}
+	err := c.OnTunnel(ctx, req)
+	if err != nil && !errors.Is(err, ErrTunnelRejected) {
+		err = fmt.Errorf("%w: %w", ErrTunnelRejected, err)
+	}
+	return err
+}
+
+// openUpstream runs the admission checks for a tunnel to target and dials it
+// on the given network. It writes an error response and returns nil if the
+// tunnel can't be opened.
+func (c *ServerConfig) openUpstream(w http.ResponseWriter, req *http.Request, network, target string) *serverTunnel {
+	ctx := withTunnelState(req.Context())
+	req = req.WithContext(ctx)
+	t := newServerTunnel(c, ctx, req, target)
+	getTunnelState(ctx).id = t.stats.ID
+
+	if c.tracker.shuttingDown() {
+		c.Metrics.RecordTunnel(ResultRejected)
+		t.log(slog.LevelInfo, "tunnel rejected", slog.String("reason", "shutting down"))
+		t.refuse(errShuttingDown)
+		c.setProxyStatus(w, ProxyStatus{Error: ProxyStatusInternalError, Details: "shutting down"})
+		http.Error(w, "Service Unavailable: server shutting down", http.StatusServiceUnavailable)
+		return nil
+	}
+
+	if err := checkTarget(target); err != nil {
+		c.Metrics.RecordTunnel(ResultRejected)
+		t.log(slog.LevelWarn, "tunnel rejected", slog.Any("error", err))
+		t.refuse(err)
+		http.Error(w, "Bad Request: invalid target", http.StatusBadRequest)
+		return nil
+	}
+
+	// Call OnTunnel callback if configured
+	if err := c.checkTunnel(ctx, req); err != nil {
+		c.Metrics.RecordTunnel(ResultRejected)
+		t.log(slog.LevelWarn, "tunnel rejected", slog.Any("error", err))
+		t.refuse(err)
+		c.rejectTunnel(w, err)
+		return nil
+	}
+
+	// Evaluate the destination policy with the identity OnTunnel attached
+	if c.Policy != nil {
+		if err := c.Policy.Check(ctx, Identity(ctx), target); err != nil {
+			c.Metrics.RecordTunnel(ResultRejected)
+			t.log(slog.LevelWarn, "tunnel rejected", slog.Any("error", err))
+			t.refuse(err)
+			var pe *PolicyError
+			if errors.As(err, &pe) {
+				details := fmt.Sprintf("denied by policy rule %q", pe.Rule)
+				c.setProxyStatus(w, ProxyStatus{Error: ProxyStatusRequestDenied, Details: details})
+				http.Error(w, "Forbidden: "+details, http.StatusForbidden)
+			} else {
+				c.setProxyStatus(w, ProxyStatus{Error: ProxyStatusRequestDenied})
+				http.Error(w, "Forbidden", http.StatusForbidden)
+			}
+			return nil
+		}
+	}
+
+	// Reserve a slot under the concurrent tunnel limits
+	identity := Identity(ctx)
+	if ok, limit := c.admit(t.client, identity); !ok {
+		c.Metrics.RecordTunnel(ResultRejected)
+		t.log(slog.LevelWarn, "tunnel rejected", slog.String("reason", "concurrent tunnel limit"), slog.String("limit", limit))
+		details := fmt.Sprintf("%s concurrent tunnel limit reached", limit)
+		t.refuse(fmt.Errorf("connecttunnel: %s", details))
+		c.setProxyStatus(w, ProxyStatus{Error: ProxyStatusRequestDenied, Details: details})
+		w.Header().Set("Retry-After", limitRetryAfter)
+		http.Error(w, "Too Many Requests: "+details, http.StatusTooManyRequests)
+		return nil
+	}
+	t.admitted, t.admittedIdentity = true, identity
+
+	// Dial upstream target, or route it to a reverse tunnel listener
+	dial := c.getDialFunc()
+	name, reverse := c.reverseName(target)
+	if reverse {
+		dial = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return c.reverse.dial(ctx, network, name, req.RemoteAddr)
+		}
+	}
+	upstream, err := dial(ctx, network, target)
+	if err == nil && network == "tcp" && c.UpstreamProxyProtocol != 0 && !reverse {
+		if err = c.sendProxyHeader(upstream, req, t); err != nil {
+			_ = upstream.Close()
+		}
+	}
+	t.stats.DialLatency = time.Since(t.stats.Start)
+	c.Metrics.RecordDial(t.stats.DialLatency)
+	var re *RejectionError
+	if errors.As(err, &re) {
+		// Dial routed the tunnel nowhere, rather than failing to reach it
+		t.release()
+		c.Metrics.RecordTunnel(ResultRejected)
+		t.log(slog.LevelWarn, "tunnel rejected", slog.Any("error", err))
+		t.refuse(err)
+		c.writeRejection(w, re)
+		return nil
+	}
+	if err != nil {
+		err = fmt.Errorf("%w: %w", ErrUpstreamDial, err)
+		t.release()
+		t.log(slog.LevelWarn, "tunnel dial failed", slog.Duration("dial_latency", t.stats.DialLatency), slog.Any("error", err))
+		t.refuse(err)
+		c.setProxyStatus(w, proxyStatusError(err))
+		status := errorStatus(err)
+		if errors.Is(err, ErrDestinationDenied) {
+			c.Metrics.RecordTunnel(ResultRejected)
+			http.Error(w, "Forbidden: destination address denied", status)
+		} else {
+			c.Metrics.RecordTunnel(ResultDialFailed)
+			http.Error(w, http.StatusText(status), status)
+		}
+		return nil
+	}
+	c.Metrics.RecordTunnel(ResultAccepted)
+	t.upstream = upstream
+	return t
+}
+
+// rejectTunnel writes the response for a request OnTunnel rejected with err.
+func (c *ServerConfig) rejectTunnel(w http.ResponseWriter, err error) {
+	var re *RejectionError
+	if errors.As(err, &re) {
+		c.writeRejection(w, re)
+		return
+	}
+	c.setProxyStatus(w, ProxyStatus{Error: ProxyStatusRequestDenied})
+	status := errorStatus(err)
+	http.Error(w, http.StatusText(status), status)
+}
+
+// setProxyStatus sets the Proxy-Status header of an error response.
+func (c *ServerConfig) setProxyStatus(w http.ResponseWriter, st ProxyStatus) {
+	st.Proxy = c.proxyName()
+	w.Header().Set(proxyStatusHeader, st.String())
+}
+
+// proxyName returns the name the proxy identifies itself with.
+func (c *ServerConfig) proxyName() string {
+	if c.ProxyName != "" {
+		return c.ProxyName
+	}
+	return DefaultProxyName
+}
+
+type tunnelStateKey struct{}
+
+// tunnelState is the mutable per-tunnel state carried in the request context
+// while a tunnel is admitted.
+type tunnelState struct {
+	id string // set before the tunnel is admitted, then read-only
+
+	mu   sync.Mutex
+	info TunnelInfo
+}
+
+func withTunnelState(ctx context.Context) context.Context {
+	return context.WithValue(ctx, tunnelStateKey{}, &tunnelState{})
+}
+
+func getTunnelState(ctx context.Context) *tunnelState {
+	st, _ := ctx.Value(tunnelStateKey{}).(*tunnelState)
+	return st
+}
+
+// TunnelInfo describes who a tunnel was admitted for. OnTunnel attaches it
+// with SetTunnelInfo once it has authenticated the request, and the handlers
+// carry it in the tunnel's context to Dial, the tunnel hooks and the logs, so
+// routing, quotas and auditing share one verification.
+type TunnelInfo struct {
+	// TunnelID is the tunnel's ID, as returned by TunnelID. It is set by
+	// the handlers.
+	TunnelID string
+
+	// Identity is used for the Policy, the per-identity limits and
+	// bandwidth, and logged as user. If empty, SetTunnelInfo uses Email, or
+	// else Subject.
+	Identity string
+
+	// Subject is the authenticated principal, e.g. a token's sub claim.
+	Subject string
+
+	// Email is the principal's email address, if known.
+	Email string
+
+	// Groups are the groups the principal belongs to, if known.
+	Groups []string
+
+	// Claims are the verified token claims, if any. They must not be
+	// modified once attached.
+	Claims map[string]any
+}
+
+// SetTunnelInfo attaches the authenticated principal to the tunnel being
+// admitted, replacing any attached before. It is intended to be called from
+// OnTunnel. It is a no-op if ctx is not a tunnel context.
+func SetTunnelInfo(ctx context.Context, info TunnelInfo) {
+	st := getTunnelState(ctx)
+	if st == nil {
+		return
+	}
+	if info.Identity == "" {
+		info.Identity = info.Email
+	}
+	if info.Identity == "" {
+		info.Identity = info.Subject
+	}
+	info.TunnelID = st.id
+	st.mu.Lock()
+	st.info = info
+	st.mu.Unlock()
+}
+
+// TunnelInfoFromContext returns the TunnelInfo attached to the tunnel, with
+// its TunnelID and any identity attached with SetIdentity. The ctx may be the
+// one passed to OnTunnel, Dial or the tunnel hooks. It reports false if ctx
+// is not a tunnel context.
+func TunnelInfoFromContext(ctx context.Context) (TunnelInfo, bool) {
+	st := getTunnelState(ctx)
+	if st == nil {
+		return TunnelInfo{}, false
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	info := st.info
+	info.TunnelID = st.id
+	return info, true
+}
+
+// SetIdentity attaches the authenticated identity (e.g. a token subject or
+// email) to the tunnel being admitted, keeping the rest of its TunnelInfo. It
+// is intended to be called from OnTunnel, and the identity is then used when
+// evaluating the Policy. It is a no-op if ctx is not a tunnel context.
+func SetIdentity(ctx context.Context, identity string) {
+	if st := getTunnelState(ctx); st != nil {
+		st.mu.Lock()
+		st.info.Identity = identity
+		st.mu.Unlock()
+	}
+}
+
+// TunnelID returns the ID of the tunnel being admitted or established, as
+// reported in TunnelStats.ID and logged as tunnel_id, so OnTunnel and Dial
+// can be correlated with the tunnel hooks. It returns "" if ctx is not a
+// tunnel context.
+func TunnelID(ctx context.Context) string {
+	if st := getTunnelState(ctx); st != nil {
+		return st.id
+	}
+	return ""
+}
+
+// Identity returns the identity attached to the tunnel with SetIdentity, or ""
+// if there is none.
+func Identity(ctx context.Context) string {
+	st := getTunnelState(ctx)
+	if st == nil {
+		return ""
 	}
-	return nil
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.info.Identity
 }
@@ -0,0 +1,187 @@
+package connect
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+// startUDPEcho starts a UDP echo server and returns its address.
+func startUDPEcho(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create UDP echo server: %v", err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// testUDPEcho sends datagrams through the dialer and checks they are echoed.
+func testUDPEcho(t *testing.T, dialer Dialer, echoAddr string) {
+	t.Helper()
+	pd, ok := dialer.(PacketDialer)
+	if !ok {
+		t.Fatalf("Dialer %T does not implement PacketDialer", dialer)
+	}
+
+	ctx := context.Background()
+	pc, err := pd.DialPacket(ctx, "udp", echoAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial through proxy: %v", err)
+	}
+	defer func() { _ = pc.Close() }()
+
+	for _, msg := range []string{"Hello, UDP!", "", strings.Repeat("x", 1200)} {
+		if _, err := pc.WriteTo([]byte(msg), nil); err != nil {
+			t.Fatalf("Failed to write datagram: %v", err)
+		}
+		buf := make([]byte, 2048)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Failed to read datagram: %v", err)
+		}
+		if got := string(buf[:n]); got != msg {
+			t.Errorf("Expected echo %q, got %q", msg, got)
+		}
+		if addr.String() != echoAddr {
+			t.Errorf("Expected datagram from %s, got %s", echoAddr, addr)
+		}
+	}
+}
+
+// TestH1ConnectUDP tests CONNECT-UDP over an HTTP/1.1 upgrade.
+func TestH1ConnectUDP(t *testing.T) {
+	echoAddr := startUDPEcho(t)
+
+	var gotTarget string
+	proxyHandler := NewHandler(&ServerConfig{
+		OnTunnel: func(ctx context.Context, req *http.Request) error {
+			gotTarget = req.URL.Path
+			return nil
+		},
+	})
+	proxyServer := httptest.NewServer(proxyHandler)
+	defer proxyServer.Close()
+
+	dialer := NewH1Dialer(&ClientConfig{
+		ProxyURL: proxyServer.URL,
+	})
+	testUDPEcho(t, dialer, echoAddr)
+
+	host, port, _ := net.SplitHostPort(echoAddr)
+	if want := "/.well-known/masque/udp/" + host + "/" + port + "/"; gotTarget != want {
+		t.Errorf("Expected request path %q, got %q", want, gotTarget)
+	}
+}
+
+// TestH2ConnectUDP tests CONNECT-UDP over HTTP/2 extended CONNECT.
+func TestH2ConnectUDP(t *testing.T) {
+	// The net/http HTTP/2 server only advertises extended CONNECT when this
+	// is set in the environment at startup.
+	if !strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		t.Skip("requires GODEBUG=http2xconnect=1")
+	}
+	echoAddr := startUDPEcho(t)
+
+	// Use a query-based template on both sides
+	const tmpl = "/masque/udp{?target_host,target_port}"
+	proxyHandler := NewHandler(&ServerConfig{
+		UDPTemplate: tmpl,
+	})
+	proxyServer := httptest.NewUnstartedServer(proxyHandler)
+	proxyServer.EnableHTTP2 = true
+	proxyServer.StartTLS()
+	defer proxyServer.Close()
+
+	dialer := NewH2Dialer(&ClientConfig{
+		ProxyURL:    proxyServer.URL,
+		UDPTemplate: tmpl,
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	})
+	testUDPEcho(t, dialer, echoAddr)
+}
+
+// TestConnectUDPRejection tests that OnTunnel can reject UDP associations.
+func TestConnectUDPRejection(t *testing.T) {
+	proxyHandler := NewHandler(&ServerConfig{
+		OnTunnel: func(ctx context.Context, req *http.Request) error {
+			return ErrTunnelRejected
+		},
+	})
+	proxyServer := httptest.NewServer(proxyHandler)
+	defer proxyServer.Close()
+
+	dialer := NewH1Dialer(&ClientConfig{ProxyURL: proxyServer.URL}).(PacketDialer)
+	_, err := dialer.DialPacket(context.Background(), "udp", "127.0.0.1:53")
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("Expected 403 proxy error, got: %v", err)
+	}
+}
+
+// TestURITemplate tests template expansion and matching.
+func TestURITemplate(t *testing.T) {
+	for _, tc := range []struct {
+		tmpl string
+		host string
+		port string
+		want string
+	}{
+		{DefaultUDPTemplate, "192.0.2.1", "53", "/.well-known/masque/udp/192.0.2.1/53/"},
+		{DefaultUDPTemplate, "2001:db8::1", "443", "/.well-known/masque/udp/2001%3Adb8%3A%3A1/443/"},
+		{"/masque{?target_host,target_port}", "example.com", "443", "/masque?target_host=example.com&target_port=443"},
+		{"https://proxy.example/u/{target_host}:{target_port}", "example.com", "80", "https://proxy.example/u/example.com:80"},
+	} {
+		tmpl, err := parseURITemplate(tc.tmpl)
+		if err != nil {
+			t.Fatalf("parse %q: %v", tc.tmpl, err)
+		}
+		got := tmpl.expand(map[string]string{"target_host": tc.host, "target_port": tc.port})
+		if got != tc.want {
+			t.Errorf("expand %q: want %q, got %q", tc.tmpl, tc.want, got)
+			continue
+		}
+
+		u, err := url.Parse(got)
+		if err != nil {
+			t.Fatalf("parse expanded %q: %v", got, err)
+		}
+		vars, ok := tmpl.match(u)
+		if !ok {
+			t.Errorf("match %q against %q failed", got, tc.tmpl)
+			continue
+		}
+		if vars["target_host"] != tc.host || vars["target_port"] != tc.port {
+			t.Errorf("match %q: got %v", got, vars)
+		}
+	}
+
+	tmpl, _ := parseURITemplate(DefaultUDPTemplate)
+	for _, p := range []string{"/", "/.well-known/masque/udp/", "/.well-known/masque/udp/a/b/c/", "/other/a/1/"} {
+		if _, ok := tmpl.match(&url.URL{Path: p}); ok {
+			t.Errorf("Expected %q not to match", p)
+		}
+	}
+
+	if _, err := parseURITemplate("/{target_host"); err == nil {
+		t.Error("Expected error for unterminated expression")
+	}
+}
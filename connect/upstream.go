@@ -0,0 +1,163 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// UpstreamRoute sends the tunnels to matching targets through an upstream
+// proxy, such as a corporate HTTP proxy, a second netrelay hop or a SOCKS5
+// proxy. Each non-empty condition must match for the route to apply, and a
+// condition matches if any of its entries does, as for a PolicyRule. A route
+// with no conditions matches every tunnel.
+//
+// Call Match from ServerConfig.Dial to pick a route, and its DialContext to
+// dial through it. Routed targets are resolved and dialed by the upstream
+// proxy, so a GuardedDialer doesn't apply to them.
+type UpstreamRoute struct {
+	// Name identifies the route in errors and logs.
+	Name string
+
+	// Hosts are glob patterns matched against the target host, e.g.
+	// "*.example.com". Matching is case-insensitive.
+	Hosts []string
+
+	// Domains match the target host and all its subdomains.
+	Domains []string
+
+	// CIDRs match targets given as IP literals.
+	CIDRs []netip.Prefix
+
+	// Ports match the target port.
+	Ports []PortRange
+
+	// Identities are glob patterns matched against the tunnel's identity,
+	// as attached with SetTunnelInfo or SetIdentity.
+	Identities []string
+
+	// Dialer connects through the upstream proxy, with the hop's own
+	// credentials: an H1, H2 or H2C dialer whose ClientConfig sends them
+	// with HeadersForRequest, or a SOCKS5 dialer from NewSOCKS5Dialer.
+	// CONNECT-UDP associations are only routed through dialers that
+	// implement PacketDialer.
+	Dialer Dialer
+}
+
+// DialContext dials address through the route's upstream proxy. UDP is
+// dialed with DialPacket if the route's Dialer is a PacketDialer.
+func (r *UpstreamRoute) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+		pd, ok := r.Dialer.(PacketDialer)
+		if !ok {
+			return nil, fmt.Errorf("connecttunnel: upstream route %q doesn't support UDP", r.Name)
+		}
+		pc, err := pd.DialPacket(ctx, network, address)
+		if err != nil {
+			return nil, r.wrapError(err)
+		}
+		conn, ok := pc.(net.Conn)
+		if !ok {
+			_ = pc.Close()
+			return nil, fmt.Errorf("connecttunnel: upstream route %q doesn't support UDP", r.Name)
+		}
+		return conn, nil
+	}
+	conn, err := r.Dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, r.wrapError(err)
+	}
+	return conn, nil
+}
+
+// wrapError annotates an error dialing through the route. The upstream
+// rejecting the hop's credentials is the relay's problem, not the client's, so
+// it isn't reported as ErrProxyAuthRequired.
+func (r *UpstreamRoute) wrapError(err error) error {
+	if errors.Is(err, ErrProxyAuthRequired) {
+		return fmt.Errorf("connecttunnel: upstream route %q: %v", r.Name, err)
+	}
+	return fmt.Errorf("connecttunnel: via upstream route %q: %w", r.Name, err)
+}
+
+// Match reports whether the route applies to a tunnel to target (host:port)
+// for identity, which is empty for unauthenticated tunnels.
+func (r *UpstreamRoute) Match(identity, target string) bool {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	return r.rule().matches(identity, host, uint16(port), nil)
+}
+
+// rule returns the route's conditions as a policy rule, to match them the
+// same way.
+func (r *UpstreamRoute) rule() *PolicyRule {
+	return &PolicyRule{
+		Hosts:      r.Hosts,
+		Domains:    r.Domains,
+		CIDRs:      r.CIDRs,
+		Ports:      r.Ports,
+		Identities: r.Identities,
+	}
+}
+
+// NewSOCKS5Dialer returns a Dialer that connects through the SOCKS5 proxy at
+// address (host:port), authenticating with username and password if username
+// is set (RFC 1929). Target hostnames are resolved by the proxy. forward dials
+// the proxy itself; if nil, net.Dialer{}.DialContext is used.
+func NewSOCKS5Dialer(address, username, password string, forward DialFunc) Dialer {
+	var auth *proxy.Auth
+	if username != "" {
+		auth = &proxy.Auth{User: username, Password: password}
+	}
+	if forward == nil {
+		var nd net.Dialer
+		forward = nd.DialContext
+	}
+	// proxy.SOCKS5 never fails, and its dialers support DialContext
+	d, _ := proxy.SOCKS5("tcp", address, auth, forwardDialer(forward))
+	return &socks5Dialer{d: d.(proxy.ContextDialer), address: address}
+}
+
+// socks5Dialer adapts a SOCKS5 proxy.Dialer to Dialer.
+type socks5Dialer struct {
+	d       proxy.ContextDialer
+	address string
+}
+
+func (s *socks5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("connecttunnel: unsupported network %q", network)
+	}
+	conn, err := s.d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, fmt.Errorf("connecttunnel: SOCKS5 proxy %s: %w", s.address, err)
+	}
+	return conn, nil
+}
+
+// forwardDialer adapts a DialFunc to proxy.Dialer and proxy.ContextDialer.
+type forwardDialer DialFunc
+
+func (f forwardDialer) Dial(network, address string) (net.Conn, error) {
+	return f(context.Background(), network, address)
+}
+
+func (f forwardDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
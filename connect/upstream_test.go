@@ -0,0 +1,213 @@
+package connect
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"testing"
+)
+
+// startSOCKS5 starts a minimal SOCKS5 proxy requiring username/password
+// authentication (RFC 1928, RFC 1929), and reports each CONNECT target.
+func startSOCKS5(t *testing.T, user, password string, targets chan<- string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5(conn, user, password, targets)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func serveSOCKS5(conn net.Conn, user, password string, targets chan<- string) {
+	defer func() { _ = conn.Close() }()
+	r := bufio.NewReader(conn)
+	read := func(n int) []byte {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil
+		}
+		return b
+	}
+
+	// Greeting: only username/password is acceptable
+	hdr := read(2)
+	if hdr == nil || read(int(hdr[1])) == nil {
+		return
+	}
+	_, _ = conn.Write([]byte{5, 2})
+	ver := read(2)
+	if ver == nil {
+		return
+	}
+	u := read(int(ver[1]))
+	plen := read(1)
+	if plen == nil {
+		return
+	}
+	p := read(int(plen[0]))
+	if string(u) != user || string(p) != password {
+		_, _ = conn.Write([]byte{1, 1})
+		return
+	}
+	_, _ = conn.Write([]byte{1, 0})
+
+	// CONNECT request
+	req := read(4)
+	if req == nil || req[1] != 1 {
+		return
+	}
+	var host string
+	switch req[3] {
+	case 1:
+		host = netip.AddrFrom4([4]byte(read(4))).String()
+	case 3:
+		host = string(read(int(read(1)[0])))
+	default:
+		return
+	}
+	port := binary.BigEndian.Uint16(read(2))
+	target := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	targets <- target
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer func() { _ = upstream.Close() }()
+	_, _ = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go func() { _, _ = io.Copy(upstream, r) }()
+	_, _ = io.Copy(conn, upstream)
+}
+
+func TestUpstreamRouteChain(t *testing.T) {
+	echoAddr := startTCPEcho(t)
+
+	// The second hop requires its own credentials
+	hopCfg, hopStarts, _ := recordHooks()
+	hopCfg.OnTunnel = func(ctx context.Context, req *http.Request) error {
+		if req.Header.Get("Proxy-Authorization") != "Bearer hop-token" {
+			return ErrProxyAuthRequired
+		}
+		return nil
+	}
+	hopServer := httptest.NewServer(NewHandler(hopCfg))
+	defer hopServer.Close()
+
+	socksTargets := make(chan string, 1)
+	socksAddr := startSOCKS5(t, "svc", "secret", socksTargets)
+
+	routes := []UpstreamRoute{
+		{
+			Name:       "socks",
+			Identities: []string{"bob"},
+			Dialer:     NewSOCKS5Dialer(socksAddr, "svc", "secret", nil),
+		},
+		{
+			Name:  "hop",
+			CIDRs: mustPrefixes(t, "127.0.0.0/8"),
+			Dialer: NewH1Dialer(&ClientConfig{
+				ProxyURL: hopServer.URL,
+				HeadersForRequest: func(*http.Request) (http.Header, error) {
+					return http.Header{"Proxy-Authorization": {"Bearer hop-token"}}, nil
+				},
+			}),
+		},
+	}
+	user := "alice"
+	cfg := &ServerConfig{
+		OnTunnel: func(ctx context.Context, req *http.Request) error {
+			SetIdentity(ctx, user)
+			return nil
+		},
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			for i := range routes {
+				if routes[i].Match(Identity(ctx), address) {
+					return routes[i].DialContext(ctx, network, address)
+				}
+			}
+			return nil, ErrDestinationDenied
+		},
+	}
+	proxyServer := httptest.NewServer(NewHandler(cfg))
+	defer proxyServer.Close()
+	dialer := NewH1Dialer(&ClientConfig{ProxyURL: proxyServer.URL})
+
+	// alice's tunnel to a loopback address goes through the second hop
+	testTCPEcho(t, dialer, echoAddr)
+	if start := waitStats(t, hopStarts); start.Target != echoAddr {
+		t.Errorf("Second hop tunnel target = %q, want %q", start.Target, echoAddr)
+	}
+
+	// bob's go through the SOCKS5 proxy
+	user = "bob"
+	testTCPEcho(t, dialer, echoAddr)
+	if target := <-socksTargets; target != echoAddr {
+		t.Errorf("SOCKS5 target = %q, want %q", target, echoAddr)
+	}
+
+	// Conditions must all match
+	for _, r := range routes {
+		if r.Match("alice", "example.com:443") {
+			t.Errorf("Route %q matched example.com:443", r.Name)
+		}
+	}
+}
+
+func TestUpstreamRouteErrors(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("bad SOCKS5 credentials", func(t *testing.T) {
+		socksAddr := startSOCKS5(t, "svc", "secret", make(chan string, 1))
+		d := NewSOCKS5Dialer(socksAddr, "svc", "wrong", nil)
+		if _, err := d.DialContext(ctx, "tcp", "example.com:443"); err == nil {
+			t.Error("Dial with bad credentials succeeded")
+		}
+	})
+
+	t.Run("UDP through a TCP-only route", func(t *testing.T) {
+		r := &UpstreamRoute{Name: "socks", Dialer: NewSOCKS5Dialer("127.0.0.1:1", "", "", nil)}
+		if _, err := r.DialContext(ctx, "udp", "example.com:53"); err == nil {
+			t.Error("UDP dial through SOCKS5 succeeded")
+		}
+	})
+
+	t.Run("upstream refusal", func(t *testing.T) {
+		hopServer := httptest.NewServer(NewHandler(&ServerConfig{Policy: &Policy{Default: PolicyDeny}}))
+		defer hopServer.Close()
+		r := &UpstreamRoute{Name: "hop", Dialer: NewH1Dialer(&ClientConfig{ProxyURL: hopServer.URL})}
+		_, err := r.DialContext(ctx, "tcp", "example.com:443")
+		var pe *ProxyError
+		if !errors.As(err, &pe) || pe.StatusCode != http.StatusForbidden {
+			t.Errorf("Error = %v, want the upstream's 403", err)
+		}
+	})
+
+	t.Run("upstream credentials rejected", func(t *testing.T) {
+		hopServer := httptest.NewServer(NewHandler(&ServerConfig{
+			OnTunnel: func(context.Context, *http.Request) error { return ErrProxyAuthRequired },
+		}))
+		defer hopServer.Close()
+		r := &UpstreamRoute{Name: "hop", Dialer: NewH1Dialer(&ClientConfig{ProxyURL: hopServer.URL})}
+		_, err := r.DialContext(ctx, "tcp", "example.com:443")
+		if err == nil || errors.Is(err, ErrProxyAuthRequired) {
+			t.Errorf("Error = %v, want one not asking the client to authenticate", err)
+		}
+	})
+}
@@ -2,6 +2,15 @@ module lds.li/netrelay
 
 go 1.25.6
 
-require golang.org/x/net v0.48.0
+require (
+	github.com/quic-go/quic-go v0.59.1
+	golang.org/x/net v0.48.0
+	golang.org/x/time v0.12.0
+)
 
-require golang.org/x/text v0.32.0 // indirect
+require (
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/crypto v0.46.0 // indirect
+	golang.org/x/sys v0.39.0 // indirect
+	golang.org/x/text v0.32.0 // indirect
+)